@@ -0,0 +1,69 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// archNames are the names uname -m gives for each of the GOARCHes, so
+// that -requirearch can be either.
+var archNames = map[string][]string{
+	"386":     {"i386", "i486", "i586", "i686"},
+	"amd64":   {"x86_64"},
+	"arm":     {"armv6l", "armv7l", "armv8l"},
+	"arm64":   {"aarch64", "arm64"},
+	"ppc64le": {"ppc64le"},
+	"riscv64": {"riscv64"},
+	"s390x":   {"s390x"},
+}
+
+// archIs reports whether the uname -m machine m is the architecture
+// want, by its uname or its Go name.
+func archIs(m, want string) bool {
+	want = strings.ToLower(want)
+	if strings.ToLower(m) == want {
+		return true
+	}
+	for _, n := range archNames[want] {
+		if n == m {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArch is -requirearch and -requireos: it asks the remote, with
+// uname, what it is, and fails if it is not what they want, before
+// anything, e.g. a -pushbin cpud, is run there that could only fail
+// in a stranger way on it. It costs a round trip, so it is only done
+// when asked for.
+func checkArch(cl *ossh.Client) error {
+	if *requireArch == "" && *requireOS == "" {
+		return nil
+	}
+	b, err := cmd(cl, "uname -m -s")
+	if err != nil {
+		return fmt.Errorf("requirearch: %v", err)
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 {
+		return fmt.Errorf("requirearch: want the system and machine from uname on the remote, got %q", b)
+	}
+	// uname prints the system name first, whatever the order of
+	// the flags.
+	sys, m := f[0], f[1]
+	v("requirearch: the remote is %s %s", sys, m)
+	if *requireOS != "" && !strings.EqualFold(sys, *requireOS) {
+		return fmt.Errorf("the remote runs %s, not %s, as -requireos wants", sys, *requireOS)
+	}
+	if *requireArch != "" && !archIs(m, *requireArch) {
+		return fmt.Errorf("the remote is %s, not %s, as -requirearch wants", m, *requireArch)
+	}
+	return nil
+}
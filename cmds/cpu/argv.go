@@ -0,0 +1,21 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// argv is the command to run on the remote, one word to an argument,
+// as we were given it, for -exactargs.
+var argv []string
+
+// encodeArgv encodes args for cpud -argv64: joined with NULs, which
+// no argument can contain, and base64, which has no characters that
+// the ssh server, or a shell, would split or interpret.
+func encodeArgv(args []string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(args, "\x00")))
+}
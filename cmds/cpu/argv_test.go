@@ -0,0 +1,57 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/u-root/cpu/cputest"
+)
+
+// argvTests are commands, and their -argv64 encodings. cpud's tests
+// decode the same strings, so a change to either side that the other
+// does not follow fails one or the other.
+var argvTests = []struct {
+	args []string
+	enc  string
+}{
+	{args: []string{"date"}, enc: "ZGF0ZQ=="},
+	{args: []string{"echo", "a b", "  c  "}, enc: "ZWNobwBhIGIAICBjICA="},
+	{args: []string{"printf", `"%s"`, `'it''s'`}, enc: "cHJpbnRmACIlcyIAJ2l0JydzJw=="},
+	{args: []string{"ls", `a\b`, `c\`, `\\`}, enc: "bHMAYVxiAGNcAFxc"},
+	{args: []string{"sh", "-c", "echo one\necho two\n"}, enc: "c2gALWMAZWNobyBvbmUKZWNobyB0d28K"},
+	{args: []string{"touch", "", "$HOME", "*"}, enc: "dG91Y2gAACRIT01FACo="},
+}
+
+func TestEncodeArgv(t *testing.T) {
+	for _, tt := range argvTests {
+		if got := encodeArgv(tt.args); got != tt.enc {
+			t.Errorf("encodeArgv(%q): got %q, want %q", tt.args, got, tt.enc)
+		}
+	}
+}
+
+// TestExactArgs runs each command with -exactargs, and checks that
+// the remote gets its arguments word for word.
+func TestExactArgs(t *testing.T) {
+	old := argv
+	defer func() { argv = old }()
+	for _, tt := range argvTests {
+		argv = tt.args
+		var got []string
+		err := session(t, func(rem *cputest.Remote) error {
+			got = rem.Args
+			return nil
+		}, map[string]string{"nonamespace": "true", "exactargs": "true"}, "ignored")
+		if err != nil {
+			t.Errorf("%q: session: %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.args) {
+			t.Errorf("%q: the remote got %q", tt.args, got)
+		}
+	}
+}
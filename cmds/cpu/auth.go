@@ -0,0 +1,142 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/sys/unix"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// parseAuthMethods checks the -authmethods list.
+func parseAuthMethods(s string) ([]string, error) {
+	var l []string
+	for _, m := range strings.Split(s, ",") {
+		switch m {
+		case "publickey", "password", "keyboard-interactive":
+		default:
+			return nil, fmt.Errorf("authmethods: %q is not one of publickey, password or keyboard-interactive", m)
+		}
+		if contains(l, m) {
+			return nil, fmt.Errorf("authmethods: %q is given more than once", m)
+		}
+		l = append(l, m)
+	}
+	return l, nil
+}
+
+// authMethods returns the ssh auth methods for the names in l, in
+// the same order. The ssh package offers the server each method in
+// that order, skipping those the server does not take.
+func authMethods(l []string, signers []ossh.Signer) []ossh.AuthMethod {
+	var a []ossh.AuthMethod
+	for _, m := range l {
+		switch m {
+		case "publickey":
+			a = append(a, ossh.PublicKeys(signers...))
+		case "password":
+			a = append(a, ossh.PasswordCallback(func() (string, error) {
+				return ask("Password: ", false)
+			}))
+		case "keyboard-interactive":
+			a = append(a, ossh.KeyboardInteractive(questions))
+		}
+	}
+	return a
+}
+
+// questions answers the server's keyboard-interactive questions,
+// e.g. for a one time password, by asking the user. As RFC 4256
+// says, the name and instruction, if any, are shown first, then each
+// question; only the questions the server says may be echoed are.
+// The server may send several rounds of questions, including, once
+// we are in, one with none at all, which only has text to show.
+// Everything goes to the terminal, not stdout, which may be a pipe.
+func questions(name, instruction string, qs []string, echos []bool) ([]string, error) {
+	t, err := openTTY()
+	if err != nil {
+		return nil, fmt.Errorf("keyboard-interactive needs a terminal: %v", err)
+	}
+	defer t.Close()
+	for _, m := range []string{name, instruction} {
+		if m != "" {
+			fmt.Fprintln(t, printable(m))
+		}
+	}
+	var as []string
+	for i, q := range qs {
+		a, err := ask(printable(q), echos[i])
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+// printable drops the control characters, other than newlines and
+// tabs, from text the server sent, so that it can not play games
+// with our terminal.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' && r != '\t' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// openTTY opens the terminal, for a prompt. termios.New opens it too,
+// but has no way to close it again, so each prompt would leave a file
+// open.
+func openTTY() (*os.File, error) {
+	return os.OpenFile("/dev/tty", os.O_RDWR, 0)
+}
+
+// ask asks the user, on the terminal, for a line of input, only
+// echoing it if echo is set.
+func ask(prompt string, echo bool) (string, error) {
+	t, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+	if !echo {
+		r, err := termios.GetTermios(t.Fd())
+		if err != nil {
+			return "", err
+		}
+		old := *r.Termios
+		r.Lflag &^= unix.ECHO
+		if err := termios.SetTermios(t.Fd(), r); err != nil {
+			return "", err
+		}
+		defer func() {
+			termios.SetTermios(t.Fd(), &termios.Termios{Termios: &old})
+			fmt.Fprintln(t)
+		}()
+	}
+	fmt.Fprint(t, prompt)
+	// One byte at a time, so we do not read past the line.
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for {
+		if _, err := t.Read(b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// triedMethods pulls the auth methods the ssh package tried out of
+// its "unable to authenticate" error, which is only a string.
+var triedMethods = regexp.MustCompile(`attempted methods \[([^]]*)\]`)
+
+// disconnectReason pulls the reason code out of an ssh disconnect error.
+var disconnectReason = regexp.MustCompile(`ssh: disconnect, reason (\d+)`)
+
+// dialErr turns an error from setting up the ssh session into one
+// that says what most likely went wrong and what to do about it.
+// The ssh package reports most of these as plain strings, so we
+// have to look at the text. kex is true if the key exchange got as
+// far as checking the host key, i.e. we were talking to an ssh
+// server when the error happened. The error is an AuthError, if we
+// reached the server but could not log in, and a DialError, or, if we
+// could not agree on a cipher, a ProtocolError, if not.
+func dialErr(err error, user string, kex bool) error {
+	s := err.Error()
+	var hint string
+	auth := true
+	switch {
+	case strings.Contains(s, "host key mismatch"):
+		hint = "the host key is not the one in -hk; is this the right host, or has it been reinstalled?"
+	case strings.Contains(s, "knownhosts: key mismatch"):
+		hint = fmt.Sprintf("the host key has changed since it went into %v; is this the right host, or has it been reinstalled?", knownHosts)
+	case strings.Contains(s, "knownhosts: key is unknown"):
+		hint = fmt.Sprintf("the host is not in %v; add it, or use -o StrictHostKeyChecking=accept-new", knownHosts)
+	case strings.Contains(s, "no common algorithm for") && strings.Contains(s, "cipher") && *minCipher != 0:
+		l, _ := minCiphers()
+		auth = false
+		hint = fmt.Sprintf("the server has no cipher of at least -mincipherbits %d; we offered %s", *minCipher, strings.Join(l, ", "))
+	case strings.Contains(s, "no common algorithm for host key") && *hostKeyAlg != "":
+		auth = false
+		hint = fmt.Sprintf("the server has no host key of -hostkeyalgs %s; start it with a ^ to fall back to the others", *hostKeyAlg)
+	case triedMethods.MatchString(s):
+		tried := strings.Fields(triedMethods.FindStringSubmatch(s)[1])
+		switch {
+		case contains(tried, "publickey"):
+			hint = fmt.Sprintf("the server rejected the public key; is it in ~%s/.ssh/authorized_keys on the remote, and is -key right?", user)
+		case contains(tried, "password") || contains(tried, "keyboard-interactive"):
+			hint = fmt.Sprintf("the server rejected the password or answers for %q", user)
+		default:
+			hint = fmt.Sprintf("the server takes none of -authmethods %s; check what its sshd_config allows", *authMeths)
+		}
+	case disconnectReason.MatchString(s):
+		switch disconnectReason.FindStringSubmatch(s)[1] {
+		case "12":
+			hint = "the server has too many connections; try again later"
+		case "14":
+			hint = "the server has no login method left for us; is the public key in authorized_keys?"
+		default:
+			hint = fmt.Sprintf("the server refused the login; is the account %q locked, or not allowed to log in?", user)
+		}
+	case kex && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || strings.Contains(s, "EOF")):
+		hint = fmt.Sprintf("the server hung up during login; is the account %q locked, expired or not allowed (AllowUsers, PAM)? See the remote's auth log", user)
+	case errors.As(err, new(net.Error)) || errors.Is(err, io.EOF) || strings.Contains(s, "EOF"):
+		return &DialError{Err: fmt.Errorf("Failed to dial: %v: %s", err, "could not talk to an ssh server there; check the host, -sp and any firewall or proxy in the way")}
+	default:
+		return &DialError{Err: fmt.Errorf("Failed to dial: %v", err)}
+	}
+	e := fmt.Errorf("Failed to dial: %v: %s", err, hint)
+	if !auth {
+		return &ProtocolError{Err: e}
+	}
+	return &AuthError{User: user, Err: e}
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
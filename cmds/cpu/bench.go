@@ -0,0 +1,154 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchStats is how many times the -bench script stats a file, to
+// time a 9p round trip.
+const benchStats = 100
+
+// benchScript is the -bench workload, run by sh on the remote from the
+// directory it is in, in our files. It times, with the remote's clock,
+// benchStats stats of a file, with the shell's own test, so that no
+// process is started for each, then writing -benchfiles new files of
+// -benchsize bytes, then reading the files of that size we wrote for
+// it, and prints a "bench op count bytes ns" line for each.
+const benchScript = `d=$(dirname "$0"); n=%d; s=%d; k=%d
+case $(date +%%N) in *N*) echo "bench error the remote's date can not tell nanoseconds"; exit 1;; esac
+t=$(date +%%s%%N); i=0
+while [ $i -lt $k ]; do [ -e "$d/r0" ] || exit 1; i=$((i+1)); done
+echo "bench stat $k 0 $(($(date +%%s%%N)-t))"
+t=$(date +%%s%%N); i=0
+while [ $i -lt $n ]; do head -c $s /dev/zero >"$d/w$i" || exit 1; i=$((i+1)); done
+echo "bench write $n $((n*s)) $(($(date +%%s%%N)-t))"
+t=$(date +%%s%%N); i=0
+while [ $i -lt $n ]; do cat "$d/r$i" >/dev/null || exit 1; i=$((i+1)); done
+echo "bench read $n $((n*s)) $(($(date +%%s%%N)-t))"
+`
+
+// benchDir is the directory, here, that the -bench files are in, and
+// benchOut gets the remote's output, to make the report from.
+var (
+	benchDir string
+	benchOut *bytes.Buffer
+)
+
+// startBench sets up -bench: it makes a directory, in -root, with
+// the files for the remote to read, and the script, and returns the
+// command that runs the script on the remote, in our files at
+// /tmp/cpu. The files are random, so that -9pcompress does not make
+// reading them look faster than it would be for real data.
+func startBench() (cmd string, err error) {
+	switch {
+	case !nameSpace():
+		return "", fmt.Errorf("-bench needs the remote to mount our files")
+	case *snapshot:
+		return "", fmt.Errorf("-bench can not be used with -snapshot, which would not have its files")
+	case *aname != "":
+		return "", fmt.Errorf("-bench can not be used with -aname; it needs -root mounted")
+	case *benchFiles <= 0 || *benchSize <= 0:
+		return "", fmt.Errorf("-benchfiles and -benchsize must be more than 0")
+	}
+	d, err := ioutil.TempDir("", "cpu-bench")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(d)
+		}
+	}()
+	r := rootRel(d)
+	if r == "/.." || strings.HasPrefix(r, "/../") {
+		return "", fmt.Errorf("%v is not in -root %v; set TMPDIR to a directory that is", d, *root)
+	}
+	for i := 0; i < *benchFiles; i++ {
+		f, err := os.Create(filepath.Join(d, fmt.Sprintf("r%d", i)))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.CopyN(f, rand.Reader, *benchSize)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", spaceErr(err)
+		}
+	}
+	s := fmt.Sprintf(benchScript, *benchFiles, *benchSize, benchStats)
+	if err := ioutil.WriteFile(filepath.Join(d, "bench.sh"), []byte(s), 0644); err != nil {
+		return "", err
+	}
+	benchDir, benchOut = d, &bytes.Buffer{}
+	return "sh " + filepath.Join("/tmp/cpu", r, "bench.sh"), nil
+}
+
+// printBench prints the -bench report, on stdout, of what the remote
+// timed, with the settings that matter most, so that runs with other
+// settings can be compared, and removes the -bench directory. Any
+// output from the remote that is not the script's is passed on.
+func printBench(host string) {
+	if benchDir == "" {
+		return
+	}
+	defer os.RemoveAll(benchDir)
+	var rows []string
+	for _, l := range strings.Split(strings.TrimSpace(benchOut.String()), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 0 || f[0] != "bench" {
+			if l != "" {
+				fmt.Println(l)
+			}
+			continue
+		}
+		if len(f) != 5 {
+			log.Printf("bench: %s", strings.Join(f[1:], " "))
+			continue
+		}
+		n, _ := strconv.ParseInt(f[2], 10, 64)
+		b, _ := strconv.ParseInt(f[3], 10, 64)
+		ns, _ := strconv.ParseInt(f[4], 10, 64)
+		if n <= 0 || ns <= 0 {
+			log.Printf("bench: bad line from the remote: %q", l)
+			continue
+		}
+		t := time.Duration(ns)
+		rate := "-"
+		if b > 0 {
+			rate = fmt.Sprintf("%.1f", float64(b)/1e6/t.Seconds())
+		}
+		rows = append(rows, fmt.Sprintf("%s\t%d\t%d\t%v\t%s\t%v\t\n", f[1], n, b, t.Round(time.Millisecond), rate, (t/time.Duration(n)).Round(time.Microsecond)))
+	}
+	if len(rows) == 0 {
+		return
+	}
+	fmt.Printf("bench: %d files of %d bytes on %s, msize %d, cache %s, 9pcompress %v\n",
+		*benchFiles, *benchSize, host, *msize, *cacheMode, *compress9p)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "op\tcount\tbytes\ttime\tMB/s\tper op\t\n")
+	for _, r := range rows {
+		fmt.Fprint(w, r)
+	}
+	w.Flush()
+	for i := 0; i < *benchFiles; i++ {
+		if fi, err := os.Stat(filepath.Join(benchDir, fmt.Sprintf("w%d", i))); err == nil && fi.Size() != *benchSize {
+			log.Printf("Warning: bench: the remote wrote %d of the %d bytes of w%d", fi.Size(), *benchSize, i)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/cputest"
+)
+
+// TestCache changes a file here, in a session with each -cache mode,
+// and checks what the remote sees of it: the new contents, and, with
+// strict, a new QID version, which is what tells the remote's kernel
+// to drop the pages it has cached. With none and loose the version
+// stays 0, and the kernel goes by its own cache mode, that cpud
+// mounts with.
+func TestCache(t *testing.T) {
+	for _, tt := range []struct {
+		mode, flag string
+		newVersion bool
+	}{
+		{mode: "none"},
+		{mode: "loose", flag: "loose"},
+		{mode: "strict", flag: "strict", newVersion: true},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			r := tempRoot(t, map[string]string{"f": "one"})
+			defer os.RemoveAll(r)
+			var (
+				flag        string
+				before, now string
+				v1, v2      uint32
+			)
+			err := session(t, func(rem *cputest.Remote) error {
+				flag = rem.Flags["cache"]
+				_, f, err := rem.Root.Walk([]string{"f"})
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				q, _, _, err := f.GetAttr(p9.AttrMaskAll)
+				if err != nil {
+					return err
+				}
+				v1 = q.Version
+				b, err := readFile(rem.Root, "f")
+				if err != nil {
+					return err
+				}
+				before = string(b)
+				if err := ioutil.WriteFile(filepath.Join(r, "f"), []byte("two, longer"), 0644); err != nil {
+					return fmt.Errorf("changing the file here: %v", err)
+				}
+				if q, _, _, err = f.GetAttr(p9.AttrMaskAll); err != nil {
+					return err
+				}
+				v2 = q.Version
+				b, err = readFile(rem.Root, "f")
+				now = string(b)
+				return err
+			}, map[string]string{"root": r, "cache": tt.mode}, "cat /tmp/cpu/f")
+			if err != nil {
+				t.Fatalf("session: %v", err)
+			}
+			if flag != tt.flag {
+				t.Errorf("cpud -cache: got %q, want %q", flag, tt.flag)
+			}
+			if before != "one" || now != "two, longer" {
+				t.Errorf("the file: got %q, then %q, want %q, then %q", before, now, "one", "two, longer")
+			}
+			switch {
+			case tt.newVersion && v1 == v2:
+				t.Errorf("QID version: got %d before and after the change, want a new one", v1)
+			case !tt.newVersion && (v1 != 0 || v2 != 0):
+				t.Errorf("QID version: got %d, then %d, want 0", v1, v2)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// foldWalk returns the path that walking to name from dir leads to,
+// with -caseinsensitive, when there is nothing in dir called exactly
+// name. It looks for a name in dir that differs only in case. If
+// there are several, e.g. Makefile and makefile, it picks the first
+// in byte order, i.e. upper case before lower, so the remote always
+// gets the same one; the others can only be reached by their exact
+// names. Exports at the top of -root are matched the same way, ahead
+// of anything in -root. As for exportWalk, ro is whether it is a tree
+// -exportallow gave read-only.
+func foldWalk(dir, name string) (p string, ro, ok bool) {
+	var names []string
+	if dir == *root {
+		exportMu.RLock()
+		for n := range exportPaths {
+			if strings.EqualFold(n, name) {
+				names = append(names, n)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			p, ro := exportPaths[names[0]], roExports[names[0]]
+			exportMu.RUnlock()
+			return p, ro, true
+		}
+		exportMu.RUnlock()
+	}
+	var fi []os.FileInfo
+	if snap != nil {
+		s, err := snapInfo(dir)
+		if err != nil {
+			return "", false, false
+		}
+		fi = s.ents
+	} else {
+		var err error
+		if fi, err = readDir(dir); err != nil {
+			return "", false, false
+		}
+	}
+	// ReadDir, and so the snapshot, sort by name.
+	for _, f := range fi {
+		if strings.EqualFold(f.Name(), name) {
+			v("caseinsensitive: %q in %v is %q", name, dir, f.Name())
+			p, ro := exportWalk(dir, f.Name())
+			return p, ro, true
+		}
+	}
+	return "", false, false
+}
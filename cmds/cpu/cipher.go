@@ -0,0 +1,48 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cipherBits is the strength, in bits of symmetric key, of each of the
+// ciphers the ssh package uses by default, in its order of preference.
+// chacha20-poly1305 uses two 256-bit keys, but is a 256-bit cipher.
+var cipherBits = []struct {
+	name string
+	bits int
+}{
+	{"aes128-gcm@openssh.com", 128},
+	{"chacha20-poly1305@openssh.com", 256},
+	{"aes128-ctr", 128},
+	{"aes192-ctr", 192},
+	{"aes256-ctr", 256},
+}
+
+// minCiphers returns the ciphers of at least -mincipherbits bits,
+// in the ssh package's order of preference, or nil if it is not set.
+// The ssh package does not tell us which cipher it negotiated, so
+// rather than check after the handshake, we only offer the server
+// strong enough ciphers; if it has none of them, the handshake fails.
+func minCiphers() ([]string, error) {
+	if *minCipher == 0 {
+		return nil, nil
+	}
+	var l, weak []string
+	for _, c := range cipherBits {
+		if c.bits >= *minCipher {
+			l = append(l, c.name)
+		} else {
+			weak = append(weak, fmt.Sprintf("%s (%d)", c.name, c.bits))
+		}
+	}
+	if len(l) == 0 {
+		return nil, fmt.Errorf("mincipherbits %d: no cipher is that strong; the strongest are 256 bits", *minCipher)
+	}
+	v("mincipherbits %d: offering %s; not %s", *minCipher, strings.Join(l, ", "), strings.Join(weak, ", "))
+	return l, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The config file gives per-host defaults for cpu's flags.
+// It looks a bit like an ssh_config:
+//
+//	# build machines export /data
+//	host build*
+//		root /data
+//	host *
+//		root /
+//
+// Each setting is a flag name and its value. A setting applies to
+// hosts matching any of the patterns of its host line, which are
+// filepath.Match patterns. As in ssh_config, the first value found
+// for a flag wins, so specific hosts go first. Flags given on the
+// command line always win over the config file.
+//
+// A profile block is a named set of settings, used only when -profile
+// picks it, for whatever host:
+//
+//	profile lab
+//		nononce true
+//		yes-i-know true
+//
+// The profile's settings win over those of the host blocks, but not
+// over the command line.
+
+// hostFlags are the flags the config file may set. The others, e.g.
+// -d, -i, -noterminal, -unshare or -diagfd, are acted on as cpu
+// starts, before it knows the host, so setting them there would do
+// nothing.
+var hostFlags = map[string]bool{}
+
+func init() {
+	for _, n := range []string{
+		"4", "6", "9pcompress", "9pcompresslevel", "9pevents",
+		"9pkeepalive", "9pmsgtimeout", "9preadbuf", "9premount",
+		"9pwritebuf", "J", "allowpaths", "aname", "audit", "auditpaths",
+		"authmethods", "bin", "binsha256", "cache", "caseinsensitive",
+		"connfd", "controlpath", "crlf", "dbg9p", "dumpfids", "echocmd",
+		"exactargs", "export", "exportallow", "forwardsignals", "gitignore",
+		"hangtimeout", "healthline", "hk", "hostkeyalgs", "httpproxy",
+		"keepenv", "key", "l", "libenv", "listentries", "locale",
+		"localpost", "localpre", "max9pconcurrency", "maxbytes", "maxdepth",
+		"maxduration", "maxenv", "maxopenfiles", "mergestderr",
+		"mincipherbits", "mountcheck", "mountmode", "mountopts", "msize",
+		"network", "nonamespace", "noncemode", "nononce", "o", "otlp",
+		"overlay", "parallelread", "pidfile", "port9p", "prefetch",
+		"prioritizeinteractive", "privcmd", "pushbin", "q9perrors",
+		"rekeybytes", "rekeyinterval", "requirearch", "requireos", "root",
+		"rusage", "setupkey", "snapshot", "snapshotmax", "socks", "sp",
+		"stdinretries", "sudo", "tcpkeepalive", "tcpnodelay", "timeout9p",
+		"timing", "umask", "union", "verify9p", "yes-i-know",
+	} {
+		hostFlags[n] = true
+	}
+}
+
+// configFrom is, for each flag the config file set, the block it came
+// from, for -showconfig.
+var configFrom = map[string]string{}
+
+// A hostConfig is one host or profile block from the config file.
+type hostConfig struct {
+	patterns []string
+	profile  string      // the name, if this is a profile block
+	settings [][2]string // flag name and value, in file order
+}
+
+// match returns true if the block applies to host.
+func (h *hostConfig) match(host string) bool {
+	if h.profile != "" {
+		return false
+	}
+	for _, p := range h.patterns {
+		if ok, _ := filepath.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the block's first line, e.g. "host build*".
+func (h *hostConfig) String() string {
+	if h.profile != "" {
+		return "profile " + h.profile
+	}
+	return "host " + strings.Join(h.patterns, " ")
+}
+
+// readConfig reads the config file. A missing file is not an error.
+func readConfig(file string) ([]hostConfig, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		hosts []hostConfig
+		line  int
+	)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line++
+		t := strings.TrimSpace(s.Text())
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		kv := strings.Fields(t)
+		k, vals := kv[0], kv[1:]
+		if len(vals) == 0 {
+			return nil, fmt.Errorf("%s:%d: %q has no value", file, line, k)
+		}
+		if k == "host" {
+			hosts = append(hosts, hostConfig{patterns: vals})
+			continue
+		}
+		if k == "profile" {
+			if len(vals) != 1 {
+				return nil, fmt.Errorf("%s:%d: a profile has one name, not %q", file, line, vals)
+			}
+			hosts = append(hosts, hostConfig{profile: vals[0]})
+			continue
+		}
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("%s:%d: %q is not in a host or profile block", file, line, k)
+		}
+		if flag.Lookup(k) == nil {
+			return nil, fmt.Errorf("%s:%d: %q is not a cpu flag", file, line, k)
+		}
+		if !hostFlags[k] {
+			return nil, fmt.Errorf("%s:%d: -%s can not be set in a host or profile block; cpu acts on it before it reads %s, so give it on the command line", file, line, k, file)
+		}
+		h := &hosts[len(hosts)-1]
+		h.settings = append(h.settings, [2]string{k, strings.Join(vals, " ")})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// applyConfig sets the flags from the config file for host, and
+// the -profile, leaving alone any flag that was set on the command line.
+func applyConfig(host string) error {
+	hosts, err := readConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var blocks []hostConfig
+	if *profile != "" {
+		var names []string
+		for _, h := range hosts {
+			if h.profile == *profile {
+				blocks = append(blocks, h)
+			}
+			if h.profile != "" {
+				names = append(names, h.profile)
+			}
+		}
+		if len(blocks) == 0 {
+			if len(names) == 0 {
+				return fmt.Errorf("profile %q is not in %s, which has no profiles", *profile, *configFile)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("profile %q is not in %s, which has %s", *profile, *configFile, strings.Join(names, ", "))
+		}
+	}
+	for _, h := range hosts {
+		if h.match(host) {
+			blocks = append(blocks, h)
+		}
+	}
+	for _, h := range blocks {
+		for _, kv := range h.settings {
+			if set[kv[0]] {
+				continue
+			}
+			v("config: %s: %s %s", host, kv[0], kv[1])
+			if err := flag.Set(kv[0], kv[1]); err != nil {
+				return fmt.Errorf("config %s: %s %s: %v", *configFile, kv[0], kv[1], err)
+			}
+			set[kv[0]] = true
+			configFrom[kv[0]] = fmt.Sprintf("%s: %v", *configFile, &h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHostFlags checks that each flag the config file may set is one.
+func TestHostFlags(t *testing.T) {
+	for n := range hostFlags {
+		if flag.Lookup(n) == nil {
+			t.Errorf("hostFlags has %q, which is not a flag", n)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	d, err := ioutil.TempDir("", "cpuconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	for _, tt := range []struct {
+		config string
+		err    string
+	}{
+		{config: "host *\n\troot /data\n\tnononce true\n"},
+		{config: "profile lab\n\tkey /a\n\tkey /b\n"},
+		{config: "host *\n\td true\n", err: "-d can not be set"},
+		{config: "host *\n\troot /\nhost b*\n\tnoterminal true\n", err: ":4: -noterminal can not be set"},
+		{config: "profile p\n\tunshare true\n", err: "-unshare can not be set"},
+		{config: "profile a b\n", err: "a profile has one name"},
+		{config: "host *\n\tnosuchflag 1\n", err: "is not a cpu flag"},
+		{config: "root /\n", err: "is not in a host or profile block"},
+	} {
+		f := filepath.Join(d, "config")
+		if err := ioutil.WriteFile(f, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readConfig(f)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: got %v, want nil", tt.config, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: got %v, want an error with %q", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// fdAddr is the address of a -connfd connection, which has none of
+// its own that we know.
+type fdAddr int
+
+func (a fdAddr) Network() string { return "fd" }
+func (a fdAddr) String() string  { return fmt.Sprintf("fd %d", int(a)) }
+
+// fileConn is a net.Conn on a file that is not a socket, e.g. a pipe
+// or a serial device to a VM. Deadlines work as far as the file
+// supports them.
+type fileConn struct {
+	*os.File
+	fd int
+}
+
+func (c *fileConn) LocalAddr() net.Addr  { return fdAddr(c.fd) }
+func (c *fileConn) RemoteAddr() net.Addr { return fdAddr(c.fd) }
+
+// fdConn returns a net.Conn on the file descriptor fd, which cpu was
+// started with, already connected to the host's ssh server, e.g. by a
+// program that reaches it over a transport cpu can not dial. If fd is
+// a socket, the net.Conn is on the socket; otherwise it reads and
+// writes fd as a file. fd itself is closed either way: the net.Conn
+// has its own descriptor, which the ssh client closes at the end of
+// the session, or if the handshake fails.
+func fdConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("connfd %d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("connfd %d: not a valid file descriptor", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, err
+	}
+	c, err := net.FileConn(f)
+	if err == nil {
+		f.Close()
+		return c, nil
+	}
+	v("connfd %d is not a socket (%v); using it as a file", fd, err)
+	return &fileConn{File: f, fd: fd}, nil
+}
+
+// dialFD is the dialer for -connfd: it runs ssh on the -connfd
+// connection, as a, instead of dialing n.
+func dialFD(n, a string, config *ossh.ClientConfig) (*ossh.Client, error) {
+	conn, err := fdConn(*connFD)
+	if err != nil {
+		return nil, err
+	}
+	return sshClient(conn, a, config)
+}
+
+// checkConnFD returns an error if -connfd is set along with a flag
+// that only means something when cpu dials the host itself.
+func checkConnFD() error {
+	if *connFD < 0 {
+		return nil
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"J", *jump != ""},
+		{"socks", *socks != ""},
+		{"httpproxy", *httpProxy != "" && *httpProxy != "none"},
+		{"4", *ipv4},
+		{"6", *ipv6},
+	} {
+		if f.set {
+			return fmt.Errorf("-connfd can not be used with -%s: cpu does not dial the host", f.name)
+		}
+	}
+	return nil
+}
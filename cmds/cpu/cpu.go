@@ -7,6 +7,9 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,14 +19,15 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/klauspost/compress/flate"
 	// We use this ssh because it implements port redirection.
 	// It can not, however, unpack password-protected keys yet.
-
 	// TODO: get rid of krpty
 	"github.com/u-root/u-root/pkg/termios"
 	"github.com/u-root/u-root/pkg/ulog"
@@ -37,23 +41,124 @@ type nonce [32]byte
 
 var (
 	// For the ssh server part
+	aname       = flag.String("aname", "", "9p attach name for the remote mount: the name of an -export, or a path in -root")
+	allowPaths  = flag.String("allowpaths", "", "only serve the paths, relative to -root, listed in this file, e.g. one written by -auditpaths")
+	audit       = flag.String("audit", "", "append a record of every remote command to this file")
+	authMeths   = flag.String("authmethods", "publickey", "comma-separated ssh auth methods to try, in order: publickey, password, keyboard-interactive")
+	auditPaths  = flag.String("auditpaths", "", "append every path, relative to -root, that the remote uses to this file")
+	bench       = flag.Bool("bench", false, "instead of a command, time 9p stats, writes and reads on the remote, through the mount, and print a report, e.g. to compare -msize or -9pcompress")
+	benchFiles  = flag.Int("benchfiles", 4, "how many files -bench writes and reads")
+	benchSize   = flag.Int64("benchsize", 16<<20, "how big, in bytes, each file -bench writes and reads is")
 	bin         = flag.String("bin", "cpud", "path of cpu binary")
+	binSHA256   = flag.String("binsha256", "", "if set, the sha256 the remote -bin must have; cpu will not run it otherwise")
+	cacheMode   = flag.String("cache", "none", "how the remote caches the namespace: none, loose or strict")
+	caseFold    = flag.Bool("caseinsensitive", false, "match the names the remote looks up without regard to case, e.g. for a macOS remote")
+	check9p     = flag.Bool("verify9p", false, "before the session, check that a test file read by the remote over 9p arrives intact, to catch a corrupting transport")
+	compress9p  = flag.Bool("9pcompress", false, "compress the 9p channel; worth it on slow links")
+	compressLvl = flag.Int("9pcompresslevel", 5, "compression level for -9pcompress, 1 (fastest) to 9 (smallest)")
+	configFile  = flag.String("config", filepath.Join(os.Getenv("HOME"), ".cpu", "config"), "config file with per-host flag defaults")
+	controlPath = flag.String("controlpath", "", "if set, the control socket of an OpenSSH ControlMaster to the host, e.g. from ssh -M -S path, to run the session over, rather than logging in ourselves")
+	connFD      = flag.Int("connfd", -1, "if set, a file descriptor, already connected to the host's ssh server, to run the session over instead of dialing")
+	crlf        = flag.String("crlf", "", "comma-separated patterns, e.g. *.txt,*.bat, of local CRLF text files the remote sees with LF line endings")
 	debug       = flag.Bool("d", false, "enable debug prints")
+	diagFD      = flag.Int("diagfd", -1, "if set, a file descriptor to write cpu's own messages to, rather than stderr, which then only has the remote's, e.g. -diagfd 3 3>cpu.log")
+	diagPrefix  = flag.String("diagprefix", "", "if set, e.g. \"cpu: \", put this at the start of each line of cpu's own messages, so they can be told from the remote's stderr")
 	dbg9p       = flag.Bool("dbg9p", false, "show 9p io")
+	detach      = flag.Bool("detach", false, "start the command on the remote under nohup, print its pid and output file, and exit; it gets no namespace")
 	dump        = flag.Bool("dump", false, "Dump copious output, including a 9p trace, to a temp file at exit")
+	dumpOnError = flag.Bool("dumponerror", false, "with -dump, keep the output in memory and only write it out if the session fails")
+	exactArgs   = flag.Bool("exactargs", false, "give the remote the command's arguments word for word, spaces, quotes and newlines and all, rather than as one string it splits on white space; needs a cpud that knows -argv64")
+	fidDump     = flag.Bool("dumpfids", false, "on SIGUSR1, write the fids the remote holds, and the paths and modes of the open ones, to stderr or the -dump file")
+	echoCmd     = flag.Bool("echocmd", false, "print the remote command on stdout, before its output, e.g. for CI logs")
+	fwdSignals  = flag.String("forwardsignals", "", "comma-separated signals, of INT, QUIT, TERM, USR1 and USR2, to pass on to the remote command rather than act on")
+	gitIgnore   = flag.Bool("gitignore", false, "do not serve what the .gitignore files in our trees ignore, e.g. build output; the remote gets ENOENT for it")
+	hangTimeout = flag.String("hangtimeout", "", "if set, and the session is not running after this long, e.g. 30s, dump all goroutine stacks and exit")
+	interactive = flag.Bool("i", false, "require an interactive session, with a remote pty, and fail if stdin is not a terminal; without -i, a session is one if stdin is a terminal, with a command or without, unless -noterminal")
+	ipv4        = flag.Bool("4", false, "only use IPv4 to reach the host")
+	ipv6        = flag.Bool("6", false, "only use IPv6 to reach the host")
+	events9p    = flag.String("9pevents", "", "if set, a Unix socket on which to stream the remote's 9p operations, as JSON lines, to whatever connects")
+	exportAllow = flag.String("exportallow", "", "if set, comma-separated directories, each path, read-only, or rw=path, any directory in which the remote may ask, during the session, to be served too, with cpud -requestexport")
+	exports     = &stringList{}
+	httpProxy   = flag.String("httpproxy", "", "connect through this HTTP proxy, with CONNECT, http[s]://[user[:password]@]host[:port]; by default, $HTTPS_PROXY or $ALL_PROXY, if set; none for no proxy")
+	showCfg     = flag.Bool("showconfig", false, "print the settings cpu would use for the host, after the -config file and -profile, and where each came from, then exit without connecting; passwords are not shown")
+	showHealth  = flag.Bool("healthline", false, "in an interactive session, show how the connection is, from ssh keepalive round trips, on the bottom line of the terminal")
+	hostKeyAlg  = flag.String("hostkeyalgs", "", "if set, e.g. ssh-ed25519, the host key algorithms to take, comma-separated, in order of preference; with a leading ^, these go first, then the rest")
 	hostKeyFile = flag.String("hk", "" /*"/etc/ssh/ssh_host_rsa_key"*/, "file for host key")
-	keyFile     = flag.String("key", filepath.Join(os.Getenv("HOME"), ".ssh/cpu_rsa"), "key file")
+	jump        = flag.String("J", "", "reach the host through these ssh jump hosts, [user@]host[:port][,...]")
+	keepAlive9p = flag.String("9pkeepalive", "", "if set, how often the remote stats the 9p mount when it is otherwise idle, e.g. 1m")
+	keepEnv     = flag.String("keepenv", "", "comma-separated variables, of those -libenv is about, e.g. LD_PRELOAD, to send as they are")
+	keyFiles    = &stringList{}
+	libPaths    = flag.String("libenv", "", "what to do with LD_LIBRARY_PATH, LD_PRELOAD, PKG_CONFIG_PATH and the like: keep, drop or remap, to under /tmp/cpu; the default is drop when the remote gets all of /, and keep otherwise")
+	listenTries = flag.Int("listentries", 4, "how many times to ask the remote to listen for the 9p forward before giving up")
+	locale      = flag.Bool("locale", false, "set TZ for the remote, if it is not set here, from our time zone, as well as passing on LANG and LC_*")
+	localPre    = flag.String("localpre", "", "local command to run before connecting; if it fails, cpu does not connect")
+	localPost   = flag.String("localpost", "", "local command to run after the session ends, even if it failed")
+	login       = flag.Bool("l", false, "run the remote shell as a login shell")
+	max9pOps    = flag.Int("max9pconcurrency", 256, "the most 9p operations to run at once; more are queued. 0 means no limit")
+	maxBytes    = flag.Int64("maxbytes", 0, "if set, refuse 9p reads and writes once the remote has moved this many bytes")
+	maxDepth    = flag.Int("maxdepth", 0, "if set, do not serve paths more than this many levels below -root; the remote gets ENOENT for them")
+	maxEnv      = flag.Int("maxenv", 0, "if set, the most environment variables to send the remote; cpu's own, then CPU_*, TERM and the locale, go first")
+	maxOpen     = flag.Int64("maxopenfiles", 0, "if set, the most files the remote may have open over 9p at once")
+	maxDur      = flag.String("maxduration", "", "if set, e.g. 2h, end the session this long after it starts, however busy it is: the remote command gets SIGTERM, and 5s later the session is closed")
+	mergeStderr = flag.Bool("mergestderr", false, "send the remote's stderr to our stdout, as 2>&1 would")
+	mountMode   = flag.String("mountmode", "auto", "how the remote mounts our files: kernel, with its kernel's 9p; fuse, with cpud's own 9p client, over FUSE, which is slower; or auto, kernel if it has 9p, and fuse if not, or with -parallelread")
+	mntCheck    = flag.String("mountcheck", "", "if set, e.g. \"test -f /tmp/cpu/src/Makefile\", a command to run on the remote, with our files mounted, before the session; if it fails, cpu stops there")
 	mountopts   = flag.String("mountopts", "", "Extra options to add to the 9p mount")
+	minCipher   = flag.Int("mincipherbits", 0, "if set, only use ssh ciphers with keys of at least this many bits, e.g. 256")
+	msgTimeout  = flag.String("9pmsgtimeout", "", "if set, e.g. to 30s, the longest a 9p operation on our files may take, plus 1s per MiB moved, before the remote gets EIO")
 	msize       = flag.Int("msize", 1048576, "msize to use")
 	network     = flag.String("network", "tcp", "network to use")
+	noNameSpace = flag.Bool("nonamespace", false, "do not give the remote our namespace; as CPU_NAMESPACE= does")
+	nonceMode   = flag.String("noncemode", "env", "how to give cpud the nonce: env, in $CPUNONCE; arg, on its command line, visible to ps on the remote; or file, in a file only we can read, for an sshd whose AcceptEnv drops CPUNONCE")
+	noNonce     = flag.Bool("nononce", false, "INSECURE: do not check the nonce on the 9p and status forwards; only for trusted machines, as anything on the remote may then mount us")
+	noTerm      = flag.Bool("noterminal", false, "leave the local terminal alone and do not ask for a remote pty, e.g. when run by a program that manages the terminal")
+	otlp        = flag.String("otlp", "", "if set, e.g. http://localhost:4318, at the end of the session send a span for each phase of the connection, and the command, to this OTLP/HTTP collector")
+	overlay     = flag.String("overlay", "", "if set, discard, list or keep: keep the remote's writes in an overlay, so our files are untouched, and at the end, discard it, list what is in it and discard it, or keep it")
 	port        = flag.String("sp", "23", "cpu default port")
-	port9p      = flag.String("port9p", "", "port9p # on remote machine for 9p mount")
+	parRead     = flag.Int("parallelread", 0, "if more than 1, e.g. 8, the remote keeps this many reads of a file in flight while it is read in order, to hide the link's latency; up to 64, and only over a FUSE mount, which it picks with -mountmode auto")
+	pushBin     = flag.String("pushbin", "", "if set, a statically linked cpud here to copy to the remote, for the session, if the remote does not have -bin")
+	pidFile     = flag.String("pidfile", "", "write the pid of the remote command to this file")
+	profile     = flag.String("profile", "", "use the settings of this profile in the -config file, as defaults for flags not given here")
+	prefetch    = flag.String("prefetch", "", "file listing paths, relative to -root, to read into the cache once the remote has mounted us")
+	port9p      = flag.String("port9p", "", "port on the remote machine for the 9p forward (default $CPU_PORT9P, or any free port)")
+	q9perrors   = flag.Bool("q9perrors", true, "only show 9p connection errors at the end of a session in debug output")
+	readBuf9p   = flag.Int("9preadbuf", 0, "if set, the socket receive buffer, in bytes, of the connection 9p runs over, e.g. for long, fast links")
+	showRusage  = flag.Bool("rusage", false, "at the end of the session, print on stderr the user and system time and the largest resident set of the remote command, as time -v would")
+	requireArch = flag.String("requirearch", "", "if set, e.g. amd64 or x86_64, fail unless uname -m on the remote says it is this architecture")
+	requireOS   = flag.String("requireos", "", "if set, e.g. Linux, fail unless uname -s on the remote says it runs this system")
+	privCmd     = flag.String("privcmd", "sudo -E", "with -sudo, the command to run cpud with to make it root; it must keep the environment, as sudo -E does")
+	prioKeys    = flag.Bool("prioritizeinteractive", true, "in a session with a pty, while keys are being typed, hold 9p back, so that they are not queued behind a big read of our files")
+	rekeyBytes  = flag.Uint64("rekeybytes", 0, "if set, negotiate new ssh keys after this many bytes, at least 1 MiB; 0 means the cipher's default")
+	rekeyTime   = flag.String("rekeyinterval", "", "if set, e.g. 1h, at least 1m, also negotiate new ssh keys this often, however little has been sent; needs -rekeybytes, as each costs that many bytes of padding")
+	remount9p   = flag.Bool("9premount", false, "if the 9p channel breaks while the session goes on, give the remote a new one to remount")
 	root        = flag.String("root", "/", "9p root")
+	setupKey    = flag.Bool("setupkey", false, "make the -key, if there is none, and offer to add it to authorized_keys on the host, logging in with a password; asks before each step")
+	snapshot    = flag.Bool("snapshot", false, "serve the remote a snapshot of -root, taken in memory as cpu starts, so local changes do not reach it")
+	snapMax     = flag.Int64("snapshotmax", 1<<30, "the largest -snapshot, in bytes")
+	socks       = flag.String("socks", "", "connect through this SOCKS5 proxy, [user[:password]@]host:port")
+	sshOpts     = &stringList{}
+	stdinTries  = flag.Int("stdinretries", 10, "how many EINTR or EAGAIN errors in a row to ride out when reading a terminal before input to the remote stops; an EOF always stops it")
+	sudo        = flag.Bool("sudo", false, "run cpud on the remote as root, with -privcmd, for a login that can not mount; the command still runs as the login")
+	subsystem   = flag.String("subsystem", "", "request this ssh subsystem, e.g. sftp, instead of running cpud and a command")
+	tcpAlive    = flag.String("tcpkeepalive", "", "how often the kernel checks, when the ssh connection is idle, that the host is still there, e.g. 30s, or off; the default is every 15s")
+	tcpNoDelay  = flag.Bool("tcpnodelay", true, "set TCP_NODELAY on the ssh connection, so keys typed are sent at once, not held back by Nagle's algorithm")
+	thenShell   = flag.Bool("then-interactive", false, "run the command, without a pty, then, if it worked, an interactive shell, over the same connection")
+	timing      = flag.Bool("timing", false, "print how long each phase of the connection took at the end of the session")
 	timeout9P   = flag.String("timeout9p", "100ms", "time to wait for the 9p mount to happen.")
+	umask       = flag.String("umask", "", "if set, the umask, in octal, of the remote command, e.g. 022")
+	union       = flag.String("union", "", "if set, local or remote: the remote gets a read-only union of our files and its own, rather than ours in place of its own, with that side's on top; needs overlayfs on the remote")
+	unshare     = flag.Bool("unshare", false, "Linux only: run cpu in a new mount namespace, so its mounts do not leak into ours")
+	usePager    = flag.Bool("pager", false, "with -noterminal, which it sets, page the remote's stdout through $PAGER, or less, when stdout is a terminal")
+	writeBuf9p  = flag.Int("9pwritebuf", 0, "if set, the socket send buffer, in bytes, of the connection 9p runs over")
+	yesIKnow    = flag.Bool("yes-i-know", false, "do not warn that the remote can read and write all of / when -root is /")
+
+	defaultKey = filepath.Join(os.Getenv("HOME"), ".ssh/cpu_rsa")
+	authKey    string // the -key that authenticated us, if we know
 
 	v          = func(string, ...interface{}) {}
 	pid1       bool
-	dumpWriter *os.File
+	nonceTries = 3 // how many times we try the 9p nonce handshake
+	dumpWriter io.Writer
 )
 
 func verbose(f string, a ...interface{}) {
@@ -76,31 +181,120 @@ func (n nonce) String() string {
 	return string(n[:])
 }
 
-func dial(n, a string, config *ossh.ClientConfig) (*ossh.Client, error) {
-	client, err := ossh.Dial(n, a, config)
+// stringList is a flag.Value for flags that may be given more than once.
+// The values are kept in the order given.
+type stringList []string
+
+// String implements flag.Value.String.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value.Set.
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// keySigner is a Signer that remembers, in authKey, which key
+// file was last used to sign. The ssh package only signs with a key
+// once the server has said it will accept it, so after a successful
+// publickey auth this is the key that did it.
+type keySigner struct {
+	ossh.Signer
+	file string
+}
+
+// Sign implements ossh.Signer.Sign.
+func (k *keySigner) Sign(r io.Reader, data []byte) (*ossh.Signature, error) {
+	authKey = k.file
+	return k.Signer.Sign(r, data)
+}
+
+// certFiles holds the certificates certSigner found, by key file.
+var certFiles = map[string]string{}
+
+// certSigner returns a signer for the OpenSSH certificate of the key
+// in kf, which is kf-cert.pub, as for ssh. It returns nil if there is
+// no certificate.
+func certSigner(kf string, s ossh.Signer) (ossh.Signer, error) {
+	cf := kf + "-cert.pub"
+	b, err := ioutil.ReadFile(cf)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pk, _, _, _, err := ossh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cf, err)
+	}
+	c, ok := pk.(*ossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a certificate", cf)
+	}
+	if c.ValidBefore != ossh.CertTimeInfinity && time.Now().Unix() >= int64(c.ValidBefore) {
+		verbose("certificate %v has expired; trying it anyway, then the plain key", cf)
+	}
+	cs, err := ossh.NewCertSigner(c, s)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to dial: %v", err)
+		return nil, fmt.Errorf("%v: %v", cf, err)
 	}
-	return client, nil
+	certFiles[kf] = cf
+	return &keySigner{Signer: cs, file: cf}, nil
 }
 
-func config(kf string) (*ossh.ClientConfig, error) {
-	cb := ossh.InsecureIgnoreHostKey()
+// minRekeyBytes is the smallest -rekeybytes we take. The ssh package
+// would go as low as 256 bytes, but a key exchange every few packets
+// would leave no time for anything else.
+const minRekeyBytes = 1 << 20
+
+// config builds the client config.
+// Keys are offered to the server in the order given. The server
+// stops us at the first one it accepts, so no more keys are tried
+// than necessary; put the likeliest key first to stay clear of
+// the server's MaxAuthTries.
+// The keys are only read if -authmethods includes publickey.
+func config(kfs []string) (*ossh.ClientConfig, error) {
+	methods, err := parseAuthMethods(*authMeths)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(methods, "publickey") {
+		kfs = nil
+	}
+	cb, err := strictHostKeys()
+	if err != nil {
+		return nil, err
+	}
 	//var hostKey ssh.PublicKey
 	// A public key may be used to authenticate against the remote
 	// server by using an unencrypted PEM-encoded private key file.
 	//
 	// If you have an encrypted private key, the crypto/x509 package
 	// can be used to decrypt it.
-	key, err := ioutil.ReadFile(kf)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read private key %v: %v", kf, err)
-	}
+	var signers []ossh.Signer
+	for _, kf := range kfs {
+		key, err := ioutil.ReadFile(kf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read private key %v: %v", kf, err)
+		}
 
-	// Create the Signer for this private key.
-	signer, err := ossh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("ParsePrivateKey %v: %v", kf, err)
+		// Create the Signer for this private key.
+		signer, err := ossh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("ParsePrivateKey %v: %v", kf, err)
+		}
+		// An OpenSSH certificate for the key, if there is one, is
+		// offered first. If it is rejected, e.g. because it has
+		// expired, the plain key is offered next.
+		if cs, err := certSigner(kf, signer); err != nil {
+			log.Printf("Not using certificate for %v: %v", kf, err)
+		} else if cs != nil {
+			signers = append(signers, cs)
+		}
+		signers = append(signers, &keySigner{Signer: signer, file: kf})
 	}
 	if *hostKeyFile != "" {
 		hk, err := ioutil.ReadFile(*hostKeyFile)
@@ -114,22 +308,34 @@ func config(kf string) (*ossh.ClientConfig, error) {
 		cb = ossh.FixedHostKey(pk)
 	}
 	config := &ossh.ClientConfig{
-		User: os.Getenv("USER"),
-		Auth: []ossh.AuthMethod{
-			// Use the PublicKeys method for remote authentication.
-			ossh.PublicKeys(signer),
-		},
+		User:            os.Getenv("USER"),
+		Auth:            authMethods(methods, signers),
 		HostKeyCallback: cb,
 	}
+	if config.Ciphers, err = minCiphers(); err != nil {
+		return nil, err
+	}
+	if config.HostKeyAlgorithms, err = hostKeyAlgorithms(); err != nil {
+		return nil, err
+	}
+	if *rekeyBytes != 0 {
+		if *rekeyBytes < minRekeyBytes {
+			return nil, fmt.Errorf("rekeybytes %d: must be at least %d", *rekeyBytes, minRekeyBytes)
+		}
+		config.RekeyThreshold = *rekeyBytes
+	}
 	return config, nil
 }
 
-func cmd(client *ossh.Client, s string) ([]byte, error) {
+func cmd(client *ossh.Client, s string, envs ...string) ([]byte, error) {
 	session, err := client.NewSession()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create session: %v", err)
 	}
 	defer session.Close()
+	if len(envs) > 0 {
+		env(session, envs...)
+	}
 
 	var b bytes.Buffer
 	session.Stdout = &b
@@ -139,25 +345,376 @@ func cmd(client *ossh.Client, s string) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// checkBin makes sure the -bin on the remote is the one we expect,
+// by running sha256sum on it and comparing with -binsha256.
+// The remote could of course lie to us; this catches a wrong
+// version or a binary changed behind the remote's back, not a
+// remote that is out to get us.
+func checkBin(cl *ossh.Client) error {
+	want := strings.ToLower(*binSHA256)
+	if _, err := hex.DecodeString(want); err != nil || len(want) != sha256.Size*2 {
+		return fmt.Errorf("binsha256 %q: want %d hex digits", *binSHA256, sha256.Size*2)
+	}
+	b, err := cmd(cl, "sha256sum "+shQuote(*bin))
+	if err != nil {
+		return fmt.Errorf("Getting sha256 of remote %v: %v", *bin, err)
+	}
+	f := strings.Fields(string(b))
+	if len(f) == 0 {
+		return fmt.Errorf("Getting sha256 of remote %v: no output from sha256sum", *bin)
+	}
+	if got := strings.ToLower(f[0]); got != want {
+		return fmt.Errorf("remote %v has sha256 %v, not %v; refusing to run it", *bin, got, want)
+	}
+	verbose("remote %v has sha256 %v", *bin, want)
+	return nil
+}
+
+// auditRecord appends a line to the -audit file describing the session
+// about to be started. It is deliberately not part of verbose logging:
+// the record is written whether or not debugging is on, and before the
+// remote command runs, so failed commands are recorded too.
+// If the record can not be written we complain loudly, but do not stop
+// the session.
+func auditRecord(host, user, cmd string) {
+	if *audit == "" {
+		return
+	}
+	rec := fmt.Sprintf("%s host=%q user=%q cmd=%q\n", time.Now().Format(time.RFC3339), host, user, cmd)
+	f, err := os.OpenFile(*audit, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("WARNING: AUDIT RECORD NOT WRITTEN: %v: %s", err, rec)
+		return
+	}
+	if _, err := f.WriteString(rec); err != nil {
+		log.Printf("WARNING: AUDIT RECORD NOT WRITTEN: %v: %s", err, rec)
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("WARNING: AUDIT RECORD MAY BE LOST: closing %q: %v", *audit, err)
+	}
+}
+
+// localHook runs one of the -localpre or -localpost commands.
+// The target host and port are in $CPU_HOST and $CPU_PORT.
+func localHook(c, host string) error {
+	f := strings.Fields(c)
+	if len(f) == 0 {
+		return nil
+	}
+	x := exec.Command(f[0], f[1:]...)
+	x.Stdin, x.Stdout, x.Stderr = os.Stdin, os.Stdout, os.Stderr
+	x.Env = append(os.Environ(), "CPU_HOST="+host, "CPU_PORT="+*port)
+	v("run local hook %v", x)
+	if err := x.Run(); err != nil {
+		return fmt.Errorf("running %q: %v", c, err)
+	}
+	return nil
+}
+
 // To make sure defer gets run and you tty is sane on exit
 func runClient(host, a string) error {
-	c, err := config(*keyFile)
+	defer close(tearingDown)
+	defer phase("total", time.Now())
+	// Settings from the config file, e.g. a per-host -root,
+	// must be in place before anything uses them.
+	if err := applyConfig(host); err != nil {
+		return err
+	}
+	if *showCfg {
+		return showConfig(os.Stdout, host)
+	}
+	if err := parseExports(*exports); err != nil {
+		return err
+	}
+	warnRoot()
+	if err := checkSockBufs(); err != nil {
+		return err
+	}
+	if err := checkConnFD(); err != nil {
+		return err
+	}
+	if err := checkTCPOpts(); err != nil {
+		return err
+	}
+	if err := checkLibEnv(); err != nil {
+		return err
+	}
+	if err := checkNonceMode(); err != nil {
+		return err
+	}
+	if err := checkMaxDuration(); err != nil {
+		return err
+	}
+	if err := checkRekeyInterval(); err != nil {
+		return err
+	}
+	if err := checkOTLP(); err != nil {
+		return err
+	}
+	if err := checkExportAllow(); err != nil {
+		return err
+	}
+	if err := readAllowed(); err != nil {
+		return err
+	}
+	if err := parseMsgTimeout(); err != nil {
+		return err
+	}
+	if *events9p != "" {
+		if err := listenEvents(); err != nil {
+			return fmt.Errorf("9pevents: %v", err)
+		}
+		defer closeEvents()
+	}
+	if *fidDump {
+		sigs, err := parseSignals(*fwdSignals)
+		if err != nil {
+			return err
+		}
+		if contains(sigs, "USR1") {
+			return fmt.Errorf("-dumpfids takes SIGUSR1, so it can not be in -forwardsignals")
+		}
+		go watchFidDump()
+	}
+	if err := localHook(*localPre, host); err != nil {
+		return fmt.Errorf("localpre: %v", err)
+	}
+	// The post hook runs however the session ends.
+	defer func() {
+		if err := localHook(*localPost, host); err != nil {
+			log.Printf("localpost: %v", err)
+		}
+	}()
+	if *controlPath != "" {
+		return runMux(host, a)
+	}
+	defer removePidFile()
+	kfs := *keyFiles
+	if len(kfs) == 0 {
+		kfs = []string{defaultKey}
+	}
+	dialer := dial
+	switch {
+	case *jump != "":
+		dialer = dialJumps
+	case *connFD >= 0:
+		dialer = dialFD
+	}
+	// The key must be there before config reads it.
+	if *setupKey {
+		if err := installKey(kfs[0], host, dialer); err != nil {
+			return err
+		}
+	}
+	c, err := config(kfs)
 	if err != nil {
 		return err
 	}
-	cl, err := dial(*network, net.JoinHostPort(host, *port), c)
+	cl, err := dialer(*network, net.JoinHostPort(host, *port), c)
 	if err != nil {
 		return err
 	}
+	defer rekeyTimer(cl)()
+	verbose("authenticated with key %v", authKey)
+	if cf, ok := certFiles[authKey]; ok {
+		log.Printf("Certificate %v was not accepted; authenticated with the plain key %v", cf, authKey)
+	}
+	if err := checkArch(cl); err != nil {
+		return err
+	}
+	if *detach {
+		return runDetached(cl, host, c.User, a)
+	}
 	// Special case: maybe we don't want a namespace. If so, we don't need
 	// to open up the socket.
-	wantNameSpace := true
-	if n, ok := os.LookupEnv("CPU_NAMESPACE"); ok && len(n) == 0 {
-		wantNameSpace = false
+	wantNameSpace := nameSpace()
+	if *hangTimeout != "" {
+		d, err := time.ParseDuration(*hangTimeout)
+		if err != nil {
+			return fmt.Errorf("hangtimeout: %v", err)
+		}
+		go watchHang(d, wantNameSpace)
+	}
+
+	if *pushBin != "" && *subsystem == "" {
+		p, err := pushCPUD(cl)
+		if err != nil {
+			return err
+		}
+		if p != "" {
+			defer removePushed(cl, p)
+			*bin = p
+		}
+	}
+
+	if *binSHA256 != "" {
+		if err := checkBin(cl); err != nil {
+			return err
+		}
+	}
+
+	priv, err := setupPriv(cl, host)
+	if err != nil {
+		return err
+	}
+	base, deadline, err := cpudCommand(priv, host, wantNameSpace)
+	if err != nil {
+		return err
+	}
+
+	// The export outlives a failed nonce handshake: the retries
+	// below serve the same one.
+	var ex *export
+	if wantNameSpace {
+		if *snapshot {
+			if err := takeSnapshot(); err != nil {
+				return err
+			}
+		}
+		if err := startOverlay(); err != nil {
+			return err
+		}
+		defer endOverlay()
+		ex = newExport(*root)
+	}
+
+	if *check9p && wantNameSpace {
+		if err := verify9p(cl, ex, base, deadline); err != nil {
+			log.Printf("WARNING: -verify9p: %v", err)
+		}
+	}
+	// -verify9p needs the top of -root, so the -aname comes last.
+	if *aname != "" {
+		base = fmt.Sprintf("%s -aname %q", base, *aname)
+	}
+	if *mntCheck != "" {
+		if !wantNameSpace {
+			log.Printf("Warning: -mountcheck: there is no namespace to check")
+		} else if err := mountCheck(cl, ex, base, deadline); err != nil {
+			return err
+		}
+	}
+
+	// If the nonce handshake is rejected, e.g. because of a race
+	// or a stale cpud, the remote fails the mount and exits.
+	// In that case we try again, a few times, with a fresh
+	// listener and nonce. srv has closed the old listener and
+	// returned by the time it tells us the handshake failed.
+	for try := 1; ; try++ {
+		var (
+			env       []string
+			handshake chan error
+			nf        string
+		)
+		cmd := base
+		// cpud mounts nothing if CPU_NAMESPACE is empty; with
+		// -nonamespace it is not in our environment to pass on.
+		if *noNameSpace {
+			env = append(env, "CPU_NAMESPACE=")
+		}
+		if *locale {
+			env = append(env, localeEnv()...)
+		}
+		if wantNameSpace || wantStatus() {
+			var n nonce
+			if !*noNonce {
+				if n, err = generateNonce(); err != nil {
+					log.Fatalf("Getting nonce: %v", err)
+				}
+				// Before the forwards, since the -timeout9p
+				// deadline starts with them.
+				e, f, file, err := sendNonce(cl, n)
+				if err != nil {
+					return err
+				}
+				env, cmd, nf = append(env, e...), cmd+f, file
+			}
+			if wantNameSpace {
+				port9p, h, err := forward9p(cl, ex, n, deadline)
+				if err != nil {
+					return noNonceFile(cl, nf, &MountError{Err: err})
+				}
+				handshake = h
+				cmd = fmt.Sprintf("%s -port9p %v", cmd, port9p)
+			}
+			if wantStatus() {
+				sp, err := statusChannel(cl, n)
+				if err != nil {
+					return noNonceFile(cl, nf, err)
+				}
+				cmd = fmt.Sprintf("%s -statusport %v", cmd, sp)
+			}
+		}
+		if *exactArgs {
+			cmd = fmt.Sprintf("%s -argv64 %s", cmd, encodeArgv(argv))
+		}
+		cmd = fmt.Sprintf("%s %q", cmd, a)
+		auditRecord(host, c.User, cmd)
+		run, done, err := withAskpass(cl, cmd)
+		if err != nil {
+			return noNonceFile(cl, nf, err)
+		}
+		err = durationErr(noNonceFile(cl, nf, sessionErr(shell(cl, run, env...))))
+		done()
+		if handshake != nil {
+			select {
+			case herr := <-handshake:
+				// Only a session that failed is tried again:
+				// one that worked has run its command, and
+				// must not run it twice.
+				if herr != nil && err != nil && try < nonceTries {
+					verbose("9p handshake failed: %v; try %d of %d with a new nonce", herr, try+1, nonceTries)
+					continue
+				}
+				// cpud could not mount us, so whatever it
+				// exited with says less than why.
+				if herr != nil && err != nil {
+					return &MountError{Err: fmt.Errorf("9p handshake failed %d times: %v", try, herr)}
+				}
+			default:
+			}
+		}
+		// With -then-interactive, a shell follows the command, if
+		// it worked, over the same connection, with a 9p mount and
+		// a nonce of its own.
+		if err == nil && *thenShell {
+			*thenShell, *noTerm = false, false
+			argv = []string{os.Getenv("SHELL")}
+			a = argv[0]
+			try = 0
+			continue
+		}
+		return err
 	}
+}
 
-	var env []string
-	cmd := fmt.Sprintf("%v -remote -bin %v", *bin, *bin)
+// cpudCommand returns the command that runs cpud on the remote, with
+// the flags ours call for, bar the -aname, the nonce and the ports,
+// and the -timeout9p deadline. priv is what runs it as root, for -sudo.
+func cpudCommand(priv, host string, wantNameSpace bool) (base string, deadline time.Duration, err error) {
+	base = fmt.Sprintf("%s%v -remote -bin %v", priv, *bin, *bin)
+	if *sudo {
+		base += runAs
+	}
+	if *login {
+		base += " -l"
+	}
+	if *showRusage && *subsystem == "" {
+		base += " -rusage"
+	}
+	switch *union {
+	case "":
+	case "local", "remote":
+		base = fmt.Sprintf("%s -union %s", base, *union)
+	default:
+		return "", 0, fmt.Errorf("union %q: want local or remote", *union)
+	}
+	if *umask != "" {
+		if _, err := parseUmask(*umask); err != nil {
+			return "", 0, err
+		}
+		base = fmt.Sprintf("%s -umask %s", base, *umask)
+	}
 	if wantNameSpace {
 		// From setting up the forward to having the nonce written back to us,
 		// we only allow 100ms. This is a lot, considering that at this point,
@@ -165,42 +722,149 @@ func runClient(host, a string) error {
 		// told what to do. We suggest that making the deadline a flag
 		// would be a bad move, since people might be tempted to make it
 		// large.
-		deadline, err := time.ParseDuration(*timeout9P)
-		if err != nil {
-			return err
+		if deadline, err = time.ParseDuration(*timeout9P); err != nil {
+			return "", 0, err
 		}
-		// Arrange port forwarding from remote ssh to our server.
-		// Request the remote side to open port 5640 on all interfaces.
-		// Note: cl.Listen returns a TCP listener with network is "tcp"
-		// or variants. This lets us use a listen deadline.
-		l, err := cl.Listen("tcp", "127.0.0.1:0")
-		if err != nil {
-			return fmt.Errorf("First cl.Listen %v", err)
+		if *keepAlive9p != "" {
+			if _, err := time.ParseDuration(*keepAlive9p); err != nil {
+				return "", 0, fmt.Errorf("9pkeepalive: %v", err)
+			}
+			base = fmt.Sprintf("%s -9pkeepalive %v", base, *keepAlive9p)
+		}
+		if *remount9p {
+			base += " -9premount"
+		}
+		if *exportAllow != "" {
+			base += " -exportrequests"
+		}
+		// auto is what a cpud that does not know -mountmode does,
+		// bar the fallback, so it is only passed when it is not.
+		switch *mountMode {
+		case "auto":
+		case "kernel", "fuse":
+			base = fmt.Sprintf("%s -mountmode %s", base, *mountMode)
+		default:
+			return "", 0, fmt.Errorf("mountmode %q: must be auto, kernel or fuse", *mountMode)
+		}
+		// Each read in flight holds a buffer on the remote.
+		if *parRead < 0 || *parRead > 64 {
+			return "", 0, fmt.Errorf("parallelread %d: must be from 0 to 64", *parRead)
 		}
-		ap := strings.Split(l.Addr().String(), ":")
-		if len(ap) == 0 {
-			return fmt.Errorf("Can't find a port number in %v", l.Addr().String())
+		if *parRead > 1 {
+			base = fmt.Sprintf("%s -parallelread %d", base, *parRead)
 		}
-		port9p := ap[len(ap)-1]
-		v("listener %T %v addr %v port %v", l, l, l.Addr().String(), port)
+		switch *cacheMode {
+		case "none":
+		case "loose", "strict":
+			base = fmt.Sprintf("%s -cache %s", base, *cacheMode)
+		default:
+			return "", 0, fmt.Errorf("cache %q: must be none, loose or strict", *cacheMode)
+		}
+		if *compress9p {
+			if *compressLvl < flate.BestSpeed || *compressLvl > flate.BestCompression {
+				return "", 0, fmt.Errorf("9pcompresslevel %d: must be from %d to %d", *compressLvl, flate.BestSpeed, flate.BestCompression)
+			}
+			base = fmt.Sprintf("%s -9pcompress -9pcompresslevel %d", base, *compressLvl)
+		}
+	}
 
-		nonce, err := generateNonce()
-		if err != nil {
-			log.Fatalf("Getting nonce: %v", err)
+	// Without the nonce, anything on the remote that can reach the
+	// forwarded ports, and not just cpud, gets our files.
+	if *noNonce && (wantNameSpace || wantStatus()) {
+		log.Printf("WARNING: -nononce: any process on %v can mount -root %v as you while the session runs", host, *root)
+		base += " -nononce"
+	}
+	return base, deadline, nil
+}
+
+// parseUmask parses an octal umask such as 022.
+func parseUmask(s string) (int, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("umask %q: want an octal number from 0 to 777", s)
+	}
+	return int(m), nil
+}
+
+// nameSpace returns true if the remote is to mount our namespace.
+// It is not with -nonamespace, if $CPU_NAMESPACE is set but empty,
+// or with -subsystem, which does not run cpud at all.
+func nameSpace() bool {
+	if *noNameSpace || *subsystem != "" || *detach {
+		return false
+	}
+	if n, ok := os.LookupEnv("CPU_NAMESPACE"); ok && len(n) == 0 {
+		return false
+	}
+	return true
+}
+
+// remotePort9p returns the port the remote listens on for the 9p
+// forward: -port9p, or $CPU_PORT9P, or if neither is set, 0, for
+// any free port.
+func remotePort9p() string {
+	if *port9p != "" {
+		return *port9p
+	}
+	if p := os.Getenv("CPU_PORT9P"); p != "" {
+		return p
+	}
+	return "0"
+}
+
+// listenRemote asks the remote ssh to listen on port, on 127.0.0.1,
+// and forward connections to us; port 0 is any free port.
+// It returns the listener and the port.
+// A loaded server may refuse the forward for a moment right after we
+// connect, so we try -listentries times, backing off, before giving up.
+func listenRemote(cl *ossh.Client, port string) (net.Listener, string, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+	delay := 50 * time.Millisecond
+	for try := 1; ; try++ {
+		// Note: cl.Listen returns a TCP listener with network is "tcp"
+		// or variants. This lets us use a listen deadline.
+		if l, err = cl.Listen("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+			break
 		}
-		go srv(l, *root, nonce, deadline)
-		cmd = fmt.Sprintf("%s -port9p %v", cmd, port9p)
-		env = append(env, "CPUNONCE="+nonce.String())
+		if try >= *listenTries {
+			return nil, "", fmt.Errorf("First cl.Listen %v (tried %d times)", err, try)
+		}
+		verbose("cl.Listen: %v; try %d of %d in %v", err, try+1, *listenTries, delay)
+		time.Sleep(delay)
+		delay *= 2
 	}
-	cmd = fmt.Sprintf("%s %q", cmd, a)
-	if err := shell(cl, cmd, env...); err != nil {
-		return err
+	ap := strings.Split(l.Addr().String(), ":")
+	if len(ap) == 0 {
+		l.Close()
+		return nil, "", fmt.Errorf("Can't find a port number in %v", l.Addr().String())
 	}
-	return nil
+	v("listener %T %v addr %v", l, l, l.Addr().String())
+	return l, ap[len(ap)-1], nil
+}
+
+// forward9p arranges port forwarding from the remote ssh to our 9p
+// server, and starts serving e there with the nonce n.
+// It returns the remote port and the channel
+// on which srv reports the result of the nonce handshake.
+func forward9p(cl *ossh.Client, e *export, n nonce, deadline time.Duration) (string, chan error, error) {
+	l, port9p, err := listenRemote(cl, remotePort9p())
+	if err != nil {
+		return "", nil, err
+	}
+	handshake := make(chan error, 1)
+	go func() {
+		if err := e.srv(l, n, deadline, handshake, tearingDown); err == nil && *remount9p {
+			e.supervise(cl, deadline, tearingDown)
+		}
+	}()
+	return port9p, handshake, nil
 }
 
 func env(s *ossh.Session, envs ...string) {
-	for _, v := range append(os.Environ(), envs...) {
+	for _, v := range limitEnv(append(libEnv(os.Environ()), envs...), len(envs)) {
 		env := strings.SplitN(v, "=", 2)
 		if len(env) == 1 {
 			env = append(env, "")
@@ -211,29 +875,85 @@ func env(s *ossh.Session, envs ...string) {
 	}
 }
 
+// isTerminal returns true if r is a terminal, or some other
+// character device.
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ttyRead reads into b from r. If r is a terminal, tty is true, and up
+// to -stdinretries errors in a row that may pass, EINTR and EAGAIN, are
+// waited out rather than ending the input. An EOF is always the end: on
+// a terminal it is a ^D typed, or a hang up, and a ^D must end e.g. cpu
+// host cat at once. Other errors, such as EIO, end the input too.
+func ttyRead(r io.Reader, b []byte, tty bool) (int, error) {
+	for try := 0; ; try++ {
+		n, err := r.Read(b)
+		if n > 0 || err == nil || !tty || try >= *stdinTries {
+			return n, err
+		}
+		if !errors.Is(err, syscall.EINTR) && !errors.Is(err, syscall.EAGAIN) {
+			return n, err
+		}
+		v("stdin: %v from the terminal; try %d of %d", err, try+1, *stdinTries)
+		time.Sleep(time.Duration(try+1) * 10 * time.Millisecond)
+	}
+}
+
+// writeAll writes all of p to w, looping over short writes, which an
+// ssh channel can do when the remote is slow to take input, so that
+// e.g. a large paste is not cut short. A writer that takes nothing,
+// and gives no error, gets io.ErrShortWrite, rather than a loop that
+// never ends.
+func writeAll(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		p = p[n:]
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
 func stdin(s *ossh.Session, w io.WriteCloser, r io.Reader) {
 	var newLine, tilde bool
 	var t = []byte{'~'}
 	var b [1]byte
+	tty := isTerminal(r)
+	send := writeAll
+	if *prioKeys {
+		send = sendKey
+	}
+	defer verbose("stdin: no more input goes to the remote")
 	for {
-		if _, err := r.Read(b[:]); err != nil {
+		if _, err := ttyRead(r, b[:], tty); err != nil {
+			verbose("stdin: %v", err)
 			break
 		}
 		switch b[0] {
 		default:
 			newLine = false
 			if tilde {
-				if _, err := w.Write(t[:]); err != nil {
+				if err := send(w, t[:]); err != nil {
 					return
 				}
 				tilde = false
 			}
-			if _, err := w.Write(b[:]); err != nil {
+			if err := send(w, b[:]); err != nil {
 				return
 			}
 		case '\n', '\r':
 			newLine = true
-			if _, err := w.Write(b[:]); err != nil {
+			if err := send(w, b[:]); err != nil {
 				return
 			}
 		case '~':
@@ -242,7 +962,7 @@ func stdin(s *ossh.Session, w io.WriteCloser, r io.Reader) {
 				tilde = true
 				break
 			}
-			if _, err := w.Write(t[:]); err != nil {
+			if err := send(w, t[:]); err != nil {
 				return
 			}
 		case '.':
@@ -250,45 +970,96 @@ func stdin(s *ossh.Session, w io.WriteCloser, r io.Reader) {
 				s.Close()
 				return
 			}
-			if _, err := w.Write(b[:]); err != nil {
+			if err := send(w, b[:]); err != nil {
+				return
+			}
+		case 0x1a: // ^Z
+			if tilde {
+				tilde = false
+				suspend()
+				break
+			}
+			if err := send(w, b[:]); err != nil {
 				return
 			}
 		}
 	}
 }
 
-func shell(client *ossh.Client, cmd string, envs ...string) error {
-	t, err := termios.New()
+// ptySize returns the height and width of the local terminal, for the
+// remote pty.
+func ptySize(t *termios.TTYIO) (int, int) {
+	return winSize(t.GetWinSize())
+}
+
+// winSize returns the height and width for the remote pty of a local
+// terminal whose size is ws, or, if err is set, not known. Some
+// terminals, e.g. serial consoles, do not know their size and report
+// 0x0; a 0x0 pty breaks curses programs, so then, or if we can not
+// tell, we say 80x24.
+func winSize(ws *termios.Winsize, err error) (int, int) {
 	if err != nil {
-		return err
+		v("can not get window size, using 80x24: %v", err)
+		return 24, 80
 	}
-	r, err := t.Raw()
-	if err != nil {
-		return err
+	if ws.Row == 0 || ws.Col == 0 {
+		v("window size is %dx%d, using 80x24", ws.Col, ws.Row)
+		return 24, 80
+	}
+	return int(ws.Row), int(ws.Col)
+}
+
+func shell(client *ossh.Client, cmd string, envs ...string) error {
+	var (
+		r    *termios.Termios
+		t    *termios.TTYIO
+		h, w int
+		hl   *healthLine
+		rows int
+		err  error
+	)
+	if !*noTerm {
+		if t, err = termios.New(); err != nil {
+			return err
+		}
+		h, w = ptySize(t)
+		// The last row is the -healthline's.
+		if *showHealth && h > 2 {
+			rows, h = h, h-1
+		}
+		if r, err = t.Raw(); err != nil {
+			return err
+		}
+		defer t.Set(r)
+		term, cooked = t, r
 	}
-	defer t.Set(r)
 	if *bin == "" {
 		if *bin, err = exec.LookPath("cpu"); err != nil {
 			return err
 		}
 	}
 
+	sigs, err := parseSignals(*fwdSignals)
+	if err != nil {
+		return err
+	}
 	v("command is %q", cmd)
 	session, err := client.NewSession()
 	if err != nil {
-		return err
+		return &ProtocolError{Err: err}
 	}
 	defer session.Close()
 	env(session, envs...)
-	// Set up terminal modes
-	modes := ossh.TerminalModes{
-		ossh.ECHO:          0,     // disable echoing
-		ossh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ossh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-	}
-	// Request pseudo terminal
-	if err := session.RequestPty("ansi", 40, 80, modes); err != nil {
-		log.Fatal("request for pseudo terminal failed: ", err)
+	// With -noterminal, the terminal, if there is one, is not ours,
+	// so the remote does not get a pty, and we pass bytes through.
+	if !*noTerm {
+		// Set up terminal modes to match the local terminal, as it was
+		// before we put it in raw mode.
+		modes := termModes(r)
+		// Request pseudo terminal
+		if err := session.RequestPty("ansi", h, w, modes); err != nil {
+			return &ProtocolError{Err: fmt.Errorf("request for pseudo terminal failed: %v", err)}
+		}
 	}
 	i, err := session.StdinPipe()
 	if err != nil {
@@ -303,35 +1074,199 @@ func shell(client *ossh.Client, cmd string, envs ...string) error {
 		return err
 	}
 
-	v("Start remote with command %q", cmd)
-	if err := session.Start(cmd); err != nil {
-		return fmt.Errorf("Failed to run %v: %v", cmd, err.Error())
+	if *subsystem != "" {
+		cmd = "subsystem " + *subsystem
+	}
+	if *echoCmd {
+		// In raw mode a newline does not return the carriage.
+		nl := "\r\n"
+		if *noTerm {
+			nl = "\n"
+		}
+		fmt.Printf("+ %s%s", cmd, nl)
+	}
+	if *subsystem != "" {
+		v("Start remote subsystem %q", *subsystem)
+		if err := session.RequestSubsystem(*subsystem); err != nil {
+			return fmt.Errorf("Failed to start subsystem %v: %v", *subsystem, err)
+		}
+	} else {
+		v("Start remote with command %q", cmd)
+		if err := session.Start(cmd); err != nil {
+			return fmt.Errorf("Failed to run %v: %v", cmd, err.Error())
+		}
+	}
+	started()
+	defer phase("command", time.Now())
+	if rows > 0 {
+		hl = startHealth(client, os.Stdout, rows)
+		defer hl.stop()
+	}
+	if t != nil {
+		defer watchSize(session, t, hl)()
 	}
+	defer limitSession(session)()
+	defer forwardSignals(session, sigs)()
 	//env(session, "CPUNONCE="+n.String())
-	go stdin(session, i, os.Stdin)
-	go io.Copy(os.Stdout, o)
-	go io.Copy(os.Stderr, e)
-	return session.Wait()
+	switch {
+	case *noTerm && *thenShell:
+		// What is typed is for the shell that comes next, so
+		// the command gets no stdin, as with ssh -n.
+		i.Close()
+	case *noTerm:
+		go func() {
+			io.Copy(i, os.Stdin)
+			i.Close()
+		}()
+	default:
+		go stdin(session, i, os.Stdin)
+	}
+	var p *pager
+	if *usePager {
+		if p, err = startPager(); err != nil {
+			return err
+		}
+	}
+	if p == nil && benchOut == nil {
+		out := io.Writer(os.Stdout)
+		if hl != nil {
+			out = hl
+		}
+		go io.Copy(out, o)
+	}
+	errOut := os.Stderr
+	if *mergeStderr {
+		errOut = os.Stdout
+	}
+	go io.Copy(errOut, e)
+	// The report needs all of the -bench output.
+	if benchOut != nil {
+		io.Copy(benchOut, o)
+		return session.Wait()
+	}
+	if p == nil {
+		return session.Wait()
+	}
+	// The pager gets all the output, then waits for the user.
+	copied := make(chan struct{})
+	go func() {
+		p.copy(session, o)
+		close(copied)
+	}()
+	err = session.Wait()
+	<-copied
+	p.wait()
+	if p.quit {
+		return nil
+	}
+	return err
+}
+
+// noTerminal returns whether the session does without a remote pty,
+// and leaves the local terminal alone, or an error if the flags can
+// not go together. noTerm is whether something, such as -noterminal
+// or -pager, already does without one; interactive is -i, thenShell
+// -then-interactive, and cmd whether a command was given. ttyErr is
+// nil if stdin is a terminal, or why it is not.
+//
+// Whether there is a command, and whether the session is interactive,
+// are two things: from a terminal, a command gets a pty, as a shell
+// does, so that e.g. cpu host vi works, unless -noterminal says not to;
+// from anything else, neither does, and -i, which insists on one,
+// fails.
+func noTerminal(noTerm, interactive, thenShell, cmd bool, ttyErr error) (bool, error) {
+	// The shell after -then-interactive's command is interactive,
+	// so it needs what -i does; the command itself is not.
+	switch {
+	case thenShell && interactive:
+		return false, fmt.Errorf("-then-interactive runs its command without a pty, and -i with one; use one or the other")
+	case thenShell && noTerm:
+		return false, fmt.Errorf("-then-interactive needs a remote pty for the shell, which -noterminal, -pager, -detach, -subsystem and -bench do without")
+	case thenShell && ttyErr != nil:
+		return false, fmt.Errorf("-then-interactive needs stdin to be a terminal: %v", ttyErr)
+	case thenShell && !cmd:
+		return false, fmt.Errorf("-then-interactive needs a command to run before the shell")
+	}
+	switch {
+	case interactive && noTerm:
+		return false, fmt.Errorf("-i needs a remote pty, which -noterminal, -pager, -detach, -subsystem and -bench do without")
+	case interactive && ttyErr != nil:
+		return false, fmt.Errorf("-i needs stdin to be a terminal: %v", ttyErr)
+	case thenShell, ttyErr != nil:
+		return true, nil
+	}
+	return noTerm, nil
 }
 
 // We do flag parsing in init so we can
 // Unshare if needed while we are still
 // single threaded.
 func init() {
+	flag.Var(keyFiles, "key", "key file; may be given more than once, keys are tried in order (default $HOME/.ssh/cpu_rsa)")
+	flag.Var(sshOpts, "o", "ssh option, as name=value; only StrictHostKeyChecking=yes, no or accept-new for now")
+	flag.BoolVar(interactive, "interactive", false, "the same as -i")
+	flag.Var(exports, "export", "name=path, or name:ro=path for a read-only tree: serve path as well as -root, to remotes that attach with -aname name; may be given more than once")
 	flag.Parse()
+	if err := setupDiag(); err != nil {
+		log.Fatal(err)
+	}
 	if *dump && *debug {
 		log.Fatalf("You can only set either dump OR debug")
 	}
 	if *debug {
 		v = log.Printf
 	}
+	// This must happen before anything else does: cpu starts
+	// again, in the new namespace, from the beginning.
+	if *unshare {
+		if err := unshareMounts(); err != nil {
+			log.Fatalf("unshare: %v", err)
+		}
+	}
+	// A subsystem speaks its own protocol on stdin and stdout,
+	// which a pty, or our raw terminal, would only get in the way of.
+	if *subsystem != "" {
+		*noTerm = true
+	}
+	// A detached command has no terminal to talk to.
+	if *detach {
+		if flag.NArg() < 2 {
+			log.Fatalf("-detach needs a command to run")
+		}
+		*noTerm = true
+	}
+	// The benchmark is its own command, and we read its output.
+	if *bench {
+		if flag.NArg() > 1 {
+			log.Fatalf("-bench runs its own workload, and takes no command")
+		}
+		*noTerm = true
+	}
+	// The pager needs the terminal, and a remote pty would
+	// turn our output into its screen.
+	if *usePager {
+		*noTerm = true
+	}
+	_, ttyErr := termios.GetTermios(0)
+	nt, err := noTerminal(*noTerm, *interactive, *thenShell, flag.NArg() > 1, ttyErr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	*noTerm = nt
+	if *dumpOnError && !*dump {
+		log.Fatalf("-dumponerror only makes sense with -dump")
+	}
 	if *dump {
-		var err error
-		dumpWriter, err = ioutil.TempFile("", "cpu")
-		if err != nil {
-			log.Fatal(err)
+		if *dumpOnError {
+			dumpWriter = newRingBuffer(dumpRingSize)
+		} else {
+			f, err := ioutil.TempFile("", "cpu")
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Logging to %s", f.Name())
+			dumpWriter = f
 		}
-		log.Printf("Logging to %s", dumpWriter.Name())
 		*dbg9p = true
 		ulog.Log = log.New(dumpWriter, "", log.Ltime|log.Lmicroseconds)
 		v = ulog.Log.Printf
@@ -352,33 +1287,62 @@ func usage() {
 	log.Fatalf("Usage: cpu [options] host [shell command]:\n%v", b.String())
 }
 
+// saveTerminal returns stdin's terminal, from get, to put back when we
+// are done, or nil if stdin is not one. It is saved whenever stdin is a
+// terminal, pty or not: -then-interactive starts with none, then puts
+// it in raw mode for the shell. Without -noterminal it must be one.
+func saveTerminal(noTerm bool, get func(uintptr) (*termios.Termios, error)) (*termios.Termios, error) {
+	t, err := get(0)
+	switch {
+	case err == nil:
+		return t, nil
+	case noTerm:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Getting Termios: %v", err)
+}
+
 func main() {
 	args := flag.Args()
 	if len(args) == 0 {
 		usage()
 	}
 	host := args[0]
-	a := strings.Join(args[1:], " ")
+	argv = args[1:]
 	verbose("Running as client")
-	if a == "" {
-		a = os.Getenv("SHELL")
+	if len(argv) == 0 {
+		argv = []string{os.Getenv("SHELL")}
 	}
-	t, err := termios.GetTermios(0)
+	a := strings.Join(argv, " ")
+	if *bench {
+		var err error
+		if a, err = startBench(); err != nil {
+			log.Fatalf("bench: %v", err)
+		}
+		argv = strings.Fields(a)
+	}
+	t, err := saveTerminal(*noTerm, termios.GetTermios)
 	if err != nil {
-		log.Fatal("Getting Termios")
+		log.Fatal(err)
 	}
+	savedTerm = t
+	e := 0
 	if err := runClient(host, a); err != nil {
-		e := 1
+		e = exitCode(err)
 		log.Printf("SSH error %s", err)
-		if x, ok := err.(*ossh.ExitError); ok {
-			e = x.ExitStatus()
-		}
+		flushDump()
 		defer os.Exit(e)
 	}
-	if err := termios.SetTermios(0, t); err != nil {
-		// Never make this a log.Fatal, it might
-		// interfere with the exit handling
-		// for errors from the remote process.
-		log.Print(err)
+	if t != nil {
+		if err := termios.SetTermios(0, t); err != nil {
+			// Never make this a log.Fatal, it might
+			// interfere with the exit handling
+			// for errors from the remote process.
+			log.Print(err)
+		}
 	}
+	printTimings()
+	exportSpans(host, e)
+	printRusage()
+	printBench(host)
 }
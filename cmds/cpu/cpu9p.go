@@ -15,10 +15,11 @@
 package main
 
 import (
-	"io/ioutil"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/hugelgupf/p9/fsimpl/templatefs"
@@ -32,11 +33,17 @@ type cpu9p struct {
 
 	path string
 	file *os.File
+	mode p9.OpenFlags // how file was opened, for -dumpfids
+	text *crlfText    // see -crlf
+	fid  uint64       // for -9pevents
+	// ro is set if the file is in a tree -exportallow gave
+	// read-only, walked to through its name.
+	ro bool
 }
 
 // Attach implements p9.Attacher.Attach.
 func (l *cpu9p) Attach() (p9.File, error) {
-	return &cpu9p{path: *root}, nil
+	return trackFid(fidEvent(&cpu9p{path: *root}, "attach")), nil
 }
 
 var (
@@ -53,10 +60,14 @@ func (l *cpu9p) info() (p9.QID, os.FileInfo, error) {
 	)
 
 	// Stat the file.
-	if l.file != nil {
-		fi, err = l.file.Stat()
-	} else {
-		fi, err = os.Lstat(l.path)
+	switch {
+	case snap != nil:
+		var s *snapFile
+		if s, err = snapInfo(l.path); err == nil {
+			fi = s.fi
+		}
+	default:
+		fi, err = timedStat(localPath(l.path), l.file)
 	}
 	if err != nil {
 		//log.Printf("error stating %#v: %v", l, err)
@@ -68,19 +79,25 @@ func (l *cpu9p) info() (p9.QID, os.FileInfo, error) {
 
 	// Save the path from the Ino.
 	qid.Path = fi.Sys().(*syscall.Stat_t).Ino
+	// With -cache strict, the version changes when the file does,
+	// so the remote kernel knows to drop what it has cached.
+	if *cacheMode == "strict" {
+		qid.Version = uint32(fi.ModTime().UnixNano()) ^ uint32(fi.Size())
+	}
 	return qid, fi, nil
 }
 
 // Walk implements p9.File.Walk.
 func (l *cpu9p) Walk(names []string) ([]p9.QID, p9.File, error) {
+	defer opSlot()()
 	var qids []p9.QID
-	last := &cpu9p{path: l.path}
+	last := &cpu9p{path: l.path, ro: l.ro}
 	// If the names are empty we return info for l
 	// An extra stat is never hurtful; all servers
 	// are a bundle of race conditions and there's no need
 	// to make things worse.
 	if len(names) == 0 {
-		c := &cpu9p{path: last.path}
+		c := &cpu9p{path: last.path, ro: last.ro}
 		qid, fi, err := c.info()
 		v("Walk to %v: %v, %v, %v", *c, qid, fi, err)
 		if err != nil {
@@ -88,12 +105,25 @@ func (l *cpu9p) Walk(names []string) ([]p9.QID, p9.File, error) {
 		}
 		qids = append(qids, qid)
 		v("Walk: return %v, %v, nil", qids, last)
-		return qids, last, nil
+		return qids, trackFid(fidEvent(last, "walk")), nil
 	}
 	v("Walk: %v", names)
 	for _, name := range names {
-		c := &cpu9p{path: filepath.Join(last.path, name)}
+		p, ro := exportWalk(last.path, name)
+		c := &cpu9p{path: p, ro: last.ro || ro}
+		if err := allowPath(c.path); err != nil {
+			return nil, nil, err
+		}
 		qid, fi, err := c.info()
+		if err != nil && *caseFold && os.IsNotExist(err) {
+			if p, ro, ok := foldWalk(last.path, name); ok {
+				c.path, c.ro = p, last.ro || ro
+				if err := allowPath(c.path); err != nil {
+					return nil, nil, err
+				}
+				qid, fi, err = c.info()
+			}
+		}
 		v("Walk to %v: %v, %v, %v", *c, qid, fi, err)
 		if err != nil {
 			return nil, nil, err
@@ -102,17 +132,31 @@ func (l *cpu9p) Walk(names []string) ([]p9.QID, p9.File, error) {
 		last = c
 	}
 	v("Walk: return %v, %v, nil", qids, last)
-	return qids, last, nil
+	return qids, trackFid(fidEvent(last, "walk")), nil
 }
 
 // FSync implements p9.File.FSync.
 func (l *cpu9p) FSync() error {
-	return l.file.Sync()
+	defer opSlot()()
+	if snap != nil {
+		return nil
+	}
+	if err := l.text.flush(localPath(l.path)); err != nil {
+		return err
+	}
+	return spaceErr(l.file.Sync())
 }
 
 // Close implements p9.File.Close.
 func (l *cpu9p) Close() error {
+	untrackFid(l)
+	event(l, "clunk", 0, nil)
 	if l.file != nil {
+		closeQuota()
+		if err := l.text.flush(localPath(l.path)); err != nil {
+			l.file.Close()
+			return err
+		}
 		return l.file.Close()
 	}
 	return nil
@@ -120,47 +164,180 @@ func (l *cpu9p) Close() error {
 
 // Open implements p9.File.Open.
 func (l *cpu9p) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
+	defer opSlot()()
 	qid, fi, err := l.info()
 	verbose("Open %v: (%v, %v, %v", *l, qid, fi, err)
 	if err != nil {
 		return qid, 0, err
 	}
+	if snap != nil {
+		if mode.Mode() != p9.ReadOnly {
+			return qid, 0, errSnapshot
+		}
+		return qid, 4096, nil
+	}
+	path := localPath(l.path)
+	if mode.Mode() != p9.ReadOnly {
+		if err := l.writable(l.path); err != nil {
+			return qid, 0, err
+		}
+		// With -overlay, the remote writes to a copy.
+		if path, err = copyUp(l.path); err != nil {
+			return qid, 0, err
+		}
+	}
 
+	if err := openQuota(); err != nil {
+		return qid, 0, err
+	}
 	flags := osflags(fi, mode)
 	// Do the actual open.
-	f, err := os.OpenFile(l.path, flags, 0)
-	verbose("Open(%v, %v, %v): (%v, %v", l.path, flags, 0, f, err)
+	f, err := os.OpenFile(path, flags, 0)
+	verbose("Open(%v, %v, %v): (%v, %v", path, flags, 0, f, err)
+	event(l, "open", 0, err)
 	if err != nil {
+		closeQuota()
 		return qid, 0, err
 	}
-	l.file = f
+	setOpen(l, f, mode)
+	if !fi.IsDir() {
+		if err := l.openCRLF(); err != nil {
+			l.Close()
+			return qid, 0, err
+		}
+	}
 	verbose("Open returns %v, 4096, nil", qid)
 	return qid, 4096, nil
 }
 
 // Read implements p9.File.ReadAt.
 func (l *cpu9p) ReadAt(p []byte, offset int64) (int, error) {
-	return l.file.ReadAt(p, int64(offset))
+	n, err := l.readAt(p, offset)
+	event(l, "read", n, err)
+	return n, err
+}
+
+func (l *cpu9p) readAt(p []byte, offset int64) (int, error) {
+	defer opSlot()()
+	if err := byteQuota(); err != nil {
+		return 0, err
+	}
+	if snap != nil {
+		s, err := snapInfo(l.path)
+		if err != nil {
+			return 0, err
+		}
+		n := s.readAt(p, offset)
+		countBytes(n)
+		return n, nil
+	}
+	if l.text != nil {
+		n := l.text.readAt(p, offset)
+		countBytes(n)
+		return n, nil
+	}
+	n, err := timedReadAt(l.file, p, offset)
+	countBytes(n)
+	return n, err
+}
+
+// fullOnce makes sure we only complain once about a full disk.
+var fullOnce sync.Once
+
+// spaceErr makes sure that running out of space on our side reaches
+// the remote as ENOSPC or EDQUOT, with nothing in the way, so the
+// program that is writing sees "no space left on device" and
+// not a generic I/O error. We also tell the local user, once, since
+// it is their disk that is full.
+func spaceErr(err error) error {
+	var e syscall.Errno
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		e = syscall.ENOSPC
+	case errors.Is(err, syscall.EDQUOT):
+		e = quotaErrno
+	default:
+		return err
+	}
+	fullOnce.Do(func() {
+		log.Printf("Remote write failed, out of space on this machine: %v", err)
+	})
+	return e
 }
 
 // Write implements p9.File.WriteAt.
 func (l *cpu9p) WriteAt(p []byte, offset int64) (int, error) {
-	return l.file.WriteAt(p, int64(offset))
+	n, err := l.writeAt(p, offset)
+	event(l, "write", n, err)
+	return n, err
+}
+
+func (l *cpu9p) writeAt(p []byte, offset int64) (int, error) {
+	defer opSlot()()
+	if snap != nil {
+		return 0, errSnapshot
+	}
+	if err := byteQuota(); err != nil {
+		return 0, err
+	}
+	if l.text != nil {
+		n := l.text.writeAt(p, offset)
+		countBytes(n)
+		return n, nil
+	}
+	n, err := timedWriteAt(l.file, p, offset)
+	countBytes(n)
+	return writeResult(n, err)
+}
+
+// writeResult is what a write that wrote n bytes, and failed with err,
+// tells the remote. One that gets partway before running out of space
+// reports what it wrote, and the remote gets the error when it writes
+// the rest, as it would from a local disk. Any other error, such as
+// EIO or EROFS, is reported with what was written.
+func writeResult(n int, err error) (int, error) {
+	err = spaceErr(err)
+	if n > 0 && (err == syscall.ENOSPC || err == quotaErrno) {
+		return n, nil
+	}
+	return n, err
 }
 
 // Create implements p9.File.Create.
 func (l *cpu9p) Create(name string, mode p9.OpenFlags, permissions p9.FileMode, _ p9.UID, _ p9.GID) (p9.File, p9.QID, uint32, error) {
-	f, err := os.OpenFile(filepath.Join(l.path, name), os.O_CREATE|mode.OSFlags(), os.FileMode(permissions))
+	defer opSlot()()
+	if snap != nil {
+		return nil, p9.QID{}, 0, errSnapshot
+	}
+	if err := allowPath(filepath.Join(l.path, name)); err != nil {
+		return nil, p9.QID{}, 0, err
+	}
+	if err := l.writable(filepath.Join(l.path, name)); err != nil {
+		return nil, p9.QID{}, 0, err
+	}
+	path, err := newPath(filepath.Join(l.path, name))
 	if err != nil {
 		return nil, p9.QID{}, 0, err
 	}
+	if err := openQuota(); err != nil {
+		return nil, p9.QID{}, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|mode.OSFlags(), os.FileMode(permissions))
+	if err != nil {
+		closeQuota()
+		return nil, p9.QID{}, 0, spaceErr(err)
+	}
 
-	l2 := &cpu9p{path: filepath.Join(l.path, name), file: f}
+	l2 := trackFid(fidEvent(&cpu9p{path: filepath.Join(l.path, name), file: f, mode: mode, ro: l.ro}, "create"))
 	qid, _, err := l2.info()
 	if err != nil {
 		l2.Close()
 		return nil, p9.QID{}, 0, err
 	}
+	if err := l2.openCRLF(); err != nil {
+		l2.Close()
+		return nil, p9.QID{}, 0, err
+	}
 
 	return l2, qid, 4096, nil
 }
@@ -169,9 +346,23 @@ func (l *cpu9p) Create(name string, mode p9.OpenFlags, permissions p9.FileMode,
 //
 // Not properly implemented.
 func (l *cpu9p) Mkdir(name string, permissions p9.FileMode, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	if err := os.Mkdir(filepath.Join(l.path, name), os.FileMode(permissions)); err != nil {
+	defer opSlot()()
+	if snap != nil {
+		return p9.QID{}, errSnapshot
+	}
+	if err := allowPath(filepath.Join(l.path, name)); err != nil {
 		return p9.QID{}, err
 	}
+	if err := l.writable(filepath.Join(l.path, name)); err != nil {
+		return p9.QID{}, err
+	}
+	path, err := newPath(filepath.Join(l.path, name))
+	if err != nil {
+		return p9.QID{}, err
+	}
+	if err := os.Mkdir(path, os.FileMode(permissions)); err != nil {
+		return p9.QID{}, spaceErr(err)
+	}
 
 	// Blank QID.
 	return p9.QID{}, nil
@@ -181,9 +372,23 @@ func (l *cpu9p) Mkdir(name string, permissions p9.FileMode, _ p9.UID, _ p9.GID)
 //
 // Not properly implemented.
 func (l *cpu9p) Symlink(oldname string, newname string, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	if err := os.Symlink(oldname, filepath.Join(l.path, newname)); err != nil {
+	defer opSlot()()
+	if snap != nil {
+		return p9.QID{}, errSnapshot
+	}
+	if err := allowPath(filepath.Join(l.path, newname)); err != nil {
+		return p9.QID{}, err
+	}
+	if err := l.writable(filepath.Join(l.path, newname)); err != nil {
+		return p9.QID{}, err
+	}
+	path, err := newPath(filepath.Join(l.path, newname))
+	if err != nil {
 		return p9.QID{}, err
 	}
+	if err := os.Symlink(oldname, path); err != nil {
+		return p9.QID{}, spaceErr(err)
+	}
 
 	// Blank QID.
 	return p9.QID{}, nil
@@ -193,12 +398,49 @@ func (l *cpu9p) Symlink(oldname string, newname string, _ p9.UID, _ p9.GID) (p9.
 //
 // Not properly implemented.
 func (l *cpu9p) Link(target p9.File, newname string) error {
-	return os.Link(target.(*cpu9p).path, filepath.Join(l.path, newname))
+	defer opSlot()()
+	if snap != nil {
+		return errSnapshot
+	}
+	if err := allowPath(filepath.Join(l.path, newname)); err != nil {
+		return err
+	}
+	if err := l.writable(filepath.Join(l.path, newname)); err != nil {
+		return err
+	}
+	// A new name for a file in a read-only tree would be a way to
+	// write it.
+	t := target.(*cpu9p)
+	if t.ro {
+		return errReadOnly
+	}
+	// With -overlay, the link is to the copy of the target.
+	old, err := copyUp(t.path)
+	if err != nil {
+		return err
+	}
+	path, err := newPath(filepath.Join(l.path, newname))
+	if err != nil {
+		return err
+	}
+	return spaceErr(os.Link(old, path))
 }
 
 // Readdir implements p9.File.Readdir.
 func (l *cpu9p) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
-	fi, err := ioutil.ReadDir(l.path)
+	defer opSlot()()
+	var (
+		fi  []os.FileInfo
+		err error
+	)
+	if snap != nil {
+		var s *snapFile
+		if s, err = snapInfo(l.path); err == nil {
+			fi = s.ents
+		}
+	} else {
+		fi, err = readDir(l.path)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -206,6 +448,14 @@ func (l *cpu9p) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
 	//log.Printf("readdir %q returns %d entries start at offset %d", l.path, len(fi), offset)
 	for i := int(offset); i < len(fi); i++ {
 		entry := cpu9p{path: filepath.Join(l.path, fi[i].Name())}
+		if tooDeep(entry.path) || gitIgnored(entry.path, fi[i].IsDir()) {
+			continue
+		}
+		if *allowPaths != "" {
+			if !allowed[rootRel(entry.path)] {
+				continue
+			}
+		}
 		qid, _, err := entry.info()
 		if err != nil {
 			continue
@@ -217,13 +467,22 @@ func (l *cpu9p) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
 			Offset: uint64(i + 1),
 		})
 	}
+	event(l, "readdir", len(dirents), nil)
 
 	return dirents, nil
 }
 
 // Readlink implements p9.File.Readlink.
 func (l *cpu9p) Readlink() (string, error) {
-	n, err := os.Readlink(l.path)
+	defer opSlot()()
+	if snap != nil {
+		s, err := snapInfo(l.path)
+		if err != nil {
+			return "", err
+		}
+		return s.link, nil
+	}
+	n, err := os.Readlink(localPath(l.path))
 	if false && err != nil {
 		log.Printf("Readlink(%v): %v, %v", *l, n, err)
 	}
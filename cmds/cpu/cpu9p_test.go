@@ -0,0 +1,97 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+func TestSpaceErr(t *testing.T) {
+	for _, tt := range []struct {
+		err, want error
+	}{
+		{err: nil, want: nil},
+		{err: syscall.ENOENT, want: syscall.ENOENT},
+		{err: syscall.ENOSPC, want: syscall.ENOSPC},
+		{err: &os.PathError{Op: "write", Path: "/x", Err: syscall.ENOSPC}, want: syscall.ENOSPC},
+		{err: &os.LinkError{Op: "link", Old: "/x", New: "/y", Err: syscall.EDQUOT}, want: quotaErrno},
+	} {
+		if got := spaceErr(tt.err); got != tt.want {
+			t.Errorf("spaceErr(%v): got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	eio := &os.PathError{Op: "write", Path: "/x", Err: syscall.EIO}
+	for _, tt := range []struct {
+		n    int
+		err  error
+		want error
+	}{
+		{n: 0},
+		{n: 5},
+		{n: 0, err: syscall.ENOSPC, want: syscall.ENOSPC},
+		{n: 5, err: syscall.ENOSPC},
+		{n: 5, err: &os.PathError{Op: "write", Path: "/x", Err: syscall.EDQUOT}},
+		{n: 0, err: syscall.EDQUOT, want: quotaErrno},
+		{n: 5, err: syscall.EIO, want: syscall.EIO},
+		{n: 5, err: eio, want: eio},
+		{n: 5, err: syscall.EROFS, want: syscall.EROFS},
+		{n: 0, err: syscall.EROFS, want: syscall.EROFS},
+	} {
+		if n, err := writeResult(tt.n, tt.err); n != tt.n || err != tt.want {
+			t.Errorf("writeResult(%d, %v): got %d, %v, want %d, %v", tt.n, tt.err, n, err, tt.n, tt.want)
+		}
+	}
+}
+
+// TestDumpFidsOpen dumps the fid table while fids are opened, as
+// SIGUSR1 would; with -race, it checks that the dump does not read a
+// fid's file and mode while Open is setting them.
+func TestDumpFidsOpen(t *testing.T) {
+	r := tempRoot(t, map[string]string{"f": "f"})
+	defer os.RemoveAll(r)
+	defer setFlags(t, map[string]string{"root": r, "dumpfids": "true"})()
+	root, err := (&cpu9p{}).Attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			dumpFids(ioutil.Discard)
+		}
+	}()
+	var open []p9.File
+	for i := 0; i < 100; i++ {
+		_, f, err := root.Walk([]string{"f"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		open = append(open, f)
+		if _, _, err := f.Open(p9.ReadOnly); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	var b bytes.Buffer
+	dumpFids(&b)
+	for _, f := range open {
+		f.Close()
+	}
+	if n := strings.Count(b.String(), "open "); n != len(open) {
+		t.Errorf("dump: %d open fids, want %d:\n%s", n, len(open), b.String())
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"syscall"
 
@@ -18,3 +19,17 @@ func osflags(fi os.FileInfo, mode p9.OpenFlags) int {
 	}
 	return flags
 }
+
+// quotaErrno is what the remote is told when we are over quota.
+// 9p2000.L uses Linux errnos, and EDQUOT on darwin is not the
+// same number, so the remote would only see EIO; ENOSPC is close enough.
+const quotaErrno = syscall.ENOSPC
+
+// sockBufScale is how much more than it was set to a socket buffer
+// reads back: on darwin, it is what was set.
+const sockBufScale = 1
+
+// unshareMounts is for -unshare, which needs Linux mount namespaces.
+func unshareMounts() error {
+	return errors.New("-unshare is only supported on Linux")
+}
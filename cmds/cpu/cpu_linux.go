@@ -5,7 +5,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"syscall"
 
 	"github.com/hugelgupf/p9/p9"
@@ -18,3 +21,43 @@ func osflags(fi os.FileInfo, mode p9.OpenFlags) int {
 	}
 	return flags
 }
+
+// quotaErrno is what the remote is told when we are over quota.
+const quotaErrno = syscall.EDQUOT
+
+// sockBufScale is how much more than it was set to a socket buffer
+// reads back. Linux doubles what it is asked for, to allow for its own
+// overhead, and reports that.
+const sockBufScale = 2
+
+// unshareMounts, for -unshare, puts cpu in a new, private mount namespace.
+// As cpud says, unsharing a running Go program does not work: it
+// only unshares one thread. So we run ourselves again, with the same
+// arguments, in a new mount namespace made by clone, and exit as it
+// does. The second cpu makes / private, so mounts it makes do not
+// propagate back, and carries on.
+// Making a mount namespace needs CAP_SYS_ADMIN, i.e., usually, root.
+func unshareMounts() error {
+	if os.Getenv("CPU_UNSHARED") != "" {
+		os.Unsetenv("CPU_UNSHARED")
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("making / private: %v", err)
+		}
+		return nil
+	}
+	c := exec.Command("/proc/self/exe", os.Args[1:]...)
+	c.Args[0] = os.Args[0]
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	c.Env = append(os.Environ(), "CPU_UNSHARED=1")
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	err := c.Run()
+	var x *exec.ExitError
+	if errors.As(err, &x) {
+		os.Exit(x.ExitCode())
+	}
+	if err != nil {
+		return fmt.Errorf("running cpu in a new mount namespace: %v", err)
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,339 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/cputest"
+	"github.com/u-root/u-root/pkg/termios"
+)
+
+// init parses cpu's flags, and it runs after the package's variables
+// are set, so the test flags have to be there by then.
+var _ = func() bool { testing.Init(); return true }()
+
+// setFlags sets cpu's flags, by name, and returns a func that puts
+// them back as they were.
+func setFlags(t *testing.T, fl map[string]string) func() {
+	t.Helper()
+	old := map[string]string{}
+	for n, val := range fl {
+		f := flag.Lookup(n)
+		if f == nil {
+			t.Fatalf("no flag -%s", n)
+		}
+		old[n] = f.Value.String()
+		if err := flag.Set(n, val); err != nil {
+			t.Fatalf("-%s %q: %v", n, val, err)
+		}
+	}
+	return func() {
+		for n, val := range old {
+			flag.Set(n, val)
+		}
+	}
+}
+
+// writeKey writes a new private key, for cpu -key, in d, and returns
+// its name.
+func writeKey(t *testing.T, d string) string {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf := filepath.Join(d, "key")
+	if err := ioutil.WriteFile(kf, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return kf
+}
+
+// session runs cmd on a cputest server, which calls h in place of
+// cpud, with runClient, as cpu would with the flags in fl, and those
+// every session needs, set. It returns what runClient does.
+func session(t *testing.T, h cputest.Handler, fl map[string]string, cmd string) error {
+	t.Helper()
+	s, err := cputest.NewServer(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	d, err := ioutil.TempDir("", "cputest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	set := map[string]string{
+		"sp":         s.Port(),
+		"hk":         s.HostKeyFile(),
+		"config":     filepath.Join(d, "config"),
+		"noterminal": "true",
+		"timeout9p":  "5s",
+		"yes-i-know": "true",
+	}
+	for n, val := range fl {
+		set[n] = val
+	}
+	defer setFlags(t, set)()
+	old := *keyFiles
+	*keyFiles = stringList{writeKey(t, d)}
+	defer func() { *keyFiles = old }()
+	// runClient closes it when the session is over.
+	tearingDown = make(chan struct{})
+	return runClient("127.0.0.1", cmd)
+}
+
+// readFile reads the file named by the path p, from root.
+func readFile(root p9.File, p string) ([]byte, error) {
+	_, f, err := root.Walk(strings.Split(p, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("walk %q: %v", p, err)
+	}
+	defer f.Close()
+	if _, _, err := f.Open(p9.ReadOnly); err != nil {
+		return nil, fmt.Errorf("open %q: %v", p, err)
+	}
+	var b []byte
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.ReadAt(buf, int64(len(b)))
+		b = append(b, buf[:n]...)
+		if n == 0 || err != nil {
+			return b, nil
+		}
+	}
+}
+
+// tempRoot makes a directory, for -root, holding the files in fs, by
+// name, and returns it.
+func tempRoot(t *testing.T, fs map[string]string) string {
+	t.Helper()
+	d, err := ioutil.TempDir("", "cpuroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, s := range fs {
+		p := filepath.Join(d, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// TestSession runs a command, with each way of giving cpud the nonce,
+// and checks that it gets the command, and our files, over the 9p
+// forward, once the nonce is checked.
+func TestSession(t *testing.T) {
+	r := tempRoot(t, map[string]string{"hello": "hello, world\n"})
+	defer os.RemoveAll(r)
+	for _, mode := range []string{"env", "arg"} {
+		t.Run(mode, func(t *testing.T) {
+			var got, cmd string
+			err := session(t, func(rem *cputest.Remote) error {
+				cmd = rem.Cmd
+				if rem.Root == nil {
+					return fmt.Errorf("no 9p mount")
+				}
+				b, err := readFile(rem.Root, "hello")
+				got = string(b)
+				return err
+			}, map[string]string{"root": r, "noncemode": mode}, "cat /tmp/cpu/hello")
+			if err != nil {
+				t.Fatalf("session: %v", err)
+			}
+			if cmd != "cat /tmp/cpu/hello" {
+				t.Errorf("command: got %q, want %q", cmd, "cat /tmp/cpu/hello")
+			}
+			if got != "hello, world\n" {
+				t.Errorf("hello over 9p: got %q, want %q", got, "hello, world\n")
+			}
+		})
+	}
+}
+
+// TestSessionExit checks that a command that fails fails the session.
+func TestSessionExit(t *testing.T) {
+	r := tempRoot(t, nil)
+	defer os.RemoveAll(r)
+	err := session(t, func(*cputest.Remote) error {
+		return fmt.Errorf("it failed")
+	}, map[string]string{"root": r}, "false")
+	if err == nil {
+		t.Fatal("session: got nil, want an error")
+	}
+	if c := exitCode(err); c != 1 {
+		t.Errorf("exit code: got %d, want 1", c)
+	}
+}
+
+// TestSessionNoNameSpace checks that, with -nonamespace, the remote
+// gets no 9p forward.
+func TestSessionNoNameSpace(t *testing.T) {
+	err := session(t, func(rem *cputest.Remote) error {
+		if rem.FS != nil {
+			return fmt.Errorf("got a 9p mount with -nonamespace")
+		}
+		return nil
+	}, map[string]string{"nonamespace": "true"}, "date")
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+}
+
+// TestCheckBinQuoted checks that -bin reaches the remote's shell, for
+// -binsha256, as one word, with nothing in it expanded.
+func TestCheckBinQuoted(t *testing.T) {
+	const bin = "/x/it's $(id)"
+	var got string
+	err := session(t, func(rem *cputest.Remote) error {
+		// cputest gives the words after the first, as it would
+		// those after cpud's flags; the first call is sha256sum.
+		if got == "" {
+			got = rem.Cmd
+			fmt.Fprintf(rem.Stdout, "%064x  %s\n", 0, bin)
+		}
+		return nil
+	}, map[string]string{"bin": bin, "binsha256": strings.Repeat("ab", 32)}, "date")
+	if err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("session: got %v, want the sha256 refused", err)
+	}
+	if want := shQuote(bin); got != want {
+		t.Errorf("the remote ran sha256sum %s, want sha256sum %s", got, want)
+	}
+}
+
+func TestNoTerminal(t *testing.T) {
+	notty := errors.New("inappropriate ioctl for device")
+	for _, tt := range []struct {
+		name                                string
+		noTerm, interactive, thenShell, cmd bool
+		ttyErr                              error
+		want                                bool
+		err                                 string
+	}{
+		{name: "a shell, on a terminal", want: false},
+		{name: "a shell, from a pipe", ttyErr: notty, want: true},
+		{name: "a command, on a terminal", cmd: true, want: false},
+		{name: "a command, from a pipe", cmd: true, ttyErr: notty, want: true},
+		{name: "-i with a command", interactive: true, cmd: true, want: false},
+		{name: "-i with a shell", interactive: true, want: false},
+		{name: "-i from a pipe", interactive: true, cmd: true, ttyErr: notty, err: "-i needs stdin to be a terminal"},
+		{name: "-i with -noterminal", interactive: true, noTerm: true, err: "-i needs a remote pty"},
+		{name: "-noterminal with a shell", noTerm: true, want: true},
+		{name: "-noterminal with a command", noTerm: true, cmd: true, want: true},
+		{name: "-noterminal from a pipe", noTerm: true, cmd: true, ttyErr: notty, want: true},
+		{name: "-then-interactive", thenShell: true, cmd: true, want: true},
+		{name: "-then-interactive without a command", thenShell: true, err: "needs a command"},
+		{name: "-then-interactive from a pipe", thenShell: true, cmd: true, ttyErr: notty, err: "-then-interactive needs stdin to be a terminal"},
+		{name: "-then-interactive with -i", thenShell: true, interactive: true, cmd: true, err: "use one or the other"},
+		{name: "-then-interactive with -noterminal", thenShell: true, noTerm: true, cmd: true, err: "-then-interactive needs a remote pty"},
+	} {
+		got, err := noTerminal(tt.noTerm, tt.interactive, tt.thenShell, tt.cmd, tt.ttyErr)
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: got %v, want nil", tt.name, err)
+		case tt.err == "" && got != tt.want:
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// errReader gives each of errs, in turn, from Read, and then "x".
+type errReader struct {
+	errs  []error
+	reads int
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	r.reads++
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return 0, err
+	}
+	return copy(b, "x"), nil
+}
+
+// TestSaveTerminal checks that the terminal is saved whenever stdin is
+// one, even with no pty for now, as with -then-interactive.
+func TestSaveTerminal(t *testing.T) {
+	tty := &termios.Termios{}
+	notty := errors.New("inappropriate ioctl for device")
+	for _, tt := range []struct {
+		noTerm bool
+		err    error
+		want   *termios.Termios
+		fail   bool
+	}{
+		{want: tty},
+		{noTerm: true, want: tty},
+		{noTerm: true, err: notty},
+		{err: notty, fail: true},
+	} {
+		got, err := saveTerminal(tt.noTerm, func(uintptr) (*termios.Termios, error) {
+			if tt.err != nil {
+				return nil, tt.err
+			}
+			return tty, nil
+		})
+		if got != tt.want || (err != nil) != tt.fail {
+			t.Errorf("noTerm %v, stdin error %v: got %v, %v, want %v, error %v", tt.noTerm, tt.err, got, err, tt.want, tt.fail)
+		}
+	}
+}
+
+func TestTTYRead(t *testing.T) {
+	defer setFlags(t, map[string]string{"stdinretries": "3"})()
+	eintr, eio := syscall.EINTR, syscall.EIO
+	for _, tt := range []struct {
+		name  string
+		errs  []error
+		tty   bool
+		n     int
+		err   error
+		reads int
+	}{
+		{name: "data", tty: true, n: 1, reads: 1},
+		{name: "a ^D", errs: []error{io.EOF}, tty: true, err: io.EOF, reads: 1},
+		{name: "EINTR, then data", errs: []error{eintr, syscall.EAGAIN}, tty: true, n: 1, reads: 3},
+		{name: "EINTR, then a ^D", errs: []error{eintr, io.EOF}, tty: true, err: io.EOF, reads: 2},
+		{name: "EINTR, more than -stdinretries", errs: []error{eintr, eintr, eintr, eintr}, tty: true, err: eintr, reads: 4},
+		{name: "EIO", errs: []error{eio}, tty: true, err: eio, reads: 1},
+		{name: "EINTR, from a pipe", errs: []error{eintr}, err: eintr, reads: 1},
+	} {
+		r := &errReader{errs: tt.errs}
+		n, err := ttyRead(r, make([]byte, 8), tt.tty)
+		if n != tt.n || err != tt.err || r.reads != tt.reads {
+			t.Errorf("%s: got %d, %v, in %d reads, want %d, %v, in %d", tt.name, n, err, r.reads, tt.n, tt.err, tt.reads)
+		}
+	}
+}
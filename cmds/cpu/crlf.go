@@ -0,0 +1,98 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// crlfText is the LF view of a local CRLF text file, for -crlf.
+// The whole file is read when it is opened, and written back, with
+// CRLF line endings, when it is synced or closed after a write.
+type crlfText struct {
+	b     []byte
+	dirty bool
+}
+
+// crlfMatch reports whether the name matches one of the -crlf patterns.
+// Patterns are as for filepath.Match, against the last element of
+// the name, e.g. *.txt,*.bat.
+func crlfMatch(name string) bool {
+	if *crlf == "" {
+		return false
+	}
+	base := filepath.Base(name)
+	for _, p := range strings.Split(*crlf, ",") {
+		if ok, _ := filepath.Match(p, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isCRLF reports whether b is text with only CRLF line endings:
+// no NUL in the first 8000 bytes, as git decides it, and no LF
+// without a CR before it. Anything else is left alone, since
+// translating it could not be undone.
+func isCRLF(b []byte) bool {
+	h := b
+	if len(h) > 8000 {
+		h = h[:8000]
+	}
+	if bytes.IndexByte(h, 0) >= 0 {
+		return false
+	}
+	return bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n"))
+}
+
+// openCRLF sets up the LF view of l, if it matches -crlf and is a
+// CRLF text file. An empty file, e.g. a new one, always qualifies.
+func (l *cpu9p) openCRLF() error {
+	if !crlfMatch(l.path) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(localPath(l.path))
+	if err != nil {
+		return err
+	}
+	if !isCRLF(b) {
+		v("crlf: %q is not CRLF text, not translating", l.path)
+		return nil
+	}
+	l.text = &crlfText{b: bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))}
+	return nil
+}
+
+// readAt reads the LF view.
+func (t *crlfText) readAt(p []byte, off int64) int {
+	if off >= int64(len(t.b)) {
+		return 0
+	}
+	return copy(p, t.b[off:])
+}
+
+// writeAt writes the LF view.
+func (t *crlfText) writeAt(p []byte, off int64) int {
+	if end := off + int64(len(p)); end > int64(len(t.b)) {
+		t.b = append(t.b, make([]byte, end-int64(len(t.b)))...)
+	}
+	t.dirty = true
+	return copy(t.b[off:], p)
+}
+
+// flush writes the LF view back to path with CRLF line endings.
+func (t *crlfText) flush(path string) error {
+	if t == nil || !t.dirty {
+		return nil
+	}
+	if err := ioutil.WriteFile(path, bytes.ReplaceAll(t.b, []byte("\n"), []byte("\r\n")), 0); err != nil {
+		return spaceErr(err)
+	}
+	t.dirty = false
+	return nil
+}
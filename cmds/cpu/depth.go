@@ -0,0 +1,87 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	depthOnce sync.Once
+	// depthTops maps the trees the remote can walk, -root and the
+	// -export trees, with their symlinks resolved, to how deep their
+	// tops are: -root is at 0, and an export, found by name in -root,
+	// at 1. exportMu guards it once the session is going.
+	depthTops map[string]int
+)
+
+// findDepthTops fills in depthTops.
+func findDepthTops() {
+	depthTops = map[string]int{}
+	add := func(p string, d int) {
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			p = r
+		}
+		depthTops[p] = d
+	}
+	add(*root, 0)
+	for _, p := range exportPaths {
+		add(p, 1)
+	}
+}
+
+// elems returns how many names there are in the relative path r.
+func elems(r string) int {
+	if r == "." {
+		return 0
+	}
+	return strings.Count(r, string(filepath.Separator)) + 1
+}
+
+// depth returns how many levels below the root the local path n is.
+// Symlinks in n are resolved first, so that a link to somewhere deep,
+// e.g. a -> a/b/c/d, can not be used to get past -maxdepth; n is then
+// as deep as the shallowest way the remote could walk to where it
+// leads, from -root or an export. A path that leads out of them all
+// counts from /. A path that can not be resolved, e.g. one that is not
+// there, or one in a -snapshot, goes by its name.
+func depth(n string) int {
+	depthOnce.Do(findDepthTops)
+	if snap == nil {
+		if r, err := filepath.EvalSymlinks(n); err == nil {
+			n = r
+		}
+	}
+	d := -1
+	exportMu.RLock()
+	defer exportMu.RUnlock()
+	for t, td := range depthTops {
+		r, err := filepath.Rel(t, n)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if k := td + elems(r); d < 0 || k < d {
+			d = k
+		}
+	}
+	if d < 0 {
+		d = elems(strings.TrimPrefix(n, string(filepath.Separator)))
+	}
+	return d
+}
+
+// tooDeep reports whether the local path n is deeper than -maxdepth.
+func tooDeep(n string) bool {
+	if *maxDepth <= 0 {
+		return false
+	}
+	if d := depth(n); d > *maxDepth {
+		v("maxdepth: %q is %d deep", n, d)
+		return true
+	}
+	return false
+}
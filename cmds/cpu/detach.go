@@ -0,0 +1,42 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// detachScript is run by sh on the remote for -detach. It starts the
+// command, $1, under nohup, with no stdin and its output in a new
+// file, and prints its pid and the name of that file; then it exits,
+// leaving the command running.
+const detachScript = `l=$(mktemp /tmp/cpu-detach.XXXXXX) || exit 1; nohup sh -c "$1" </dev/null >"$l" 2>&1 & echo "$! $l"`
+
+// runDetached starts a on the remote, with -detach, and returns
+// without waiting for it. It runs in the remote's own namespace,
+// not ours: cpud is not involved, so there is no 9p mount, and
+// there could not be one anyway, since we are about to hang up.
+func runDetached(cl *ossh.Client, host, user, a string) error {
+	c := fmt.Sprintf("sh -c %s cpu-detach %s", shQuote(detachScript), shQuote(a))
+	auditRecord(host, user, c)
+	b, err := cmd(cl, c)
+	if err != nil {
+		return err
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 {
+		return fmt.Errorf("detach: want a pid and a file name from the remote, got %q", b)
+	}
+	fmt.Printf("%s: pid %s, output in %s\n", host, f[0], f[1])
+	return nil
+}
+
+// shQuote quotes s for a POSIX shell.
+func shQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
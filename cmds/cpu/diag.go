@@ -0,0 +1,66 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// diagOut is where cpu's own messages go, as distinct from the remote
+// command's stderr: stderr, or -diagfd, with -diagprefix at the start
+// of each line.
+var diagOut io.Writer = os.Stderr
+
+// prefixWriter writes to w with a prefix at the start of each line.
+// Lines may end in \r\n, in raw mode, or \n.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	mid    bool // in the middle of a line
+}
+
+// Write implements io.Writer.Write.
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []byte
+	for _, c := range b {
+		if !p.mid && c != '\r' && c != '\n' {
+			out = append(out, p.prefix...)
+			p.mid = true
+		}
+		out = append(out, c)
+		if c == '\n' {
+			p.mid = false
+		}
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// setupDiag sends cpu's messages, the log's and the reports written
+// at the end of the session alike, to -diagfd and puts -diagprefix in
+// front of them, so that they can be told from the remote's stderr.
+func setupDiag() error {
+	if *diagFD >= 0 {
+		f := os.NewFile(uintptr(*diagFD), "diagfd")
+		if _, err := f.Stat(); err != nil {
+			return fmt.Errorf("diagfd %d: %v", *diagFD, err)
+		}
+		diagOut = f
+	}
+	if *diagPrefix != "" {
+		diagOut = &prefixWriter{w: diagOut, prefix: []byte(*diagPrefix)}
+	}
+	log.SetOutput(diagOut)
+	return nil
+}
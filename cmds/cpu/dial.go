@@ -0,0 +1,140 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// familyAddrs applies -4 or -6 to the network n and address a.
+// It returns the network to use, e.g. tcp4, and the addresses of
+// the host in that family, in the order the resolver gave them.
+func familyAddrs(n, a string) (string, []string, error) {
+	if *ipv4 && *ipv6 {
+		return "", nil, fmt.Errorf("-4 and -6 can not both be set")
+	}
+	fam, suffix := "IPv4", "4"
+	if *ipv6 {
+		fam, suffix = "IPv6", "6"
+	}
+	if !strings.HasPrefix(n, "tcp") {
+		return "", nil, fmt.Errorf("-%s needs a tcp network, not %q", suffix, n)
+	}
+	n = strings.TrimRight(n, "46") + suffix
+	host, port, err := net.SplitHostPort(a)
+	if err != nil {
+		return "", nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		if (ip.To4() != nil) == *ipv4 {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return "", nil, fmt.Errorf("%s has no %s address", host, fam)
+	}
+	return n, addrs, nil
+}
+
+// dialNet makes the connection the ssh session will run over,
+// through a SOCKS5 or HTTP proxy if one was asked for.
+func dialNet(n, a string) (net.Conn, error) {
+	var d proxy.Dialer = proxy.Direct
+	switch hd, err := httpProxyDialer(); {
+	case err != nil:
+		return nil, err
+	case *socks != "" && *httpProxy != "" && *httpProxy != "none":
+		return nil, fmt.Errorf("-socks and -httpproxy can not both be set")
+	case *socks != "":
+		if d, err = socksDialer(*socks); err != nil {
+			return nil, err
+		}
+		v("dial %v via socks proxy %v", a, *socks)
+	case hd != nil:
+		d = hd
+	}
+	addrs := []string{a}
+	t := time.Now()
+	if *ipv4 || *ipv6 {
+		var err error
+		if n, addrs, err = familyAddrs(n, a); err != nil {
+			return nil, err
+		}
+		phase("dns", t)
+	} else if traced() && d == proxy.Direct {
+		// Resolve the name ourselves, so that it can be timed
+		// apart from the connect.
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return nil, err
+		}
+		hosts, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = nil
+		for _, h := range hosts {
+			addrs = append(addrs, net.JoinHostPort(h, port))
+		}
+		phase("dns", t)
+	}
+	var err error
+	t = time.Now()
+	for _, a := range addrs {
+		var c net.Conn
+		if c, err = d.Dial(n, a); err == nil {
+			phase("connect", t)
+			return c, nil
+		}
+		v("dial %v %v: %v", n, a, err)
+	}
+	return nil, err
+}
+
+func dial(n, a string, config *ossh.ClientConfig) (*ossh.Client, error) {
+	conn, err := dialNet(n, a)
+	if err != nil {
+		return nil, dialErr(err, config.User, false)
+	}
+	return sshClient(conn, a, config)
+}
+
+// sshClient runs the ssh protocol on conn, which goes to a.
+// The host key is checked at the end of the key exchange, so for
+// -timing that is where the handshake ends and auth starts, and for
+// errors it tells us whether the other end is an ssh server.
+func sshClient(conn net.Conn, a string, config *ossh.ClientConfig) (*ossh.Client, error) {
+	setSockBufs(conn)
+	setTCPOpts(conn)
+	t := time.Now()
+	var kex bool
+	hc, cb := *config, config.HostKeyCallback
+	hc.HostKeyCallback = func(h string, r net.Addr, k ossh.PublicKey) error {
+		kex = true
+		phase("ssh handshake", t)
+		v("host key of %v: %s %s", h, k.Type(), ossh.FingerprintSHA256(k))
+		t = time.Now()
+		return cb(h, r, k)
+	}
+	c, chans, reqs, err := ossh.NewClientConn(conn, a, &hc)
+	if err != nil {
+		conn.Close()
+		return nil, dialErr(err, config.User, kex)
+	}
+	phase("auth", t)
+	return ossh.NewClient(c, chans, reqs), nil
+}
@@ -62,39 +62,861 @@
 //     it mounts in a private /tmp; there is little to see when
 //     it is running from outside the ssh session
 //
+// Exit status:
+//     cpu exits with the remote command's exit status. If the session
+//     fails before, or without, the command giving one, cpu exits with:
+//         251  the host could not be reached: no such name, the connection
+//              refused, or a proxy or jump host failing
+//         252  the login failed: the host key is wrong or unknown, or the
+//              server took none of our keys or passwords
+//         253  the remote could not mount our files: the 9p forward could
+//              not be set up, cpud never presented the nonce on it, or the
+//              -mountcheck failed
+//         254  the ssh session went wrong: no cipher in common, no session
+//              or pty, or the command ended without an exit status
+//         124  -maxduration ended the session
+//         1    anything else, e.g. a bad flag
+//     so that a program running cpu can tell, say, a failed login from a
+//     failed mount without looking at the message.
+//
 // Options:
+//     -4
+//           only use IPv4 addresses to reach the host
+//     -6
+//           only use IPv6 addresses to reach the host
+//     -9pcompress
+//           compress the 9p channel with deflate. This is worth it on slow
+//           links: source trees shrink to about a fifth, binaries to under
+//           half. On a fast link the compressor is the bottleneck and it
+//           will be slower than not compressing.
+//     -9pcompresslevel int
+//           compression level for -9pcompress, from 1 (fastest) to 9 (smallest)
+//           (default 5). Measured on one core, with a flush per 64 KiB write,
+//           by go test -bench . -cpu 1 in flateconn:
+//           level  source tree       Go binary
+//             1    23.4% 126 MB/s    49.7%  95 MB/s
+//             3    21.8% 115 MB/s    47.6%  81 MB/s
+//             5    20.1% 105 MB/s    46.0%  68 MB/s
+//             7    17.9%  56 MB/s    44.4%  47 MB/s
+//             9    17.0%   7 MB/s    43.9%   7 MB/s
+//           Levels above 7 cost a lot of time for very little.
+//     -9pevents string
+//           if set, the path of a Unix socket cpu listens on, and streams the
+//           remote's 9p operations on our files to, e.g. for a dashboard of
+//           file system activity. Each operation is a JSON object on a line:
+//               {"time":"...","type":"read","fid":7,"path":"/etc/hosts","size":120}
+//           type is attach, walk, open, create, read, write, readdir or
+//           clunk. fid is a number cpu gives each file, the same from its
+//           walk, attach or create to its clunk; it is not the remote's 9p fid
+//           number. size is the bytes read or written, or the entries a
+//           readdir returned, and err is there if the operation failed. Each
+//           consumer gets the operations from when it connects; one that
+//           falls more than a second behind is dropped. With no consumer
+//           connected, nothing is built or sent. Unlike -dbg9p, which traces
+//           the 9p messages themselves, as text, to stderr or -dump, this
+//           says what was done to which file.
+//     -9pkeepalive string
+//           if set, e.g. to 1m, the remote stats the 9p mount whenever the
+//           9p channel has been idle for that long. This keeps ssh servers
+//           which reap idle forwarded channels from breaking the mount.
+//     -9pmsgtimeout string
+//           if set, e.g. to 30s, the longest cpu waits for a stat, a read, a
+//           write or a directory read on its own files, for a 9p request from
+//           the remote, before it gives up and the remote gets EIO. Reads and
+//           writes get 1s more per MiB, so a large read from a slow but
+//           working disk is not cut off. Without it, a request to a hung file
+//           system here, e.g. a stale NFS mount, blocks the remote program
+//           for good. The operation itself can not be stopped, and goes on in
+//           the background.
+//     -9preadbuf int
+//           if set, the kernel receive buffer, in bytes, of the TCP connection
+//           to the host, which 9p, like everything else, runs over. On a link
+//           with a large bandwidth-delay product, e.g. a WAN build, the default
+//           can be what limits 9p reads. cpu warns if the system gives it less;
+//           on Linux, see net.core.rmem_max. There is nothing to set when the
+//           connection goes through -J.
+//     -9premount
+//           if the 9p channel breaks while the session goes on, set up a new
+//           one and have the remote move /tmp/cpu, and its binds, to it.
+//           This is best effort: it can not help if the ssh connection
+//           itself is lost, and cpu tries 3 times in a row before it gives
+//           up. With the kernel's 9p, whatever the remote had in flight or
+//           open on the old mount gets errors; only what it opens from then
+//           on sees the new mount. Over FUSE, -mountmode fuse, the mount
+//           goes on over the new channel instead: open files are opened
+//           again, and reads, writes, lookups, stats, directory reads and
+//           the like that were in flight, or are made while the channel is
+//           down, are done again on it, for up to a minute, so a big copy
+//           goes on from where it was. A mkdir, create, remove, rename or
+//           link that was in flight may or may not have been done, and still
+//           fails, with EIO; a file removed or renamed here while the channel
+//           was down gets ESTALE.
+//     -9pwritebuf int
+//           if set, the kernel send buffer, in bytes, of the TCP connection to
+//           the host, as -9preadbuf is for receiving; this is what limits the
+//           files we serve the remote. On Linux, see net.core.wmem_max.
+//     -J string
+//           reach the host through these ssh jump hosts, in order, as with
+//           ssh -J. The list is [user@]host[:port][,[user@]host[:port]...];
+//           the port defaults to 22, and a hop without a user uses the same
+//           user as the cpu host. The keys are the same for every hop.
+//           For example, -J alice@bastion.example.com,ops@gw.lab:2222
+//     -aname string
+//           the 9p attach name the remote mounts with; by default it attaches
+//           to -root. Valid anames are the name of an -export, e.g. src; a
+//           path in an export, e.g. src/cmds; or, with no export of that
+//           name, a path relative to -root, e.g. home/me.
+//     -allowpaths string
+//           only serve the paths listed in this file, one per line and
+//           relative to -root; anything else is not there (ENOENT) as far
+//           as the remote can tell. Directories above a listed path can be
+//           walked through, but only list what is allowed. The list is
+//           usually one written by -auditpaths, perhaps trimmed by hand.
+//     -audit string
+//           append a line recording the time, host, user and exact remote
+//           command of every session to this file. The record is written
+//           before the session starts, so failed commands are recorded too.
+//     -auditpaths string
+//           append to this file every path, relative to -root, that the remote
+//           walks to or creates, once each. Run a command once this way to
+//           find out what it needs, then give the list to -allowpaths from
+//           then on, so that nothing else is exported to it.
+//     -authmethods string
+//           the ssh auth methods to try, in order, as a comma-separated list
+//           of publickey, password and keyboard-interactive (default
+//           "publickey"). Nothing else is tried, so a server that counts
+//           failed attempts against an account only sees the ones you list.
+//           Certificates are part of publickey: a key's certificate, then
+//           the key, are offered in its place. The keys are only read if
+//           publickey is listed. cpu does not use an ssh agent. Passwords
+//           and answers are asked for on the terminal. For a server that
+//           wants a one time password after the key, as with many two factor
+//           setups, use -authmethods publickey,keyboard-interactive; the
+//           server's questions are asked one by one, without echo unless the
+//           server says they may be echoed.
+//     -bench
+//           instead of running a command, benchmark our files over 9p on the
+//           remote. cpu writes -benchfiles files of -benchsize bytes, of
+//           random data, to a new directory in $TMPDIR, which must be in
+//           -root, and has the remote, through the mount, stat one of them
+//           100 times, write as many new files of the same size, and read
+//           the files cpu wrote. It prints, on stdout, a report of how long
+//           each took, by the remote's clock, in MB/s and per operation,
+//           with -msize, -cache and -9pcompress, to compare runs with
+//           other settings on the same link. The directory is removed
+//           at the end. The remote needs sh, head and a date that can tell
+//           nanoseconds, as GNU and busybox have.
+//     -benchfiles int
+//           how many files -bench writes and reads (default 4)
+//     -benchsize int
+//           how big, in bytes, each file -bench writes and reads is
+//           (default 16777216)
 //     -bin string
 //           path of cpu binary
+//     -binsha256 string
+//           if set, cpu runs sha256sum on -bin on the remote first, and
+//           refuses to go on if the hash is not this one. This catches a
+//           wrong version of cpud, or one changed behind your back; a
+//           remote that is out to fool you can of course lie about it.
+//     -cache string
+//           how the remote kernel caches the namespace (default "none"):
+//           none   nothing is cached; every read and stat comes to us, so
+//                  local changes are seen at once, but it is the slowest.
+//           loose  data, attributes and names are cached and never checked,
+//                  which is fast but the remote will not see local changes to
+//                  files it has already looked at. Use it for trees that do
+//                  not change during the session, e.g. a toolchain.
+//           strict only pages that are mapped, e.g. of programs and
+//                  libraries, are cached (9p cache=mmap), and cpu changes a
+//                  file's version whenever it changes here, so the remote
+//                  drops what it has cached when it next looks the file up.
+//                  9p has no way for us to tell the remote a file changed,
+//                  so a file the remote has open and mapped can still be
+//                  stale until it is looked up again.
+//     -caseinsensitive
+//           when the remote looks up a name that is not here, use one that
+//           differs only in case, as a case-insensitive file system, e.g. on a
+//           macOS remote, would. If several do, e.g. Makefile and makefile,
+//           the first in byte order, upper case before lower, is used, every
+//           time; the others can only be reached by their exact names. An
+//           exact match always wins. Names the remote creates keep their case,
+//           so it can still create makefile next to Makefile.
+//     -config string
+//           config file giving per-host defaults for flags
+//           (default "$HOME/.cpu/config"). For example, to export /data
+//           to build machines and / to everything else:
+//               host build*
+//                   root /data
+//               host *
+//                   root /
+//           Host patterns are as for filepath.Match; the first value found
+//           for a flag wins, so put specific hosts first. Flags given on
+//           the command line always win. See also -profile, and
+//           -showconfig, which shows where each setting came from.
+//           Flags cpu acts on as it starts, before it knows the host, e.g.
+//           -d, -dump, -i, -noterminal, -then-interactive, -unshare,
+//           -subsystem, -detach, -bench, -pager, -diagfd, -config and
+//           -profile, can not be set there; the file is rejected if it does.
+//     -connfd int
+//           if set, a file descriptor cpu was started with that is already
+//           connected to the host's ssh server, e.g. a socket or pipe given
+//           by a program that reaches the host, or a VM, over a transport
+//           cpu can not dial itself. cpu runs ssh on it instead of dialing;
+//           the host argument is still used to check the host key and to
+//           pick -config settings. A socket is used as one; anything else
+//           is read and written as a file. cpu owns the descriptor from
+//           then on, and closes it when the session ends or the handshake
+//           fails. It can not be used with -J, -socks, -4 or -6.
+//           (default -1)
+//     -controlpath string
+//           if set, the control socket of an OpenSSH ControlMaster to the
+//           host, e.g. from ssh -M -S path host, or ControlPath in
+//           ssh_config. cpu does not dial or log in: it speaks OpenSSH's
+//           mux protocol (PROTOCOL.mux in the OpenSSH source), as ssh -S
+//           does, and asks the master for a forward of a port on the remote
+//           to a Unix socket of ours, for 9p, and for a session, with our
+//           stdin, stdout and stderr, that runs cpud. So the master's key,
+//           agent, -J and other ssh_config settings are what count, and
+//           -key, -hk, -o and the like are not used. The master needs to be
+//           OpenSSH 6.7 or later, for forwards to Unix sockets; it has been
+//           tried with 9.2. The master passes on only the variables its
+//           SendEnv allows, so the nonce goes on cpud's command line, as
+//           with -noncemode arg, unless -noncemode env is given, and the
+//           master has SendEnv CPUNONCE. Since the master does the
+//           session's I/O, and cpu has no ssh connection of its own, it
+//           can not be used with -9premount, -J, -bench, -binsha256,
+//           -connfd, -detach, -forwardsignals, -healthline, -httpproxy,
+//           -maxduration, -mountcheck, -noncemode file, -pager, -pidfile,
+//           -pushbin, -requirearch, -requireos, -rusage, -setupkey,
+//           -socks, -subsystem, -sudo, -then-interactive or -verify9p.
+//     -crlf string
+//           comma-separated patterns, as for filepath.Match, e.g. *.txt,*.bat.
+//           Local files whose names match, and which contain only CRLF line
+//           endings, are seen by the remote with LF line endings; what the
+//           remote writes to them gets CRLF line endings. Files that look
+//           binary (a NUL in the first 8000 bytes), or have any bare LF, are
+//           never translated. New files that match are created with CRLF.
+//           Use with care: a translated file is held in memory while open and
+//           written back whole when it is closed, so concurrent writers from
+//           the remote and the local side will lose data; and stat shows the
+//           on-disk size, which is larger than what the remote reads.
 //     -d
 //           enable debug prints
 //     -dbg9p
 //           show 9p io
+//     -detach
+//           start the command on the remote with nohup, so that it outlives
+//           the session, print its pid and the remote file its output goes
+//           to, e.g. "host: pid 1234, output in /tmp/cpu-detach.Ab12Cd", and
+//           exit without waiting for it. This is for fire-and-forget jobs.
+//           The command runs in the remote's own namespace, from its own
+//           shell, not cpud: there is no 9p mount, since cpu hangs up, so
+//           the command can not see your files, and must exist on the remote.
+//           Its stdin is /dev/null. The remote needs sh, nohup and mktemp.
+//     -diagfd int
+//           write cpu's own messages, its log, warnings and errors, and the
+//           -timing and -rusage reports, to this file descriptor,
+//           e.g. -diagfd 3 3>cpu.log, rather than to stderr, which then has
+//           only the remote command's. It must be open when cpu starts.
+//     -diagprefix string
+//           put this, e.g. "cpu: ", at the start of each line of cpu's own
+//           messages, wherever they go, so that they can be told from the
+//           remote command's stderr, which they are otherwise mixed with.
 //     -dump
 //           Dump all debug output and 9p packets to a file in /tmp
+//     -dumpfids
+//           keep a table of the 9p fids the remote holds on us, and write it
+//           out each time cpu gets SIGUSR1, e.g. kill -USR1 $(pgrep cpu), to
+//           the -dump file if there is one, or else stderr. Each line says
+//           whether the fid is open, and for reading or writing, how long the
+//           remote has held it, and its path. This is for finding fid leaks
+//           and stuck opens, e.g. when the remote hits "too many open files".
+//           USR1 can then not be in -forwardsignals.
+//     -dumponerror
+//           with -dump, keep the dump in memory and only write it to a file
+//           in /tmp if the session fails. Only the last 32 MiB are kept.
+//     -echocmd
+//           print the command cpu runs on the remote, as "+ command", on
+//           stdout before the command's own output, so a saved log shows
+//           what was run. Unlike -d, this goes to stdout, not stderr.
+//     -exactargs
+//           give the remote the command's arguments word for word. Without
+//           it, cpu joins them into one string, which cpud splits on white
+//           space, so an argument with a space in it, e.g. a file name, is
+//           split in two, and quotes do not help. With -exactargs, cpu also
+//           passes cpud the arguments, joined with NULs, in base64, with
+//           -argv64, and cpud runs exactly those, with no shell in between:
+//               cpu -exactargs host grep 'two words' "my file"
+//           runs grep with two arguments. It needs a cpud that knows
+//           -argv64; an older one stops, saying the flag is not defined.
+//     -export string
+//           name=path: serve path as well as -root, to a remote that attaches
+//           with -aname name. May be given more than once, e.g.
+//           -export src=$HOME/src -export data=/data -aname data.
+//           Names can not contain a / or a :. An export is found by name at
+//           the top of -root, so it hides anything there with the same name.
+//           name:ro=path makes the tree read-only, and name:rw=path, the
+//           same as name=path, read-write; e.g. for a build, with the source
+//           read-only and the output not,
+//           -export src:ro=$HOME/src -export out:rw=$HOME/out.
+//           The remote gets EROFS when it tries to change a read-only tree,
+//           however it got there, even by walking from -root.
+//     -exportallow string
+//           comma-separated directories the remote may ask for, while the
+//           session goes on, as more exports. A command on the remote runs
+//               cpud -requestexport /home/me/src
+//           which prints where it is, e.g. /tmp/cpu/src. cpud passes the
+//           request on over the status channel; cpu gives only a directory
+//           that, with its symlinks resolved, is one of these, or is in one,
+//           and read-only, unless the innermost of them it is in is given
+//           as rw=path, e.g. -exportallow $HOME/src,rw=$HOME/src/out. A
+//           read-only one is read-only only through its name, e.g. at
+//           /tmp/cpu/src: what it holds is as writable as it was to the
+//           remote through -root, or an -export. The remote does not
+//           choose the name: it is the directory's own, made unique, and
+//           never one in -root. -allowpaths, -maxdepth and -gitignore still
+//           apply. At most 64 trees, each logged. Not with -snapshot or
+//           -controlpath.
+//     -forwardsignals string
+//           comma-separated list of signals, from INT, QUIT, TERM, USR1 and
+//           USR2, that cpu passes on to the remote command when it gets them,
+//           e.g. -forwardsignals TERM,USR1. With a terminal in raw mode, ^C
+//           is just a byte sent to the remote and needs none of this; this
+//           is for signals sent to cpu itself, e.g. by kill or a job system.
+//           cpud delivers them to the command; other ssh servers may not.
+//     -gitignore
+//           do not serve what the .gitignore files in our trees ignore, as
+//           git status would, e.g. to build from a working tree without
+//           sending the remote its old build output: the remote gets ENOENT
+//           for it, and it is not listed. The .gitignore in each directory
+//           from the top of -root, or of an -export, down applies below it,
+//           with nested ones winning, and !patterns let back in what was
+//           ignored, but not below an ignored directory. A directory with a
+//           .git starts afresh, with .git/info/exclude as well; .git itself
+//           is always served. A .gitignore is read again when it changes.
+//     -hangtimeout string
+//           if set, e.g. to 30s, and by then the remote command has not
+//           started, or the remote has not mounted us, cpu writes the stacks
+//           of all its goroutines to stderr, or the -dump file, and exits.
+//           If cpu hangs on you, run it with this and send us the stacks.
+//     -healthline
+//           in an interactive session, keep the bottom line of the terminal
+//           for cpu, and show on it how the connection is: every 5s, cpu
+//           sends the host an ssh keepalive, and shows how long the answer
+//           took, or, if there is none, for how long there has not been one.
+//           The remote gets a pty one row shorter than the terminal, and
+//           the rows above the line scroll on their own. cpu only draws
+//           when the remote's output has been quiet for a moment, saving
+//           and restoring the cursor around it, so it does not land in the
+//           middle of what the remote draws. A program that resets the
+//           scroll region, though, may write over the line until it is
+//           next drawn. A terminal resized to two rows or fewer can not
+//           spare one, so the line goes until it grows again. It needs a
+//           terminal that knows the VT100 scroll region and cursor save and
+//           restore, as xterm and its kin do.
 //     -hk string
 //           host key file
+//     -hostkeyalgs string
+//           if set, e.g. to ssh-ed25519, the host key algorithms to accept,
+//           comma-separated, in order of preference, as for ssh's
+//           HostKeyAlgorithms. A server with more than one host key may
+//           otherwise show a different one from one connection to the
+//           next, e.g. after an upgrade of either side, and so seem not to
+//           match known_hosts or -hk. With a leading ^, as in ^ssh-ed25519,
+//           the algorithms named go first, and the others after them, in
+//           case the server has none of them. An algorithm cpu can not
+//           check, such as rsa-sha2-256, is an error. With -v, cpu says
+//           which kind of host key the server showed.
+//     -httpproxy string
+//           connect through an HTTP proxy, with CONNECT, as many company
+//           networks want for outgoing connections. It is a URL,
+//           http://[user[:password]@]host[:port], or https:// to talk to
+//           the proxy over TLS; http:// may be left out, and the port is
+//           80, or 443, by default. A user and password are sent with basic
+//           auth; if there is a user but no password, the password is taken
+//           from $CPU_HTTPPROXY_PASSWORD. If -httpproxy is not set, cpu uses
+//           $HTTPS_PROXY, or else $ALL_PROXY, if it is an http or https URL,
+//           for hosts that $NO_PROXY does not list; -httpproxy none turns
+//           that off. The 9p forward rides the ssh connection, so it needs
+//           nothing extra. It can not be used with -socks.
+//     -i
+//           require an interactive session: put the local terminal in raw
+//           mode, ask the remote for a pty, and look for ~. escapes, and fail
+//           if stdin is not a terminal, rather than do without. Which
+//           sessions are interactive:
+//               cpu host [cmd]      interactive, if stdin is a terminal, so
+//                                   that e.g. vi or top works; otherwise not,
+//                                   and $SHELL, or cmd, reads stdin as it is
+//               cpu -i host [cmd]   interactive; stdin must be a terminal
+//               cpu -noterminal host [cmd]
+//                                   not interactive, from a terminal or not
+//               -pager, -detach and -subsystem are never interactive, and,
+//               like -noterminal, can not be used with -i.
+//           A session that is not interactive passes stdin, stdout and
+//           stderr straight through, as -noterminal does. In an interactive
+//           session, ~. at the start of a line ends it, and ~^Z stops cpu,
+//           with the terminal put back as it was, for the shell to go on;
+//           when cpu is continued, e.g. with fg, it makes the terminal raw
+//           again. Then, and whenever the terminal is resized, cpu tells the
+//           remote its size.
+//     -interactive
+//           the same as -i.
+//     -keepenv string
+//           comma-separated variables, of those -libenv is about, to send
+//           as they are, whatever -libenv says, e.g. -keepenv LD_PRELOAD.
 //     -key string
-//           key file (default "$HOME/.ssh/cpu_rsa")
+//           key file (default "$HOME/.ssh/cpu_rsa"). May be given more than once;
+//           the keys are offered in the order given, and no more are offered
+//           once one is accepted. Put the likeliest key first, so as not to
+//           run into the server's MaxAuthTries. With -d, cpu shows which key
+//           was accepted, so unused keys can be pruned.
+//           If there is an OpenSSH certificate for a key, in key-cert.pub,
+//           it is offered first, then the plain key; so if the certificate
+//           has expired or is rejected, cpu falls back to the key, and says so.
+//     -l
+//           run the remote command as a login shell, i.e. with argv[0]
+//           prefixed with a '-', so it reads /etc/profile and ~/.profile.
+//           This only makes sense when the command is a shell, as it is
+//           when no command is given. A plain shell only sees the
+//           environment forwarded from the local machine; a login shell
+//           starts with that environment and then runs the profile scripts,
+//           which may change forwarded variables such as PATH.
+//     -libenv string
+//           what to do with the variables that tell the dynamic linker, or
+//           pkg-config, where to look: LD_LIBRARY_PATH, LD_PRELOAD,
+//           LD_AUDIT, PKG_CONFIG_PATH, DYLD_LIBRARY_PATH and
+//           DYLD_INSERT_LIBRARIES. They name our paths, which on the remote
+//           are other files, or none, so the remote's own programs, e.g.
+//           the shell, can load the wrong libraries, and fail to start, or
+//           crash. keep sends them as they are; drop does not send them;
+//           remap puts each path in them under /tmp/cpu, where the remote
+//           sees our files, which is right for running our own programs
+//           there. The default is drop when the remote gets all of our /,
+//           with -root /, and keep otherwise. Run with -d to see what cpu
+//           did with them.
+//     -listentries int
+//           how many times to ask the remote ssh server to listen for the 9p
+//           and status forwards before giving up (default 4). A loaded server
+//           may refuse for a moment right after we connect; cpu waits 50ms,
+//           then twice as long each time, between tries.
+//     -locale
+//           make sure the remote command has our locale and time zone, so
+//           that dates, and text that is not ASCII, come out as they do
+//           here. cpu passes on its whole environment, so LANG, LANGUAGE and
+//           the LC_ variables, e.g. LC_ALL and LC_TIME, go along in any case;
+//           -locale adds TZ, if it is not set, from the zone /etc/localtime
+//           links to, or /etc/timezone names, e.g. TZ=Europe/Berlin. With -d,
+//           cpu shows the locale variables the remote gets. The remote must
+//           have the locale and zone installed to use them.
+//     -localpost string
+//           a local command, with arguments, to run after the session ends,
+//           e.g. to shut down a VPN. It runs even if the session failed.
+//           The target host and port are in $CPU_HOST and $CPU_PORT.
+//     -localpre string
+//           a local command, with arguments, to run before connecting,
+//           e.g. to bring up a VPN. If it fails, cpu does not connect.
+//           The target host and port are in $CPU_HOST and $CPU_PORT.
+//     -max9pconcurrency int
+//           the most 9p operations, e.g. reads, writes and walks, that are run
+//           at once for the remote (default 256); any more wait their turn.
+//           This keeps a very parallel remote workload from swamping this
+//           machine. 0 means no limit.
+//     -maxbytes int
+//           if set, once the remote has read and written this many bytes
+//           of our files, all further 9p reads and writes fail with EDQUOT
+//           (ENOSPC from darwin). The count is for the whole session.
+//     -maxdepth int
+//           if set, the deepest, in levels below -root, that the remote can
+//           go in our files: with -maxdepth 2 it can see /home/me, but not
+//           /home/me/src, which gets ENOENT, and is not listed in /home/me.
+//           An -export is one level down, at its name. Symlinks are resolved
+//           before the levels are counted, so a link to somewhere deeper
+//           is as deep as where it leads, and can not be used to get past
+//           the limit; a link out of -root counts its levels from /.
+//     -maxduration string
+//           if set, e.g. 2h, end the session this long after cpu starts,
+//           whatever it is doing, unlike an idle timeout, e.g. for time-boxed
+//           use of a lab machine. cpu says so on stderr, sends the remote
+//           command SIGTERM, so it can clean up, and, if it has not exited 5s
+//           later, closes the session; the terminal is put back as it was,
+//           and cpu exits 124, as timeout(1) does. The time is for the
+//           whole session, including the shell after -then-interactive.
+//     -maxenv int
+//           if set, the most environment variables cpu sends the remote. Some
+//           sshds, with a limit on the variables they take, drop the rest and
+//           say nothing, so which get through is up to chance. With -maxenv,
+//           cpu picks: first its own, e.g. the nonce, which it sends however
+//           low -maxenv is; then the CPU_ variables, e.g. CPU_NAMESPACE; then
+//           TERM, LANG, LANGUAGE, TZ and the LC_ variables; then the rest, in
+//           the order of its environment. cpu warns, naming them, about the
+//           variables it does not send.
+//     -maxopenfiles int
+//           if set, the most files the remote may have open over 9p at once;
+//           past that, opens fail with EMFILE, "too many open files".
+//           Use these, with -root, when serving your files to remote
+//           commands you do not fully trust.
+//     -mergestderr
+//           send the remote command's stderr to our stdout, as 2>&1 would,
+//           rather than to our stderr (the default). This only matters with
+//           -noterminal: with a pty, the remote terminal already merges them.
+//     -mincipherbits int
+//           if set, e.g. to 256, only use ssh ciphers with symmetric keys of
+//           at least this many bits, for a security policy that says how
+//           strong, rather than which. The ciphers cpu can use are
+//           aes128-gcm@openssh.com, aes128-ctr (128 bits), aes192-ctr (192),
+//           and aes256-ctr and chacha20-poly1305@openssh.com (256). Only those
+//           strong enough are offered to the server, so if it has none of
+//           them, cpu does not connect, and the error says what each side
+//           offered.
+//     -mountcheck string
+//           if set, a command cpu runs on the remote, with our files mounted
+//           as they will be for the session, before it starts the session,
+//           e.g. -mountcheck "test -f /tmp/cpu/src/Makefile". If it fails,
+//           cpu stops there, with exit status 253, as a wrong -root, -aname
+//           or -export is better caught then than part way into a build. It
+//           is run as the command is, by cpud, not by a shell, and gets a
+//           mount of its own, from the same export.
+//     -mountmode string
+//           how the remote mounts our files on /tmp/cpu: kernel, with its
+//           kernel's 9p; fuse, with cpud's own 9p client, over FUSE; or auto
+//           (the default), kernel if its kernel has 9p, and fuse, with a
+//           warning, if not, or with -parallelread. FUSE needs /dev/fuse, and cpud to be root for the
+//           mount. It is slower than the kernel's 9p, as every request goes
+//           through cpud as well, which shows most on many small files; and
+//           -mountopts, which is for the kernel's 9p, is not used.
 //     -mountopts string
 //           extra options for the 9p mount, default "". Lightly tested.
 //     -msize uint
 //           max size for 9p packets, default 1 MiB
 //     -network string
 //           network to use (default "tcp")
+//     -nonamespace
+//           do not give the remote our namespace: there is no 9p forward
+//           and nothing is mounted on /tmp/cpu. Setting CPU_NAMESPACE to ""
+//           does the same.
+//     -noncemode string
+//           how cpu gives cpud the nonce for the 9p and status forwards:
+//           env, the default, in $CPUNONCE; arg, on cpud's command line, where
+//           anything on the remote that can run ps can see it while cpud
+//           starts; or file, in a new file in /tmp on the remote that only
+//           you can read, which cpud reads and removes. An sshd whose
+//           AcceptEnv does not have CPUNONCE drops it, and the mount then
+//           fails; arg and file work anyway. file costs one more round trip,
+//           and needs sh and mktemp on the remote. The cpud must know -nonce
+//           and -noncefile. (default "env")
+//     -nononce
+//           INSECURE. Do not generate the nonce, or check that the remote
+//           presents it, on the 9p and status forwards. The forwarded ports
+//           are then open to any process on the remote that finds them, which
+//           can mount -root, with all your files, as you. It saves a little
+//           time on each connection; only use it on a trusted machine, on a
+//           trusted network, and never with -root /. cpu warns when it is set,
+//           and passes -nononce to cpud so both sides skip the handshake.
+//     -noterminal
+//           leave the local terminal alone: do not put it in raw mode, do not
+//           ask the remote for a pty, and do not look for ~. escapes; stdin,
+//           stdout and stderr are passed straight through. Use this when cpu
+//           is run by a program, e.g. a TUI, that manages the terminal itself,
+//           or when a command run from a terminal should not have a pty,
+//           e.g. cpu -noterminal host tar c dir > dir.tar, whose output the
+//           pty would otherwise change, as it makes each newline a CR LF.
+//     -o value
+//           an ssh option, as name=value, as for ssh -o. May be given more
+//           than once. For now the only one is StrictHostKeyChecking:
+//           no           do not check host keys at all (the default).
+//           yes          the host must be in ~/.ssh/known_hosts, with the
+//                        key it offers; cpu will not add it.
+//           accept-new   a host that is not in ~/.ssh/known_hosts is added
+//                        to it, but one that is there must have the same
+//                        key as before.
+//           A host on a port other than 22 is listed as [host]:port, as
+//           ssh does. -hk, if given, is checked instead.
+//     -otlp string
+//           if set, to the URL of an OpenTelemetry collector, e.g.
+//           http://localhost:4318, at the end of the session send it, over
+//           OTLP/HTTP, in JSON, to /v1/traces if the URL has no path, a
+//           trace of the session: a cpu span, with the host, as
+//           server.address, and the exit status, as process.exit.code, and
+//           under it a span for each phase -timing times, and for the
+//           command. With -J, there is one span for each hop. cpu waits no
+//           more than 5s for the collector, and only logs a failure.
+//     -overlay string
+//           if set, to discard, list or keep, serve -root, and each -export,
+//           copy-on-write: the remote can change anything it could before,
+//           but its writes, and the files and directories it makes, go to
+//           a temporary directory, not to our files. A file is copied there
+//           the first time the remote opens it to write; from then on, the
+//           remote sees the copy, and everything else as it is here. When
+//           the session ends, cpu throws the overlay away (discard), lists,
+//           on stderr, the files in it before throwing it away (list), or
+//           leaves it, and says where it is (keep). Use it to try out a
+//           command that might wreck things. The remote can not remove or
+//           rename files over 9p, with or without -overlay. It can not be
+//           used with -snapshot.
+//     -pager
+//           page the remote's stdout, e.g. for cpu host cat biglog, through
+//           $PAGER, or less if it is not set. It sets -noterminal, since the
+//           pager needs the local terminal. Output is only paged when stdout
+//           is a terminal. If you quit the pager before the output ends, cpu
+//           stops the remote command, and exits without an error.
+//     -parallelread int
+//           if more than 1, e.g. 8, while the remote reads a file of ours in
+//           order, it keeps this many reads of it in flight, rather than the
+//           one or two the kernel asks for, so that over a link with a long
+//           round trip they overlap: with a 20ms round trip, a 32 MiB file
+//           took 0.64s to read with -parallelread 8, and 1.7s without. Only
+//           cpud's FUSE mount can do it, so -mountmode auto picks FUSE, and
+//           with -mountmode kernel it is not used. At most 64; each read in
+//           flight holds up to 128 KiB on the remote.
+//     -pidfile string
+//           write the pid of the remote command to this file, so that other
+//           tools can manage it. The pid is as seen on the remote machine,
+//           i.e. in the remote's pid namespace, not ours. The file is removed
+//           when the session ends.
 //     -port9p string
-//           port9p # on remote machine for 9p mount
+//           port on the remote machine for the 9p forward. If not set,
+//           $CPU_PORT9P is used, and if that is not set either, any free
+//           port. Not used with -nonamespace.
+//     -prefetch string
+//           a file listing paths, one per line and relative to -root, that
+//           cpu reads in the background as soon as the remote has mounted
+//           the namespace, so they are in the local page cache when the
+//           remote first asks for them, e.g. the headers and sources of a
+//           build. Paths that are missing are skipped; with -d, progress is
+//           shown. To cache on the remote side too, use -mountopts cache=loose.
+//     -prioritizeinteractive
+//           in a session with a pty, while keys are being typed, hold 9p
+//           back, so that they are not queued behind a big read of our files
+//           (default true). For half a second after a key is typed, 9p is
+//           written 16 KiB at a time, with a short pause between, about 8
+//           MB/s, and a key being sent goes first. Only what cpu sends is
+//           held back, which for 9p is mostly the data the remote reads;
+//           -prioritizeinteractive=false turns it off.
+//     -profile string
+//           use the settings of the named profile in the -config file. A
+//           profile block is like a host block, but starts with a "profile
+//           name" line, and applies to any host, e.g.
+//               profile secure
+//                   o StrictHostKeyChecking=yes
+//                   export src:ro=/home/me/src
+//               profile lab
+//                   nononce true
+//                   yes-i-know true
+//           and then cpu -profile lab host. The profile wins over the host
+//           blocks, and flags given on the command line win over both. It is
+//           an error if there is no such profile; the error lists those
+//           there are.
+//     -privcmd string
+//           the command -sudo puts in front of cpud on the remote (default
+//           "sudo -E"). Keep -E, or whatever keeps the environment, with the
+//           default -noncemode env, or cpud loses $CPUNONCE; or use -noncemode
+//           file. Anything but sudo, e.g. doas, must need no password there.
+//     -pushbin string
+//           the path here of a cpud, statically linked, e.g. built with
+//           CGO_ENABLED=0 for the remote's architecture, to use on a remote
+//           that has only a stock sshd. If the remote has no -bin, cpu copies
+//           this one to a new file in its /tmp, that only the user can read
+//           or run, runs it as -bin, and removes it when the session ends; if
+//           cpu is killed, it is left behind. Caveats: it needs a shell,
+//           mktemp, cat and wc on the remote, and a /tmp it can run programs
+//           from, i.e. not mounted noexec; cpud must still be allowed to make
+//           its private mounts, which mostly takes root; cpu sends the whole
+//           binary every time; and cpu only checks that all of it arrived,
+//           not that it was not changed on the way or on the remote, so use
+//           -binsha256, which checks the pushed binary, when that matters.
+//     -q9perrors
+//           when the session ends the remote closes the 9p connection, which
+//           the 9p server sees as an error. If set (the default) such errors
+//           are only shown with -d. Errors during the session are always shown.
+//     -rekeybytes uint
+//           negotiate new ssh keys after this many bytes in either direction.
+//           The default, 0, leaves it to the cipher: every 64 GiB for AES,
+//           every 1 GiB for the others. A larger value means fewer pauses
+//           in a long session that moves a lot of 9p data, at the price of
+//           more data under each key; a smaller one the reverse. It must be
+//           at least 1 MiB.
+//     -rekeyinterval string
+//           if set, e.g. to 1h, also negotiate new ssh keys this often, however
+//           little has been sent, so that no key is used for longer. It must
+//           be at least 1m, and needs -rekeybytes: golang.org/x/crypto/ssh
+//           only starts a key exchange itself, once -rekeybytes have gone
+//           out, so cpu forces one by sending that many bytes of padding,
+//           which the remote ignores. Each costs those bytes, and a pause,
+//           so a small -rekeybytes keeps it cheap.
 //     -remote
 //           Indicates we are the remote side of the cpu session
+//     -requirearch string
+//           before anything else is run there, ask the remote, with uname -m,
+//           what it is, and fail, saying what it is, unless it is this
+//           architecture, named as uname or Go names it, e.g. x86_64 or amd64,
+//           aarch64 or arm64. This catches e.g. a -bin or -pushbin cpud for
+//           arm64 used on an amd64 host, which would otherwise fail in a way
+//           that says little. It costs a round trip, so it is off by default.
+//     -requireos string
+//           the same, for the system uname -s names, e.g. Linux or Darwin; case
+//           does not matter. Both are checked with one uname.
 //     -root
 //           Root for 9p server, default "/"
 //           If you are cpu'ing from, eg., x86 to arm, you might
 //           use, e.g., /amd64
+//     -rusage
+//           when the session ends, print on stderr what the remote command
+//           used: its user and system time, and its largest resident set,
+//           and how it ended, much as time -v would:
+//               cpu: rusage: user 1.235s, system 23ms, max resident 10240 KiB (exit status 0)
+//           cpud reports it on the status channel once the command is done.
+//           A command that was killed reports what it used until then; if
+//           cpud itself was killed, or the session broke first, cpu says the
+//           remote did not report it. It is for the command only, not cpud
+//           or the 9p mount.
+//     -setupkey
+//           set up a first cpu to the host. If the -key file (the first, if
+//           there are several) is not there, cpu offers to make a new ed25519
+//           key in it, with its public key in the same file with .pub added,
+//           and prints the public key. It then offers to add the public key
+//           to ~/.ssh/authorized_keys on the host, logging in once with a
+//           password to do it, unless the key is there already, and goes on
+//           with the session. cpu asks before each step, so it needs a
+//           terminal, and it never replaces a key that is there; it uses
+//           that key instead.
+//     -showconfig
+//           print the settings cpu would use for the host, and exit without
+//           connecting. Each flag is shown as it is once the -config file and
+//           -profile are applied, with where its value came from: the command
+//           line, a host or profile block of the config file, or the default.
+//           After the flags comes what cpu makes of them and of its
+//           environment: the user, host and port it connects to, any jump
+//           host or proxy, the keys it tries, how it checks the host key, and
+//           what the remote mounts, e.g. a port from $CPU_PORT9P. Proxy
+//           passwords are shown as REDACTED, and those in the environment only
+//           as set, so the output can be shared.
+//     -snapshot
+//           before the remote mounts us, read all of -root, and each -export,
+//           into memory, and serve the remote from there, read-only. The
+//           remote sees the tree as it was when cpu started, however you
+//           change it in the meantime, which is what you want for a
+//           reproducible build. The cost is memory for every byte of every
+//           file, and the time to read them all up front, so use it with a
+//           -root that is a source tree, not /. Unlike -cache, which is the
+//           remote kernel deciding what to keep, a snapshot is our side
+//           deciding what there is: nothing changes, and nothing can be
+//           written. -crlf does not apply to a snapshot. A file that changes
+//           while the snapshot is taken may be caught partway.
+//     -snapshotmax int
+//           the most bytes of file data -snapshot will hold; if -root is
+//           larger, cpu stops with an error (default 1073741824).
+//     -socks string
+//           connect through a SOCKS5 proxy, given as [user[:password]@]host:port.
+//           If a user but no password is given, the password is taken from
+//           $CPU_SOCKS_PASSWORD. The 9p forward rides the ssh connection, so
+//           it needs nothing extra.
+//     -stdinretries int
+//           how many errors in a row that pass, EINTR or EAGAIN, cpu rides out
+//           when reading the local terminal, before it stops sending input to
+//           the remote (default 10); without this, a signal at the wrong
+//           moment would leave input dead for the rest of the session. An
+//           EOF is not ridden out: from a terminal, it is a ^D, which must
+//           end e.g. cpu host cat at once, or a hang up. It only applies to
+//           a terminal: a pipe or file that ends is done. 0 stops input at
+//           the first error. Run with -d to see why input stopped.
+//     -subsystem string
+//           request this ssh subsystem, e.g. sftp, rather than running cpud
+//           and a command. Stdin and stdout are passed through as they are,
+//           as with -noterminal, and there is no 9p mount. Any command is
+//           ignored.
 //     -sp string
 //          remote port, default 23
 //     -srv string
 //           what server to run (default none; use internal)
+//     -sudo
+//           run cpud on the remote as root, with -privcmd, so that it can make
+//           the 9p mount on a host that only lets root mount, and give it
+//           -runas, so that the command still runs as the user cpu logged in
+//           as, not as root. cpu first tries the -privcmd with -n; if that
+//           needs a password, cpu asks for it here, and, for each sudo it
+//           runs, writes a script that prints it to a new file in /tmp on the
+//           remote that only you can read or run, for sudo -k -A. The script
+//           removes itself when sudo runs it, before sudo goes on, and cpu
+//           removes it if sudo never got that far. While it is there, anyone
+//           who is root there, or you, can read the password from it, so
+//           prefer a sudoers entry that needs none. cpud must know -runas.
+//     -tcpkeepalive string
+//           how often, when the ssh connection is idle, the kernel checks
+//           that the host is still there, e.g. 30s, so that a host that went
+//           away is found out, and the session ends, even when neither ssh
+//           nor 9p has anything to send. off turns the checks off. The
+//           default is Go's, every 15s. Like -tcpnodelay, it only applies
+//           when the ssh connection is a TCP socket; -d says when it is not.
+//     -tcpnodelay
+//           set TCP_NODELAY on the ssh connection (default true), so that
+//           each key typed is sent at once, rather than held back by Nagle's
+//           algorithm until what was sent before is acknowledged.
+//           -tcpnodelay=false sends fewer, fuller packets, which may help
+//           bulk 9p traffic on a slow link, at the cost of laggy typing.
+//     -then-interactive
+//           run the command, without a pty, as a command is, and then, if it
+//           worked, an interactive shell, $SHELL, over the same connection,
+//           e.g. cpu -then-interactive host ./setup.sh. The shell gets a 9p
+//           mount of its own, of the same files, so it sees what the command
+//           did to them, but nothing else of the command's, e.g. the
+//           variables it set. The command gets no stdin, as with ssh -n, so
+//           what is typed goes to the shell. If the command fails, there is
+//           no shell, and cpu exits with the command's exit status; if it
+//           works, cpu exits with the shell's. stdin must be a terminal, and
+//           -i, -noterminal, -pager, -detach, -subsystem and -bench can not
+//           be used with it.
+//     -timing
+//           at the end of the session, print on stderr how long each phase
+//           took: dns, connect, ssh handshake, auth, 9p mount (from offering
+//           the 9p port until cpud connects to it with the nonce, so it
+//           includes starting cpud), command, from starting the remote
+//           command until it exits, and total, the whole session. With -J,
+//           each phase is the sum over all the hops.
 //     -timeout9p time.Duration
 //           How long to wait for the server to connect to 9p (default100ms)
+//     -umask string
+//           if set, e.g. to 022, the umask of the remote command. It only
+//           affects the mode of files the remote creates, through the 9p mount
+//           or otherwise. Files created through the mount are created here,
+//           by us, as the user running cpu, whatever uid the remote runs as;
+//           the umask only decides their mode.
+//     -union string
+//           if set, local or remote: on the remote, each directory named in
+//           CPU_NAMESPACE, e.g. /lib and /usr, becomes a union of ours and
+//           the remote's own, rather than ours bound over it, so that e.g.
+//           our tools can run with the remote's system libraries. Names only
+//           one side has are all there; where both have a name, the side
+//           -union says wins, local for ours and remote for the remote's, and
+//           the other is shadowed; directories both have are merged, all the
+//           way down. The union is an overlayfs with both sides as read-only
+//           lower layers, so it can not be written; our files can still be
+//           written in /tmp/cpu. It needs overlayfs in the remote's kernel,
+//           and one that takes 9p as a layer; where the union can not be
+//           mounted, cpud warns and binds ours over it, as it would without
+//           -union. A directory with a : or , in its path can not be in a
+//           union.
+//     -unshare
+//           Linux only: run cpu in a new mount namespace, with / made private,
+//           so that any mounts cpu makes locally are not seen outside it and
+//           go away with it. cpu runs itself again, in the new namespace,
+//           since a running Go program can not be moved to one. It needs
+//           CAP_SYS_ADMIN, which usually means running as root. It can not
+//           be set in the -config file.
+//     -verify9p
+//           before the session starts, check the 9p transport end to end: cpu
+//           serves a 4 MiB test file, half random and half repetitive, the
+//           remote reads it over a 9p mount set up just like the session's,
+//           with the same -9pcompress and other flags, and runs sha256sum on
+//           it, and cpu compares that with its own. If they differ, something
+//           on the way, e.g. an MTU or compression bug, is corrupting data, and
+//           cpu warns loudly; the session goes on. It costs one more remote
+//           command, and the remote needs sha256sum.
+//     -yes-i-know
+//           do not warn that the remote can read and write all of / as you.
+//           Without it, cpu warns when -root is /, the default, and neither
+//           -snapshot nor -allowpaths limits what the remote gets, and names
+//           the directories, such as ~/.ssh, ~/.gnupg and ~/.aws, with
+//           secrets the remote can reach. cpu goes on either way.
 // Examples
 // In these examples, cpu runs with warning messages enabled.
 // The first message is a warning that cpu could not use overlayfs to build a
@@ -0,0 +1,120 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// dumpRingSize is how much of the -dumponerror trace we keep.
+// Once it fills, the oldest output is dropped; what is left
+// is the run-up to the failure, which is the interesting part.
+const dumpRingSize = 32 << 20
+
+// ringBuffer is an io.Writer that keeps the last max bytes written.
+// It only grows to max as it fills, so a short trace costs what it
+// holds, not max.
+type ringBuffer struct {
+	mu      sync.Mutex
+	b       []byte
+	max     int
+	off     int
+	wrapped bool
+}
+
+func newRingBuffer(n int) *ringBuffer {
+	return &ringBuffer{max: n}
+}
+
+// grow makes room for c more bytes in b, up to max, doubling it as
+// append would, but never past max.
+func (r *ringBuffer) grow(c int) {
+	if len(r.b)+c <= cap(r.b) {
+		return
+	}
+	n := 2 * cap(r.b)
+	if n < len(r.b)+c {
+		n = len(r.b) + c
+	}
+	if n > r.max {
+		n = r.max
+	}
+	b := make([]byte, len(r.b), n)
+	copy(b, r.b)
+	r.b = b
+}
+
+// Write implements io.Writer.Write.
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(p)
+	if len(p) > r.max {
+		p = p[len(p)-r.max:]
+	}
+	if len(r.b) < r.max {
+		c := r.max - len(r.b)
+		if c > len(p) {
+			c = len(p)
+		}
+		r.grow(c)
+		r.b = append(r.b, p[:c]...)
+		p = p[c:]
+		r.off = len(r.b)
+		if r.off == r.max {
+			r.off, r.wrapped = 0, true
+		}
+	}
+	for len(p) > 0 {
+		c := copy(r.b[r.off:], p)
+		p = p[c:]
+		r.off += c
+		if r.off == len(r.b) {
+			r.off, r.wrapped = 0, true
+		}
+	}
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo.WriteTo, oldest bytes first.
+func (r *ringBuffer) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tot int64
+	if r.wrapped {
+		n, err := w.Write(r.b[r.off:])
+		tot += int64(n)
+		if err != nil {
+			return tot, err
+		}
+	}
+	n, err := w.Write(r.b[:r.off])
+	return tot + int64(n), err
+}
+
+// flushDump writes the -dumponerror trace out to a file.
+// It is only called when the session has failed; on success
+// the trace is simply dropped on the floor.
+func flushDump() {
+	r, ok := dumpWriter.(*ringBuffer)
+	if !ok {
+		return
+	}
+	f, err := ioutil.TempFile("", "cpu")
+	if err != nil {
+		log.Printf("Can not save the dump: %v", err)
+		return
+	}
+	if _, err := r.WriteTo(f); err != nil {
+		log.Printf("Writing dump to %s: %v", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("Writing dump to %s: %v", f.Name(), err)
+	}
+	log.Printf("Session failed; dump is in %s", f.Name())
+}
@@ -0,0 +1,55 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRingBuffer writes to a ring buffer in pieces of many sizes, and
+// checks that it keeps the last max bytes, and only grows as it needs.
+func TestRingBuffer(t *testing.T) {
+	const max = 100
+	for _, sizes := range [][]int{
+		{},
+		{1},
+		{0, 5, 0},
+		{10, 20, 30},
+		{99, 1},
+		{100},
+		{99, 2},
+		{250},
+		{3, 250, 7},
+		{60, 60, 60, 60, 60, 3, 1},
+	} {
+		r := newRingBuffer(max)
+		var all []byte
+		for _, n := range sizes {
+			p := make([]byte, n)
+			for i := range p {
+				p[i] = byte(len(all) + i)
+			}
+			if got, err := r.Write(p); got != n || err != nil {
+				t.Errorf("%v: Write of %d: got %d, %v, want %d, nil", sizes, n, got, err, n)
+			}
+			all = append(all, p...)
+		}
+		want := all
+		if len(want) > max {
+			want = want[len(want)-max:]
+		}
+		var b bytes.Buffer
+		if _, err := r.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Errorf("%v: got %v, want %v", sizes, b.Bytes(), want)
+		}
+		if c := cap(r.b); c > max || (len(all) < max/2 && c > 2*len(all)) {
+			t.Errorf("%v: after %d bytes, the buffer holds %d", sizes, len(all), c)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// -exportallow lets the remote ask, while the session goes on, for more
+// of our files than -root and the -export trees, without connecting
+// again. A command on the remote runs cpud -requestexport path, with
+// the local path it wants, and cpud asks us for it:
+//
+//	the command to cpud, on the Unix socket in $CPU_EXPORT:  path
+//	cpud to us, on the status channel:  export id path
+//	us to cpud:  export id ok name, or export id error why
+//	cpud to the command:  ok /tmp/cpu/name, or error why
+//
+// We add the tree as an export named name, just as -export name=path
+// would have, so it is at /tmp/cpu/name on the remote, and a new mount
+// can attach to it with -aname name. Only a directory that, with its
+// symlinks resolved, is one of the -exportallow directories, or is in
+// one, is given, and only read-only, through its name, unless the
+// innermost one it is in was listed as rw=path. The remote can not name what it is given: the name
+// is the directory's own, made unique, and never one in -root, which it
+// would hide. Each tree given is logged here.
+
+// maxDynExports is the most trees -exportallow gives in one session.
+const maxDynExports = 64
+
+// An allowRoot is one of the -exportallow directories.
+type allowRoot struct {
+	path string // with its symlinks resolved
+	rw   bool
+}
+
+var (
+	allowRoots []allowRoot
+	// dynExports counts the trees given so far.
+	dynExports int
+)
+
+// checkExportAllow parses -exportallow, comma-separated directories,
+// each path, read-only, or rw=path or ro=path.
+func checkExportAllow() error {
+	allowRoots = nil
+	if *exportAllow == "" {
+		return nil
+	}
+	if *snapshot {
+		return fmt.Errorf("exportallow: can not be used with -snapshot, which is taken before the remote can ask")
+	}
+	for _, e := range strings.Split(*exportAllow, ",") {
+		var a allowRoot
+		p := e
+		switch {
+		case strings.HasPrefix(e, "rw="):
+			a.rw, p = true, e[3:]
+		case strings.HasPrefix(e, "ro="):
+			p = e[3:]
+		}
+		r, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return fmt.Errorf("exportallow %q: %v", e, err)
+		}
+		if r, err = filepath.Abs(r); err != nil {
+			return fmt.Errorf("exportallow %q: %v", e, err)
+		}
+		if fi, err := os.Stat(r); err != nil || !fi.IsDir() {
+			return fmt.Errorf("exportallow %q: not a directory", e)
+		}
+		a.path = r
+		allowRoots = append(allowRoots, a)
+	}
+	return nil
+}
+
+// allowedExport returns the local directory p, with its symlinks
+// resolved, and whether the remote may write it, if -exportallow
+// allows it to be given: the innermost of the -exportallow directories
+// it is in says which.
+func allowedExport(p string) (string, bool, error) {
+	if !filepath.IsAbs(p) {
+		return "", false, fmt.Errorf("%q is not an absolute path", p)
+	}
+	r, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", false, err
+	}
+	if fi, err := os.Stat(r); err != nil || !fi.IsDir() {
+		return "", false, fmt.Errorf("%q is not a directory", p)
+	}
+	// The innermost directory r is in says whether it is writable.
+	var in *allowRoot
+	for i, a := range allowRoots {
+		if r != a.path && !strings.HasPrefix(r, a.path+string(filepath.Separator)) && a.path != string(filepath.Separator) {
+			continue
+		}
+		if in == nil || len(a.path) > len(in.path) {
+			in = &allowRoots[i]
+		}
+	}
+	if in == nil {
+		return "", false, fmt.Errorf("%q is not in -exportallow", p)
+	}
+	return r, in.rw, nil
+}
+
+// exportName returns the name to give the local directory r, which is
+// not yet exported: its own, or, if that is taken, by an export or by
+// something in -root, with -2, -3 and so on after it.
+func exportName(r string) string {
+	base := strings.NewReplacer(":", "_", string(filepath.Separator), "_").Replace(filepath.Base(r))
+	if base == "" || base == "." || base == ".." {
+		base = "export"
+	}
+	for i := 1; ; i++ {
+		n := base
+		if i > 1 {
+			n = fmt.Sprintf("%s-%d", base, i)
+		}
+		if _, ok := exportPaths[n]; ok {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(*root, n)); err == nil {
+			continue
+		}
+		return n
+	}
+}
+
+// addExport is -exportallow: it serves the local directory p, if it
+// is allowed, as an export, and returns its name. A directory that is
+// already an export keeps its name.
+func addExport(p string) (string, error) {
+	r, rw, err := allowedExport(p)
+	if err != nil {
+		return "", err
+	}
+	if *maxDepth > 0 {
+		depthOnce.Do(findDepthTops)
+	}
+	exportMu.Lock()
+	defer exportMu.Unlock()
+	for n, ep := range exportPaths {
+		if ep == r {
+			return n, nil
+		}
+	}
+	if dynExports >= maxDynExports {
+		return "", fmt.Errorf("already %d trees given; no more", maxDynExports)
+	}
+	n := exportName(r)
+	exportPaths[n] = r
+	// Read-only by name, not by path, as readOnlyPaths are: the
+	// remote asked for it, and must not be able to make any of
+	// -root, or of a read-write -export, read-only to itself.
+	if !rw {
+		roExports[n] = true
+	}
+	if depthTops != nil {
+		depthTops[r] = 1
+	}
+	dynExports++
+	mode := "read-only"
+	if rw {
+		mode = "read-write"
+	}
+	log.Printf("Serving %v to the remote, %s, as %v, as it asked", r, mode, n)
+	return n, nil
+}
+
+// exportRequest answers cpud's request, "id path", for the directory
+// path, with "id ok name" or "id error why".
+func exportRequest(val string) {
+	f := strings.SplitN(val, " ", 2)
+	if len(f) != 2 {
+		v("exportallow: bad request %q", val)
+		return
+	}
+	reply := f[0] + " "
+	n, err := addExport(f[1])
+	if err != nil {
+		log.Printf("Not serving %v to the remote, as it asked: %v", f[1], err)
+		reply += "error " + strings.Replace(err.Error(), "\n", " ", -1)
+	} else {
+		reply += "ok " + n
+	}
+	if err := tellStatus("export", reply); err != nil {
+		log.Printf("exportallow: answering cpud: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+// allowExports sets -exportallow to e, and -root to r, as cpu would
+// have them at the start of the session, and returns a func that puts
+// them back.
+func allowExports(t *testing.T, r, e string) func() {
+	t.Helper()
+	restore := setFlags(t, map[string]string{"root": r, "exportallow": e})
+	if err := parseExports(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkExportAllow(); err != nil {
+		t.Fatal(err)
+	}
+	dynExports = 0
+	return func() {
+		restore()
+		parseExports(nil)
+		allowRoots, dynExports = nil, 0
+	}
+}
+
+// TestDynExportReadOnly gives, read-only, a directory that is also in
+// -root, and checks that it is read-only through the name it is given,
+// and only there: the remote must not be able to make any of -root
+// read-only by asking for it.
+func TestDynExportReadOnly(t *testing.T) {
+	r := tempRoot(t, map[string]string{"d/f": "f", "g": "g"})
+	defer os.RemoveAll(r)
+	r, err := filepath.EvalSymlinks(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowExports(t, r, filepath.Join(r, "d"))()
+	n, err := addExport(filepath.Join(r, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == "d" {
+		t.Fatalf("the export is called %q, which hides d in -root", n)
+	}
+	if err := writable(filepath.Join(r, "d", "f")); err != nil {
+		t.Errorf("writable(%q): got %v, want nil", filepath.Join(r, "d", "f"), err)
+	}
+
+	root, err := (&cpu9p{}).Attach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// open walks to p, from -root, and opens it for writing.
+	open := func(p ...string) error {
+		_, f, err := root.Walk(p)
+		if err != nil {
+			t.Fatalf("walk %q: %v", p, err)
+		}
+		defer f.Close()
+		_, _, err = f.Open(p9.WriteOnly)
+		return err
+	}
+	if err := open("d", "f"); err != nil {
+		t.Errorf("d/f, through -root: got %v, want nil", err)
+	}
+	if err := open(n, "f"); err != errReadOnly {
+		t.Errorf("%s/f, through the export: got %v, want %v", n, err, errReadOnly)
+	}
+
+	_, d, err := root.Walk([]string{n})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, _, _, err := d.Create("new", p9.WriteOnly, 0644, p9.NoUID, p9.NoGID); err != errReadOnly {
+		t.Errorf("create in %s: got %v, want %v", n, err, errReadOnly)
+	}
+	if _, err := d.Mkdir("new", 0755, p9.NoUID, p9.NoGID); err != errReadOnly {
+		t.Errorf("mkdir in %s: got %v, want %v", n, err, errReadOnly)
+	}
+	// A new name, where it can be written, for a file in the export
+	// would let it be written.
+	_, f, err := root.Walk([]string{n, "f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := root.Link(f, "link"); err != errReadOnly {
+		t.Errorf("link to %s/f from -root: got %v, want %v", n, err, errReadOnly)
+	}
+}
+
+func TestAllowedExport(t *testing.T) {
+	d := tempRoot(t, map[string]string{
+		"a/x/f": "", "a/file": "", "a/rw/x/f": "", "a/rw/ro/x/f": "", "b/f": "",
+	})
+	defer os.RemoveAll(d)
+	d, err := filepath.EvalSymlinks(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for old, new := range map[string]string{"a/out": "../b", "b/in": "../a/x", "a/rw/up": "../x"} {
+		if err := os.Symlink(new, filepath.Join(d, old)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := func(s string) string { return filepath.Join(d, s) }
+	defer allowExports(t, d, p("a")+",rw="+p("a/rw")+",ro="+p("a/rw/ro"))()
+	for _, tt := range []struct {
+		name, path, want string
+		rw               bool
+		err              bool
+	}{
+		{name: "an allowed directory", path: p("a"), want: p("a")},
+		{name: "one in it", path: p("a/x"), want: p("a/x")},
+		{name: "one in a rw= one", path: p("a/rw/x"), want: p("a/rw/x"), rw: true},
+		{name: "the rw= one", path: p("a/rw"), want: p("a/rw"), rw: true},
+		{name: "a read-only one in a rw= one", path: p("a/rw/ro/x"), want: p("a/rw/ro/x")},
+		{name: "a symlink out of it", path: p("a/out"), err: true},
+		{name: "a symlink into it", path: p("b/in"), want: p("a/x")},
+		{name: "a symlink from rw= to read-only", path: p("a/rw/up"), want: p("a/x")},
+		{name: "dot dot out of it", path: p("a") + "/../b", err: true},
+		{name: "outside", path: p("b"), err: true},
+		{name: "above it", path: d, err: true},
+		{name: "a name that only starts the same", path: p("a") + "x", err: true},
+		{name: "relative", path: "a/x", err: true},
+		{name: "a file", path: p("a/file"), err: true},
+		{name: "not there", path: p("a/none"), err: true},
+	} {
+		got, rw, err := allowedExport(tt.path)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: %q: got %q, want an error", tt.name, tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || rw != tt.rw {
+			t.Errorf("%s: %q: got %q, rw %v, %v, want %q, rw %v", tt.name, tt.path, got, rw, err, tt.want, tt.rw)
+		}
+	}
+}
+
+// TestAddExportLimit checks that no more than maxDynExports trees are
+// given, and that asking again for one already given does not count.
+func TestAddExportLimit(t *testing.T) {
+	fs := map[string]string{}
+	for i := 0; i <= maxDynExports; i++ {
+		fs[filepath.Join("a", strconv.Itoa(i), "f")] = ""
+	}
+	d := tempRoot(t, fs)
+	defer os.RemoveAll(d)
+	d, err := filepath.EvalSymlinks(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tempRoot(t, nil)
+	defer os.RemoveAll(r)
+	defer allowExports(t, r, filepath.Join(d, "a"))()
+	first, err := addExport(filepath.Join(d, "a", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < maxDynExports; i++ {
+		if _, err := addExport(filepath.Join(d, "a", strconv.Itoa(i))); err != nil {
+			t.Fatalf("tree %d of %d: %v", i+1, maxDynExports, err)
+		}
+	}
+	if n, err := addExport(filepath.Join(d, "a", "0")); err != nil || n != first {
+		t.Errorf("the first tree, again: got %q, %v, want %q, nil", n, err, first)
+	}
+	if n, err := addExport(filepath.Join(d, "a", strconv.Itoa(maxDynExports))); err == nil {
+		t.Errorf("tree %d: got %q, want an error", maxDynExports+1, n)
+	}
+	if len(exportPaths) != maxDynExports {
+		t.Errorf("%d exports, want %d", len(exportPaths), maxDynExports)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// These are the kinds of failure a session can end in. errors.Is with
+// one of them, or errors.As with the type that goes with it, tells
+// which an error is, however it has been wrapped, without looking at
+// its text; main turns each into an exit status of its own, so that
+// what runs cpu can tell them apart too.
+var (
+	ErrDial     = errors.New("can not reach the host")
+	ErrAuth     = errors.New("can not log in to the host")
+	ErrMount    = errors.New("the remote can not mount our files")
+	ErrProtocol = errors.New("the ssh session went wrong")
+	ErrRemote   = errors.New("the remote command failed")
+)
+
+// The exit statuses for each kind of failure, other than the remote
+// command's, which cpu exits with. They are high, as ssh's 255 is, so
+// that they are not often those of a command.
+const (
+	exitDial     = 251
+	exitAuth     = 252
+	exitMount    = 253
+	exitProtocol = 254
+
+	exitMaxDuration = 124
+)
+
+// DialError is a failure to reach the ssh server on the host: the
+// name does not resolve, the connection is refused, or the proxy or
+// jump host in the way fails.
+type DialError struct {
+	Err error
+}
+
+func (e *DialError) Error() string        { return e.Err.Error() }
+func (e *DialError) Unwrap() error        { return e.Err }
+func (e *DialError) Is(target error) bool { return target == ErrDial }
+
+// AuthError is a failure to log in once the ssh server is reached:
+// the host key is wrong or unknown, or the server takes none of our
+// keys or passwords, or hangs up on us.
+type AuthError struct {
+	User string
+	Err  error
+}
+
+func (e *AuthError) Error() string        { return e.Err.Error() }
+func (e *AuthError) Unwrap() error        { return e.Err }
+func (e *AuthError) Is(target error) bool { return target == ErrAuth }
+
+// MountError is a failure to give the remote our files: the 9p
+// forward can not be set up, or cpud never presents the nonce on it.
+type MountError struct {
+	Err error
+}
+
+func (e *MountError) Error() string        { return e.Err.Error() }
+func (e *MountError) Unwrap() error        { return e.Err }
+func (e *MountError) Is(target error) bool { return target == ErrMount }
+
+// ProtocolError is the ssh session going wrong: we and the server
+// have no cipher in common, the server will not open a session, or the
+// remote command ends without an exit status, e.g. when the
+// connection is lost.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string        { return e.Err.Error() }
+func (e *ProtocolError) Unwrap() error        { return e.Err }
+func (e *ProtocolError) Is(target error) bool { return target == ErrProtocol }
+
+// RemoteExitError is the remote command exiting with a status other
+// than 0, or being killed by a signal; Code is what cpu exits with.
+type RemoteExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *RemoteExitError) Error() string        { return e.Err.Error() }
+func (e *RemoteExitError) Unwrap() error        { return e.Err }
+func (e *RemoteExitError) Is(target error) bool { return target == ErrRemote }
+
+// sessionErr sorts the error a session ended with: the remote
+// command's exit, the session ending without one, or neither.
+func sessionErr(err error) error {
+	var x *ossh.ExitError
+	var m *ossh.ExitMissingError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &x):
+		return &RemoteExitError{Code: x.ExitStatus(), Err: err}
+	case errors.As(err, &m):
+		return &ProtocolError{Err: err}
+	}
+	return err
+}
+
+// exitCode is the exit status for the error err a session ended with:
+// the remote command's, one for each other kind of failure, or 1.
+func exitCode(err error) int {
+	var r *RemoteExitError
+	switch {
+	case errors.Is(err, ErrMaxDuration):
+		return exitMaxDuration
+	case errors.As(err, &r):
+		return r.Code
+	case errors.Is(err, ErrDial):
+		return exitDial
+	case errors.Is(err, ErrAuth):
+		return exitAuth
+	case errors.Is(err, ErrMount):
+		return exitMount
+	case errors.Is(err, ErrProtocol):
+		return exitProtocol
+	}
+	return 1
+}
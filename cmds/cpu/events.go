@@ -0,0 +1,115 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An event9p is one 9p operation the remote did on our files, as
+// -9pevents sends it: one JSON object to a line.
+//
+// Type is the operation: attach, walk, open, create, read, write,
+// readdir or clunk. Fid is the number cpu gave the file, which is
+// the same for every event on it from its walk, or attach or create,
+// to its clunk; it is not the 9p fid number the remote uses, which
+// the server keeps to itself. Path is the local path. Size is the
+// bytes read or written, or the entries read by a readdir. Err is
+// the error the remote got, if any.
+type event9p struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Fid  uint64    `json:"fid"`
+	Path string    `json:"path"`
+	Size int       `json:"size,omitempty"`
+	Err  string    `json:"err,omitempty"`
+}
+
+var (
+	// fidNum is the last fid number -9pevents gave out.
+	fidNum uint64
+	// watchers counts the -9pevents consumers connected. Events are
+	// only built when there is at least one, so that -9pevents costs
+	// nothing while no one is looking.
+	watchers int32
+	events   struct {
+		sync.Mutex
+		c map[net.Conn]*json.Encoder
+	}
+)
+
+// listenEvents listens on the Unix socket -9pevents for consumers,
+// e.g. a dashboard, each of which gets every event from when it
+// connects. A consumer that can not keep up, or goes away, is
+// dropped.
+func listenEvents() error {
+	os.Remove(*events9p)
+	l, err := net.Listen("unix", *events9p)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				v("9pevents: %v", err)
+				return
+			}
+			verbose("9pevents: consumer connected")
+			events.Lock()
+			if events.c == nil {
+				events.c = map[net.Conn]*json.Encoder{}
+			}
+			events.c[c] = json.NewEncoder(c)
+			atomic.AddInt32(&watchers, 1)
+			events.Unlock()
+		}
+	}()
+	return nil
+}
+
+// closeEvents stops -9pevents, and removes the socket.
+func closeEvents() {
+	if *events9p != "" {
+		os.Remove(*events9p)
+	}
+}
+
+// fidEvent gives l a fid number, if -9pevents is set, and sends an
+// event of type t for it.
+func fidEvent(l *cpu9p, t string) *cpu9p {
+	if *events9p != "" {
+		l.fid = atomic.AddUint64(&fidNum, 1)
+	}
+	event(l, t, 0, nil)
+	return l
+}
+
+// event sends an event of type t, for l, to the -9pevents consumers.
+func event(l *cpu9p, t string, size int, err error) {
+	if atomic.LoadInt32(&watchers) == 0 {
+		return
+	}
+	e := event9p{Time: time.Now(), Type: t, Fid: l.fid, Path: l.path, Size: size}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	events.Lock()
+	defer events.Unlock()
+	for c, enc := range events.c {
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := enc.Encode(e); err != nil {
+			v("9pevents: dropping consumer: %v", err)
+			c.Close()
+			delete(events.c, c)
+			atomic.AddInt32(&watchers, -1)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// exportPaths maps the names of the -export trees to their local paths.
+// exportMu guards it, and roExports, since -exportallow adds to them
+// while the session goes on.
+var (
+	exportMu    sync.RWMutex
+	exportPaths map[string]string
+	// roExports are the names of the trees -exportallow gave
+	// read-only. Unlike readOnlyPaths, they are read-only only to
+	// the remote's fids that were walked through the name; see
+	// cpu9p.ro.
+	roExports map[string]bool
+)
+
+// readOnlyPaths are the local paths of the -export trees that are
+// read-only. They are only ever ones we gave on the command line.
+var readOnlyPaths []string
+
+// errReadOnly is what the remote gets when it tries to change a
+// read-only -export.
+var errReadOnly error = syscall.EROFS
+
+// parseExports checks the -export flags, name=path or name:mode=path,
+// and fills in exportPaths and readOnlyPaths. The mode is ro or rw,
+// and rw is the default. Names can not contain a /, since the aname
+// is a path: an aname of name/sub attaches to sub in the tree called
+// name. Nor can they contain a :, which starts the mode.
+func parseExports(l []string) error {
+	exportPaths = map[string]string{}
+	roExports = map[string]bool{}
+	readOnlyPaths = nil
+	for _, e := range l {
+		c := strings.SplitN(e, "=", 2)
+		if len(c) != 2 || c[0] == "" || c[1] == "" {
+			return fmt.Errorf("export %q: want name=path or name:mode=path", e)
+		}
+		name, mode := c[0], "rw"
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, mode = name[:i], name[i+1:]
+		}
+		if name == "" {
+			return fmt.Errorf("export %q: no name", e)
+		}
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("export %q: the name can not contain a /", e)
+		}
+		if _, ok := exportPaths[name]; ok {
+			return fmt.Errorf("export %q: %q is already exported", e, name)
+		}
+		p, err := filepath.Abs(c[1])
+		if err != nil {
+			return fmt.Errorf("export %q: %v", e, err)
+		}
+		switch mode {
+		case "ro":
+			readOnlyPaths = append(readOnlyPaths, p)
+		case "rw":
+		default:
+			return fmt.Errorf("export %q: mode %q must be ro or rw", e, mode)
+		}
+		exportPaths[name] = p
+	}
+	return nil
+}
+
+// writable returns errReadOnly if path is in a read-only -export.
+// It goes by the local path, not the way the remote walked there,
+// so a read-only tree can not be changed by walking to it from -root,
+// or from a read-write export it is in.
+func writable(path string) error {
+	exportMu.RLock()
+	defer exportMu.RUnlock()
+	for _, p := range readOnlyPaths {
+		if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+			verbose("%v is in a read-only export", path)
+			return errReadOnly
+		}
+	}
+	return nil
+}
+
+// writable is writable for path, a file l is, or is the directory of.
+// If l was walked to through a tree -exportallow gave read-only, it
+// is read-only too, whatever its path.
+func (l *cpu9p) writable(path string) error {
+	if l.ro {
+		verbose("%v is in a read-only export the remote asked for", path)
+		return errReadOnly
+	}
+	return writable(path)
+}
+
+// exportWalk returns the path that walking to name from the directory
+// dir leads to, and whether it is a tree -exportallow gave read-only.
+// The 9p server turns the attach name into walks from the root of the
+// tree, -root, so a named export is found by walking to its name from
+// -root. An export hides anything in -root of the same name.
+func exportWalk(dir, name string) (string, bool) {
+	if dir == *root {
+		exportMu.RLock()
+		p, ok := exportPaths[name]
+		ro := roExports[name]
+		exportMu.RUnlock()
+		if ok {
+			return p, ro
+		}
+	}
+	return filepath.Join(dir, name), false
+}
+
+// sensitiveDirs are the directories, in $HOME, that warnRoot names as
+// reachable by the remote.
+var sensitiveDirs = []string{".ssh", ".gnupg", ".aws", ".config/gcloud", ".kube", ".docker"}
+
+// warnRoot warns, unless -yes-i-know is set, when the remote gets all
+// of / read-write: -root /, with no -snapshot or -allowpaths to limit
+// it. Anything run on the remote can then read, and change, every file
+// we can, such as the keys in the directories it lists. This is only a
+// warning; cpu goes on.
+func warnRoot() {
+	if *yesIKnow || !nameSpace() || filepath.Clean(*root) != "/" || *snapshot || *allowPaths != "" {
+		return
+	}
+	var found []string
+	home := os.Getenv("HOME")
+	for _, d := range sensitiveDirs {
+		p := filepath.Join(home, d)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() && writable(p) == nil {
+			found = append(found, p)
+		}
+	}
+	log.Printf("WARNING: the remote can read and write all of / on this machine, as you")
+	if len(found) > 0 {
+		log.Printf("WARNING: that includes %s", strings.Join(found, ", "))
+	}
+	log.Printf("WARNING: use -root, -snapshot or -allowpaths to serve less, or -yes-i-know to go without this warning")
+}
@@ -0,0 +1,185 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/cputest"
+)
+
+func TestParseExports(t *testing.T) {
+	defer parseExports(nil)
+	for _, tt := range []struct {
+		exports []string
+		paths   map[string]string
+		ro      []string
+		err     string
+	}{
+		{},
+		{exports: []string{"a=/a"}, paths: map[string]string{"a": "/a"}},
+		{exports: []string{"a:rw=/a"}, paths: map[string]string{"a": "/a"}},
+		{exports: []string{"a:ro=/a", "b=/b/c/"}, paths: map[string]string{"a": "/a", "b": "/b/c"}, ro: []string{"/a"}},
+		{exports: []string{"a"}, err: "want name=path"},
+		{exports: []string{"=/a"}, err: "want name=path"},
+		{exports: []string{"a="}, err: "want name=path"},
+		{exports: []string{":ro=/a"}, err: "no name"},
+		{exports: []string{"a/b=/a"}, err: "can not contain a /"},
+		{exports: []string{"a=/a", "a:ro=/b"}, err: "already exported"},
+		{exports: []string{"a:rx=/a"}, err: "must be ro or rw"},
+		{exports: []string{"a:ro:rw=/a"}, err: "must be ro or rw"},
+	} {
+		err := parseExports(tt.exports)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got %v, want an error with %q", tt.exports, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got %v, want nil", tt.exports, err)
+			continue
+		}
+		if len(exportPaths) != len(tt.paths) {
+			t.Errorf("%q: got %v, want %v", tt.exports, exportPaths, tt.paths)
+		}
+		for n, p := range tt.paths {
+			if exportPaths[n] != p {
+				t.Errorf("%q: %s is %q, want %q", tt.exports, n, exportPaths[n], p)
+			}
+		}
+		if strings.Join(readOnlyPaths, ",") != strings.Join(tt.ro, ",") {
+			t.Errorf("%q: read-only %q, want %q", tt.exports, readOnlyPaths, tt.ro)
+		}
+	}
+}
+
+func TestWritable(t *testing.T) {
+	if err := parseExports([]string{"ro:ro=/ro", "rw=/ro/rw", "x=/x"}); err != nil {
+		t.Fatal(err)
+	}
+	defer parseExports(nil)
+	for _, tt := range []struct {
+		path string
+		want error
+	}{
+		{path: "/ro", want: errReadOnly},
+		{path: "/ro/f", want: errReadOnly},
+		{path: "/ro/rw/f", want: errReadOnly},
+		{path: "/rosy"},
+		{path: "/x/f"},
+		{path: "/"},
+	} {
+		if got := writable(tt.path); got != tt.want {
+			t.Errorf("writable(%q): got %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// TestExportWrites writes, over 9p, to a read-only and a read-write
+// export, and checks that only the read-write one changes.
+func TestExportWrites(t *testing.T) {
+	r := tempRoot(t, nil)
+	defer os.RemoveAll(r)
+	ro := tempRoot(t, map[string]string{"f": "ro"})
+	defer os.RemoveAll(ro)
+	rw := tempRoot(t, map[string]string{"f": "rw"})
+	defer os.RemoveAll(rw)
+	old := *exports
+	*exports = stringList{"ro:ro=" + ro, "rw:rw=" + rw}
+	defer func() { *exports = old; parseExports(old) }()
+
+	// write opens n, in the tree called e, for writing, and writes to
+	// it, or, with create, makes it.
+	write := func(root p9.File, e, n string, create bool) error {
+		_, d, err := root.Walk([]string{e})
+		if err != nil {
+			return fmt.Errorf("walk %q: %v", e, err)
+		}
+		defer d.Close()
+		if create {
+			f, _, _, err := d.Create(n, p9.WriteOnly, 0644, p9.NoUID, p9.NoGID)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+		_, f, err := d.Walk([]string{n})
+		if err != nil {
+			return fmt.Errorf("walk %q: %v", n, err)
+		}
+		defer f.Close()
+		if _, _, err := f.Open(p9.WriteOnly); err != nil {
+			return err
+		}
+		_, err = f.WriteAt([]byte("new"), 0)
+		return err
+	}
+	err := session(t, func(rem *cputest.Remote) error {
+		for _, e := range []string{"ro", "rw"} {
+			for _, create := range []bool{false, true} {
+				n := "f"
+				if create {
+					n = "g"
+				}
+				err := write(rem.Root, e, n, create)
+				switch {
+				case e == "ro" && err == nil:
+					return fmt.Errorf("%s (create %v): a write to a read-only export worked", e, create)
+				case e == "ro" && err.Error() != errReadOnly.Error():
+					return fmt.Errorf("%s (create %v): got %v, want %v", e, create, err, errReadOnly)
+				case e == "rw" && err != nil:
+					return fmt.Errorf("%s (create %v): %v", e, create, err)
+				}
+			}
+		}
+		return nil
+	}, map[string]string{"root": r}, "date")
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+	for _, tt := range []struct {
+		dir, want string
+		g         bool
+	}{
+		{dir: ro, want: "ro"},
+		{dir: rw, want: "new", g: true},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(tt.dir, "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s/f: got %q, want %q", tt.dir, b, tt.want)
+		}
+		if _, err := os.Stat(filepath.Join(tt.dir, "g")); (err == nil) != tt.g {
+			t.Errorf("%s/g: got %v, want it made %v", tt.dir, err, tt.g)
+		}
+	}
+}
+
+// TestExportAllowFlag checks that, with -exportallow, cpud is told it
+// may ask for exports.
+func TestExportAllowFlag(t *testing.T) {
+	r := tempRoot(t, nil)
+	defer os.RemoveAll(r)
+	d := tempRoot(t, nil)
+	defer os.RemoveAll(d)
+	err := session(t, func(rem *cputest.Remote) error {
+		if got := rem.Flags["exportrequests"]; got != "true" {
+			return fmt.Errorf("-exportrequests: got %q, want true", got)
+		}
+		return nil
+	}, map[string]string{"root": r, "exportallow": d}, "date")
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+// fids is the table of the fids the remote holds on us, for -dumpfids:
+// every cpu9p we gave the 9p server, from Attach, Walk or Create, until
+// the server closes it. It is only kept with -dumpfids.
+var fids struct {
+	sync.Mutex
+	m map[*cpu9p]time.Time
+}
+
+// trackFid adds l to the fid table, and returns it.
+func trackFid(l *cpu9p) *cpu9p {
+	if !*fidDump {
+		return l
+	}
+	fids.Lock()
+	defer fids.Unlock()
+	if fids.m == nil {
+		fids.m = map[*cpu9p]time.Time{}
+	}
+	fids.m[l] = time.Now()
+	return l
+}
+
+// setOpen records that l is open, as f, with mode. It takes the fid
+// table's lock, as dumpFids reads both from another goroutine.
+func setOpen(l *cpu9p, f *os.File, mode p9.OpenFlags) {
+	fids.Lock()
+	defer fids.Unlock()
+	l.file, l.mode = f, mode
+}
+
+// untrackFid removes l from the fid table.
+func untrackFid(l *cpu9p) {
+	if !*fidDump {
+		return
+	}
+	fids.Lock()
+	defer fids.Unlock()
+	delete(fids.m, l)
+}
+
+// dumpFids writes the fid table to w, one fid to a line, sorted by
+// path: whether it is open, and how, how long the remote has had it,
+// and the path. Fids that are only walked to are how the remote holds
+// on to a directory or file it has not opened; an open one holds one
+// of our file descriptors.
+func dumpFids(w io.Writer) {
+	type fid struct {
+		path, mode string
+		age        time.Duration
+	}
+	var (
+		l    []fid
+		open int
+	)
+	fids.Lock()
+	for f, t := range fids.m {
+		mode := "walked"
+		if f.file != nil {
+			mode = "open " + f.mode.Mode().String()
+			open++
+		}
+		l = append(l, fid{path: f.path, mode: mode, age: time.Since(t).Round(time.Millisecond)})
+	}
+	fids.Unlock()
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].path != l[j].path {
+			return l[i].path < l[j].path
+		}
+		return l[i].age > l[j].age
+	})
+	fmt.Fprintf(w, "cpu: %d fids, %d open, at %v\n", len(l), open, time.Now().Format(time.RFC3339))
+	for _, f := range l {
+		fmt.Fprintf(w, "%-16s %12v %s\n", f.mode, f.age, f.path)
+	}
+}
+
+// watchFidDump dumps the fid table, to the -dump output or stderr,
+// each time we get SIGUSR1.
+func watchFidDump() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for range c {
+		w := diagOut
+		if dumpWriter != nil {
+			w = dumpWriter
+		}
+		dumpFids(w)
+	}
+}
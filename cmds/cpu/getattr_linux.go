@@ -24,6 +24,7 @@ import (
 //
 // Not fully implemented.
 func (l *cpu9p) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	defer opSlot()()
 	qid, fi, err := l.info()
 	if err != nil {
 		return qid, p9.AttrMask{}, p9.Attr{}, err
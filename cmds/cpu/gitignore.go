@@ -0,0 +1,229 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -gitignore serves a git working tree without what its .gitignore
+// files ignore, such as build output, as git status would. The
+// .gitignore in each directory, from the top of the tree the path is
+// in, -root or an -export, down to it, applies to what is below that
+// directory, and one further down wins over one above it; in each,
+// the last pattern that matches wins, so a !pattern can let back in
+// what one before it ignored. As in git, nothing can be let back in
+// below a directory that is ignored, a directory with a .git in it
+// starts afresh, with its .git/info/exclude under its .gitignore, and
+// nothing in .git is ever ignored.
+
+// ignorePattern is one line of a .gitignore.
+type ignorePattern struct {
+	segs     []string // the pattern, split at each /
+	negate   bool     // it started with a !
+	dirOnly  bool     // it ended with a /, so only matches directories
+	anyDepth bool     // it had no other /, so matches a name at any level
+}
+
+// ignoreDir is what a directory adds to the patterns below it.
+type ignoreDir struct {
+	mod  time.Time // of its .gitignore, to see when it changes
+	size int64     // of its .gitignore, or -1 if there is none
+	repo bool      // it has a .git, so starts afresh
+	pats []ignorePattern
+}
+
+var (
+	ignoreMu   sync.Mutex
+	ignoreDirs = map[string]*ignoreDir{}
+)
+
+// parseIgnore parses the lines of a .gitignore, or .git/info/exclude.
+func parseIgnore(b []byte) []ignorePattern {
+	var pats []ignorePattern
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSuffix(l, "\r")
+		for strings.HasSuffix(l, " ") && !strings.HasSuffix(l, `\ `) {
+			l = l[:len(l)-1]
+		}
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		var p ignorePattern
+		switch {
+		case l[0] == '!':
+			p.negate, l = true, l[1:]
+		case strings.HasPrefix(l, `\!`), strings.HasPrefix(l, `\#`):
+			l = l[1:]
+		}
+		if strings.HasSuffix(l, "/") {
+			p.dirOnly, l = true, strings.TrimRight(l, "/")
+		}
+		if l == "" {
+			continue
+		}
+		p.anyDepth = !strings.Contains(l, "/")
+		l = strings.ReplaceAll(strings.TrimPrefix(l, "/"), "[!", "[^")
+		p.segs = strings.Split(l, "/")
+		pats = append(pats, p)
+	}
+	return pats
+}
+
+// matchSegs reports whether the names match the pattern segments, where
+// a ** matches any number of names, and, at the end, at least one.
+func matchSegs(pat, names []string) bool {
+	for ; len(pat) > 0; pat, names = pat[1:], names[1:] {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				return len(names) > 0
+			}
+			for i := range names {
+				if matchSegs(pat[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], names[0]); !ok {
+			return false
+		}
+	}
+	return len(names) == 0
+}
+
+// match reports whether p matches the path whose names, from the
+// directory of the .gitignore p is in, are rel.
+func (p *ignorePattern) match(rel []string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	if p.anyDepth {
+		ok, _ := path.Match(p.segs[0], rel[len(rel)-1])
+		return ok
+	}
+	return matchSegs(p.segs, rel)
+}
+
+// ignoresIn returns what the directory d adds to the patterns, read
+// again if its .gitignore has changed.
+func ignoresIn(d string) *ignoreDir {
+	mod, size := time.Time{}, int64(-1)
+	if fi, err := os.Stat(filepath.Join(d, ".gitignore")); err == nil {
+		mod, size = fi.ModTime(), fi.Size()
+	}
+	ignoreMu.Lock()
+	i := ignoreDirs[d]
+	ignoreMu.Unlock()
+	if i != nil && i.mod.Equal(mod) && i.size == size {
+		return i
+	}
+	i = &ignoreDir{mod: mod, size: size}
+	if _, err := os.Lstat(filepath.Join(d, ".git")); err == nil {
+		i.repo = true
+		if b, err := ioutil.ReadFile(filepath.Join(d, ".git", "info", "exclude")); err == nil {
+			i.pats = parseIgnore(b)
+		}
+	}
+	if size >= 0 {
+		if b, err := ioutil.ReadFile(filepath.Join(d, ".gitignore")); err == nil {
+			i.pats = append(i.pats, parseIgnore(b)...)
+		}
+	}
+	ignoreMu.Lock()
+	ignoreDirs[d] = i
+	ignoreMu.Unlock()
+	return i
+}
+
+// ignoreTop returns the top of the tree the local path n is in, for
+// -gitignore: the shortest of -root and the -export trees that holds
+// it, so that a path is ignored, or not, however it was walked to.
+func ignoreTop(n string) string {
+	top := string(filepath.Separator)
+	found := false
+	try := func(t string) {
+		r, err := filepath.Rel(t, n)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			return
+		}
+		if !found || len(t) < len(top) {
+			top, found = t, true
+		}
+	}
+	try(*root)
+	exportMu.RLock()
+	for _, p := range exportPaths {
+		try(p)
+	}
+	exportMu.RUnlock()
+	return top
+}
+
+// gitIgnored reports whether -gitignore hides the local path n, which
+// is a directory if dir is set. Each directory above n is looked at on
+// the way down, since what is below an ignored one is ignored too.
+func gitIgnored(n string, dir bool) bool {
+	if !*gitIgnore {
+		return false
+	}
+	top := ignoreTop(n)
+	r, err := filepath.Rel(top, n)
+	if err != nil || r == "." {
+		return false
+	}
+	names := strings.Split(r, string(filepath.Separator))
+	type from struct {
+		base int // where, in names, the directory of the patterns is
+		pats []ignorePattern
+	}
+	var froms []from
+	d := top
+	for i, name := range names {
+		if name == ".git" {
+			return false
+		}
+		id := ignoresIn(d)
+		if id.repo {
+			froms = nil
+		}
+		if len(id.pats) > 0 {
+			froms = append(froms, from{base: i, pats: id.pats})
+		}
+		isDir := dir || i < len(names)-1
+		ignored := false
+		for _, f := range froms {
+			for j := range f.pats {
+				if p := &f.pats[j]; p.match(names[f.base:i+1], isDir) {
+					ignored = !p.negate
+				}
+			}
+		}
+		if ignored {
+			v("gitignore: %q is ignored", n)
+			return true
+		}
+		d = filepath.Join(d, name)
+	}
+	return false
+}
+
+// gitIgnoredPath is gitIgnored, for a path whose kind is not known.
+func gitIgnoredPath(n string) bool {
+	if !*gitIgnore {
+		return false
+	}
+	fi, err := os.Lstat(n)
+	return gitIgnored(n, err == nil && fi.IsDir())
+}
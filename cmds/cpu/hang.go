@@ -0,0 +1,80 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/u-root/u-root/pkg/termios"
+)
+
+var (
+	// cmdStarted is closed once the remote command has started.
+	cmdStarted     = make(chan struct{})
+	cmdStartedOnce sync.Once
+	// mounted is closed once the remote has mounted us, i.e. the
+	// 9p nonce handshake is done.
+	mounted     = make(chan struct{})
+	mountedOnce sync.Once
+
+	// savedTerm is the terminal as it was when we started, so that
+	// watchHang can put it back before it gives up.
+	savedTerm *termios.Termios
+)
+
+func started() {
+	cmdStartedOnce.Do(func() { close(cmdStarted) })
+}
+
+func mountDone() {
+	mountedOnce.Do(func() { close(mounted) })
+}
+
+// watchHang is -hangtimeout. If, after d, the remote command has not
+// started or, if namespace is set, the remote has not mounted us, it
+// writes the stacks of all goroutines to the -dump output, or stderr,
+// and exits. Most hangs people see are in the 9p handshake, and the
+// stacks show where.
+func watchHang(d time.Duration, namespace bool) {
+	t := time.After(d)
+	for _, c := range []chan struct{}{cmdStarted, mounted} {
+		if c == mounted && !namespace {
+			continue
+		}
+		select {
+		case <-c:
+		case <-t:
+			dumpStacks(d)
+		}
+	}
+}
+
+func dumpStacks(d time.Duration) {
+	if savedTerm != nil {
+		if err := termios.SetTermios(0, savedTerm); err != nil {
+			log.Print(err)
+		}
+	}
+	b := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(b, true)
+		if n < len(b) {
+			b = b[:n]
+			break
+		}
+		b = make([]byte, 2*len(b))
+	}
+	w := diagOut
+	if dumpWriter != nil {
+		w = dumpWriter
+	}
+	fmt.Fprintf(w, "cpu: session not running after %v; all goroutines:\n%s\n", d, b)
+	flushDump()
+	log.Fatalf("Session did not start within %v; please include the goroutine stacks in any report", d)
+}
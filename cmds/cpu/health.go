@@ -0,0 +1,172 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// healthEvery is how often -healthline checks the connection.
+	healthEvery = 5 * time.Second
+	// healthQuiet is how long the remote's output must have stopped
+	// for before -healthline draws, so that it does not land in the
+	// middle of something the remote is drawing.
+	healthQuiet = 300 * time.Millisecond
+)
+
+// healthLine is -healthline: a line, at the bottom of the terminal,
+// that says how the connection is. The remote's pty is one row
+// shorter than the terminal, and the rows above the line are set to
+// scroll on their own, so the remote never writes to it.
+type healthLine struct {
+	mu    sync.Mutex
+	w     io.Writer
+	row   int       // the terminal's last row, ours; 0 if it is too small to spare one
+	last  time.Time // when the remote last wrote
+	shown string    // what we last drew
+	done  chan struct{}
+}
+
+// startHealth takes the last of the rows of the terminal w, and starts
+// checking cl, and showing what it finds there. The remote's output
+// must be written through the healthLine, so that what we draw never
+// lands in the middle of it.
+func startHealth(cl *ossh.Client, w io.Writer, rows int) *healthLine {
+	h := &healthLine{w: w, row: rows, done: make(chan struct{})}
+	// Make sure there is a free line at the bottom, then keep the
+	// remote to the rows above it. Setting them moves the cursor,
+	// so it is saved and restored around that.
+	fmt.Fprintf(w, "\n\x1b[1A\x1b7\x1b[1;%dr\x1b8", rows-1)
+	h.draw("cpu: checking the connection")
+	go h.run(cl)
+	return h
+}
+
+// Write writes the remote's output b to the terminal.
+func (h *healthLine) Write(b []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Now()
+	return h.w.Write(b)
+}
+
+// draw writes s on our line, in reverse video, and puts the cursor,
+// and the attributes, back as they were.
+func (h *healthLine) draw(s string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shown = s
+	if h.row > 0 {
+		fmt.Fprintf(h.w, "\x1b7\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", h.row, s)
+	}
+}
+
+// resize moves our line to the last of the rows of the resized
+// terminal, and returns how many rows the remote gets. A terminal of
+// two rows or fewer can not spare one, so we give ours up, and take it
+// back when the terminal grows again.
+func (h *healthLine) resize(rows int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rows <= 2 {
+		if h.row > 0 {
+			fmt.Fprint(h.w, "\x1b7\x1b[r\x1b8")
+		}
+		h.row = 0
+		return rows
+	}
+	h.row = rows
+	fmt.Fprintf(h.w, "\x1b7\x1b[1;%dr\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", rows-1, rows, h.shown)
+	return rows - 1
+}
+
+// quiet reports whether the remote has not written for healthQuiet.
+func (h *healthLine) quiet() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.last) >= healthQuiet
+}
+
+// run checks the connection every healthEvery, with an ssh keepalive,
+// and draws what it found, once the remote's output is quiet. A server
+// answers a keepalive, even one it does not know, so the time the
+// answer takes is the round trip.
+func (h *healthLine) run(cl *ossh.Client) {
+	st := make(chan string)
+	send := func(s string) bool {
+		select {
+		case st <- s:
+			return true
+		case <-h.done:
+			return false
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-time.After(healthEvery):
+			}
+			t := time.Now()
+			r := make(chan error, 1)
+			go func() {
+				_, _, err := cl.SendRequest("keepalive@openssh.com", true, nil)
+				r <- err
+			}()
+			var s string
+			for s == "" {
+				select {
+				case <-h.done:
+					return
+				case err := <-r:
+					s = fmt.Sprintf("cpu: connection ok, %v round trip, at %s", time.Since(t).Round(100*time.Microsecond), time.Now().Format("15:04:05"))
+					if err != nil {
+						s = fmt.Sprintf("cpu: connection lost: %v", err)
+					}
+				case <-time.After(healthEvery):
+					if !send(fmt.Sprintf("cpu: no answer from the host for %v", time.Since(t).Round(time.Second))) {
+						return
+					}
+				}
+			}
+			if !send(s) {
+				return
+			}
+		}
+	}()
+	tick := time.NewTicker(healthQuiet / 2)
+	defer tick.Stop()
+	var pending string
+	for {
+		select {
+		case <-h.done:
+			return
+		case pending = <-st:
+		case <-tick.C:
+			if pending != "" && h.quiet() {
+				h.draw(pending)
+				pending = ""
+			}
+		}
+	}
+}
+
+// stop stops the checks and gives the terminal back all its rows,
+// with our line cleared.
+func (h *healthLine) stop() {
+	close(h.done)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.row > 0 {
+		fmt.Fprintf(h.w, "\x1b7\x1b[%d;1H\x1b[2K\x1b[r\x1b8", h.row)
+	}
+}
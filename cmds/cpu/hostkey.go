@@ -0,0 +1,152 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	ossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHosts is the file -o StrictHostKeyChecking checks host keys
+// against, the same one ssh uses.
+var knownHosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+
+// sshOption returns the value of the -o option named name, or def
+// if it is not given. As for ssh, names are not case sensitive and
+// the value may follow an = or a space. Only the options cpu knows
+// are accepted; anything else is an error rather than quietly not
+// doing what was asked.
+func sshOption(name, def string) (string, error) {
+	v := def
+	for _, o := range *sshOpts {
+		kv := strings.SplitN(strings.Replace(o, " ", "=", 1), "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("-o %q: want name=value", o)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "stricthostkeychecking":
+		default:
+			return "", fmt.Errorf("-o %q: only StrictHostKeyChecking is supported", o)
+		}
+		if strings.EqualFold(kv[0], name) {
+			v = kv[1]
+		}
+	}
+	return v, nil
+}
+
+// strictHostKeys returns the host key callback for
+// -o StrictHostKeyChecking, which works as it does for ssh. With no,
+// the default, host keys are not checked at all. With yes, the host
+// must be in known_hosts, with this key. With accept-new, a host that
+// is not in known_hosts is added to it, but one that is there must
+// have the same key. -hk, if set, wins over all of these.
+func strictHostKeys() (ossh.HostKeyCallback, error) {
+	mode, err := sshOption("StrictHostKeyChecking", "no")
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(mode) {
+	case "no", "off":
+		return ossh.InsecureIgnoreHostKey(), nil
+	case "yes", "accept-new":
+	default:
+		return nil, fmt.Errorf("StrictHostKeyChecking %q: must be yes, no or accept-new", mode)
+	}
+	var files []string
+	if _, err := os.Stat(knownHosts); err == nil {
+		files = append(files, knownHosts)
+	}
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(mode) == "yes" {
+		return cb, nil
+	}
+	var mu sync.Mutex
+	return func(h string, r net.Addr, k ossh.PublicKey) error {
+		err := cb(h, r, k)
+		var ke *knownhosts.KeyError
+		if !errors.As(err, &ke) || len(ke.Want) != 0 {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := addKnownHost(h, k); err != nil {
+			return fmt.Errorf("adding %v to %v: %v", h, knownHosts, err)
+		}
+		log.Printf("Permanently added %v (%v) to the list of known hosts", h, k.Type())
+		return nil
+	}, nil
+}
+
+// addKnownHost appends the key k for the host h to knownHosts.
+func addKnownHost(h string, k ossh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(knownHosts), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(h)}, k)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hostKeyAlgs are the host key algorithms the ssh package can check,
+// in its order of preference.
+var hostKeyAlgs = []string{
+	ossh.CertAlgoRSAv01, ossh.CertAlgoDSAv01, ossh.CertAlgoECDSA256v01,
+	ossh.CertAlgoECDSA384v01, ossh.CertAlgoECDSA521v01, ossh.CertAlgoED25519v01,
+	ossh.KeyAlgoECDSA256, ossh.KeyAlgoECDSA384, ossh.KeyAlgoECDSA521,
+	ossh.KeyAlgoRSA, ossh.KeyAlgoDSA,
+	ossh.KeyAlgoED25519,
+}
+
+// hostKeyAlgorithms returns the host key algorithms -hostkeyalgs
+// names, in its order, or nil, for the ssh package's, if it is not
+// set. As with ssh's HostKeyAlgorithms, a list that starts with a ^
+// goes ahead of the others, rather than in place of them, so the
+// server still has something to offer if it has none of these.
+func hostKeyAlgorithms() ([]string, error) {
+	if *hostKeyAlg == "" {
+		return nil, nil
+	}
+	s := *hostKeyAlg
+	first := strings.HasPrefix(s, "^")
+	s = strings.TrimPrefix(s, "^")
+	var l []string
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if !contains(hostKeyAlgs, a) {
+			return nil, fmt.Errorf("hostkeyalgs: %q is not one of %s", a, strings.Join(hostKeyAlgs, ", "))
+		}
+		if !contains(l, a) {
+			l = append(l, a)
+		}
+	}
+	if first {
+		for _, a := range hostKeyAlgs {
+			if !contains(l, a) {
+				l = append(l, a)
+			}
+		}
+	}
+	v("hostkeyalgs: offering %s", strings.Join(l, ", "))
+	return l, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// A hop is one of the -J jump hosts.
+type hop struct {
+	user string // empty means the same user as for the cpu host
+	addr string // host:port
+}
+
+// parseJumps parses the -J list, [user@]host[:port][,...].
+// The port defaults to 22, since jump hosts run an ordinary sshd,
+// not cpud.
+// Each hop has its own user, since bastions in different places
+// seldom agree on what we are called.
+func parseJumps(s string) ([]hop, error) {
+	var hops []hop
+	for _, j := range strings.Split(s, ",") {
+		var h hop
+		if i := strings.LastIndex(j, "@"); i >= 0 {
+			h.user, j = j[:i], j[i+1:]
+			if h.user == "" {
+				return nil, fmt.Errorf("jump host %q: empty user", j)
+			}
+		}
+		if j == "" {
+			return nil, fmt.Errorf("jump list %q: empty host", s)
+		}
+		if _, _, err := net.SplitHostPort(j); err != nil {
+			j = net.JoinHostPort(strings.Trim(j, "[]"), "22")
+		}
+		h.addr = j
+		hops = append(hops, h)
+	}
+	return hops, nil
+}
+
+// dialJumps reaches a, the cpu host, through the -J jump hosts.
+// The first hop is dialed as any host would be; each hop after that,
+// and finally a, is reached through a direct-tcpip channel of the
+// hop before. All hops use the keys of config but each may have
+// its own user.
+// The hop clients stay open for as long as the session does.
+func dialJumps(n, a string, config *ossh.ClientConfig) (*ossh.Client, error) {
+	hops, err := parseJumps(*jump)
+	if err != nil {
+		return nil, err
+	}
+	var cl *ossh.Client
+	for _, h := range hops {
+		hc := h.config(config)
+		v("jump through %s@%s", hc.User, h.addr)
+		if cl, err = dialVia(cl, n, h.addr, hc); err != nil {
+			return nil, fmt.Errorf("jump host %v: %v", h.addr, err)
+		}
+	}
+	return dialVia(cl, n, a, config)
+}
+
+// config returns the config to log in to the hop with: config, the
+// one for the cpu host, with the hop's own user, if it has one.
+func (h hop) config(config *ossh.ClientConfig) *ossh.ClientConfig {
+	hc := *config
+	if h.user != "" {
+		hc.User = h.user
+	}
+	return &hc
+}
+
+// dialVia makes an ssh client for a, through the client via,
+// or directly if via is nil.
+func dialVia(via *ossh.Client, n, a string, config *ossh.ClientConfig) (*ossh.Client, error) {
+	if via == nil {
+		return dial(n, a, config)
+	}
+	conn, err := via.Dial("tcp", a)
+	if err != nil {
+		return nil, dialErr(err, config.User, false)
+	}
+	return sshClient(conn, a, config)
+}
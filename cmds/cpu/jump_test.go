@@ -0,0 +1,74 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseJumps(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []hop
+		err  bool
+	}{
+		{in: "bastion", want: []hop{{addr: "bastion:22"}}},
+		{in: "me@bastion:2222", want: []hop{{user: "me", addr: "bastion:2222"}}},
+		{in: "a@b@bastion", want: []hop{{user: "a@b", addr: "bastion:22"}}},
+		{in: "[::1]", want: []hop{{addr: "[::1]:22"}}},
+		{in: "[::1]:2222", want: []hop{{addr: "[::1]:2222"}}},
+		{
+			in:   "alice@outer.example.com,bob@inner:2200",
+			want: []hop{{user: "alice", addr: "outer.example.com:22"}, {user: "bob", addr: "inner:2200"}},
+		},
+		{in: "", err: true},
+		{in: "a,,b", err: true},
+		{in: "@bastion", err: true},
+		{in: "me@", err: true},
+	} {
+		got, err := parseJumps(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseJumps(%q): got %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseJumps(%q): got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestJumpConfigs checks that each hop of a two-hop chain logs in as
+// its own user, and the cpu host as ours, all with the same keys and
+// host key check.
+func TestJumpConfigs(t *testing.T) {
+	hops, err := parseJumps("alice@outer,inner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ossh.ClientConfig{
+		User:            "me",
+		Auth:            []ossh.AuthMethod{ossh.Password("x")},
+		HostKeyCallback: ossh.InsecureIgnoreHostKey(),
+		Ciphers:         []string{"aes256-ctr"},
+	}
+	for i, want := range []string{"alice", "me"} {
+		hc := hops[i].config(config)
+		if hc == config {
+			t.Errorf("hop %d: got the cpu host's config, want a copy", i)
+		}
+		if hc.User != want {
+			t.Errorf("hop %d (%s): user %q, want %q", i, hops[i].addr, hc.User, want)
+		}
+		if len(hc.Auth) != 1 || hc.HostKeyCallback == nil || !reflect.DeepEqual(hc.Ciphers, config.Ciphers) {
+			t.Errorf("hop %d: got %+v, want the cpu host's auth, host key check and ciphers", i, hc)
+		}
+	}
+	if config.User != "me" {
+		t.Errorf("the cpu host's user: got %q after the hops, want %q", config.User, "me")
+	}
+}
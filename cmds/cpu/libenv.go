@@ -0,0 +1,87 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// libVars are the variables -libenv is about: those that tell the
+// dynamic linker, or pkg-config, where to look, which name our paths.
+var libVars = []string{"LD_LIBRARY_PATH", "LD_PRELOAD", "LD_AUDIT", "PKG_CONFIG_PATH", "DYLD_LIBRARY_PATH", "DYLD_INSERT_LIBRARIES"}
+
+// libEnvMode returns what -libenv says to do with libVars: keep,
+// drop or remap. With no -libenv, they are dropped when the remote
+// gets all of our /, and kept otherwise.
+func libEnvMode() string {
+	if *libPaths != "" {
+		return *libPaths
+	}
+	if nameSpace() && filepath.Clean(*root) == "/" {
+		return "drop"
+	}
+	return "keep"
+}
+
+// checkLibEnv checks -libenv and -keepenv.
+func checkLibEnv() error {
+	switch *libPaths {
+	case "", "keep", "drop", "remap":
+	default:
+		return fmt.Errorf("libenv %q: want keep, drop or remap", *libPaths)
+	}
+	for _, n := range strings.Split(*keepEnv, ",") {
+		if n != "" && !contains(libVars, n) {
+			return fmt.Errorf("keepenv: %q is not one of %s", n, strings.Join(libVars, ", "))
+		}
+	}
+	return nil
+}
+
+// libEnv returns our environment, e, with libVars, other than those
+// in -keepenv, dropped or remapped as -libenv says. They name our
+// paths, which on the remote are other files, or none: the remote's
+// programs, loading the remote's libraries from where ours are here,
+// can fail to start, or crash. Remapped, each path is put under
+// /tmp/cpu, where the remote sees our files, for running our own
+// programs there.
+func libEnv(e []string) []string {
+	m := libEnvMode()
+	if m == "keep" {
+		return e
+	}
+	var r []string
+	for _, kv := range e {
+		c := strings.SplitN(kv, "=", 2)
+		if !contains(libVars, c[0]) || contains(strings.Split(*keepEnv, ","), c[0]) {
+			r = append(r, kv)
+			continue
+		}
+		if m == "drop" || len(c) == 1 {
+			v("libenv: not sending %s", c[0])
+			continue
+		}
+		kv = c[0] + "=" + remapPaths(c[1])
+		v("libenv: sending %s", kv)
+		r = append(r, kv)
+	}
+	return r
+}
+
+// remapPaths puts each absolute path in the list l under /tmp/cpu.
+// The paths may be separated by colons or, as LD_PRELOAD allows,
+// spaces; the list that comes back is separated by colons.
+func remapPaths(l string) string {
+	var r []string
+	for _, p := range strings.FieldsFunc(l, func(c rune) bool { return c == ':' || c == ' ' }) {
+		if filepath.IsAbs(p) {
+			p = filepath.Join("/tmp/cpu", p)
+		}
+		r = append(r, p)
+	}
+	return strings.Join(r, ":")
+}
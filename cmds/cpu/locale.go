@@ -0,0 +1,61 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isLocaleVar reports whether the variable name is one -locale is
+// about: LANG, LANGUAGE, an LC_ variable or TZ.
+func isLocaleVar(name string) bool {
+	return name == "LANG" || name == "LANGUAGE" || name == "TZ" || strings.HasPrefix(name, "LC_")
+}
+
+// localZone returns the name of our time zone, e.g. Europe/Berlin, from
+// the link /etc/localtime is to a zoneinfo file, or from /etc/timezone,
+// or "" if we can not tell.
+func localZone() string {
+	if l, err := filepath.EvalSymlinks("/etc/localtime"); err == nil {
+		if i := strings.Index(l, "/zoneinfo/"); i >= 0 {
+			return l[i+len("/zoneinfo/"):]
+		}
+	}
+	if b, err := ioutil.ReadFile("/etc/timezone"); err == nil {
+		return strings.TrimSpace(string(b))
+	}
+	return ""
+}
+
+// localeEnv returns what -locale adds to the environment the remote
+// gets. Our locale variables go along with the rest of our environment
+// anyway; what we add is TZ, if it is not set, from the zone this
+// machine is in, so that the remote, which may be in another zone, or
+// have none set, shows times as we would. It logs, with -d, the locale
+// variables the remote gets.
+func localeEnv() []string {
+	var (
+		e    []string
+		sent []string
+	)
+	for _, kv := range os.Environ() {
+		if isLocaleVar(strings.SplitN(kv, "=", 2)[0]) {
+			sent = append(sent, kv)
+		}
+	}
+	if _, ok := os.LookupEnv("TZ"); !ok {
+		if z := localZone(); z != "" {
+			e = append(e, "TZ="+z)
+			sent = append(sent, "TZ="+z)
+		} else {
+			v("locale: can not tell our time zone; not setting TZ")
+		}
+	}
+	v("locale: the remote gets %q", sent)
+	return e
+}
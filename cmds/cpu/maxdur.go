@@ -0,0 +1,90 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// maxDurGrace is how long the remote command has, once -maxduration
+// is up and it has been sent SIGTERM, to exit before the session is
+// closed on it.
+const maxDurGrace = 5 * time.Second
+
+// ErrMaxDuration is the error a session ended by -maxduration ends
+// with; cpu then exits 124, as timeout(1) does.
+var ErrMaxDuration = errors.New("the session ran for -maxduration")
+
+var (
+	// sessionEnd is when -maxduration is up; zero if it is not set.
+	sessionEnd time.Time
+	// durUp is 1 once -maxduration has ended the session.
+	durUp int32
+)
+
+// checkMaxDuration parses -maxduration and starts the clock: the limit
+// is on the whole of the session, from connecting to the end, the
+// shell after -then-interactive included.
+func checkMaxDuration() error {
+	if *maxDur == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(*maxDur)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("maxduration %q: want a positive duration, e.g. 2h", *maxDur)
+	}
+	sessionEnd = time.Now().Add(d)
+	return nil
+}
+
+// limitSession ends s when -maxduration is up, however busy it is:
+// it says so, sends the remote command SIGTERM, so that it can clean
+// up, and, if it has not exited maxDurGrace later, closes the session,
+// so that shell returns and puts the terminal back as it was. The
+// returned function stops the clock.
+func limitSession(s *ossh.Session) func() {
+	if sessionEnd.IsZero() {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-time.After(time.Until(sessionEnd)):
+		case <-done:
+			return
+		}
+		atomic.StoreInt32(&durUp, 1)
+		// In raw mode a newline does not return the carriage.
+		nl := "\r\n"
+		if *noTerm {
+			nl = "\n"
+		}
+		fmt.Fprintf(diagOut, "%scpu: -maxduration %v is up; ending the session%s", nl, *maxDur, nl)
+		if err := s.Signal(ossh.SIGTERM); err != nil {
+			v("maxduration: SIGTERM: %v", err)
+		}
+		select {
+		case <-time.After(maxDurGrace):
+			v("maxduration: the remote did not exit within %v of SIGTERM; closing the session", maxDurGrace)
+			s.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// durationErr is err, or, if -maxduration ended the session, an
+// error that says so, whatever the remote command exited with.
+func durationErr(err error) error {
+	if atomic.LoadInt32(&durUp) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w, %v, and was ended", ErrMaxDuration, *maxDur)
+}
@@ -0,0 +1,52 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// envRank is how much we want the variable kv to get to the remote,
+// when -maxenv means not all of them can: 0 for the ones cpud needs,
+// CPU_NAMESPACE and the like, 1 for TERM and the locale, which it is
+// confusing to lose, and 2 for the rest.
+func envRank(kv string) int {
+	name := strings.SplitN(kv, "=", 2)[0]
+	switch {
+	case strings.HasPrefix(name, "CPU"):
+		return 0
+	case name == "TERM" || isLocaleVar(name):
+		return 1
+	}
+	return 2
+}
+
+// limitEnv returns the variables of e, our environment followed by
+// the last own, which are cpu's own, e.g. CPUNONCE, that -maxenv lets
+// us send. Some sshds drop the variables past a limit, and say
+// nothing, so that which get through is up to chance; -maxenv makes
+// it ours. cpu's own always go, since the session does not work
+// without them; then the others by envRank, and in the order of our
+// environment within a rank. We say which variables we did not send.
+func limitEnv(e []string, own int) []string {
+	if *maxEnv <= 0 || len(e) <= *maxEnv {
+		return e
+	}
+	mine, rest := e[len(e)-own:], append([]string(nil), e[:len(e)-own]...)
+	sort.SliceStable(rest, func(i, j int) bool { return envRank(rest[i]) < envRank(rest[j]) })
+	n := *maxEnv - len(mine)
+	if n < 0 {
+		log.Printf("Warning: -maxenv %d is less than the %d variables cpu needs to send; sending them anyway", *maxEnv, len(mine))
+		n = 0
+	}
+	var dropped []string
+	for _, kv := range rest[n:] {
+		dropped = append(dropped, strings.SplitN(kv, "=", 2)[0])
+	}
+	log.Printf("Warning: -maxenv %d: not sending %s", *maxEnv, strings.Join(dropped, ", "))
+	return append(rest[:n:n], mine...)
+}
@@ -0,0 +1,47 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// mountCheck runs -mountcheck on the remote, in a namespace of its own
+// set up just as the session's will be, from the same export, and
+// returns an error if it fails, so that a wrong -root or -aname is
+// caught before the session starts, rather than part way into a build.
+// base is the remote command, with the -aname.
+func mountCheck(cl *ossh.Client, e *export, base string, deadline time.Duration) error {
+	var (
+		n   nonce
+		env []string
+		fl  string
+		nf  string
+		err error
+	)
+	if !*noNonce {
+		if n, err = generateNonce(); err != nil {
+			return err
+		}
+		if env, fl, nf, err = sendNonce(cl, n); err != nil {
+			return err
+		}
+	}
+	l, port, err := listenRemote(cl, remotePort9p())
+	if err != nil {
+		return err
+	}
+	go e.srvCheck(l, n, deadline, tearingDown)
+	c := fmt.Sprintf("%s%s -port9p %v %q", base, fl, port, *mntCheck)
+	_, err = cmdPriv(cl, c, env...)
+	if err = noNonceFile(cl, nf, err); err != nil {
+		return &MountError{Err: fmt.Errorf("mountcheck %q failed on the remote, so our files there may not be what you expect; check -root, -aname and -export: %v", *mntCheck, err)}
+	}
+	verbose("mountcheck: %q succeeded", *mntCheck)
+	return nil
+}
@@ -0,0 +1,500 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/termios"
+)
+
+// -controlpath runs the session over the connection of an OpenSSH
+// ControlMaster, e.g. one started by ssh -M -S path, with the
+// multiplexing protocol OpenSSH's own ssh -S uses, described in its
+// PROTOCOL.mux. There is no login of our own: the master has the
+// connection, and its ssh_config, e.g. for the key or -J, are what
+// apply. cpu asks the master to forward a port on the remote to a Unix
+// socket of ours, for 9p, and for a session running cpud, to which it
+// hands our stdin, stdout and stderr, as ssh -S does, so that the
+// master does the session's I/O itself.
+//
+// The master sends the session only the variables its SendEnv allows,
+// so the nonce goes on cpud's command line, as with -noncemode arg,
+// unless -noncemode env is asked for, and the master's SendEnv has
+// CPUNONCE. What needs an ssh connection of our own,
+// or to see the session's I/O, can not be used with it.
+
+// The OpenSSH mux protocol's messages, and version.
+const (
+	muxVersion = 4
+
+	muxHello        = 0x00000001
+	muxNewSession   = 0x10000002
+	muxAliveCheck   = 0x10000004
+	muxOpenFwd      = 0x10000006
+	muxCloseFwd     = 0x10000007
+	muxOK           = 0x80000001
+	muxDenied       = 0x80000002
+	muxFailure      = 0x80000003
+	muxExit         = 0x80000004
+	muxAlive        = 0x80000005
+	muxOpened       = 0x80000006
+	muxRemotePort   = 0x80000007
+	muxTTYAllocFail = 0x80000008
+
+	muxFwdRemote = 2
+	// muxStreamLocal is the port of a forward to a Unix socket.
+	muxStreamLocal = 0xfffffffe
+	// muxNoEscape is the escape character for none.
+	muxNoEscape = 0xfffffffe
+)
+
+// muxFlags are the flags -controlpath can not be used with, since
+// they need an ssh connection of our own, or to see the session's I/O.
+var muxFlags = []string{
+	"9premount", "J", "bench", "binsha256", "connfd", "detach", "exportallow",
+	"forwardsignals", "healthline", "httpproxy", "maxduration",
+	"mountcheck", "pager", "pidfile", "pushbin", "requirearch",
+	"requireos", "rusage", "setupkey", "socks", "subsystem", "sudo",
+	"then-interactive", "verify9p",
+}
+
+// checkMux returns an error if -controlpath is used with a flag it can
+// not be used with. Unless -noncemode is set, it is arg, since few
+// masters' SendEnv would pass on $CPUNONCE.
+func checkMux() error {
+	var bad []string
+	modeSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if contains(muxFlags, f.Name) {
+			bad = append(bad, "-"+f.Name)
+		}
+		modeSet = modeSet || f.Name == "noncemode"
+	})
+	if !modeSet {
+		*nonceMode = "arg"
+	}
+	if *nonceMode == "file" {
+		bad = append(bad, "-noncemode file")
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("controlpath: can not be used with %s", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// muxMsg builds a mux message.
+type muxMsg struct {
+	bytes.Buffer
+}
+
+func (m *muxMsg) u32(i uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], i)
+	m.Write(b[:])
+}
+
+func (m *muxMsg) str(s string) {
+	m.u32(uint32(len(s)))
+	m.WriteString(s)
+}
+
+// muxReply takes a mux message apart.
+type muxReply struct {
+	b   []byte
+	err error
+}
+
+func (r *muxReply) u32() uint32 {
+	if len(r.b) < 4 {
+		r.err = fmt.Errorf("short message from the master")
+		return 0
+	}
+	i := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return i
+}
+
+func (r *muxReply) str() string {
+	n := r.u32()
+	if uint32(len(r.b)) < n {
+		r.err = fmt.Errorf("short message from the master")
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// A muxConn is a connection to the master's control socket.
+type muxConn struct {
+	c  *net.UnixConn
+	id uint32 // the last request id
+}
+
+// dialMux connects to the control socket path, and says hello.
+func dialMux(path string) (*muxConn, error) {
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	m := &muxConn{c: c}
+	var h muxMsg
+	h.u32(muxHello)
+	h.u32(muxVersion)
+	if err := m.send(&h); err != nil {
+		c.Close()
+		return nil, err
+	}
+	r, err := m.recv()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if t, ver := r.u32(), r.u32(); r.err != nil || t != muxHello || ver != muxVersion {
+		c.Close()
+		return nil, fmt.Errorf("%v is not an OpenSSH control socket of mux protocol version %d", path, muxVersion)
+	}
+	return m, nil
+}
+
+// send sends m, with its length.
+func (m *muxConn) send(msg *muxMsg) error {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(msg.Len()))
+	if _, err := m.c.Write(append(l[:], msg.Bytes()...)); err != nil {
+		return fmt.Errorf("writing to the master: %v", err)
+	}
+	return nil
+}
+
+// recv reads one message.
+func (m *muxConn) recv() (*muxReply, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(m.c, l[:]); err != nil {
+		return nil, fmt.Errorf("reading from the master: %v", err)
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > 256<<10 {
+		return nil, fmt.Errorf("reading from the master: a message of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(m.c, b); err != nil {
+		return nil, fmt.Errorf("reading from the master: %v", err)
+	}
+	return &muxReply{b: b}, nil
+}
+
+// request sends a request of type t, whose body, after the request id,
+// body adds, and returns the type of the reply, and the rest of it
+// after the request id, or an error, if the master refused it.
+func (m *muxConn) request(t uint32, body func(*muxMsg)) (uint32, *muxReply, error) {
+	m.id++
+	var msg muxMsg
+	msg.u32(t)
+	msg.u32(m.id)
+	if body != nil {
+		body(&msg)
+	}
+	if err := m.send(&msg); err != nil {
+		return 0, nil, err
+	}
+	return m.reply()
+}
+
+// reply reads the reply to the last request.
+func (m *muxConn) reply() (uint32, *muxReply, error) {
+	r, err := m.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	t, id := r.u32(), r.u32()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if id != m.id {
+		return 0, nil, fmt.Errorf("the master answered request %d, not %d", id, m.id)
+	}
+	switch t {
+	case muxDenied:
+		return 0, nil, fmt.Errorf("the master refused: %s", r.str())
+	case muxFailure:
+		return 0, nil, fmt.Errorf("the master failed: %s", r.str())
+	}
+	return t, r, nil
+}
+
+// alive returns the pid of the master.
+func (m *muxConn) alive() (int, error) {
+	t, r, err := m.request(muxAliveCheck, nil)
+	if err != nil {
+		return 0, err
+	}
+	pid := r.u32()
+	if t != muxAlive || r.err != nil {
+		return 0, fmt.Errorf("the master did not say it was alive")
+	}
+	return int(pid), nil
+}
+
+// forward asks the master to listen on port, on 127.0.0.1 on the
+// remote, 0 for any free one, and forward what connects to the Unix
+// socket sock. It returns the port, and a function that stops the
+// forward, which outlives us in the master otherwise.
+func (m *muxConn) forward(port, sock string) (string, func(), error) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", nil, fmt.Errorf("port %q: %v", port, err)
+	}
+	fwd := func(p uint32) func(*muxMsg) {
+		return func(msg *muxMsg) {
+			msg.u32(muxFwdRemote)
+			msg.str("127.0.0.1")
+			msg.u32(p)
+			msg.str(sock)
+			msg.u32(muxStreamLocal)
+		}
+	}
+	t, r, err := m.request(muxOpenFwd, fwd(uint32(p)))
+	if err != nil {
+		return "", nil, fmt.Errorf("forwarding 9p: %v", err)
+	}
+	got := p
+	if t == muxRemotePort {
+		got = uint64(r.u32())
+	}
+	if r.err != nil || (t != muxOK && t != muxRemotePort) {
+		return "", nil, fmt.Errorf("forwarding 9p: the master answered %#x", t)
+	}
+	// The master knows the forward by the port it was asked for,
+	// which may be 0, not by the one it got.
+	stop := func() {
+		if _, _, err := m.request(muxCloseFwd, fwd(uint32(p))); err != nil {
+			v("controlpath: removing the 9p forward: %v", err)
+		}
+	}
+	return strconv.FormatUint(got, 10), stop, nil
+}
+
+// session runs cmd, with the environment env, on the remote, with a pty
+// if tty is set, and returns its exit status. The master does its I/O,
+// with our stdin, stdout and stderr, which are sent it, as ssh -S does.
+// The terminal is made raw once the session is open, since the master
+// gives the pty the modes it has when it is asked for one.
+func (m *muxConn) session(cmd string, env []string, tty bool, pid int) (int, error) {
+	m.id++
+	var msg muxMsg
+	msg.u32(muxNewSession)
+	msg.u32(m.id)
+	msg.str("")
+	var wantTTY uint32
+	if tty {
+		wantTTY = 1
+	}
+	for _, f := range []uint32{wantTTY, 0, 0, 0, muxNoEscape} {
+		msg.u32(f)
+	}
+	msg.str(os.Getenv("TERM"))
+	msg.str(cmd)
+	for _, e := range env {
+		msg.str(e)
+	}
+	if err := m.send(&msg); err != nil {
+		return 0, err
+	}
+	for fd := 0; fd < 3; fd++ {
+		if _, _, err := m.c.WriteMsgUnix([]byte{0}, syscall.UnixRights(fd), nil); err != nil {
+			return 0, fmt.Errorf("sending fd %d to the master: %v", fd, err)
+		}
+	}
+	t, r, err := m.reply()
+	if err != nil {
+		return 0, err
+	}
+	sid := r.u32()
+	if t != muxOpened || r.err != nil {
+		return 0, fmt.Errorf("the master did not open a session: it answered %#x", t)
+	}
+	v("controlpath: session %d is open", sid)
+	if tty {
+		t, err := termios.New()
+		if err != nil {
+			return 0, err
+		}
+		cooked, err := t.Raw()
+		if err != nil {
+			return 0, err
+		}
+		defer t.Set(cooked)
+		// The master sizes the pty from the terminal it was sent,
+		// when it is told it has changed, as ssh -S tells it.
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGWINCH)
+		defer signal.Stop(c)
+		go func() {
+			for range c {
+				syscall.Kill(pid, syscall.SIGWINCH)
+			}
+		}()
+	}
+	for {
+		r, err := m.recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) || strings.Contains(err.Error(), "EOF") {
+				return 0, &ProtocolError{Err: fmt.Errorf("the master closed the session without an exit status, e.g. because the remote was killed by a signal")}
+			}
+			return 0, err
+		}
+		t, id := r.u32(), r.u32()
+		switch {
+		case r.err != nil:
+			return 0, r.err
+		case id != sid:
+		case t == muxTTYAllocFail:
+			log.Printf("controlpath: the remote could not allocate a pty")
+		case t == muxExit:
+			code := r.u32()
+			return int(code), r.err
+		}
+	}
+}
+
+// runMux is runClient, for -controlpath.
+func runMux(host, a string) error {
+	if err := checkMux(); err != nil {
+		return err
+	}
+	t := time.Now()
+	m, err := dialMux(*controlPath)
+	if err != nil {
+		return &DialError{Err: fmt.Errorf("controlpath: %v", err)}
+	}
+	defer m.c.Close()
+	pid, err := m.alive()
+	if err != nil {
+		return &DialError{Err: fmt.Errorf("controlpath: %v", err)}
+	}
+	phase("connect", t)
+	verbose("controlpath: using the connection of the master, pid %d, on %v", pid, *controlPath)
+	wantNameSpace := nameSpace()
+	if *hangTimeout != "" {
+		d, err := time.ParseDuration(*hangTimeout)
+		if err != nil {
+			return fmt.Errorf("hangtimeout: %v", err)
+		}
+		go watchHang(d, wantNameSpace)
+	}
+	base, deadline, err := cpudCommand("", host, wantNameSpace)
+	if err != nil {
+		return err
+	}
+	if *aname != "" {
+		base = fmt.Sprintf("%s -aname %q", base, *aname)
+	}
+	var env []string
+	if *noNameSpace {
+		env = append(env, "CPU_NAMESPACE=")
+	}
+	if *locale {
+		env = append(env, localeEnv()...)
+	}
+	cmd := base
+	var handshake chan error
+	if wantNameSpace {
+		if *snapshot {
+			if err := takeSnapshot(); err != nil {
+				return err
+			}
+		}
+		if err := startOverlay(); err != nil {
+			return err
+		}
+		defer endOverlay()
+		ex := newExport(*root)
+		var n nonce
+		if !*noNonce {
+			if n, err = generateNonce(); err != nil {
+				return err
+			}
+			// checkMux refuses -noncemode file, the one
+			// mode that needs a client.
+			e, f, _, err := sendNonce(nil, n)
+			if err != nil {
+				return err
+			}
+			env, cmd = append(env, e...), cmd+f
+		}
+		// The master, running as us, connects to the socket, in a
+		// directory only we can get into.
+		d, err := ioutil.TempDir("", "cpumux")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(d)
+		sock := filepath.Join(d, "9p")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			return err
+		}
+		port9p, stop, err := m.forward(remotePort9p(), sock)
+		if err != nil {
+			l.Close()
+			return &MountError{Err: err}
+		}
+		defer stop()
+		handshake = make(chan error, 1)
+		go ex.srv(l, n, deadline, handshake, tearingDown)
+		cmd = fmt.Sprintf("%s -port9p %v", cmd, port9p)
+	}
+	if *exactArgs {
+		cmd = fmt.Sprintf("%s -argv64 %s", cmd, encodeArgv(argv))
+	}
+	cmd = fmt.Sprintf("%s %q", cmd, a)
+	auditRecord(host, os.Getenv("USER"), cmd)
+	v("command is %q", cmd)
+	// The session needs its own connection: once it is open, the
+	// master takes this one for the session's.
+	s, err := dialMux(*controlPath)
+	if err != nil {
+		return &DialError{Err: fmt.Errorf("controlpath: %v", err)}
+	}
+	defer s.c.Close()
+	started()
+	defer phase("command", time.Now())
+	code, err := s.session(cmd, limitEnv(append(libEnv(os.Environ()), env...), len(env)), !*noTerm, pid)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		if handshake != nil {
+			select {
+			case herr := <-handshake:
+				if herr != nil {
+					return &MountError{Err: fmt.Errorf("9p handshake failed: %v", herr)}
+				}
+			default:
+			}
+		}
+		return &RemoteExitError{Code: code, Err: fmt.Errorf("Process exited with status %d", code)}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// nonceScript is run by sh on the remote for -noncemode file. It
+// copies its stdin, the nonce, to a new file that only the user can
+// read, and prints the file's name, for cpud to read it from.
+const nonceScript = `umask 077; f=$(mktemp /tmp/cpunonce.XXXXXX) || exit 1; cat >"$f" && echo "$f"`
+
+// checkNonceMode makes sure -noncemode is one we know.
+func checkNonceMode() error {
+	switch *nonceMode {
+	case "env", "arg", "file":
+		return nil
+	}
+	return fmt.Errorf("noncemode %q: want env, arg or file", *nonceMode)
+}
+
+// sendNonce gives cpud the nonce n the way -noncemode says: in
+// $CPUNONCE, the default, which an sshd whose AcceptEnv does not have
+// it drops; on cpud's command line, with -nonce, where anything on the
+// remote that can run ps can see it; or in a file only the user can
+// read, whose name is given with -noncefile, which costs a round trip.
+// It returns the environment and the flags to give cpud, and, for a
+// file, its name, for noNonceFile.
+func sendNonce(cl *ossh.Client, n nonce) (env []string, flags, file string, err error) {
+	switch *nonceMode {
+	case "arg":
+		return nil, " -nonce " + n.String(), "", nil
+	case "file":
+		f, err := writeNonce(cl, n)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return nil, fmt.Sprintf(" -noncefile %q", f), f, nil
+	}
+	return []string{"CPUNONCE=" + n.String()}, "", "", nil
+}
+
+// writeNonce writes n to a new file on the remote, and returns its name.
+func writeNonce(cl *ossh.Client, n nonce) (string, error) {
+	s, err := cl.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("noncemode file: %v", err)
+	}
+	defer s.Close()
+	var b bytes.Buffer
+	s.Stdin, s.Stdout = strings.NewReader(n.String()), &b
+	if err := s.Run("sh -c " + shQuote(nonceScript)); err != nil {
+		return "", fmt.Errorf("noncemode file: writing the nonce on the remote: %v", err)
+	}
+	f := strings.TrimSpace(b.String())
+	if f == "" || strings.ContainsAny(f, " \t\n\"") {
+		return "", fmt.Errorf("noncemode file: want a file name from the remote, got %q", b.String())
+	}
+	v("noncemode file: the nonce is in %v on the remote", f)
+	return f, nil
+}
+
+// noNonceFile returns err, after removing the nonce file f, if there is
+// one, from the remote, if err says cpud may not have read, and
+// removed, it. cpud removes it as soon as it has read it, so that,
+// when all is well, removing it costs no round trip.
+func noNonceFile(cl *ossh.Client, f string, err error) error {
+	if f == "" || err == nil {
+		return err
+	}
+	if _, rerr := cmd(cl, "rm -f "+shQuote(f)); rerr != nil {
+		log.Printf("Warning: noncemode file: removing %v from the remote: %v", f, rerr)
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/cputest"
+	"golang.org/x/sys/unix"
+)
+
+// TestNoSpace fills a small tmpfs, as -root, from the remote, and
+// checks that the remote gets ENOSPC, for a write and for a mkdir.
+func TestNoSpace(t *testing.T) {
+	d, err := ioutil.TempDir("", "cpufull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := unix.Mount("tmpfs", d, "tmpfs", 0, "size=64k,nr_inodes=16"); err != nil {
+		t.Skipf("mounting a tmpfs, which needs root: %v", err)
+	}
+	defer unix.Unmount(d, unix.MNT_DETACH)
+	var werr, merr error
+	err = session(t, func(r *cputest.Remote) error {
+		_, f, err := r.Root.Walk(nil)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, _, _, err := f.Create("big", p9.WriteOnly, 0644, p9.NoUID, p9.NoGID); err != nil {
+			return fmt.Errorf("create: %v", err)
+		}
+		b := make([]byte, 8192)
+		for off := int64(0); off < 1<<20; {
+			n, err := f.WriteAt(b, off)
+			if err != nil {
+				werr = err
+				break
+			}
+			off += int64(n)
+		}
+		// The inodes run out too.
+		for i := 0; i < 32 && merr == nil; i++ {
+			_, merr = r.Root.Mkdir(fmt.Sprintf("d%d", i), 0755, p9.NoUID, p9.NoGID)
+		}
+		return nil
+	}, map[string]string{"root": d}, "fill")
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+	// The remote gets the errno as a number; it is not a
+	// syscall.Errno there.
+	for _, e := range []struct {
+		op  string
+		err error
+	}{{"write", werr}, {"mkdir", merr}} {
+		if e.err == nil || e.err.Error() != syscall.ENOSPC.Error() {
+			t.Errorf("%s on a full disk: got %v, want %v", e.op, e.err, syscall.ENOSPC)
+		}
+	}
+}
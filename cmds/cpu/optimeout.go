@@ -0,0 +1,136 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// minOpRate is the slowest, in bytes per second, that -9pmsgtimeout
+// lets a read or write go before giving up, on top of the timeout
+// itself, so that a large read from a slow but working disk is not cut
+// off: a 1 MiB read gets one second more.
+const minOpRate = 1 << 20
+
+// opDeadline is -9pmsgtimeout. 0 means operations may take as long
+// as they take.
+var opDeadline time.Duration
+
+// parseMsgTimeout sets opDeadline from -9pmsgtimeout.
+func parseMsgTimeout() error {
+	if *msgTimeout == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(*msgTimeout)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("9pmsgtimeout %q: want a positive duration, e.g. 30s", *msgTimeout)
+	}
+	opDeadline = d
+	return nil
+}
+
+// timeoutOnce makes sure we only tell the local user once that 9p
+// operations are timing out.
+var timeoutOnce sync.Once
+
+// timed runs f, which does what, and moves n bytes, in a goroutine, and
+// returns EIO if it takes longer than -9pmsgtimeout allows. The remote
+// then gets an I/O error rather than waiting forever, e.g. on a hung
+// NFS mount here. f can not be stopped, so it goes on in the background;
+// it must not use anything its caller does once timed returns.
+func timed(what string, n int, f func()) error {
+	if opDeadline == 0 {
+		f()
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	d := opDeadline + time.Duration(n)*time.Second/minOpRate
+	select {
+	case <-done:
+		return nil
+	case <-time.After(d):
+		timeoutOnce.Do(func() {
+			log.Printf("Warning: a 9p operation, %s, took more than %v; the remote gets EIO", what, d)
+		})
+		v("9pmsgtimeout: %s took more than %v", what, d)
+		return syscall.EIO
+	}
+}
+
+// timedReadAt reads from f, as f.ReadAt does, within -9pmsgtimeout.
+// It reads into a buffer of its own, so that a read that finishes
+// after we gave up on it does not write to p.
+func timedReadAt(f *os.File, p []byte, off int64) (int, error) {
+	if opDeadline == 0 {
+		return f.ReadAt(p, off)
+	}
+	var (
+		b   = make([]byte, len(p))
+		n   int
+		err error
+	)
+	if terr := timed("read "+f.Name(), len(p), func() { n, err = f.ReadAt(b, off) }); terr != nil {
+		return 0, terr
+	}
+	return copy(p, b[:n]), err
+}
+
+// timedWriteAt writes to f, as f.WriteAt does, within -9pmsgtimeout.
+// It writes from a copy of p, since p may be reused once we return.
+func timedWriteAt(f *os.File, p []byte, off int64) (int, error) {
+	if opDeadline == 0 {
+		return f.WriteAt(p, off)
+	}
+	var (
+		b   = append([]byte(nil), p...)
+		n   int
+		err error
+	)
+	if terr := timed("write "+f.Name(), len(p), func() { n, err = f.WriteAt(b, off) }); terr != nil {
+		return 0, terr
+	}
+	return n, err
+}
+
+// timedStat is os.Lstat, or f.Stat if f is not nil, within -9pmsgtimeout.
+func timedStat(path string, f *os.File) (os.FileInfo, error) {
+	var (
+		fi  os.FileInfo
+		err error
+	)
+	stat := func() {
+		if f != nil {
+			fi, err = f.Stat()
+		} else {
+			fi, err = os.Lstat(path)
+		}
+	}
+	if terr := timed("stat "+path, 0, stat); terr != nil {
+		return nil, terr
+	}
+	return fi, err
+}
+
+// timedReadDir is ioutil.ReadDir within -9pmsgtimeout.
+func timedReadDir(path string) ([]os.FileInfo, error) {
+	var (
+		fi  []os.FileInfo
+		err error
+	)
+	if terr := timed("readdir "+path, 0, func() { fi, err = ioutil.ReadDir(path) }); terr != nil {
+		return nil, terr
+	}
+	return fi, err
+}
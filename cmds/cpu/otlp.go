@@ -0,0 +1,244 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -otlp sends the phases -timing times, each as a span, to an
+// OpenTelemetry collector, over OTLP/HTTP with JSON, at the end of the
+// session. The session is one trace: a cpu span, from start to end,
+// with the host and the exit status, and under it a span for each
+// time a phase ran: dns, connect, ssh handshake, auth, 9p mount and
+// command. With -J, there is one of each for every hop.
+
+// otlpWait is the longest cpu waits for the collector, at the end.
+const otlpWait = 5 * time.Second
+
+// A span is one run of a phase.
+type span struct {
+	name       string
+	start, end time.Time
+}
+
+// otlpTo is where -otlp sends the spans, once checkOTLP has found the
+// URL good.
+var otlpTo string
+
+// spans holds the phases, in the order they finished, for -otlp.
+var spans struct {
+	sync.Mutex
+	s []span
+}
+
+// traced returns true if phases are to be timed, for -timing or -otlp.
+func traced() bool {
+	return *timing || *otlp != ""
+}
+
+// addSpan records, for -otlp, that the phase name ran from start to end.
+func addSpan(name string, start, end time.Time) {
+	if *otlp == "" {
+		return
+	}
+	spans.Lock()
+	defer spans.Unlock()
+	spans.s = append(spans.s, span{name: name, start: start, end: end})
+}
+
+// The OTLP JSON encoding of a trace, as much of it as cpu needs.
+type (
+	otlpValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Int    *string `json:"intValue,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpSpan struct {
+		TraceID string     `json:"traceId"`
+		SpanID  string     `json:"spanId"`
+		Parent  string     `json:"parentSpanId,omitempty"`
+		Name    string     `json:"name"`
+		Kind    int        `json:"kind"`
+		Start   string     `json:"startTimeUnixNano"`
+		End     string     `json:"endTimeUnixNano"`
+		Attrs   []otlpAttr `json:"attributes,omitempty"`
+		Status  struct {
+			Code int `json:"code,omitempty"`
+		} `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attrs []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// strAttr and intAttr return the attribute k, with the value s, or i.
+func strAttr(k, s string) otlpAttr {
+	return otlpAttr{Key: k, Value: otlpValue{String: &s}}
+}
+
+func intAttr(k string, i int) otlpAttr {
+	s := strconv.Itoa(i)
+	return otlpAttr{Key: k, Value: otlpValue{Int: &s}}
+}
+
+// spanID returns a random ID of n bytes, in hex.
+func spanID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// otlpURL returns where the spans go: the -otlp endpoint, with the
+// path of the OTLP/HTTP traces service if it has none.
+func otlpURL() (string, error) {
+	u, err := url.Parse(*otlp)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("otlp: %q is not a URL, such as http://localhost:4318", *otlp)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// traceSpans returns the phases, as a trace of the session with host,
+// which exited with code.
+func traceSpans(host string, code int) *otlpTraces {
+	spans.Lock()
+	defer spans.Unlock()
+	if len(spans.s) == 0 {
+		return nil
+	}
+	// The cpu span is the total phase, or, if it did not finish,
+	// from the first phase to the last.
+	cs := span{name: "cpu", start: spans.s[0].start, end: spans.s[0].end}
+	var phases []span
+	for _, s := range spans.s {
+		if s.name == "total" {
+			cs.start, cs.end = s.start, s.end
+			continue
+		}
+		if s.start.Before(cs.start) {
+			cs.start = s.start
+		}
+		if s.end.After(cs.end) {
+			cs.end = s.end
+		}
+		phases = append(phases, s)
+	}
+	tid, pid := spanID(16), spanID(8)
+	hostAttr := strAttr("server.address", host)
+	ts := func(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
+	root := otlpSpan{
+		TraceID: tid,
+		SpanID:  pid,
+		Name:    cs.name,
+		Kind:    3, // client
+		Start:   ts(cs.start),
+		End:     ts(cs.end),
+		Attrs:   []otlpAttr{hostAttr, intAttr("process.exit.code", code)},
+	}
+	if code != 0 {
+		root.Status.Code = 2 // error
+	}
+	out := []otlpSpan{root}
+	for _, s := range phases {
+		out = append(out, otlpSpan{
+			TraceID: tid,
+			SpanID:  spanID(8),
+			Parent:  pid,
+			Name:    s.name,
+			Kind:    3,
+			Start:   ts(s.start),
+			End:     ts(s.end),
+			Attrs:   []otlpAttr{hostAttr},
+		})
+	}
+	var rs otlpResourceSpans
+	rs.Resource.Attrs = []otlpAttr{strAttr("service.name", "cpu")}
+	if h, err := os.Hostname(); err == nil {
+		rs.Resource.Attrs = append(rs.Resource.Attrs, strAttr("host.name", h))
+	}
+	ss := otlpScopeSpans{Spans: out}
+	ss.Scope.Name = "github.com/u-root/cpu/cmds/cpu"
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return &otlpTraces{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// exportSpans sends the phases of the session with host, which exited
+// with code, to the -otlp collector. It only logs a failure: the
+// session is over, and its exit status is the command's.
+func exportSpans(host string, code int) {
+	if otlpTo == "" {
+		return
+	}
+	if err := sendSpans(host, code); err != nil {
+		log.Print(err)
+	}
+}
+
+// checkOTLP returns an error if -otlp is set, and is not a URL.
+func checkOTLP() error {
+	if *otlp == "" {
+		return nil
+	}
+	var err error
+	otlpTo, err = otlpURL()
+	return err
+}
+
+// sendSpans is exportSpans, returning the error.
+func sendSpans(host string, code int) error {
+	u := otlpTo
+	t := traceSpans(host, code)
+	if t == nil {
+		return nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	c := &http.Client{Timeout: otlpWait}
+	r, err := c.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("otlp: %v", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		m, _ := ioutil.ReadAll(io.LimitReader(r.Body, 512))
+		return fmt.Errorf("otlp: %s: %s: %s", u, r.Status, bytes.TrimSpace(m))
+	}
+	verbose("otlp: sent %d spans to %s", len(t.ResourceSpans[0].ScopeSpans[0].Spans), u)
+	return nil
+}
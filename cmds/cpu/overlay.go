@@ -0,0 +1,195 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// upperDir is the -overlay directory, in which the remote's writes
+// are kept, or "" without -overlay. A local path p has its copy, if
+// it has one, at the same path under upperDir.
+var upperDir string
+
+// startOverlay makes the -overlay directory, if -overlay is set.
+func startOverlay() error {
+	switch *overlay {
+	case "":
+		return nil
+	case "discard", "list", "keep":
+	default:
+		return fmt.Errorf("overlay %q: want discard, list or keep", *overlay)
+	}
+	if *snapshot {
+		return fmt.Errorf("-overlay and -snapshot can not both be set")
+	}
+	d, err := ioutil.TempDir("", "cpu-overlay")
+	if err != nil {
+		return fmt.Errorf("overlay: %v", err)
+	}
+	upperDir = d
+	v("overlay: the remote's writes go to %v", d)
+	return nil
+}
+
+// endOverlay does what -overlay says with the overlay once the
+// session is over: throws it away, lists what is in it and throws it
+// away, or leaves it, and says where it is.
+func endOverlay() {
+	if upperDir == "" {
+		return
+	}
+	switch *overlay {
+	case "list":
+		fmt.Fprintf(diagOut, "cpu: the remote changed, in the overlay:\n")
+		filepath.Walk(upperDir, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				fmt.Fprintf(diagOut, "\t%s\n", p[len(upperDir):])
+			}
+			return nil
+		})
+	case "keep":
+		log.Printf("The remote's writes are in %v", upperDir)
+		return
+	}
+	if err := os.RemoveAll(upperDir); err != nil {
+		log.Printf("Warning: removing overlay %v: %v", upperDir, err)
+	}
+}
+
+// upper returns where the copy of p in the overlay goes.
+func upper(p string) string {
+	return filepath.Join(upperDir, p)
+}
+
+// localPath returns the path to reach p by here: its copy in the
+// overlay, if it has one, and otherwise p itself.
+func localPath(p string) string {
+	if upperDir == "" {
+		return p
+	}
+	if _, err := os.Lstat(upper(p)); err == nil {
+		return upper(p)
+	}
+	return p
+}
+
+// copyUp makes sure p has a copy in the overlay, for the remote to
+// change, and returns where it is. A directory's copy starts out empty:
+// what is in the original still shows through. The copy of a file is
+// made with its permissions, so a file the remote could not write
+// before can not be written now, either.
+func copyUp(p string) (string, error) {
+	if upperDir == "" {
+		return p, nil
+	}
+	u := upper(p)
+	if _, err := os.Lstat(u); err == nil {
+		return u, nil
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return "", err
+	}
+	if p != "/" {
+		if _, err := copyUp(filepath.Dir(p)); err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case fi.IsDir():
+		// We must be able to make what the remote creates in it.
+		err = os.Mkdir(u, fi.Mode().Perm()|0700)
+	case fi.Mode()&os.ModeSymlink != 0:
+		var l string
+		if l, err = os.Readlink(p); err == nil {
+			err = os.Symlink(l, u)
+		}
+	case fi.Mode().IsRegular():
+		err = copyFile(p, u, fi.Mode().Perm())
+	default:
+		err = syscall.EROFS
+	}
+	if err != nil {
+		return "", spaceErr(err)
+	}
+	v("overlay: copied %v up", p)
+	return u, nil
+}
+
+// copyFile copies the file from to a new file to, with the
+// permissions perm.
+func copyFile(from, to string, perm os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Chmod(to, perm)
+}
+
+// newPath returns where to make p, which the remote is creating: in
+// the overlay, with a copy of the directory it goes in, with -overlay,
+// and p itself otherwise.
+func newPath(p string) (string, error) {
+	if upperDir == "" {
+		return p, nil
+	}
+	if _, err := copyUp(filepath.Dir(p)); err != nil {
+		return "", err
+	}
+	return upper(p), nil
+}
+
+// readDir is ioutil.ReadDir of the directory p, within -9pmsgtimeout,
+// with what the remote has made in its copy in the overlay, if any,
+// in place of, or as well as, what is in p itself.
+func readDir(p string) ([]os.FileInfo, error) {
+	fi, err := timedReadDir(p)
+	if upperDir == "" {
+		return fi, err
+	}
+	ufi, uerr := ioutil.ReadDir(upper(p))
+	if uerr != nil {
+		return fi, err
+	}
+	if err != nil {
+		// The directory was made by the remote.
+		return ufi, nil
+	}
+	m := map[string]os.FileInfo{}
+	for _, f := range fi {
+		m[f.Name()] = f
+	}
+	for _, f := range ufi {
+		m[f.Name()] = f
+	}
+	fi = fi[:0]
+	for _, f := range m {
+		fi = append(fi, f)
+	}
+	sort.Slice(fi, func(i, j int) bool { return fi[i].Name() < fi[j].Name() })
+	return fi, nil
+}
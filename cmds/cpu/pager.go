@@ -0,0 +1,68 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// A pager is the local $PAGER that -pager sends the remote's stdout to.
+type pager struct {
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	quit bool // the pager exited before the remote command did
+}
+
+// startPager starts $PAGER, or less if it is not set, reading from a
+// pipe. It returns nil, and no error, if stdout is not a terminal:
+// as for git, output that goes to a file or a pipe is not paged.
+func startPager() (*pager, error) {
+	if !isTerminal(os.Stdout) {
+		v("pager: stdout is not a terminal; not paging")
+		return nil, nil
+	}
+	args := strings.Fields(os.Getenv("PAGER"))
+	if len(args) == 0 {
+		args = []string{"less"}
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	in, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("pager %q: %v", args[0], err)
+	}
+	return &pager{cmd: c, in: in}, nil
+}
+
+// copy copies the remote's stdout, o, to the pager. If the pager
+// exits first, e.g. because the user quit it, the write fails, and
+// there is no one left to read what the remote writes, so we stop
+// the remote command.
+func (p *pager) copy(s *ossh.Session, o io.Reader) {
+	if _, err := io.Copy(p.in, o); err != nil {
+		v("pager: %v; stopping the remote command", err)
+		p.quit = true
+		s.Signal(ossh.SIGTERM)
+		s.Close()
+	}
+}
+
+// wait closes the pager's input and waits for the user to be done
+// with it.
+func (p *pager) wait() {
+	p.in.Close()
+	if err := p.cmd.Wait(); err != nil {
+		v("pager: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The path audit, -auditpaths, and the allowlist, -allowpaths, are
+// two halves of one workflow: run a command once with -auditpaths to
+// learn which paths it uses, then run it from then on with that list
+// as -allowpaths, so that nothing else is served.
+// Paths are relative to -root, and start with a /.
+var (
+	auditMu   sync.Mutex
+	auditSeen = map[string]bool{}
+	auditFile *os.File
+
+	allowed map[string]bool // the listed paths, and every directory above them
+)
+
+// rootRel returns the path of n as the remote sees it.
+func rootRel(n string) string {
+	r, err := filepath.Rel(*root, n)
+	if err != nil {
+		return n
+	}
+	return filepath.Join("/", r)
+}
+
+// auditPath appends n to the -auditpaths file, if it is not there yet.
+func auditPath(n string) {
+	if *auditPaths == "" {
+		return
+	}
+	n = rootRel(n)
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditSeen[n] {
+		return
+	}
+	auditSeen[n] = true
+	if auditFile == nil {
+		f, err := os.OpenFile(*auditPaths, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Printf("auditpaths: %v", err)
+			*auditPaths = ""
+			return
+		}
+		auditFile = f
+	}
+	if _, err := fmt.Fprintln(auditFile, n); err != nil {
+		log.Printf("auditpaths: %v", err)
+	}
+}
+
+// readAllowed reads the -allowpaths file, one path per line, as
+// written by -auditpaths, before we connect. The session does not
+// start if it can not be read: serving everything instead would
+// defeat the point.
+func readAllowed() error {
+	if *allowPaths == "" {
+		return nil
+	}
+	f, err := os.Open(*allowPaths)
+	if err != nil {
+		return fmt.Errorf("allowpaths: %v", err)
+	}
+	defer f.Close()
+	a := map[string]bool{"/": true}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		p := strings.TrimSpace(s.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		for p = filepath.Join("/", p); !a[p]; p = filepath.Dir(p) {
+			a[p] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("allowpaths: %v", err)
+	}
+	allowed = a
+	return nil
+}
+
+// allowPath checks n against -allowpaths, -maxdepth and -gitignore, and
+// records it for -auditpaths. A path that is not allowed gets ENOENT, so
+// that to the remote it simply is not there.
+// Directories above an allowed path are allowed, so it can be reached,
+// but only the allowed paths in them can be seen.
+func allowPath(n string) error {
+	auditPath(n)
+	if tooDeep(n) || gitIgnoredPath(n) {
+		return syscall.ENOENT
+	}
+	if *allowPaths == "" {
+		return nil
+	}
+	if !allowed[rootRel(n)] {
+		v("allowpaths: %q is not allowed", rootRel(n))
+		return syscall.ENOENT
+	}
+	return nil
+}
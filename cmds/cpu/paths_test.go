@@ -0,0 +1,57 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/cpu/cputest"
+)
+
+func TestReadAllowed(t *testing.T) {
+	d, err := ioutil.TempDir("", "cpuallow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	defer func() { allowed = nil }()
+	f := filepath.Join(d, "allow")
+	if err := ioutil.WriteFile(f, []byte("# from -auditpaths\n/a/b/c\n\n  d  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restore := setFlags(t, map[string]string{"allowpaths": f})
+	err = readAllowed()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]bool{"/": true, "/a": true, "/a/b": true, "/a/b/c": true, "/d": true, "/a/x": false, "/a/b/c/d": false, "# from -auditpaths": false} {
+		if allowed[p] != want {
+			t.Errorf("%q: allowed is %v, want %v", p, allowed[p], want)
+		}
+	}
+}
+
+// TestAllowPathsMissing checks that an -allowpaths file that can not
+// be read ends the session before it starts, with an error, rather
+// than cpu exiting once the remote walks.
+func TestAllowPathsMissing(t *testing.T) {
+	defer func() { allowed = nil }()
+	called := false
+	err := session(t, func(*cputest.Remote) error {
+		called = true
+		return nil
+	}, map[string]string{"allowpaths": "/does/not/exist"}, "date")
+	if err == nil || !strings.Contains(err.Error(), "allowpaths") {
+		t.Errorf("session: got %v, want an allowpaths error", err)
+	}
+	if called {
+		t.Errorf("the remote command ran")
+	}
+}
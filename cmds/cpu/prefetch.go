@@ -0,0 +1,60 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// warm reads every file named in the file list, one path per line,
+// so that they are in the page cache when the remote first asks for
+// them. Paths are relative to root. Blank lines and lines starting
+// with # are skipped, as are paths that can not be read: the list
+// is a hint, and may well be out of date.
+// cpu has no 9p cache of its own; this only saves the remote from
+// waiting on our disk. To cache on the remote side as well, add
+// e.g. cache=loose with -mountopts.
+func warm(list, root string) {
+	f, err := os.Open(list)
+	if err != nil {
+		verbose("prefetch: %v", err)
+		return
+	}
+	defer f.Close()
+	var files, bytes int64
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		p := strings.TrimSpace(s.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		n, err := prefetchFile(filepath.Join(root, p))
+		if err != nil {
+			verbose("prefetch: %v", err)
+			continue
+		}
+		files++
+		bytes += n
+		v("prefetch: %q, %d files, %d bytes so far", p, files, bytes)
+	}
+	if err := s.Err(); err != nil {
+		verbose("prefetch: reading %q: %v", list, err)
+	}
+	verbose("prefetch: done, %d files, %d bytes", files, bytes)
+}
+
+func prefetchFile(n string) (int64, error) {
+	f, err := os.Open(n)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}
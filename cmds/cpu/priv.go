@@ -0,0 +1,119 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// askpassScript is run by sh on the remote for -sudo, when sudo wants
+// a password. It copies its stdin, an askpass script, to a new file
+// that only the user can read or run, for sudo -A to run, and prints
+// the file's name.
+const askpassScript = `umask 077; f=$(mktemp /tmp/cpuaskpass.XXXXXX) || exit 1; cat >"$f" && chmod 700 "$f" && echo "$f"`
+
+// sudoPassword is the password -sudo asked for, if sudo wants one.
+var sudoPassword string
+
+// runAs is what -sudo gives cpud, so that, once it has mounted us as
+// root, it runs the command as the user we logged in as, and not as
+// root. The remote's shell fills it in before the -privcmd runs.
+const runAs = " -runas $(id -u):$(id -g)"
+
+// setupPriv is -sudo: it returns what to put in front of cpud on the
+// remote, the -privcmd. If it is sudo, and it wants a password, setupPriv
+// asks the user for it here, and each command that starts with the
+// prefix must be run through withAskpass, which gives sudo the password.
+// A -privcmd that is not sudo must need no password.
+func setupPriv(cl *ossh.Client, host string) (string, error) {
+	if !*sudo {
+		return "", nil
+	}
+	f := strings.Fields(*privCmd)
+	if len(f) == 0 {
+		return "", fmt.Errorf("-privcmd is empty")
+	}
+	if _, err := cmd(cl, "command -v "+shQuote(f[0])); err != nil {
+		return "", fmt.Errorf("sudo: %v has no %v", host, f[0])
+	}
+	if _, err := cmd(cl, *privCmd+" -n true"); err == nil {
+		v("sudo: %v needs no password on %v", *privCmd, host)
+		return *privCmd + " ", nil
+	}
+	if f[0] != "sudo" {
+		return "", fmt.Errorf("sudo: %q needs a password on %v; only sudo can be given one, so it must need none", *privCmd, host)
+	}
+	pw, err := ask(fmt.Sprintf("[%s] password for %s@%s: ", f[0], os.Getenv("USER"), host), false)
+	if err != nil {
+		return "", fmt.Errorf("sudo: a terminal is needed to ask for the password: %v", err)
+	}
+	sudoPassword = pw
+	// With -k, sudo asks every time, so each askpass is run, and
+	// so removed, by the sudo it was made for.
+	prefix := strings.Join(append([]string{"sudo", "-k", "-A"}, f[1:]...), " ") + " "
+	if _, err := cmdPriv(cl, prefix+"true"); err != nil {
+		sudoPassword = ""
+		return "", fmt.Errorf("sudo: %v would not take the password: %v", host, err)
+	}
+	return prefix, nil
+}
+
+// askpass returns an askpass script that prints pw, once: its first
+// act is to remove itself.
+func askpass(pw string) string {
+	return "#!/bin/sh\nrm -f \"$0\"\nprintf '%s\\n' " + shQuote(pw) + "\n"
+}
+
+// withAskpass returns c, a command that starts with the -sudo prefix,
+// with an askpass of its own on the remote for sudo to get the password
+// from, if it wants one, and a func that removes the askpass, to call
+// once c has run. sudo runs the askpass, which removes itself, before
+// it runs anything else, so it is there until then, and no longer; the
+// func is for a c that fails before it gets that far.
+func withAskpass(cl *ossh.Client, c string) (string, func(), error) {
+	if sudoPassword == "" {
+		return c, func() {}, nil
+	}
+	s, err := cl.NewSession()
+	if err != nil {
+		return "", nil, fmt.Errorf("sudo: %v", err)
+	}
+	defer s.Close()
+	var b bytes.Buffer
+	s.Stdin = strings.NewReader(askpass(sudoPassword))
+	s.Stdout = &b
+	if err := s.Run("sh -c " + shQuote(askpassScript)); err != nil {
+		return "", nil, fmt.Errorf("sudo: writing the askpass script: %v", err)
+	}
+	f := strings.TrimSpace(b.String())
+	if f == "" || strings.ContainsAny(f, " \t\n\"") {
+		return "", nil, fmt.Errorf("sudo: want a file name from the remote, got %q", b.String())
+	}
+	return "SUDO_ASKPASS=" + f + " " + c, func() { removeAskpass(cl, f) }, nil
+}
+
+// cmdPriv is cmd, for a command that starts with the -sudo prefix.
+func cmdPriv(cl *ossh.Client, c string, envs ...string) ([]byte, error) {
+	c, done, err := withAskpass(cl, c)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return cmd(cl, c, envs...)
+}
+
+// removeAskpass removes the askpass script f from the remote, if it is
+// still there.
+func removeAskpass(cl *ossh.Client, f string) {
+	if _, err := cmd(cl, "rm -f "+shQuote(f)); err != nil {
+		log.Printf("Warning: sudo: removing %v from the remote: %v", f, err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestAskpass makes an askpass, as the remote does for -sudo, runs it,
+// as sudo -A does, and checks that it prints the password, and that it
+// is gone after it runs, and that a second run gets nothing.
+func TestAskpass(t *testing.T) {
+	if _, err := exec.LookPath("mktemp"); err != nil {
+		t.Skipf("no mktemp: %v", err)
+	}
+	for _, pw := range []string{"secret", "it's a 'secret'", `a "b" \c $d`, " spaces "} {
+		c := exec.Command("sh", "-c", askpassScript)
+		c.Stdin = strings.NewReader(askpass(pw))
+		b, err := c.Output()
+		if err != nil {
+			t.Fatalf("making the askpass: %v", err)
+		}
+		f := strings.TrimSpace(string(b))
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := fi.Mode().Perm(); m != 0700 {
+			t.Errorf("%v: mode %v, want 0700", f, m)
+		}
+		out, err := exec.Command(f).Output()
+		if err != nil {
+			t.Errorf("running %v: %v", f, err)
+		}
+		if string(out) != pw+"\n" {
+			t.Errorf("%v: printed %q, want %q", f, out, pw+"\n")
+		}
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			os.Remove(f)
+			t.Errorf("%v is still there after it ran: %v", f, err)
+		}
+		if out, err := exec.Command(f).Output(); err == nil {
+			t.Errorf("%v ran a second time, and printed %q", f, out)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksDialer returns a dialer that goes through the SOCKS5 proxy
+// named by s, which is [user[:password]@]host:port.
+// If a user is given without a password, the password is taken
+// from $CPU_SOCKS_PASSWORD, so it need not appear in ps.
+func socksDialer(s string) (proxy.Dialer, error) {
+	var auth *proxy.Auth
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		u := strings.SplitN(s[:i], ":", 2)
+		auth = &proxy.Auth{User: u[0], Password: os.Getenv("CPU_SOCKS_PASSWORD")}
+		if len(u) == 2 {
+			auth.Password = u[1]
+		}
+		s = s[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return nil, fmt.Errorf("socks proxy %q: %v", s, err)
+	}
+	return proxy.SOCKS5("tcp", s, auth, proxy.Direct)
+}
+
+// proxyEnv are the variables, in the order we look at them, that name
+// an HTTP proxy if -httpproxy is not set.
+var proxyEnv = []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"}
+
+// httpProxyDialer returns a dialer that goes through the HTTP proxy of
+// -httpproxy, or, if it is not set, of $HTTPS_PROXY or $ALL_PROXY, or
+// nil for none. The proxy is a URL, http://[user[:password]@]host[:port],
+// or https:// to speak TLS to the proxy; the scheme may be left out.
+// If a user is given without a password, the password is taken from
+// $CPU_HTTPPROXY_PASSWORD. A proxy from the environment is only used
+// if it is http or https, e.g. not an ALL_PROXY that is socks5, and
+// not for the hosts $NO_PROXY lists.
+func httpProxyDialer() (proxy.Dialer, error) {
+	s, env := *httpProxy, ""
+	if s == "none" {
+		return nil, nil
+	}
+	if s == "" {
+		for _, env = range proxyEnv {
+			if s = os.Getenv(env); s != "" {
+				break
+			}
+		}
+		if s == "" {
+			return nil, nil
+		}
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("want an http or https proxy, not %s", u.Scheme)
+	}
+	if err != nil {
+		if env != "" {
+			v("not using $%s as an http proxy: %v", env, err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("httpproxy %q: %v", *httpProxy, err)
+	}
+	h := &httpConnect{addr: u.Host, tls: u.Scheme == "https"}
+	if u.Port() == "" {
+		port := "80"
+		if h.tls {
+			port = "443"
+		}
+		h.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		p, ok := u.User.Password()
+		if !ok {
+			p = os.Getenv("CPU_HTTPPROXY_PASSWORD")
+		}
+		h.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+p))
+	}
+	if env == "" {
+		return h, nil
+	}
+	v("using http proxy %v from $%s", h.addr, env)
+	d := proxy.NewPerHost(h, proxy.Direct)
+	d.AddFromString(os.Getenv("NO_PROXY") + "," + os.Getenv("no_proxy"))
+	return d, nil
+}
+
+// httpConnect dials through an HTTP proxy with CONNECT.
+type httpConnect struct {
+	addr string // of the proxy, host:port
+	tls  bool   // to talk to the proxy over TLS
+	auth string // the Proxy-Authorization, if any
+}
+
+// Dial implements proxy.Dialer.Dial.
+func (h *httpConnect) Dial(n, a string) (net.Conn, error) {
+	c, err := net.Dial(n, h.addr)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %v: %v", h.addr, err)
+	}
+	if h.tls {
+		host, _, _ := net.SplitHostPort(h.addr)
+		c = tls.Client(c, &tls.Config{ServerName: host})
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", a, a)
+	if h.auth != "" {
+		req += "Proxy-Authorization: " + h.auth + "\r\n"
+	}
+	if _, err := io.WriteString(c, req+"\r\n"); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("http proxy %v: %v", h.addr, err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("http proxy %v: %v", h.addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("http proxy %v: CONNECT %v: %v", h.addr, a, resp.Status)
+	}
+	v("dial %v via http proxy %v", a, h.addr)
+	// The server may have spoken, e.g. sent its ssh version, in the
+	// same read as the proxy's answer.
+	return &bufConn{Conn: c, r: br}, nil
+}
+
+// bufConn is a net.Conn whose reads go through r first.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// pushScript is run by sh on the remote for -pushbin. It copies its
+// stdin, the cpud we push, to a new file that only the user can read
+// or run, and prints the file's name and size, so we can tell that
+// all of it got there.
+const pushScript = `umask 077; f=$(mktemp /tmp/cpud.XXXXXX) || exit 1; cat >"$f" && chmod 700 "$f" && echo "$f $(wc -c <"$f")"`
+
+// checkPushBin makes sure the -pushbin file is something we can push:
+// a Linux executable. It only warns if it is dynamically linked,
+// since the remote may have the libraries it needs, but likely not.
+func checkPushBin(name string) error {
+	f, err := elf.Open(name)
+	if err != nil {
+		return fmt.Errorf("pushbin %v: not an ELF executable: %v", name, err)
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			log.Printf("Warning: pushbin %v is dynamically linked, and may not run on the remote; build it with CGO_ENABLED=0", name)
+			break
+		}
+	}
+	return nil
+}
+
+// pushCPUD copies -pushbin to the remote, if the remote does not have
+// -bin, for us to run instead of it, and returns where it put it,
+// or "" if it did not need to. It needs a shell, mktemp, cat and wc
+// on the remote, as any stock system has.
+func pushCPUD(cl *ossh.Client) (string, error) {
+	if _, err := cmd(cl, "command -v "+shQuote(*bin)); err == nil {
+		v("pushbin: the remote has %v; not pushing", *bin)
+		return "", nil
+	}
+	if err := checkPushBin(*pushBin); err != nil {
+		return "", err
+	}
+	f, err := os.Open(*pushBin)
+	if err != nil {
+		return "", fmt.Errorf("pushbin: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("pushbin: %v", err)
+	}
+	s, err := cl.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("pushbin: %v", err)
+	}
+	defer s.Close()
+	var b bytes.Buffer
+	s.Stdin, s.Stdout = f, &b
+	if err := s.Run("sh -c " + shQuote(pushScript)); err != nil {
+		return "", fmt.Errorf("pushbin: copying %v to the remote: %v", *pushBin, err)
+	}
+	r := strings.Fields(b.String())
+	if len(r) != 2 {
+		return "", fmt.Errorf("pushbin: want a file name and size from the remote, got %q", b.String())
+	}
+	if r[1] != fmt.Sprint(fi.Size()) {
+		removePushed(cl, r[0])
+		return "", fmt.Errorf("pushbin: the remote got %s of the %d bytes of %v", r[1], fi.Size(), *pushBin)
+	}
+	verbose("pushbin: the remote does not have %v; pushed %v to %v", *bin, *pushBin, r[0])
+	return r[0], nil
+}
+
+// removePushed removes the cpud we pushed to p on the remote.
+func removePushed(cl *ossh.Client, p string) {
+	if _, err := cmd(cl, "rm -f "+shQuote(p)); err != nil {
+		log.Printf("Warning: pushbin: removing %v from the remote: %v", p, err)
+	}
+}
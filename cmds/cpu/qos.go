@@ -0,0 +1,87 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// -prioritizeinteractive makes 9p give way to the keys typed in a
+// session with a pty. Both go to the remote over the one ssh
+// connection, so a key typed while the remote reads a big file sits
+// behind whatever of the file is queued ahead of it. While keys are
+// being typed, 9p writes no more than qosChunk at a time, pausing
+// between them, and lets a key that is being sent go first; the rest
+// of the time, it writes as it always does.
+const (
+	// qosChunk is the most 9p writes at once while keys are being
+	// typed, so that a key is not queued behind much of it.
+	qosChunk = 16 << 10
+	// qosRecent is how long after a key is typed 9p gives way.
+	qosRecent = 500 * time.Millisecond
+	// qosPause is how long 9p waits between chunks, which limits it
+	// to qosChunk every qosPause, about 8 MB/s, while it gives way.
+	qosPause = 2 * time.Millisecond
+	// qosWait is the longest 9p waits for a key to be sent.
+	qosWait = 50 * time.Millisecond
+)
+
+// keys is when a key was last typed, in Unix nanoseconds, and how many
+// are being sent to the remote now.
+var keys struct {
+	last    int64
+	sending int32
+}
+
+// sendKey is writeAll, for what is typed: while it writes, 9p waits.
+func sendKey(w io.Writer, p []byte) error {
+	atomic.StoreInt64(&keys.last, time.Now().UnixNano())
+	atomic.AddInt32(&keys.sending, 1)
+	defer atomic.AddInt32(&keys.sending, -1)
+	return writeAll(w, p)
+}
+
+// typing returns true if a key was typed within qosRecent.
+func typing() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&keys.last))) < qosRecent
+}
+
+// qosConn is a 9p connection that gives way to keys being typed.
+type qosConn struct {
+	net.Conn
+}
+
+// Write implements io.Writer.Write. If keys are being typed, p is
+// written qosChunk at a time, with a pause between them, and each
+// waits for any key that is being sent.
+func (q *qosConn) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if !typing() {
+			m, err := q.Conn.Write(p)
+			return n + m, err
+		}
+		if n > 0 {
+			time.Sleep(qosPause)
+		}
+		for t := time.Now(); atomic.LoadInt32(&keys.sending) > 0 && time.Since(t) < qosWait; {
+			time.Sleep(qosPause / 10)
+		}
+		c := len(p)
+		if c > qosChunk {
+			c = qosChunk
+		}
+		m, err := q.Conn.Write(p[:c])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[c:]
+	}
+	return n, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// The quotas, -maxopenfiles and -maxbytes, limit what a remote we do
+// not fully trust can do with our files. They count for the session
+// as a whole, not per file or per mount.
+var (
+	openFiles int64
+	xferBytes int64
+	quotaOnce sync.Once
+)
+
+// quotaHit tells the local user, once, that the remote ran into a quota.
+func quotaHit(what string, limit int64) {
+	quotaOnce.Do(func() {
+		log.Printf("Remote has hit the %s quota of %d; further requests are refused", what, limit)
+	})
+}
+
+// openQuota takes one of the -maxopenfiles files.
+// When they are all in use it returns EMFILE, for "too many open files".
+// If it returns nil, the caller must call closeQuota when the file
+// is closed.
+func openQuota() error {
+	if *maxOpen <= 0 {
+		return nil
+	}
+	if atomic.AddInt64(&openFiles, 1) > *maxOpen {
+		atomic.AddInt64(&openFiles, -1)
+		quotaHit("open files", *maxOpen)
+		return syscall.EMFILE
+	}
+	return nil
+}
+
+// closeQuota gives back a file taken by openQuota.
+func closeQuota() {
+	if *maxOpen > 0 {
+		atomic.AddInt64(&openFiles, -1)
+	}
+}
+
+// byteQuota checks that the remote may still read or write.
+// Once -maxbytes is used up, every read and write gets EDQUOT.
+// It is checked before the I/O, and what is actually moved is
+// counted after, so the last request may go a little over.
+func byteQuota() error {
+	if *maxBytes <= 0 {
+		return nil
+	}
+	if atomic.LoadInt64(&xferBytes) >= *maxBytes {
+		quotaHit("bytes", *maxBytes)
+		return quotaErrno
+	}
+	return nil
+}
+
+// countBytes counts n bytes against -maxbytes.
+func countBytes(n int) {
+	if *maxBytes > 0 && n > 0 {
+		atomic.AddInt64(&xferBytes, int64(n))
+	}
+}
+
+var (
+	opsOnce sync.Once
+	ops     chan struct{}
+)
+
+// opSlot waits for one of the -max9pconcurrency slots for a 9p operation,
+// and returns the function that gives it back, for use with defer.
+// The 9p server runs every request in its own goroutine, with no limit,
+// so this is what keeps a remote from having thousands of operations
+// going at once on our disks. Requests over the limit queue here.
+// Only the file operations take a slot, and none of them calls another
+// that does, so a request holding a slot never waits for another slot.
+// In particular, a flush, which waits for the request it flushes, takes
+// no slot.
+func opSlot() func() {
+	if *max9pOps <= 0 {
+		return func() {}
+	}
+	opsOnce.Do(func() { ops = make(chan struct{}, *max9pOps) })
+	ops <- struct{}{}
+	return func() { <-ops }
+}
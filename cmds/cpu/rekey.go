@@ -0,0 +1,89 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// minRekeyInterval is the shortest -rekeyinterval we take: each
+	// key exchange it forces costs -rekeybytes of padding.
+	minRekeyInterval = time.Minute
+	// rekeyPad is how much padding each request carries, well under
+	// the largest packet the remote must take.
+	rekeyPad = 32 << 10
+	// rekeyRequest is the global request the padding goes in. The
+	// remote does not know it, and, as no reply is wanted, ignores it.
+	rekeyRequest = "rekey-pad@u-root.org"
+)
+
+// rekeyEvery is -rekeyinterval, once checkRekeyInterval has parsed
+// it; 0 if it is not set.
+var rekeyEvery time.Duration
+
+// checkRekeyInterval parses -rekeyinterval. It needs -rekeybytes, as
+// forcing a key exchange costs that many bytes.
+func checkRekeyInterval() error {
+	if *rekeyTime == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(*rekeyTime)
+	if err != nil || d < minRekeyInterval {
+		return fmt.Errorf("rekeyinterval %q: want a duration of at least %v, e.g. 1h", *rekeyTime, minRekeyInterval)
+	}
+	if *rekeyBytes == 0 {
+		return fmt.Errorf("rekeyinterval %v: needs -rekeybytes, which is what each key exchange it forces costs", d)
+	}
+	rekeyEvery = d
+	return nil
+}
+
+// rekeyTimer forces new keys on cl every -rekeyinterval, until cl is
+// closed, or the returned func is called.
+func rekeyTimer(cl ossh.Conn) func() {
+	if rekeyEvery == 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(rekeyEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+			v("rekeyinterval: forcing new keys")
+			if err := forceRekey(cl, *rekeyBytes); err != nil {
+				v("rekeyinterval: %v", err)
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// forceRekey makes cl negotiate new keys. golang.org/x/crypto/ssh has
+// no call that starts a key exchange: it starts one itself, on the
+// first packet it writes once RekeyThreshold bytes have gone out under
+// the old keys. So we write that many bytes of padding, in requests
+// the remote ignores, and then one more request, which sets it off.
+// Whatever went out since the last key exchange counts too, so it may
+// come a little sooner, but never later.
+func forceRekey(cl ossh.Conn, threshold uint64) error {
+	pad := make([]byte, rekeyPad)
+	for sent := uint64(0); sent < threshold; sent += rekeyPad {
+		if _, _, err := cl.SendRequest(rekeyRequest, false, pad); err != nil {
+			return err
+		}
+	}
+	_, _, err := cl.SendRequest(rekeyRequest, false, nil)
+	return err
+}
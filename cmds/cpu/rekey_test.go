@@ -0,0 +1,146 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+func TestCheckRekeyInterval(t *testing.T) {
+	defer func() { rekeyEvery = 0 }()
+	for _, tt := range []struct {
+		interval, bytes string
+		want            time.Duration
+		err             string
+	}{
+		{},
+		{interval: "1h", bytes: "1048576", want: time.Hour},
+		{interval: "1m", bytes: "1048576", want: time.Minute},
+		{interval: "59s", bytes: "1048576", err: "at least 1m0s"},
+		{interval: "-1h", bytes: "1048576", err: "at least 1m0s"},
+		{interval: "hourly", bytes: "1048576", err: "at least 1m0s"},
+		{interval: "1h", bytes: "0", err: "needs -rekeybytes"},
+	} {
+		rekeyEvery = 0
+		fl := map[string]string{"rekeyinterval": tt.interval}
+		if tt.bytes != "" {
+			fl["rekeybytes"] = tt.bytes
+		}
+		restore := setFlags(t, fl)
+		err := checkRekeyInterval()
+		restore()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("-rekeyinterval %q -rekeybytes %q: got %v, want an error with %q", tt.interval, tt.bytes, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || rekeyEvery != tt.want {
+			t.Errorf("-rekeyinterval %q -rekeybytes %q: got %v, %v, want %v, nil", tt.interval, tt.bytes, rekeyEvery, err, tt.want)
+		}
+	}
+}
+
+// signCounter is a host key that counts its signatures: the server
+// signs once for each key exchange.
+type signCounter struct {
+	ossh.Signer
+	n int32
+}
+
+func (s *signCounter) Sign(r io.Reader, data []byte) (*ossh.Signature, error) {
+	atomic.AddInt32(&s.n, 1)
+	return s.Signer.Sign(r, data)
+}
+
+// TestForceRekey checks that forceRekey starts a key exchange, on a
+// connection that would otherwise have none for another MiB.
+func TestForceRekey(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ossh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk := &signCounter{Signer: s}
+	sc := &ossh.ServerConfig{NoClientAuth: true}
+	sc.AddHostKey(hk)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn, chans, reqs, err := ossh.NewServerConn(c, sc)
+		if err != nil {
+			c.Close()
+			return
+		}
+		defer conn.Close()
+		go ossh.DiscardRequests(reqs)
+		for nc := range chans {
+			nc.Reject(ossh.Prohibited, "no channels")
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const threshold = minRekeyBytes
+	cc := &ossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ossh.InsecureIgnoreHostKey(),
+		Config:          ossh.Config{RekeyThreshold: threshold},
+	}
+	conn, chans, reqs, err := ossh.NewClientConn(c, l.Addr().String(), cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := ossh.NewClient(conn, chans, reqs)
+	defer cl.Close()
+	if n := atomic.LoadInt32(&hk.n); n != 1 {
+		t.Fatalf("after connecting: %d key exchanges, want 1", n)
+	}
+	// Well short of the threshold, nothing should change; but a
+	// reply is waited for, so anything it set off would be done.
+	for i := 0; i < threshold/4/rekeyPad; i++ {
+		if _, _, err := cl.SendRequest("keepalive@openssh.com", true, make([]byte, rekeyPad)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&hk.n); n != 1 {
+		t.Fatalf("after %d bytes: %d key exchanges, want 1", threshold/4, n)
+	}
+
+	if err := forceRekey(cl, threshold); err != nil {
+		t.Fatalf("forceRekey: %v", err)
+	}
+	for end := time.Now().Add(5 * time.Second); atomic.LoadInt32(&hk.n) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("forceRekey: no key exchange after 5s")
+		}
+	}
+	// The connection still works under the new keys.
+	if _, _, err := cl.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("after the key exchange: %v", err)
+	}
+}
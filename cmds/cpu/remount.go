@@ -0,0 +1,74 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// remountTries is how many times in a row -9premount tries to give
+// the remote a new 9p channel before giving up.
+const remountTries = 3
+
+// supervise is -9premount. It runs once the 9p connection to the
+// remote has ended. If the session is still going on a second after
+// that, the 9p forward broke, rather than the remote going away, and
+// we set up a new forward and ask cpud, on the status channel, to
+// remount it. That is all best effort: nothing can be done if the ssh
+// connection itself is gone. With the kernel's 9p, whatever the remote
+// had in flight, or open, on the old mount gets errors, and it is only
+// what it does from then on that sees the new one; over FUSE, cpud
+// goes on over the new channel with what it was doing.
+func (e *export) supervise(cl *ossh.Client, deadline time.Duration, done <-chan struct{}) {
+	for try := 1; try <= remountTries; try++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+		log.Printf("9p connection to the remote lost; asking it to remount, try %d of %d", try, remountTries)
+		if err := e.remount(cl, deadline, done); err != nil {
+			log.Printf("Remount: %v", err)
+			continue
+		}
+		// It worked, and the new connection has since ended too.
+		try = 0
+	}
+	log.Printf("Giving up on remounting after %d tries", remountTries)
+}
+
+// remount sets up a new 9p forward, with a new nonce, tells cpud to
+// mount it, and serves it until it ends.
+func (e *export) remount(cl *ossh.Client, deadline time.Duration, done <-chan struct{}) error {
+	var n nonce
+	if !*noNonce {
+		var err error
+		if n, err = generateNonce(); err != nil {
+			return err
+		}
+	}
+	l, port, err := listenRemote(cl, remotePort9p())
+	if err != nil {
+		return err
+	}
+	req := port
+	if !*noNonce {
+		req += " " + n.String()
+	}
+	if err := tellStatus("remount", req); err != nil {
+		l.Close()
+		return fmt.Errorf("telling cpud: %v", err)
+	}
+	c, err := accept9p(l, n, deadline, false)
+	if err != nil {
+		return err
+	}
+	e.serve(c, done)
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rusageC gets the rusage line cpud sends on the status channel once
+// the remote command is done.
+var rusageC = make(chan string, 1)
+
+// rusageWait is how long we wait, at the end, for the rusage to get
+// here. cpud sends it before it exits, but it comes on the status
+// channel, not the session, so it may be a moment behind.
+const rusageWait = time.Second
+
+// printRusage prints, on stderr, for -rusage, what the remote command
+// used: its user and system time, and its largest resident set. If
+// the command was killed, that is what it used until then. If cpud
+// was killed, or the session broke, before it could tell us, we say
+// so.
+func printRusage() {
+	if !*showRusage || *subsystem != "" {
+		return
+	}
+	statusConn.Lock()
+	c := statusConn.c
+	statusConn.Unlock()
+	if c == nil {
+		fmt.Fprintf(diagOut, "cpu: rusage: cpud never opened the status channel\n")
+		return
+	}
+	var val string
+	select {
+	case val = <-rusageC:
+	case <-time.After(rusageWait):
+		fmt.Fprintf(diagOut, "cpu: rusage: the remote did not report it; cpud may have been killed, or may not know -rusage\n")
+		return
+	}
+	f := strings.SplitN(val, " ", 4)
+	if len(f) != 4 {
+		fmt.Fprintf(diagOut, "cpu: rusage: bad report %q\n", val)
+		return
+	}
+	var n [3]int64
+	for i := range n {
+		var err error
+		if n[i], err = strconv.ParseInt(f[i], 10, 64); err != nil {
+			fmt.Fprintf(diagOut, "cpu: rusage: bad report %q\n", val)
+			return
+		}
+	}
+	fmt.Fprintf(diagOut, "cpu: rusage: user %v, system %v, max resident %d KiB (%s)\n",
+		time.Duration(n[0]).Round(time.Millisecond), time.Duration(n[1]).Round(time.Millisecond), n[2], f[3])
+}
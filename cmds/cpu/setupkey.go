@@ -0,0 +1,170 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// installScript is run by sh on the remote for -setupkey. It adds the
+// public key on its stdin to ~/.ssh/authorized_keys, unless it is
+// there already, and says which it was.
+const installScript = `umask 077; read -r k || exit 1; mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys || exit 1; if grep -qxF "$k" ~/.ssh/authorized_keys; then echo present; else printf '%s\n' "$k" >>~/.ssh/authorized_keys && echo added; fi`
+
+// yes asks the user, on the terminal, a question to answer y or n;
+// anything but y or yes is no.
+func yes(q string) (bool, error) {
+	a, err := ask(q+" [y/N] ", true)
+	if err != nil {
+		return false, fmt.Errorf("a terminal is needed to ask before each step: %v", err)
+	}
+	a = strings.ToLower(strings.TrimSpace(a))
+	return a == "y" || a == "yes", nil
+}
+
+// installKey is -setupkey: it makes the key kf, if there is none, and
+// offers to install its public key on host, logging in once with a
+// password, so that a first cpu to a host needs nothing done by hand.
+// It asks before each step, and never replaces a key that is there.
+func installKey(kf, host string, dialer func(string, string, *ossh.ClientConfig) (*ossh.Client, error)) error {
+	if *connFD >= 0 {
+		return fmt.Errorf("-setupkey can not be used with -connfd, which is only good for one connection")
+	}
+	pub, err := newKey(kf)
+	if err != nil {
+		return fmt.Errorf("setupkey: %v", err)
+	}
+	line := ossh.MarshalAuthorizedKey(pub)
+	fmt.Printf("%s", line)
+	ok, err := yes(fmt.Sprintf("Add this key to ~%s/.ssh/authorized_keys on %v, logging in with a password?", os.Getenv("USER"), host))
+	if err != nil {
+		return fmt.Errorf("setupkey: %v", err)
+	}
+	if !ok {
+		return nil
+	}
+	c, err := config(nil)
+	if err != nil {
+		return err
+	}
+	c.Auth = authMethods([]string{"password", "keyboard-interactive"}, nil)
+	cl, err := dialer(*network, net.JoinHostPort(host, *port), c)
+	if err != nil {
+		return fmt.Errorf("setupkey: %v", err)
+	}
+	defer cl.Close()
+	s, err := cl.NewSession()
+	if err != nil {
+		return fmt.Errorf("setupkey: %v", err)
+	}
+	defer s.Close()
+	var b bytes.Buffer
+	s.Stdin, s.Stdout = bytes.NewReader(line), &b
+	if err := s.Run("sh -c " + shQuote(installScript)); err != nil {
+		return fmt.Errorf("setupkey: adding the key on %v: %v", host, err)
+	}
+	switch strings.TrimSpace(b.String()) {
+	case "added":
+		log.Printf("Added the key to ~%s/.ssh/authorized_keys on %v", os.Getenv("USER"), host)
+	case "present":
+		log.Printf("The key was already in ~%s/.ssh/authorized_keys on %v", os.Getenv("USER"), host)
+	default:
+		return fmt.Errorf("setupkey: want added or present from %v, got %q", host, b.String())
+	}
+	return nil
+}
+
+// newKey returns the public key of kf: that of the key there, if there
+// is one, or, if the user says so, of a new ed25519 key it makes there,
+// with its public key in kf.pub, as ssh-keygen would.
+func newKey(kf string) (ossh.PublicKey, error) {
+	if _, err := os.Stat(kf); err == nil {
+		log.Printf("Key %v is there already; not making a new one", kf)
+		return keyPub(kf)
+	}
+	ok, err := yes(fmt.Sprintf("There is no key %v. Make a new ed25519 key there?", kf))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key %v to set up", kf)
+	}
+	pk, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ossh.NewPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(kf), 0700); err != nil {
+		return nil, err
+	}
+	// O_EXCL, so that we do not write over a key that got there
+	// since we looked.
+	if err := writeNew(kf, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	if err := writeNew(kf+".pub", ossh.MarshalAuthorizedKey(pub), 0644); err != nil {
+		log.Printf("Warning: not writing the public key: %v", err)
+	}
+	log.Printf("Made a new ed25519 key %v", kf)
+	return pub, nil
+}
+
+// writeNew writes b to the new file name, with the permissions perm;
+// it is an error if name is there already.
+func writeNew(name string, b []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// keyPub returns the public key of the key kf that is there: from
+// kf.pub, if it can, since kf may need a passphrase, and from kf if not.
+func keyPub(kf string) (ossh.PublicKey, error) {
+	if b, err := ioutil.ReadFile(kf + ".pub"); err == nil {
+		if pub, _, _, _, err := ossh.ParseAuthorizedKey(b); err == nil {
+			return pub, nil
+		}
+	}
+	b, err := ioutil.ReadFile(kf)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ossh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v; a %v.pub would do", kf, err, kf)
+	}
+	return s.PublicKey(), nil
+}
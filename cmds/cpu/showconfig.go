@@ -0,0 +1,168 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// showConfig is -showconfig: it prints each of cpu's flags as it is for
+// host, once the -config file and -profile are applied, and where its
+// value came from: the command line, a block of the config file, or the
+// default. After the flags comes what cpu makes of them, and of its
+// environment: whom it connects as, the keys it tries, how it checks the
+// host key, and what the remote mounts. Passwords are never shown, only
+// whether there is one.
+func showConfig(w io.Writer, host string) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	flag.VisitAll(func(f *flag.Flag) {
+		from := "default"
+		switch {
+		case configFrom[f.Name] != "":
+			from = configFrom[f.Name]
+		case set[f.Name]:
+			from = "command line"
+		}
+		val := redact(f.Name, f.Value.String())
+		if val == "" {
+			val = `""`
+		}
+		fmt.Fprintf(tw, "-%s\t%s\t%s\n", f.Name, val, from)
+	})
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "connect to\t%s@%s\t\n", os.Getenv("USER"), net.JoinHostPort(host, *port))
+	switch {
+	case *jump != "":
+		fmt.Fprintf(tw, "through\t%s\t-J\n", *jump)
+	case *connFD >= 0:
+		fmt.Fprintf(tw, "through\tfd %d\t-connfd\n", *connFD)
+	case *socks != "":
+		fmt.Fprintf(tw, "through\t%s\t-socks\n", redact("socks", *socks))
+	case *httpProxy == "none":
+	case *httpProxy != "":
+		fmt.Fprintf(tw, "through\t%s\t-httpproxy\n", redact("httpproxy", *httpProxy))
+	default:
+		for _, env := range proxyEnv {
+			if s := os.Getenv(env); s != "" {
+				fmt.Fprintf(tw, "through\t%s\t$%s, unless $NO_PROXY has the host\n", redact("httpproxy", s), env)
+				break
+			}
+		}
+	}
+	for _, env := range []string{"CPU_SOCKS_PASSWORD", "CPU_HTTPPROXY_PASSWORD"} {
+		if _, ok := os.LookupEnv(env); ok {
+			fmt.Fprintf(tw, "proxy password\tset\t$%s\n", env)
+		}
+	}
+
+	methods, err := parseAuthMethods(*authMeths)
+	if err != nil {
+		return err
+	}
+	switch kfs := *keyFiles; {
+	case !contains(methods, "publickey"):
+		fmt.Fprintf(tw, "keys\tnone\t-authmethods has no publickey\n")
+	case len(kfs) == 0:
+		fmt.Fprintf(tw, "keys\t%s%s\tdefault\n", defaultKey, missing(defaultKey))
+	default:
+		for _, kf := range kfs {
+			fmt.Fprintf(tw, "keys\t%s%s\t-key\n", kf, missing(kf))
+		}
+	}
+
+	mode, err := sshOption("StrictHostKeyChecking", "no")
+	if err != nil {
+		return err
+	}
+	switch {
+	case *hostKeyFile != "":
+		fmt.Fprintf(tw, "host key\tmust be the one in %s%s\t-hk\n", *hostKeyFile, missing(*hostKeyFile))
+	case strings.EqualFold(mode, "no") || strings.EqualFold(mode, "off"):
+		fmt.Fprintf(tw, "host key\tnot checked\tStrictHostKeyChecking %s\n", mode)
+	default:
+		fmt.Fprintf(tw, "host key\tchecked against %s%s\tStrictHostKeyChecking %s\n", knownHosts, missing(knownHosts), mode)
+	}
+
+	switch {
+	case nameSpace():
+		fmt.Fprintf(tw, "namespace\t%s, served to the remote on /tmp/cpu\t\n", *root)
+		from := "any free port"
+		switch {
+		case *port9p != "":
+			from = "-port9p"
+		case os.Getenv("CPU_PORT9P") != "":
+			from = "$CPU_PORT9P"
+		}
+		fmt.Fprintf(tw, "9p port\t%s\t%s\n", remotePort9p(), from)
+		if n, ok := os.LookupEnv("CPU_NAMESPACE"); ok {
+			fmt.Fprintf(tw, "binds\t%s\t$CPU_NAMESPACE\n", n)
+		}
+	case *subsystem != "":
+		fmt.Fprintf(tw, "namespace\tnone\t-subsystem\n")
+	case *detach:
+		fmt.Fprintf(tw, "namespace\tnone\t-detach\n")
+	case *noNameSpace:
+		fmt.Fprintf(tw, "namespace\tnone\t-nonamespace\n")
+	default:
+		fmt.Fprintf(tw, "namespace\tnone\t$CPU_NAMESPACE is empty\n")
+	}
+	return tw.Flush()
+}
+
+// missing returns " (missing)" if there is no file f, and "" if there is.
+func missing(f string) string {
+	if _, err := os.Stat(f); err != nil {
+		return " (missing)"
+	}
+	return ""
+}
+
+// redact returns the value val of the flag name with any password in it
+// replaced, for -showconfig: that of a -socks of user:password@host:port,
+// or of an -httpproxy URL.
+func redact(name, val string) string {
+	switch name {
+	case "socks":
+		i := strings.LastIndex(val, "@")
+		if i < 0 {
+			return val
+		}
+		if j := strings.Index(val[:i], ":"); j >= 0 {
+			return val[:j] + ":REDACTED" + val[i:]
+		}
+	case "httpproxy":
+		s := val
+		if !strings.Contains(s, "://") {
+			s = "http://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			if i := strings.LastIndex(val, "@"); i >= 0 {
+				return "REDACTED" + val[i:]
+			}
+			return val
+		}
+		if u.User == nil {
+			return val
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			return u.String()
+		}
+	}
+	return val
+}
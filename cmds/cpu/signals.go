@@ -0,0 +1,81 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// forwardable are the signals -forwardsignals can pass on, by name.
+var forwardable = map[string]struct {
+	local  os.Signal
+	remote ossh.Signal
+}{
+	"INT":  {syscall.SIGINT, ossh.SIGINT},
+	"QUIT": {syscall.SIGQUIT, ossh.SIGQUIT},
+	"TERM": {syscall.SIGTERM, ossh.SIGTERM},
+	"USR1": {syscall.SIGUSR1, ossh.SIGUSR1},
+	"USR2": {syscall.SIGUSR2, ossh.SIGUSR2},
+}
+
+// parseSignals checks the -forwardsignals list and returns the
+// names in it, without any SIG prefix.
+func parseSignals(s string) ([]string, error) {
+	var l []string
+	if s == "" {
+		return l, nil
+	}
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimPrefix(strings.ToUpper(n), "SIG")
+		if _, ok := forwardable[n]; !ok {
+			return nil, fmt.Errorf("forwardsignals: can not forward %q; only INT, QUIT, TERM, USR1 and USR2", n)
+		}
+		l = append(l, n)
+	}
+	return l, nil
+}
+
+// forwardSignals sends the signals named in l, when we get them, to
+// the remote command, instead of acting on them ourselves. Signals
+// not in l do what they always do. The returned function puts things
+// back as they were.
+func forwardSignals(s *ossh.Session, l []string) func() {
+	if len(l) == 0 {
+		return func() {}
+	}
+	var sigs []os.Signal
+	names := map[os.Signal]ossh.Signal{}
+	for _, n := range l {
+		f := forwardable[n]
+		sigs = append(sigs, f.local)
+		names[f.local] = f.remote
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				v("forward signal %v", sig)
+				if err := s.Signal(names[sig]); err != nil {
+					v("forward signal %v: %v", sig, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Reset(sigs...)
+		close(done)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// A snapFile is a file, directory or symlink as it was when the
+// -snapshot was taken.
+type snapFile struct {
+	fi   os.FileInfo
+	data []byte        // for a regular file
+	ents []os.FileInfo // for a directory
+	link string        // for a symlink
+}
+
+// snap is the -snapshot, by local path. It is nil unless -snapshot
+// is set, and is not changed once it is taken, so it needs no lock.
+var snap map[string]*snapFile
+
+// takeSnapshot reads -root, and every -export, into memory. From then
+// on the remote is served from there, so it sees the tree as it was
+// now, however it changes locally while the remote runs. It is an
+// error for the snapshot to be larger than -snapshotmax bytes.
+func takeSnapshot() error {
+	t := time.Now()
+	snap = map[string]*snapFile{}
+	var size int64
+	add := func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		s := &snapFile{fi: fi}
+		switch {
+		case fi.IsDir():
+			if s.ents, err = ioutil.ReadDir(p); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			if s.link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if size += fi.Size(); size > *snapMax {
+				return fmt.Errorf("more than -snapshotmax %d bytes", *snapMax)
+			}
+			if s.data, err = ioutil.ReadFile(p); err != nil {
+				return err
+			}
+		}
+		snap[p] = s
+		return nil
+	}
+	dirs := []string{*root}
+	for _, p := range exportPaths {
+		dirs = append(dirs, p)
+	}
+	for _, d := range dirs {
+		if err := filepath.Walk(d, add); err != nil {
+			snap = nil
+			return fmt.Errorf("snapshot of %v: %v", d, err)
+		}
+	}
+	verbose("snapshot: %d files, %d bytes, in %v", len(snap), size, time.Since(t))
+	return nil
+}
+
+// snapInfo returns what the snapshot has for path.
+func snapInfo(path string) (*snapFile, error) {
+	s, ok := snap[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return s, nil
+}
+
+// readAt reads from a file in the snapshot.
+func (s *snapFile) readAt(p []byte, offset int64) int {
+	if offset >= int64(len(s.data)) {
+		return 0
+	}
+	return copy(p, s.data[offset:])
+}
+
+// errSnapshot is what the remote gets when it tries to change a
+// -snapshot, which is read-only.
+var errSnapshot error = syscall.EROFS
@@ -0,0 +1,84 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+)
+
+// checkSockBufs checks -9preadbuf and -9pwritebuf.
+func checkSockBufs() error {
+	if *readBuf9p < 0 {
+		return fmt.Errorf("9preadbuf %d: must not be negative", *readBuf9p)
+	}
+	if *writeBuf9p < 0 {
+		return fmt.Errorf("9pwritebuf %d: must not be negative", *writeBuf9p)
+	}
+	return nil
+}
+
+// setSockBufs sets the kernel socket buffers of c to -9preadbuf and
+// -9pwritebuf bytes, if they are set. 9p moves over the ssh
+// connection, so that is the socket whose buffers limit it on a long,
+// fast link; the 9p forward itself is an ssh channel, with no socket
+// of its own. Through a -J jump host, or anything else that is not a
+// TCP connection here, there is nothing we can set.
+// The kernel may give us less than we asked for, e.g. on Linux no more
+// than net.core.rmem_max and net.core.wmem_max allow; then we warn,
+// since the user asked for it and is not getting it.
+func setSockBufs(c net.Conn) {
+	if *readBuf9p == 0 && *writeBuf9p == 0 {
+		return
+	}
+	tc, ok := tcpConn(c)
+	if !ok {
+		v("socket buffers: %T is not a TCP connection; not setting them", c)
+		return
+	}
+	set := func(name string, want, opt int, f func(int) error) {
+		if want == 0 {
+			return
+		}
+		if err := f(want); err != nil {
+			log.Printf("Warning: setting %s to %d: %v", name, want, err)
+			return
+		}
+		got, err := sockOpt(tc, opt)
+		if err != nil {
+			v("socket buffers: reading %s back: %v", name, err)
+			return
+		}
+		// Linux reports double what it was set to, so there less
+		// than twice what we asked for means it was clamped.
+		if got < sockBufScale*want {
+			log.Printf("Warning: asked for a %s of %d bytes, but the system only gave %d; see net.core.rmem_max and wmem_max, or kern.ipc.maxsockbuf", name, want, got/sockBufScale)
+			return
+		}
+		v("socket buffers: %s is %d", name, got)
+	}
+	set("-9preadbuf", *readBuf9p, syscall.SO_RCVBUF, tc.SetReadBuffer)
+	set("-9pwritebuf", *writeBuf9p, syscall.SO_SNDBUF, tc.SetWriteBuffer)
+}
+
+// sockOpt returns the value of the SOL_SOCKET option opt for c.
+func sockOpt(c *net.TCPConn, opt int) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		n    int
+		oerr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		n, oerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return n, oerr
+}
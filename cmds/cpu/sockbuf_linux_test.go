@@ -0,0 +1,59 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSockBufsClamped asks for a read buffer between net.core.rmem_max
+// and twice it, which Linux clamps to rmem_max and reads back as twice
+// that, and checks that we warn; and for one well under it, which we
+// get, and checks that we do not.
+func TestSockBufsClamped(t *testing.T) {
+	b, err := ioutil.ReadFile("/proc/sys/net/core/rmem_max")
+	if err != nil {
+		t.Skipf("reading rmem_max: %v", err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range []struct {
+		want int
+		warn bool
+	}{
+		{want: max / 4},
+		{want: max + max/2, warn: true},
+	} {
+		out.Reset()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		restore := setFlags(t, map[string]string{"9preadbuf": strconv.Itoa(tt.want)})
+		setSockBufs(c)
+		restore()
+		c.Close()
+		if got := strings.Contains(out.String(), "Warning"); got != tt.warn {
+			t.Errorf("-9preadbuf %d, with rmem_max %d: warned %v, want %v: %q", tt.want, max, got, tt.warn, out.String())
+		}
+	}
+}
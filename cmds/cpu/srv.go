@@ -5,22 +5,107 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/flateconn"
 	"github.com/u-root/u-root/pkg/ulog"
 )
 
+// tearingDown is closed once the session is over.
+var tearingDown = make(chan struct{})
+
+// An export is the 9p server for our namespace. It is made once for
+// the session, and the connection of each nonce handshake, if one is
+// tried again, is served by the same one. A fanout serves one to many
+// remotes at once.
+type export struct {
+	root string
+	p9s  *p9.Server
+}
+
+// newExport makes an export of root.
+func newExport(root string) *export {
+	var opts []p9.ServerOpt
+	// If we are debugging, add the option to trace records.
+	if *dbg9p {
+		if *dump {
+			log.SetOutput(dumpWriter)
+			log.SetFlags(log.Ltime | log.Lmicroseconds)
+			ulog.Log = log.New(dumpWriter, "9p", log.Ltime|log.Lmicroseconds)
+		}
+		opts = append(opts, p9.WithServerLogger(ulog.Log))
+	}
+	var a p9.Attacher = &cpu9p{path: root}
+	if wrapFS != nil {
+		a = wrapFS(a)
+	}
+	return &export{root: root, p9s: p9.NewServer(a, opts...)}
+}
+
+// wrapFS, if not nil, wraps what an export serves. It is only set by
+// tests, e.g. to inject faults with cputest.Faults.Attacher.
+var wrapFS func(p9.Attacher) p9.Attacher
+
+// srv serves 9p on the first connection to l that presents the nonce n.
+// The result of the nonce handshake is sent on handshake, which must be
+// buffered. If the handshake fails, srv closes l and returns, so the
+// caller can try again with a new listener and nonce.
+// done is closed when the session the connection is for is over.
+// l is only ever accepted on once.
+// srv returns the handshake error, if any, once it is done serving.
 // Made harder as you can't set a read deadline on ssh.Conn
-func srv(l net.Listener, root string, n nonce, deadline time.Duration) {
+func (e *export) srv(l net.Listener, n nonce, deadline time.Duration, handshake chan<- error, done <-chan struct{}) error {
+	c, err := accept9p(l, n, deadline, true)
+	if err != nil {
+		log.Printf("srv: %v", err)
+		handshake <- err
+		return err
+	}
+	handshake <- nil
+	mountDone()
+	if *prefetch != "" {
+		go warm(*prefetch, e.root)
+	}
+	e.serve(c, done)
+	return nil
+}
+
+// srvCheck serves 9p, for a check run before the session, -verify9p
+// or -mountcheck, on the first connection to l that presents the nonce n,
+// until done is closed or the remote goes away. Unlike srv, it is not
+// the session's mount: if the remote does not connect in time it does
+// not end cpu, and it neither stops -hangtimeout nor starts -prefetch.
+// A check that goes wrong only fails the check.
+func (e *export) srvCheck(l net.Listener, n nonce, deadline time.Duration, done <-chan struct{}) {
+	c, err := accept9p(l, n, deadline, false)
+	if err != nil {
+		v("srv: check: %v", err)
+		return
+	}
+	e.serve(c, done)
+}
+
+// accept9p accepts the one connection on l, and checks that it
+// presents the nonce n. l is closed when it returns; if there is
+// an error, so is the connection.
+// If the remote does not connect within the deadline, cpu exits
+// if fatal is set; otherwise accept9p returns an error.
+func accept9p(l net.Listener, n nonce, deadline time.Duration, fatal bool) (net.Conn, error) {
 	// We only accept once
 	defer l.Close()
+	t := time.Now()
+	// If we give up waiting, nothing reads errs, so the accept
+	// must not block on it.
 	var (
-		errs = make(chan error)
+		errs = make(chan error, 1)
 		c    net.Conn
 		err  error
 	)
@@ -32,9 +117,13 @@ func srv(l net.Listener, root string, n nonce, deadline time.Duration) {
 			return
 		}
 		v("srv got %v", c)
-		var rn nonce
-		if _, err := io.ReadAtLeast(c, rn[:], len(rn)); err != nil {
-			errs <- fmt.Errorf("Reading nonce from remote: %v", err)
+		if *noNonce {
+			errs <- nil
+			return
+		}
+		rn, err := readNonce(c)
+		if err != nil {
+			errs <- err
 			return
 		}
 		v("srv: read the nonce back got %s", rn)
@@ -54,28 +143,176 @@ func srv(l net.Listener, root string, n nonce, deadline time.Duration) {
 	// To be continued ...
 	select {
 	case <-time.After(deadline):
-		log.Fatalf("cpud did not connect for more than %v", deadline)
+		if !fatal {
+			return nil, fmt.Errorf("cpud did not connect for more than %v", deadline)
+		}
+		flushDump()
+		log.Printf("cpud did not connect for more than %v", deadline)
+		os.Exit(exitMount)
 	case err := <-errs:
 		if err != nil {
-			log.Fatalf("srv: %v", err)
+			if c != nil {
+				c.Close()
+			}
+			return nil, err
 		}
 	}
-	// If we are debugging, add the option to trace records.
-	if *dbg9p {
-		if *dump {
-			log.SetOutput(dumpWriter)
-			log.SetFlags(log.Ltime | log.Lmicroseconds)
-			ulog.Log = log.New(dumpWriter, "9p", log.Ltime|log.Lmicroseconds)
+	phase("9p mount", t)
+	return c, nil
+}
+
+// readNonce reads the nonce the remote presents on c.
+func readNonce(c net.Conn) (nonce, error) {
+	var n nonce
+	if _, err := io.ReadAtLeast(c, n[:], len(n)); err != nil {
+		return n, fmt.Errorf("Reading nonce from remote: %v", err)
+	}
+	return n, nil
+}
+
+// A fanout serves one export, on one listener, to many remotes at
+// once, e.g. a build coordinator giving the same tree to many workers.
+// Each remote is let in by allow, with a nonce of its own, which it
+// must present within the deadline, and which lets in only one
+// connection. Each connection is served, and torn down, on its own:
+// one remote going, or being ended, does not touch the others.
+// -nononce does not apply; the nonce is what tells remotes apart.
+type fanout struct {
+	e        *export
+	l        net.Listener
+	deadline time.Duration
+
+	mu      sync.Mutex
+	remotes map[string]*fanRemote
+}
+
+// A fanRemote is one remote a fanout may serve.
+type fanRemote struct {
+	c         net.Conn
+	connected chan struct{}
+	done      chan struct{}
+	ended     bool
+}
+
+// newFanout returns a fanout of e on l. It accepts nothing until serve
+// is called.
+func (e *export) newFanout(l net.Listener, deadline time.Duration) *fanout {
+	return &fanout{e: e, l: l, deadline: deadline, remotes: map[string]*fanRemote{}}
+}
+
+// allow lets one remote in with the nonce n. The channel it returns is
+// closed once the remote has connected and its nonce checked. end
+// ends the remote: the nonce no longer lets it in, and, if it has
+// connected, its connection is closed.
+func (f *fanout) allow(n nonce) (connected <-chan struct{}, end func()) {
+	r := &fanRemote{connected: make(chan struct{}), done: make(chan struct{})}
+	f.mu.Lock()
+	f.remotes[n.String()] = r
+	f.mu.Unlock()
+	return r.connected, func() { f.end(n.String(), r) }
+}
+
+// end ends the remote r, let in with the nonce k.
+func (f *fanout) end(k string, r *fanRemote) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.ended {
+		return
+	}
+	r.ended = true
+	close(r.done)
+	if f.remotes[k] == r {
+		delete(f.remotes, k)
+	}
+	if r.c != nil {
+		r.c.Close()
+	}
+}
+
+// serve accepts connections on l until it is closed, and serves each
+// one that presents a nonce allow has let in.
+func (f *fanout) serve() error {
+	for {
+		c, err := f.l.Accept()
+		if err != nil {
+			return fmt.Errorf("accept 9p socket: %v", err)
 		}
-		if err := p9.NewServer(&cpu9p{path: root}, p9.WithServerLogger(ulog.Log)).Handle(c, c); err != nil {
-			if err != io.EOF {
-				log.Printf("Serving cpu remote: %v", err)
-			}
+		go f.handshake(c)
+	}
+}
+
+// handshake checks the nonce c presents, and, if allow let it in, and
+// no connection has used it yet, serves c until the remote goes away
+// or is ended. Any other connection is closed.
+// As in accept9p, we can not set a read deadline on every kind of
+// connection, so one that is slow to send its nonce is closed instead.
+func (f *fanout) handshake(c net.Conn) {
+	t := time.AfterFunc(f.deadline, func() { c.Close() })
+	n, err := readNonce(c)
+	if !t.Stop() {
+		err = fmt.Errorf("remote did not send its nonce for more than %v", f.deadline)
+	}
+	if err != nil {
+		log.Printf("fanout: %v", err)
+		c.Close()
+		return
+	}
+	k := n.String()
+	f.mu.Lock()
+	r, ok := f.remotes[k]
+	if ok {
+		// The nonce is spent: only this connection gets in with it.
+		delete(f.remotes, k)
+		r.c = c
+	}
+	f.mu.Unlock()
+	if !ok {
+		log.Printf("fanout: %v presented a nonce that is not let in", c.RemoteAddr())
+		c.Close()
+		return
+	}
+	close(r.connected)
+	f.e.serve(c, r.done)
+	f.end(k, r)
+}
+
+// serve serves 9p on c until the remote goes away, then closes c.
+func (e *export) serve(c net.Conn, done <-chan struct{}) {
+	defer c.Close()
+	// Keys are only typed to a pty; with -noterminal, what we send
+	// on stdin is as much bulk as 9p is.
+	if *prioKeys && !*noTerm {
+		c = &qosConn{Conn: c}
+	}
+	if *compress9p {
+		fc, err := flateconn.New(c, *compressLvl)
+		if err != nil {
+			log.Printf("srv: %v", err)
+			return
 		}
+		c = fc
 	}
-	if err := p9.NewServer(&cpu9p{path: root}).Handle(c, c); err != nil {
-		if err != io.EOF {
-			log.Printf("Serving cpu remote: %v", err)
+	serveErr(e.p9s.Handle(c, c), done)
+}
+
+// serveErr reports an error from serving 9p.
+// When the session ends the remote closes the 9p connection, and the
+// server sees that as an error. With -q9perrors, connection errors
+// once the session is over, i.e. done is closed, are only shown in
+// debug output. The remote
+// may close the connection a little before we hear the session is
+// over, so we give it a moment before we decide an error is real.
+func serveErr(err error, done <-chan struct{}) {
+	if err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+	if *q9perrors && errors.As(err, new(p9.ConnError)) {
+		select {
+		case <-done:
+			v("srv: 9p connection closed at end of session: %v", err)
+			return
+		case <-time.After(time.Second):
 		}
 	}
+	log.Printf("Serving cpu remote: %v", err)
 }
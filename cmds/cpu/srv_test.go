@@ -0,0 +1,231 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/cputest"
+)
+
+// dialExport connects to l as a remote would, presents the nonce n,
+// and attaches.
+func dialExport(t *testing.T, l net.Listener, n nonce) (*p9.Client, p9.File, error) {
+	t.Helper()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(n[:]); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	cl, err := p9.NewClient(c)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	root, err := cl.Attach("")
+	if err != nil {
+		cl.Close()
+		return nil, nil, err
+	}
+	return cl, root, nil
+}
+
+func newNonce(t *testing.T) nonce {
+	t.Helper()
+	n, err := generateNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestFanout serves one export to two remotes at once, and checks that
+// a nonce that was not let in, or was spent, gets nothing, and that
+// ending one remote leaves the other served.
+func TestFanout(t *testing.T) {
+	r := tempRoot(t, map[string]string{"f": "shared"})
+	defer os.RemoveAll(r)
+	defer setFlags(t, map[string]string{"root": r})()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := newExport(r).newFanout(l, time.Second)
+	go f.serve()
+
+	n1, n2 := newNonce(t), newNonce(t)
+	connected1, end1 := f.allow(n1)
+	_, end2 := f.allow(n2)
+	defer end2()
+	cl1, root1, err := dialExport(t, l, n1)
+	if err != nil {
+		t.Fatalf("remote 1: %v", err)
+	}
+	defer cl1.Close()
+	cl2, root2, err := dialExport(t, l, n2)
+	if err != nil {
+		t.Fatalf("remote 2: %v", err)
+	}
+	defer cl2.Close()
+	select {
+	case <-connected1:
+	case <-time.After(time.Second):
+		t.Errorf("remote 1 connected, and allow did not say so")
+	}
+	for i, root := range []p9.File{root1, root2} {
+		b, err := readFile(root, "f")
+		if err != nil || string(b) != "shared" {
+			t.Errorf("remote %d: f is %q, %v, want %q", i+1, b, err, "shared")
+		}
+	}
+
+	if cl, _, err := dialExport(t, l, newNonce(t)); err == nil {
+		cl.Close()
+		t.Errorf("a nonce that was not let in: got served")
+	}
+	if cl, _, err := dialExport(t, l, n1); err == nil {
+		cl.Close()
+		t.Errorf("a nonce that was spent: got served")
+	}
+
+	end1()
+	if _, err := readFile(root1, "f"); err == nil {
+		t.Errorf("remote 1, ended: read f, want an error")
+	}
+	if b, err := readFile(root2, "f"); err != nil || string(b) != "shared" {
+		t.Errorf("remote 2, once remote 1 is ended: f is %q, %v, want %q", b, err, "shared")
+	}
+}
+
+// TestFanoutDeadline checks that a connection that does not present
+// its nonce in time is closed, and that ending a remote before it
+// connects keeps it out.
+func TestFanoutDeadline(t *testing.T) {
+	r := tempRoot(t, nil)
+	defer os.RemoveAll(r)
+	defer setFlags(t, map[string]string{"root": r})()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f := newExport(r).newFanout(l, 100*time.Millisecond)
+	go f.serve()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("a connection with no nonce: read worked, want it closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("a connection with no nonce: still open after 5s")
+	}
+
+	n := newNonce(t)
+	_, end := f.allow(n)
+	end()
+	if cl, _, err := dialExport(t, l, n); err == nil {
+		cl.Close()
+		t.Errorf("a remote that was ended: got served")
+	}
+}
+
+// TestSrvCheck checks that a check's 9p server, such as -verify9p's,
+// neither ends cpu when the remote does not connect, nor, when it
+// does, counts as the session's mount.
+func TestSrvCheck(t *testing.T) {
+	r := tempRoot(t, map[string]string{"f": "check"})
+	defer os.RemoveAll(r)
+	defer setFlags(t, map[string]string{"root": r, "prefetch": ""})()
+	mounted, mountedOnce = make(chan struct{}), sync.Once{}
+	e := newExport(r)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.srvCheck(l, newNonce(t), 50*time.Millisecond, tearingDown)
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newNonce(t)
+	served := make(chan struct{})
+	go func() {
+		e.srvCheck(l, n, time.Second, tearingDown)
+		close(served)
+	}()
+	cl, root, err := dialExport(t, l, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := readFile(root, "f"); err != nil || string(b) != "check" {
+		t.Errorf("f is %q, %v, want %q", b, err, "check")
+	}
+	cl.Close()
+	<-served
+	select {
+	case <-mounted:
+		t.Errorf("a check's 9p server counted as the session's mount")
+	default:
+	}
+}
+
+// TestServedFaults injects faults into what cpu serves, and checks that
+// the remote gets them over 9p, and that, with none, it is served.
+func TestServedFaults(t *testing.T) {
+	r := tempRoot(t, map[string]string{"f": "served"})
+	defer os.RemoveAll(r)
+	defer func() { wrapFS = nil }()
+	for i, tt := range []struct {
+		faults *cputest.Faults
+		want   error
+	}{
+		{faults: &cputest.Faults{}},
+		{faults: &cputest.Faults{ShortReadRate: 1}},
+		{faults: &cputest.Faults{ErrorRate: 1}, want: syscall.EIO},
+		{faults: &cputest.Faults{ErrorRate: 1, Err: syscall.EACCES}, want: syscall.EACCES},
+	} {
+		wrapFS = tt.faults.Attacher
+		err := session(t, func(rem *cputest.Remote) error {
+			_, f, err := rem.Root.Walk([]string{"f"})
+			switch {
+			case tt.want == nil && err != nil:
+				return fmt.Errorf("walk f: %v", err)
+			case tt.want == nil:
+			case err == nil:
+				f.Close()
+				return fmt.Errorf("walk f: got nil, want %v", tt.want)
+			case err.Error() != tt.want.Error():
+				return fmt.Errorf("walk f: got %v, want %v", err, tt.want)
+			default:
+				return nil
+			}
+			defer f.Close()
+			if b, err := readFile(rem.Root, "f"); err != nil || string(b) != "served" {
+				return fmt.Errorf("f is %q, %v, want %q", b, err, "served")
+			}
+			return nil
+		}, map[string]string{"root": r}, "date")
+		if err != nil {
+			t.Errorf("faults %d: %v", i, err)
+		}
+	}
+}
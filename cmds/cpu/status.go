@@ -0,0 +1,130 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// The status channel is how cpud tells us about the remote command,
+// e.g. its pid. It is another remote forward, which cpud dials and
+// authenticates with the same nonce it uses for 9p. Then it writes
+// lines of the form
+//	key value
+// which handleStatus acts on. We can write lines of the same form
+// back, with tellStatus.
+
+// statusConn is the status channel, once cpud has connected to it.
+var statusConn struct {
+	sync.Mutex
+	c net.Conn
+}
+
+// wantStatus returns true if any flag needs the status channel.
+// A -subsystem has no cpud to talk to, so it never does.
+func wantStatus() bool {
+	return *subsystem == "" && (*pidFile != "" || *remount9p || *showRusage || *exportAllow != "")
+}
+
+// statusChannel sets up the status channel, authenticated by n,
+// and returns the remote port cpud should connect to.
+func statusChannel(cl *ossh.Client, n nonce) (string, error) {
+	l, port, err := listenRemote(cl, "0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			v("status: accept: %v", err)
+			return
+		}
+		defer c.Close()
+		if !*noNonce {
+			var rn nonce
+			if _, err := io.ReadAtLeast(c, rn[:], len(rn)); err != nil {
+				log.Printf("status: reading nonce: %v", err)
+				return
+			}
+			if rn != n {
+				log.Printf("status: nonce mismatch: got %s but want %s", rn, n)
+				return
+			}
+		}
+		statusConn.Lock()
+		statusConn.c = c
+		statusConn.Unlock()
+		s := bufio.NewScanner(c)
+		for s.Scan() {
+			kv := strings.SplitN(s.Text(), " ", 2)
+			if len(kv) != 2 {
+				v("status: bad line %q", s.Text())
+				continue
+			}
+			handleStatus(kv[0], kv[1])
+		}
+	}()
+	return port, nil
+}
+
+// handleStatus acts on one status line from cpud.
+func handleStatus(k, val string) {
+	v("status: %s %s", k, val)
+	switch k {
+	case "pid":
+		if *pidFile == "" {
+			return
+		}
+		if err := ioutil.WriteFile(*pidFile, []byte(val+"\n"), 0644); err != nil {
+			log.Printf("Writing pid file: %v", err)
+		}
+	case "remount":
+		if val != "ok" {
+			log.Printf("Remote could not remount the namespace: %v", val)
+			return
+		}
+		log.Printf("Remote remounted the namespace")
+	case "export":
+		exportRequest(val)
+	case "rusage":
+		select {
+		case rusageC <- val:
+		default:
+		}
+	}
+}
+
+// tellStatus sends a key and value to cpud on the status channel.
+func tellStatus(k, val string) error {
+	statusConn.Lock()
+	defer statusConn.Unlock()
+	if statusConn.c == nil {
+		return fmt.Errorf("no status channel")
+	}
+	_, err := fmt.Fprintf(statusConn.c, "%s %s\n", k, val)
+	return err
+}
+
+// removePidFile removes the -pidfile, if any, once the remote
+// command is gone.
+func removePidFile() {
+	if *pidFile == "" {
+		return
+	}
+	if err := os.Remove(*pidFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("Removing pid file: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// tcpConn returns the TCP connection c is, or is on, e.g. through an
+// HTTP proxy, if there is one.
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	if bc, ok := c.(*bufConn); ok {
+		c = bc.Conn
+	}
+	tc, ok := c.(*net.TCPConn)
+	return tc, ok
+}
+
+// keepAlive is -tcpkeepalive: 0 for Go's default, which is on, every
+// 15 seconds; less than 0 for off.
+var keepAlive time.Duration
+
+// checkTCPOpts checks -tcpkeepalive.
+func checkTCPOpts() error {
+	switch *tcpAlive {
+	case "":
+	case "off":
+		keepAlive = -1
+	default:
+		d, err := time.ParseDuration(*tcpAlive)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("tcpkeepalive %q: want off or a positive duration, e.g. 30s", *tcpAlive)
+		}
+		keepAlive = d
+	}
+	return nil
+}
+
+// setTCPOpts sets, on the connection c the ssh session runs over,
+// TCP_NODELAY as -tcpnodelay says, and SO_KEEPALIVE as -tcpkeepalive
+// does, before the handshake. Go dials with TCP_NODELAY on, which is
+// what keeps typing snappy, since Nagle's algorithm would hold each
+// key back until the last was acknowledged; -tcpnodelay=false is for
+// bulk 9p traffic on a link where the fewer packets matter more. The
+// keepalives are the kernel's, and find a dead connection even when
+// neither ssh nor 9p has anything to send.
+func setTCPOpts(c net.Conn) {
+	tc, ok := tcpConn(c)
+	if !ok {
+		if !*tcpNoDelay || keepAlive != 0 {
+			v("tcp options: %T is not a TCP connection; not setting them", c)
+		}
+		return
+	}
+	if err := tc.SetNoDelay(*tcpNoDelay); err != nil {
+		log.Printf("Warning: setting TCP_NODELAY to %v: %v", *tcpNoDelay, err)
+	}
+	switch {
+	case keepAlive < 0:
+		if err := tc.SetKeepAlive(false); err != nil {
+			log.Printf("Warning: turning off TCP keepalives: %v", err)
+		}
+	case keepAlive > 0:
+		if err := tc.SetKeepAlive(true); err != nil {
+			log.Printf("Warning: turning on TCP keepalives: %v", err)
+			return
+		}
+		if err := tc.SetKeepAlivePeriod(keepAlive); err != nil {
+			log.Printf("Warning: setting the TCP keepalive period to %v: %v", keepAlive, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/sys/unix"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// termFlag maps an ssh terminal mode opcode to a bit in
+// one of the termios flag words.
+type termFlag struct {
+	op   uint8
+	mask uint64
+}
+
+// termModes returns the ssh TerminalModes that mirror the local
+// terminal settings in t, so the remote pty starts out configured
+// like ours: same control characters, flow control, and input and
+// output processing. t must be the termios from before we went raw.
+func termModes(t *termios.Termios) ossh.TerminalModes {
+	m := ossh.TerminalModes{}
+	for op, i := range ccModes {
+		m[op] = uint32(t.Cc[i])
+	}
+	set := func(flags []termFlag, word uint64) {
+		for _, f := range flags {
+			m[f.op] = 0
+			if word&f.mask != 0 {
+				m[f.op] = 1
+			}
+		}
+	}
+	set(iflagModes, uint64(t.Iflag))
+	set(lflagModes, uint64(t.Lflag))
+	set(oflagModes, uint64(t.Oflag))
+	set(cflagModes, uint64(t.Cflag))
+	// CS7 and CS8 are values of the CSIZE field, not single bits.
+	m[ossh.CS7], m[ossh.CS8] = 0, 0
+	switch uint64(t.Cflag) & unix.CSIZE {
+	case unix.CS7:
+		m[ossh.CS7] = 1
+	case unix.CS8:
+		m[ossh.CS8] = 1
+	}
+	m[ossh.TTY_OP_ISPEED], m[ossh.TTY_OP_OSPEED] = termSpeeds(t)
+	return m
+}
@@ -0,0 +1,77 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/sys/unix"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	ccModes = map[uint8]int{
+		ossh.VINTR:    unix.VINTR,
+		ossh.VQUIT:    unix.VQUIT,
+		ossh.VERASE:   unix.VERASE,
+		ossh.VKILL:    unix.VKILL,
+		ossh.VEOF:     unix.VEOF,
+		ossh.VEOL:     unix.VEOL,
+		ossh.VEOL2:    unix.VEOL2,
+		ossh.VSTART:   unix.VSTART,
+		ossh.VSTOP:    unix.VSTOP,
+		ossh.VSUSP:    unix.VSUSP,
+		ossh.VDSUSP:   unix.VDSUSP,
+		ossh.VREPRINT: unix.VREPRINT,
+		ossh.VWERASE:  unix.VWERASE,
+		ossh.VLNEXT:   unix.VLNEXT,
+		ossh.VDISCARD: unix.VDISCARD,
+		ossh.VSTATUS:  unix.VSTATUS,
+	}
+	iflagModes = []termFlag{
+		{ossh.IGNPAR, unix.IGNPAR},
+		{ossh.PARMRK, unix.PARMRK},
+		{ossh.INPCK, unix.INPCK},
+		{ossh.ISTRIP, unix.ISTRIP},
+		{ossh.INLCR, unix.INLCR},
+		{ossh.IGNCR, unix.IGNCR},
+		{ossh.ICRNL, unix.ICRNL},
+		{ossh.IXON, unix.IXON},
+		{ossh.IXANY, unix.IXANY},
+		{ossh.IXOFF, unix.IXOFF},
+		{ossh.IMAXBEL, unix.IMAXBEL},
+	}
+	lflagModes = []termFlag{
+		{ossh.ISIG, unix.ISIG},
+		{ossh.ICANON, unix.ICANON},
+		{ossh.ECHO, unix.ECHO},
+		{ossh.ECHOE, unix.ECHOE},
+		{ossh.ECHOK, unix.ECHOK},
+		{ossh.ECHONL, unix.ECHONL},
+		{ossh.NOFLSH, unix.NOFLSH},
+		{ossh.TOSTOP, unix.TOSTOP},
+		{ossh.IEXTEN, unix.IEXTEN},
+		{ossh.ECHOCTL, unix.ECHOCTL},
+		{ossh.ECHOKE, unix.ECHOKE},
+		{ossh.PENDIN, unix.PENDIN},
+	}
+	oflagModes = []termFlag{
+		{ossh.OPOST, unix.OPOST},
+		{ossh.ONLCR, unix.ONLCR},
+		{ossh.OCRNL, unix.OCRNL},
+		{ossh.ONOCR, unix.ONOCR},
+		{ossh.ONLRET, unix.ONLRET},
+	}
+	cflagModes = []termFlag{
+		{ossh.PARENB, unix.PARENB},
+		{ossh.PARODD, unix.PARODD},
+	}
+)
+
+// termSpeeds returns the input and output speeds of t.
+// On darwin they are kept in bits per second.
+func termSpeeds(t *termios.Termios) (uint32, uint32) {
+	return uint32(t.Ispeed), uint32(t.Ospeed)
+}
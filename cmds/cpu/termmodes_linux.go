@@ -0,0 +1,118 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/sys/unix"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	ccModes = map[uint8]int{
+		ossh.VINTR:    unix.VINTR,
+		ossh.VQUIT:    unix.VQUIT,
+		ossh.VERASE:   unix.VERASE,
+		ossh.VKILL:    unix.VKILL,
+		ossh.VEOF:     unix.VEOF,
+		ossh.VEOL:     unix.VEOL,
+		ossh.VEOL2:    unix.VEOL2,
+		ossh.VSTART:   unix.VSTART,
+		ossh.VSTOP:    unix.VSTOP,
+		ossh.VSUSP:    unix.VSUSP,
+		ossh.VREPRINT: unix.VREPRINT,
+		ossh.VWERASE:  unix.VWERASE,
+		ossh.VLNEXT:   unix.VLNEXT,
+		ossh.VDISCARD: unix.VDISCARD,
+		ossh.VSWTCH:   unix.VSWTC,
+	}
+	iflagModes = []termFlag{
+		{ossh.IGNPAR, unix.IGNPAR},
+		{ossh.PARMRK, unix.PARMRK},
+		{ossh.INPCK, unix.INPCK},
+		{ossh.ISTRIP, unix.ISTRIP},
+		{ossh.INLCR, unix.INLCR},
+		{ossh.IGNCR, unix.IGNCR},
+		{ossh.ICRNL, unix.ICRNL},
+		{ossh.IUCLC, unix.IUCLC},
+		{ossh.IXON, unix.IXON},
+		{ossh.IXANY, unix.IXANY},
+		{ossh.IXOFF, unix.IXOFF},
+		{ossh.IMAXBEL, unix.IMAXBEL},
+	}
+	lflagModes = []termFlag{
+		{ossh.ISIG, unix.ISIG},
+		{ossh.ICANON, unix.ICANON},
+		{ossh.XCASE, unix.XCASE},
+		{ossh.ECHO, unix.ECHO},
+		{ossh.ECHOE, unix.ECHOE},
+		{ossh.ECHOK, unix.ECHOK},
+		{ossh.ECHONL, unix.ECHONL},
+		{ossh.NOFLSH, unix.NOFLSH},
+		{ossh.TOSTOP, unix.TOSTOP},
+		{ossh.IEXTEN, unix.IEXTEN},
+		{ossh.ECHOCTL, unix.ECHOCTL},
+		{ossh.ECHOKE, unix.ECHOKE},
+		{ossh.PENDIN, unix.PENDIN},
+	}
+	oflagModes = []termFlag{
+		{ossh.OPOST, unix.OPOST},
+		{ossh.OLCUC, unix.OLCUC},
+		{ossh.ONLCR, unix.ONLCR},
+		{ossh.OCRNL, unix.OCRNL},
+		{ossh.ONOCR, unix.ONOCR},
+		{ossh.ONLRET, unix.ONLRET},
+	}
+	cflagModes = []termFlag{
+		{ossh.PARENB, unix.PARENB},
+		{ossh.PARODD, unix.PARODD},
+	}
+
+	// Linux keeps the speed as a B* code in the CBAUD bits of Cflag;
+	// ssh wants it in bits per second.
+	cbaud = map[uint32]uint32{
+		unix.B50:      50,
+		unix.B75:      75,
+		unix.B110:     110,
+		unix.B134:     134,
+		unix.B150:     150,
+		unix.B200:     200,
+		unix.B300:     300,
+		unix.B600:     600,
+		unix.B1200:    1200,
+		unix.B1800:    1800,
+		unix.B2400:    2400,
+		unix.B4800:    4800,
+		unix.B9600:    9600,
+		unix.B19200:   19200,
+		unix.B38400:   38400,
+		unix.B57600:   57600,
+		unix.B115200:  115200,
+		unix.B230400:  230400,
+		unix.B460800:  460800,
+		unix.B500000:  500000,
+		unix.B576000:  576000,
+		unix.B921600:  921600,
+		unix.B1000000: 1000000,
+		unix.B1152000: 1152000,
+		unix.B1500000: 1500000,
+		unix.B2000000: 2000000,
+		unix.B2500000: 2500000,
+		unix.B3000000: 3000000,
+		unix.B3500000: 3500000,
+		unix.B4000000: 4000000,
+	}
+)
+
+// termSpeeds returns the input and output speeds of t.
+// Linux does not track them separately in the CBAUD bits.
+func termSpeeds(t *termios.Termios) (uint32, uint32) {
+	s, ok := cbaud[t.Cflag&unix.CBAUD]
+	if !ok {
+		s = 38400
+	}
+	return s, s
+}
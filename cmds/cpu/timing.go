@@ -0,0 +1,57 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// timings holds how long each phase of the session took, for -timing.
+// A phase that happens more than once, e.g. an ssh handshake
+// with each -J hop, is the sum of all of them.
+var timings = struct {
+	sync.Mutex
+	order []string
+	d     map[string]time.Duration
+}{d: map[string]time.Duration{}}
+
+// phase records that the phase name ran from start until now, for
+// -timing and -otlp.
+func phase(name string, start time.Time) {
+	if !traced() {
+		return
+	}
+	end := time.Now()
+	addSpan(name, start, end)
+	if !*timing {
+		return
+	}
+	d := end.Sub(start)
+	timings.Lock()
+	defer timings.Unlock()
+	if _, ok := timings.d[name]; !ok {
+		timings.order = append(timings.order, name)
+	}
+	timings.d[name] += d
+}
+
+// printTimings prints the phases, in the order they first finished,
+// on stderr.
+func printTimings() {
+	if !*timing {
+		return
+	}
+	timings.Lock()
+	defer timings.Unlock()
+	w := tabwriter.NewWriter(diagOut, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "phase\ttime\t\n")
+	for _, n := range timings.order {
+		fmt.Fprintf(w, "%s\t%v\t\n", n, timings.d[n].Round(time.Microsecond))
+	}
+	w.Flush()
+}
@@ -0,0 +1,96 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// verifyName is the name, at the top of -root, that -verify9p
+	// serves its test pattern under, as an -export.
+	verifyName = ".cpu-verify9p"
+	// verifySize is how big the test pattern is: several msizes,
+	// so it takes many 9p reads.
+	verifySize = 4 << 20
+)
+
+// verify9p checks that what we serve reaches the remote intact. It
+// writes a test pattern to a file here, has the remote read it back
+// through a 9p mount of e, set up just as the session's will be, and
+// checksum it, and compares that with our own checksum. Half of the
+// pattern is random, and half repeats, so that -9pcompress has both
+// kinds of data to get wrong. base is the remote command, less the
+// -aname, since the pattern is found from the top of -root.
+func verify9p(cl *ossh.Client, e *export, base string, deadline time.Duration) error {
+	d, err := ioutil.TempDir("", "cpu-verify9p")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(d)
+	b := make([]byte, verifySize)
+	if _, err := rand.Read(b[:verifySize/2]); err != nil {
+		return err
+	}
+	copy(b[verifySize/2:], bytes.Repeat([]byte("cpu verify9p 0123456789\n"), verifySize/2/24+1))
+	if err := ioutil.WriteFile(filepath.Join(d, "pattern"), b, 0600); err != nil {
+		return err
+	}
+	want := fmt.Sprintf("%x", sha256.Sum256(b))
+
+	exportMu.Lock()
+	exportPaths[verifyName] = d
+	exportMu.Unlock()
+	defer func() {
+		exportMu.Lock()
+		delete(exportPaths, verifyName)
+		exportMu.Unlock()
+	}()
+
+	var (
+		n   nonce
+		env []string
+		fl  string
+		nf  string
+	)
+	if !*noNonce {
+		if n, err = generateNonce(); err != nil {
+			return err
+		}
+		if env, fl, nf, err = sendNonce(cl, n); err != nil {
+			return err
+		}
+	}
+	l, port, err := listenRemote(cl, remotePort9p())
+	if err != nil {
+		return err
+	}
+	go e.srvCheck(l, n, deadline, tearingDown)
+	t := time.Now()
+	c := fmt.Sprintf("%s%s -port9p %v %q", base, fl, port, "sha256sum /tmp/cpu/"+verifyName+"/pattern")
+	out, err := cmdPriv(cl, c, env...)
+	if err = noNonceFile(cl, nf, err); err != nil {
+		return err
+	}
+	f := strings.Fields(string(out))
+	if len(f) == 0 {
+		return fmt.Errorf("no output from sha256sum on the remote")
+	}
+	if got := strings.ToLower(f[0]); got != want {
+		return fmt.Errorf("the remote read %d bytes with sha256 %v, but we served %v: the transport is corrupting data", verifySize, got, want)
+	}
+	verbose("verify9p: the remote read %d bytes intact in %v", verifySize, time.Since(t))
+	return nil
+}
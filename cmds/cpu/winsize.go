@@ -0,0 +1,83 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/termios"
+	ossh "golang.org/x/crypto/ssh"
+)
+
+// term is the terminal of an interactive session, and cooked its modes
+// from before we made it raw, for ~^Z to put back while we are stopped.
+var (
+	term   *termios.TTYIO
+	cooked *termios.Termios
+)
+
+// suspend is the ~^Z escape: it puts the terminal back as it was, and
+// stops us, as ^Z would, were the terminal not raw, so that the shell
+// we were run from can go on. When we are continued, e.g. with fg,
+// watchSize makes the terminal raw again.
+func suspend() {
+	if term == nil || cooked == nil {
+		return
+	}
+	if err := term.Set(cooked); err != nil {
+		v("suspend: %v", err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTSTP); err != nil {
+		v("suspend: %v", err)
+	}
+}
+
+// watchSize keeps the remote's pty the size of the terminal t, in raw
+// mode: on SIGWINCH, when the terminal is resized, and on SIGCONT, when
+// we go on after being stopped, e.g. by ~^Z, since it may have
+// been resized while we were, and we would not have been told. The
+// shell that stopped us will have set the terminal's modes back to its
+// own, so on SIGCONT they are made raw again first, or the remote would
+// get what is typed a line at a time, echoed twice. The remote's last
+// row is the -healthline's, if there is one. The returned function
+// stops watching.
+func watchSize(s *ossh.Session, t *termios.TTYIO, hl *healthLine) func() {
+	raw, err := t.Get()
+	if err != nil {
+		v("watching the terminal size: %v", err)
+		return func() {}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGWINCH, syscall.SIGCONT)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				if sig == syscall.SIGCONT {
+					if err := t.Set(raw); err != nil {
+						v("resume: making the terminal raw again: %v", err)
+					}
+				}
+				h, w := ptySize(t)
+				if hl != nil {
+					h = hl.resize(h)
+				}
+				v("%v: the window is %dx%d", sig, w, h)
+				if err := s.WindowChange(h, w); err != nil {
+					v("window change: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/sys/unix"
+)
+
+func TestWinSize(t *testing.T) {
+	ws := func(row, col uint16) *termios.Winsize {
+		return &termios.Winsize{Winsize: unix.Winsize{Row: row, Col: col}}
+	}
+	for _, tt := range []struct {
+		name string
+		ws   *termios.Winsize
+		err  error
+		h, w int
+	}{
+		{name: "a serial console, 0x0", ws: ws(0, 0), h: 24, w: 80},
+		{name: "no rows", ws: ws(0, 132), h: 24, w: 80},
+		{name: "no columns", ws: ws(50, 0), h: 24, w: 80},
+		{name: "no size", err: errors.New("inappropriate ioctl for device"), h: 24, w: 80},
+		{name: "132x50", ws: ws(50, 132), h: 50, w: 132},
+		{name: "1x1", ws: ws(1, 1), h: 1, w: 1},
+	} {
+		if h, w := winSize(tt.ws, tt.err); h != tt.h || w != tt.w {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.name, w, h, tt.w, tt.h)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// shortWriter takes at most max bytes of each write, and fails, with
+// err, once it has taken limit bytes, if limit is not 0.
+type shortWriter struct {
+	bytes.Buffer
+	max, limit int
+	err        error
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if s.limit > 0 && s.Len() >= s.limit {
+		return 0, s.err
+	}
+	if len(p) > s.max {
+		p = p[:s.max]
+	}
+	return s.Buffer.Write(p)
+}
+
+func (s *shortWriter) Close() error { return nil }
+
+func TestWriteAll(t *testing.T) {
+	in := bytes.Repeat([]byte("0123456789"), 1000)
+	errLost := errors.New("channel closed")
+	for _, tt := range []struct {
+		name string
+		w    *shortWriter
+		want int
+		err  error
+	}{
+		{name: "all at once", w: &shortWriter{max: len(in)}, want: len(in)},
+		{name: "1 byte at a time", w: &shortWriter{max: 1}, want: len(in)},
+		{name: "7 bytes at a time", w: &shortWriter{max: 7}, want: len(in)},
+		{name: "takes nothing", w: &shortWriter{}, want: 0, err: io.ErrShortWrite},
+		{name: "fails part way", w: &shortWriter{max: 7, limit: 70, err: errLost}, want: 70, err: errLost},
+	} {
+		err := writeAll(tt.w, in)
+		if err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if got := tt.w.Bytes(); !bytes.Equal(got, in[:tt.want]) {
+			t.Errorf("%s: the writer got %d bytes, want the first %d of the input", tt.name, len(got), tt.want)
+		}
+	}
+}
+
+// TestStdinShortWrites checks that stdin, forwarding to a channel that
+// takes a byte at a time, loses none of the input, tildes included.
+func TestStdinShortWrites(t *testing.T) {
+	in := "echo a~b\n~a\nx ~ y\n" + string(bytes.Repeat([]byte("paste "), 1000)) + "\n"
+	w := &shortWriter{max: 1}
+	stdin(nil, w, bytes.NewBufferString(in))
+	if got := w.String(); got != in {
+		t.Errorf("the remote got %d bytes, want %d, and they differ", len(got), len(in))
+	}
+}
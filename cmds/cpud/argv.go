@@ -0,0 +1,21 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// decodeArgv decodes the command cpu -exactargs gives us with -argv64:
+// its arguments, joined with NULs, in base64.
+func decodeArgv(s string) ([]string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("argv64: %v", err)
+	}
+	return strings.Split(string(b), "\x00"), nil
+}
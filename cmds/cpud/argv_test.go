@@ -0,0 +1,48 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// init parses cpud's flags, and it runs after the package's variables
+// are set, so the test flags have to be there by then.
+var _ = func() bool { testing.Init(); return true }()
+
+// TestDecodeArgv decodes what cpu -exactargs sends, as cpu's own
+// tests of encodeArgv check it, for the same commands.
+func TestDecodeArgv(t *testing.T) {
+	for _, tt := range []struct {
+		enc  string
+		args []string
+	}{
+		{enc: "ZGF0ZQ==", args: []string{"date"}},
+		{enc: "ZWNobwBhIGIAICBjICA=", args: []string{"echo", "a b", "  c  "}},
+		{enc: "cHJpbnRmACIlcyIAJ2l0JydzJw==", args: []string{"printf", `"%s"`, `'it''s'`}},
+		{enc: "bHMAYVxiAGNcAFxc", args: []string{"ls", `a\b`, `c\`, `\\`}},
+		{enc: "c2gALWMAZWNobyBvbmUKZWNobyB0d28K", args: []string{"sh", "-c", "echo one\necho two\n"}},
+		{enc: "dG91Y2gAACRIT01FACo=", args: []string{"touch", "", "$HOME", "*"}},
+	} {
+		got, err := decodeArgv(tt.enc)
+		if err != nil {
+			t.Errorf("decodeArgv(%q): %v", tt.enc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.args) {
+			t.Errorf("decodeArgv(%q): got %q, want %q", tt.enc, got, tt.args)
+		}
+	}
+}
+
+func TestDecodeArgvBad(t *testing.T) {
+	for _, s := range []string{"not base64!", "ZGF0ZQ"} {
+		if got, err := decodeArgv(s); err == nil || !strings.HasPrefix(err.Error(), "argv64:") {
+			t.Errorf("decodeArgv(%q): got %q, %v, want an argv64 error", s, got, err)
+		}
+	}
+}
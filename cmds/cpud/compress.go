@@ -0,0 +1,39 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/u-root/cpu/flateconn"
+	"golang.org/x/sys/unix"
+)
+
+// compress9p puts a compressor between the kernel and the 9p socket so.
+// The kernel gets one end of a socketpair, returned here, and we relay
+// between the other end and so, compressing on the way. The relay
+// runs for as long as we do, which is as long as the command.
+func compress9p(so net.Conn, level int) (*os.File, error) {
+	fz, err := flateconn.New(so, level)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	k, r := os.NewFile(uintptr(fds[0]), "9p kernel"), os.NewFile(uintptr(fds[1]), "9p relay")
+	go func() {
+		_, err := io.Copy(fz, r)
+		v("CPUD:9p compress relay to cpu done: %v", err)
+	}()
+	go func() {
+		_, err := io.Copy(r, fz)
+		v("CPUD:9p compress relay from cpu done: %v", err)
+	}()
+	return k, nil
+}
@@ -63,25 +63,100 @@
 //     it is running from outside the ssh session
 //
 // Options:
+//     -9pcompress
+//           compress the 9p channel. Set by cpu from its own -9pcompress flag.
+//     -9pcompresslevel int
+//           compression level for -9pcompress (default 5). Set by cpu.
+//     -9pkeepalive string
+//           stat /tmp/cpu whenever the 9p channel has been idle this long.
+//           Set by cpu from its own -9pkeepalive flag.
+//     -9premount
+//           when cpu asks, on the status channel, remount /tmp/cpu, and the
+//           binds of it, on a new 9p channel. A FUSE mount is not remounted:
+//           the -fuseserver goes on over the new channel, and what the
+//           command was reading or writing picks up where it left off. Set
+//           by cpu from its own -9premount flag.
+//     -aname string
+//           9p attach name to mount with. Set by cpu from its own -aname flag.
+//     -argv64 string
+//           the command to run, its arguments joined with NULs, in base64.
+//           It is run as it is, in place of the command line's arguments,
+//           which are not split on white space. Set by cpu -exactargs.
 //     -bin string
 //           path of cpu binary
+//     -cache string
+//           9p cache mode for the mount: none, loose or strict (cache=mmap).
+//           Set by cpu from its own -cache flag.
 //     -d    enable debug prints
 //     -dbg9p
 //           show 9p io
+//     -exportrequests
+//           take requests from the command, on the Unix socket in
+//           $CPU_EXPORT, for more of cpu's files, and pass them on to cpu on
+//           the status channel. Set by cpu -exportallow.
+//     -fuseserver
+//           serve a FUSE mount on fd 3 from the 9p connection on fd 4. Used by
+//           cpud itself, which starts one for -mountmode fuse. With -9premount,
+//           it takes new 9p connections, as fds, on the socket on fd 5.
 //     -hostkey string
 //           host key file
 //     -key string
 //           key file (default "$HOME/.ssh/cpu_rsa")
+//     -l
+//           run the command with a '-' prefixed to argv[0], i.e. as a login shell.
+//           Set by cpu from its own -l flag.
+//     -mountmode string
+//           kernel, fuse or auto: mount /tmp/cpu with the kernel's 9p, or with
+//           a FUSE server of our own, or with FUSE only if the kernel has no
+//           9p, or for -parallelread (the default). Set by cpu from its own -mountmode flag.
 //     -network string
 //           network to use (default "tcp")
+//     -nonce string
+//           the nonce, when cpu -noncemode arg gives it on the command line
+//           rather than in $CPUNONCE. Set by cpu.
+//     -noncefile string
+//           a file to read the nonce from, and remove, when cpu -noncemode
+//           file puts it there rather than in $CPUNONCE. Set by cpu.
+//     -nononce
+//           INSECURE. Do not write the nonce on the 9p and status channels.
+//           Set by cpu from its own -nononce flag, which must agree.
 //     -p string
 //           port to use (default "22")
+//     -parallelread int
+//           if more than 1, over a FUSE mount, keep this many reads in flight
+//           while a file is read in order; with -mountmode auto, it means
+//           FUSE. Set by cpu from its own -parallelread flag.
 //     -port9p string
 //           port9p # on remote machine for 9p mount
 //     -remote
 //           Indicates we are the remote side of the cpu session
+//     -requestexport string
+//           ask cpu, through the cpud whose socket is in $CPU_EXPORT, to serve
+//           this directory of cpu's too, and print where it is, e.g.
+//               ls $(cpud -requestexport /home/me/src)
+//           cpu decides, from its -exportallow, whether it may.
+//     -runas string
+//           uid:gid: once the mounts are made, run the command as this user,
+//           with its groups, rather than as the one cpud runs as, e.g. when
+//           cpu -sudo runs it as root. Set by cpu.
+//     -rusage
+//           when the command is done, report the user and system time and the
+//           largest resident set it used, and how it ended, to cpu on the
+//           status channel. Set by cpu from its own -rusage flag.
 //     -srv string
 //           what server to run (default none; use internal)
+//     -statusport string
+//           port # on remote machine of the cpu status channel, on which
+//           cpud reports e.g. the pid of the command. Set by cpu.
+//     -umask string
+//           umask, in octal, to run the command with. Set by cpu from its
+//           own -umask flag.
+//     -union string
+//           local or remote: mount an overlayfs union, read-only, of each part
+//           of /tmp/cpu and the directory it goes on, with that side's files
+//           on top, instead of binding the part over the directory. If the
+//           union fails, the part is bound over it. Set by cpu from its own
+//           -union flag.
 // Examples
 // In these examples, cpu runs with warning messages enabled.
 // The first message is a warning that cpu could not use overlayfs to build a
@@ -0,0 +1,168 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With -exportrequests, set by cpu -exportallow, the command can ask
+// cpu for more of its files while the session goes on. cpud listens on
+// a Unix socket, in a directory only the user can get into, and puts
+// its path in $CPU_EXPORT. cpud -requestexport path writes the path,
+// a directory on cpu's side, on it; cpud passes it on to cpu, on the
+// status channel, as "export id path", and cpu, if it allows it, serves
+// it as an export, and answers "export id ok name", or "export id error
+// why". cpud writes back "ok /tmp/cpu/name" or "error why". It is cpu
+// that decides what may be given; cpud only carries the request.
+
+// exportWait is how long a request waits for cpu's answer.
+const exportWait = 30 * time.Second
+
+// exportReplies holds, by id, where cpu's answer to each request that
+// is waiting goes.
+var exportReplies struct {
+	sync.Mutex
+	id uint64
+	c  map[string]chan string
+}
+
+// listenExports makes the socket that takes the command's requests, and
+// serves it. It returns the socket's path, and a func that removes it.
+// If cred is set, the command runs as that user, and the socket, and
+// its directory, are made the user's.
+func listenExports(cred *syscall.Credential) (string, func(), error) {
+	d, err := ioutil.TempDir("", "cpuexport")
+	if err != nil {
+		return "", nil, err
+	}
+	sock := filepath.Join(d, "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(d)
+		return "", nil, err
+	}
+	if cred != nil {
+		for _, n := range []string{d, sock} {
+			if err := os.Chown(n, int(cred.Uid), int(cred.Gid)); err != nil {
+				l.Close()
+				os.RemoveAll(d)
+				return "", nil, err
+			}
+		}
+	}
+	exportReplies.c = map[string]chan string{}
+	statusHandlers["export"] = exportReply
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				v("CPUD:exportrequests: %v", err)
+				return
+			}
+			go serveExportRequest(c)
+		}
+	}()
+	return sock, func() { l.Close(); os.RemoveAll(d) }, nil
+}
+
+// exportReply hands cpu's answer, "id ok name" or "id error why", to
+// the request it answers.
+func exportReply(val string) {
+	f := strings.SplitN(val, " ", 2)
+	exportReplies.Lock()
+	c, ok := exportReplies.c[f[0]]
+	delete(exportReplies.c, f[0])
+	exportReplies.Unlock()
+	if !ok || len(f) != 2 {
+		v("CPUD:exportrequests: answer %q to no request", val)
+		return
+	}
+	c <- f[1]
+}
+
+// serveExportRequest reads a path from c, asks cpu for it, and writes
+// back where it is, or why not.
+func serveExportRequest(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(exportWait + 5*time.Second))
+	p, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		v("CPUD:exportrequests: %v", err)
+		return
+	}
+	p = strings.TrimSuffix(p, "\n")
+	fmt.Fprintln(c, askExport(p))
+}
+
+// askExport asks cpu to serve the directory p, and returns the line
+// for the command: ok and where it is, or error and why not.
+func askExport(p string) string {
+	if p == "" || strings.ContainsAny(p, "\n\x00") {
+		return "error bad path"
+	}
+	r := make(chan string, 1)
+	exportReplies.Lock()
+	exportReplies.id++
+	id := strconv.FormatUint(exportReplies.id, 10)
+	exportReplies.c[id] = r
+	exportReplies.Unlock()
+	defer func() {
+		exportReplies.Lock()
+		delete(exportReplies.c, id)
+		exportReplies.Unlock()
+	}()
+	v("CPUD:exportrequests: asking for %q", p)
+	reportStatus("export", id+" "+p)
+	select {
+	case a := <-r:
+		if n := strings.TrimPrefix(a, "ok "); n != a {
+			return "ok " + filepath.Join("/tmp/cpu", n)
+		}
+		return a
+	case <-time.After(exportWait):
+		return "error cpu did not answer"
+	}
+}
+
+// requestExport is -requestexport: it asks cpu, through the cpud whose
+// socket is in $CPU_EXPORT, for the directory p, and prints where it is.
+func requestExport(p string) error {
+	sock := os.Getenv("CPU_EXPORT")
+	if sock == "" {
+		return fmt.Errorf("no $CPU_EXPORT: cpu was not run with -exportallow")
+	}
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(exportWait + 10*time.Second))
+	if _, err := fmt.Fprintln(c, p); err != nil {
+		return err
+	}
+	a, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no answer: %v", err)
+	}
+	a = strings.TrimSuffix(a, "\n")
+	if n := strings.TrimPrefix(a, "ok "); n != a {
+		fmt.Println(n)
+		return nil
+	}
+	// cpu's answer names the path.
+	return errors.New(strings.TrimPrefix(a, "error "))
+}
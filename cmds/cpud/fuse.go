@@ -0,0 +1,1062 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/hugelgupf/p9/p9"
+	"github.com/u-root/cpu/flateconn"
+	"golang.org/x/sys/unix"
+)
+
+// With -mountmode fuse, or auto on a kernel with no 9p, cpud is the 9p
+// client, with the p9 package's, and serves what cpu serves it to the
+// kernel over FUSE, on /tmp/cpu. Each request the kernel makes then
+// comes to us, and goes on to cpu, so it costs two more trips across
+// the kernel than with the kernel's own 9p, and one request waits for
+// another more than it would there; it is slower, most of all for
+// many small files. All it needs is /dev/fuse.
+
+// The FUSE opcodes we know. The kernel gets ENOSYS for the others,
+// and for most of them stops asking.
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseSetattr     = 4
+	fuseReadlink    = 5
+	fuseSymlink     = 6
+	fuseMkdir       = 9
+	fuseUnlink      = 10
+	fuseRmdir       = 11
+	fuseRename      = 12
+	fuseLink        = 13
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseWrite       = 16
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFsync       = 20
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseFsyncdir    = 30
+	fuseCreate      = 35
+	fuseInterrupt   = 36
+	fuseBatchForget = 42
+)
+
+const (
+	// fuseMinor is the minor version of the FUSE protocol we speak,
+	// with major version 7. We need at least 12, for the structs
+	// below to be the ones the kernel uses.
+	fuseMinor = 31
+
+	// fuseMaxWrite is the most the kernel writes in one request.
+	fuseMaxWrite = 128 << 10
+
+	// fuseRootID is the node id of /tmp/cpu.
+	fuseRootID = 1
+
+	// Bits of the FUSE init, setattr and open flags.
+	fuseAsyncRead   = 1 << 0
+	fuseAtomicTrunc = 1 << 3
+	fuseBigWrites   = 1 << 5
+	fuseMaxPages    = 1 << 22
+	fattrMode       = 1 << 0
+	fattrUID        = 1 << 1
+	fattrGID        = 1 << 2
+	fattrSize       = 1 << 3
+	fattrAtime      = 1 << 4
+	fattrMtime      = 1 << 5
+	fattrAtimeNow   = 1 << 7
+	fattrMtimeNow   = 1 << 8
+	fattrCtime      = 1 << 10
+	fopenKeepCache  = 1 << 1
+)
+
+// The FUSE structs, as in linux/fuse.h, that we read and write with
+// encoding/binary, in fuseOrder.
+type (
+	fuseInHeader struct {
+		Len, Opcode    uint32
+		Unique, Nodeid uint64
+		UID, GID, PID  uint32
+		_              uint32
+	}
+	fuseOutHeader struct {
+		Len    uint32
+		Error  int32
+		Unique uint64
+	}
+	fuseAttr struct {
+		Ino, Size, Blocks, Atime, Mtime, Ctime                       uint64
+		Atimensec, Mtimensec, Ctimensec, Mode, Nlink, UID, GID, Rdev uint32
+		Blksize                                                      uint32
+		_                                                            uint32
+	}
+	fuseEntryOut struct {
+		Nodeid, Generation, EntryValid, AttrValid uint64
+		EntryValidNsec, AttrValidNsec             uint32
+		Attr                                      fuseAttr
+	}
+	fuseAttrOut struct {
+		AttrValid     uint64
+		AttrValidNsec uint32
+		_             uint32
+		Attr          fuseAttr
+	}
+	fuseInitIn struct {
+		Major, Minor, MaxReadahead, Flags uint32
+	}
+	fuseInitOut struct {
+		Major, Minor, MaxReadahead, Flags  uint32
+		MaxBackground, CongestionThreshold uint16
+		MaxWrite, TimeGran                 uint32
+		MaxPages, MapAlignment             uint16
+		Flags2                             uint32
+		_                                  [7]uint32
+	}
+	fuseSetattrIn struct {
+		Valid                           uint32
+		_                               uint32
+		Fh, Size, LockOwner             uint64
+		Atime, Mtime, Ctime             uint64
+		Atimensec, Mtimensec, Ctimensec uint32
+		Mode                            uint32
+		_                               uint32
+		UID, GID                        uint32
+		_                               uint32
+	}
+	fuseOpenIn struct {
+		Flags, OpenFlags uint32
+	}
+	fuseOpenOut struct {
+		Fh        uint64
+		OpenFlags uint32
+		_         uint32
+	}
+	fuseCreateIn struct {
+		Flags, Mode, Umask, OpenFlags uint32
+	}
+	fuseMkdirIn struct {
+		Mode, Umask uint32
+	}
+	fuseRenameIn struct {
+		Newdir uint64
+	}
+	fuseLinkIn struct {
+		Oldnodeid uint64
+	}
+	// fuseIOIn is fuse_read_in and fuse_write_in, which are the same.
+	fuseIOIn struct {
+		Fh, Offset  uint64
+		Size, Flags uint32
+		LockOwner   uint64
+		OpenFlags   uint32
+		_           uint32
+	}
+	fuseWriteOut struct {
+		Size uint32
+		_    uint32
+	}
+	// fuseReleaseIn is the start of fuse_release_in, and of
+	// fuse_fsync_in, which is all we need of either.
+	fuseReleaseIn struct {
+		Fh uint64
+	}
+	fuseForgetIn struct {
+		Nlookup uint64
+	}
+	fuseBatchForgetIn struct {
+		Count uint32
+		_     uint32
+	}
+	fuseForgetOne struct {
+		Nodeid, Nlookup uint64
+	}
+	fuseKstatfs struct {
+		Blocks, Bfree, Bavail, Files, Ffree uint64
+		Bsize, Namelen, Frsize              uint32
+		_                                   uint32
+		_                                   [6]uint32
+	}
+	fuseDirent struct {
+		Ino, Off      uint64
+		Namelen, Type uint32
+	}
+)
+
+// fuseOrder is the byte order of the FUSE structs, which is the
+// machine's own.
+var fuseOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// A fuseNode is a file the kernel has looked up, and not yet forgotten.
+type fuseNode struct {
+	f     p9.File  // walked to the file, never opened
+	path  uint64   // its QID path, which is its inode number
+	refs  uint64   // lookups the kernel has not forgotten
+	names []string // the walk to it from the root, to find it again with -9premount
+	stale bool     // with -9premount, it could not be found again
+}
+
+// A fuseFile is a file the kernel has open.
+type fuseFile struct {
+	f     p9.File
+	n     *fuseNode
+	fl    p9.OpenFlags // how it was opened, to open it again with -9premount
+	stale bool         // with -9premount, it could not be opened again
+}
+
+// fuseFS serves, on /tmp/cpu, over FUSE, the 9p tree of a p9 client.
+type fuseFS struct {
+	dev int           // the /dev/fuse fd
+	ttl time.Duration // how long the kernel may keep names and attributes
+	// keep is true if the kernel may keep a file's pages when it is
+	// opened again.
+	keep bool
+
+	// conn is held, shared, by each request while it uses the 9p
+	// connection, and by renew while it replaces it.
+	conn    sync.RWMutex
+	cl      *p9.Client
+	c9      *p9Conn       // what cl runs over
+	gen     uint64        // how many times the connection has been replaced
+	renewed chan struct{} // closed, and made again, each time it is
+
+	mu     sync.Mutex
+	nodes  map[uint64]*fuseNode // by node id
+	ids    map[uint64]uint64    // node ids, by QID path
+	next   uint64               // the last node id given out
+	files  map[uint64]*fuseFile // open files, by handle
+	nextFh uint64               // the last handle given out
+}
+
+// no9p reports whether the kernel has no 9p, and can not load it. A
+// 9p mount with no connection fails anyway, but only with ENODEV if
+// there is no such file system.
+func no9p() bool {
+	err := unix.Mount("cpu", "/tmp/cpu", "9p", unix.MS_NODEV|unix.MS_NOSUID, "trans=fd,rfdno=-1,wfdno=-1")
+	if err == nil {
+		unix.Unmount("/tmp/cpu", unix.MNT_DETACH)
+	}
+	v("CPUD:9p probe: %v", err)
+	return err == unix.ENODEV
+}
+
+// mountFuse mounts, on /tmp/cpu, with the mount flags flags, the 9p
+// tree cpu serves on c, over FUSE, and starts cpud -fuseserver to
+// serve it, which it returns. The server must be a process of its
+// own: we start the command with vfork, which holds up the rest of
+// us until the kernel has loaded it, perhaps from /tmp/cpu, which it
+// would then wait on us for. For the same reason the server, and not
+// us, does -9pcompress. The server lives in our mount namespace,
+// and so keeps it, and the mount, from going away when we exit; it
+// must be killed once the command is done, and dies with us if not.
+// With -9premount, it also returns our end of the server's control
+// socket, on which resumeFuse gives it a new 9p connection.
+func mountFuse(c *os.File, flags uintptr) (*os.Process, *net.UnixConn, error) {
+	if *mountopts != "" {
+		log.Printf("CPUD:Warning: -mountopts %q is for the kernel's 9p; FUSE does not use it", *mountopts)
+	}
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fuse: %v; the remote needs FUSE in its kernel", err)
+	}
+	// The kernel checks permissions itself, from the modes and owners
+	// cpu gives, as the kernel's 9p does; allow_other is for a command
+	// that does not run as root.
+	opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions,allow_other", dev.Fd(), os.Getuid(), os.Getgid())
+	v("CPUD: mount cpu on /tmp/cpu fuse.cpu %#x %s", flags, opts)
+	if err := unix.Mount("cpu", "/tmp/cpu", "fuse.cpu", flags, opts); err != nil {
+		dev.Close()
+		return nil, nil, fmt.Errorf("fuse mount: %v", err)
+	}
+	args := []string{"-fuseserver", "-msize", strconv.Itoa(*msize), "-cache", *cache, "-aname", *aname}
+	if *compress {
+		args = append(args, "-9pcompress", "-9pcompresslevel", strconv.Itoa(*zlevel))
+	}
+	if *parRead > 1 {
+		args = append(args, "-parallelread", strconv.Itoa(*parRead))
+	}
+	if *debug {
+		args = append(args, "-d")
+	}
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.ExtraFiles = []*os.File{dev, c}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	var ctl *net.UnixConn
+	if *remount {
+		var theirs *os.File
+		if ctl, theirs, err = ctlPair(); err != nil {
+			dev.Close()
+			unix.Unmount("/tmp/cpu", unix.MNT_DETACH)
+			return nil, nil, fmt.Errorf("fuse: control socket: %v", err)
+		}
+		defer theirs.Close()
+		cmd.Args = append(cmd.Args, "-9premount")
+		cmd.ExtraFiles = append(cmd.ExtraFiles, theirs)
+	}
+	// fail undoes the mount, and the control socket.
+	fail := func(err error) (*os.Process, *net.UnixConn, error) {
+		unix.Unmount("/tmp/cpu", unix.MNT_DETACH)
+		if ctl != nil {
+			ctl.Close()
+		}
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	// The server has its own copy of dev; closing ours means that,
+	// if it dies, the mount fails rather than hangs.
+	dev.Close()
+	if err != nil {
+		return fail(fmt.Errorf("fuse: starting the server: %v", err))
+	}
+	go cmd.Wait()
+	// This waits for the server to attach, and fails if it could not.
+	if _, err := os.Stat("/tmp/cpu"); err != nil {
+		cmd.Process.Kill()
+		return fail(fmt.Errorf("fuse: %v", err))
+	}
+	v("CPUD: fuse mount done")
+	return cmd.Process, ctl, nil
+}
+
+// ctlPair returns the two ends of a control socket for -9premount: ours,
+// and the server's, for it to have as fd 5.
+func ctlPair() (*net.UnixConn, *os.File, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	ours := os.NewFile(uintptr(fds[0]), "ctl")
+	defer ours.Close()
+	c, err := net.FileConn(ours)
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, nil, err
+	}
+	return c.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "ctl"), nil
+}
+
+// serveFuse is cpud -fuseserver: it serves FUSE, on fd 3, from the
+// 9p tree on fd 4, until the mount is gone, or it is killed. With
+// -9premount, it takes new 9p connections on the control socket, fd 5.
+// -cache loose lets the kernel keep names, attributes and file pages
+// for a second; otherwise, as with the kernel's 9p, it asks each time.
+func serveFuse() error {
+	// Once the binds are made, /etc is likely ours to serve; were
+	// a log message then the first to need the time zone, reading
+	// /etc/localtime would wait on us. So it is read now.
+	_ = time.Local.String()
+	c, err := net.FileConn(os.NewFile(4, "9p"))
+	if err != nil {
+		return fmt.Errorf("fuse: 9p connection: %v", err)
+	}
+	cl, c9, root, q, err := attach9p(c)
+	if err != nil {
+		return err
+	}
+	fs := &fuseFS{
+		dev:     3,
+		cl:      cl,
+		c9:      c9,
+		renewed: make(chan struct{}),
+		nodes:   map[uint64]*fuseNode{fuseRootID: {f: root, path: q.Path, refs: 1}},
+		ids:     map[uint64]uint64{q.Path: fuseRootID},
+		next:    fuseRootID,
+		files:   map[uint64]*fuseFile{},
+	}
+	if *cache == "loose" {
+		fs.ttl, fs.keep = time.Second, true
+	}
+	if *remount {
+		go fs.renewOnRequest(os.NewFile(5, "ctl"))
+	}
+	fs.serve()
+	return nil
+}
+
+// attach9p starts a 9p client on c, and attaches to -aname. It returns
+// the client, the connection it runs over, the root and the root's QID.
+func attach9p(c net.Conn) (*p9.Client, *p9Conn, p9.File, p9.QID, error) {
+	var err error
+	if *compress {
+		if c, err = flateconn.New(c, *zlevel); err != nil {
+			return nil, nil, nil, p9.QID{}, fmt.Errorf("fuse: 9pcompress: %v", err)
+		}
+	}
+	c9 := &p9Conn{Conn: c}
+	cl, err := p9.NewClient(c9, p9.WithMessageSize(uint32(*msize)))
+	if err != nil {
+		return nil, nil, nil, p9.QID{}, fmt.Errorf("fuse: 9p version: %v", err)
+	}
+	root, err := cl.Attach(*aname)
+	if err != nil {
+		cl.Close()
+		return nil, nil, nil, p9.QID{}, fmt.Errorf("fuse: 9p attach: %v", err)
+	}
+	q, _, _, err := root.GetAttr(p9.AttrMaskAll)
+	if err != nil {
+		cl.Close()
+		return nil, nil, nil, p9.QID{}, fmt.Errorf("fuse: 9p getattr of the root: %v", err)
+	}
+	return cl, c9, root, q, nil
+}
+
+// serve reads the kernel's requests, and answers each in a goroutine
+// of its own, so that a slow one does not hold up the rest, until
+// /tmp/cpu is unmounted.
+func (fs *fuseFS) serve() {
+	for {
+		b := make([]byte, fuseMaxWrite+unix.Getpagesize())
+		n, err := unix.Read(fs.dev, b)
+		switch err {
+		case nil:
+			go fs.handle(b[:n])
+		case unix.EINTR, unix.EAGAIN, unix.ENOENT:
+			// ENOENT is a request that was interrupted
+			// before we got it.
+		case unix.ENODEV:
+			v("CPUD:fuse: unmounted")
+			return
+		default:
+			log.Printf("CPUD:fuse: reading /dev/fuse: %v", err)
+			return
+		}
+	}
+}
+
+// handle answers the request b. With -9premount, a request that the
+// 9p connection failed under is done again once there is a new one.
+func (fs *fuseFS) handle(b []byte) {
+	var h fuseInHeader
+	if err := binary.Read(bytes.NewReader(b), fuseOrder, &h); err != nil {
+		v("CPUD:fuse: short request: %v", err)
+		return
+	}
+	body := b[binary.Size(h):]
+	var (
+		out []interface{}
+		err error
+	)
+	for {
+		fs.conn.RLock()
+		gen, c9 := fs.gen, fs.c9
+		out, err = fs.do(&h, bytes.NewReader(body), body)
+		fs.conn.RUnlock()
+		if !fs.resume(h.Opcode, err, gen, c9) {
+			break
+		}
+		v("CPUD:fuse: op %d on node %d: trying again on the new 9p connection", h.Opcode, h.Nodeid)
+	}
+	switch h.Opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// The kernel wants no answer.
+		return
+	}
+	if err != nil {
+		v("CPUD:fuse: op %d on node %d: %v", h.Opcode, h.Nodeid, err)
+	}
+	fs.reply(h.Unique, err, out...)
+}
+
+// reply answers the request unique with err, if it is not nil, and
+// with out if it is: each is written as its bytes, if it is a []byte,
+// and with encoding/binary if not.
+func (fs *fuseFS) reply(unique uint64, err error, out ...interface{}) {
+	var b bytes.Buffer
+	binary.Write(&b, fuseOrder, fuseOutHeader{Unique: unique, Error: -fuseErrno(err)})
+	if err == nil {
+		for _, o := range out {
+			if raw, ok := o.([]byte); ok {
+				b.Write(raw)
+				continue
+			}
+			binary.Write(&b, fuseOrder, o)
+		}
+	}
+	m := b.Bytes()
+	fuseOrder.PutUint32(m, uint32(len(m)))
+	// ENOENT is a request that was interrupted while we worked on it.
+	if _, err := unix.Write(fs.dev, m); err != nil && err != unix.ENOENT {
+		v("CPUD:fuse: answering %d: %v", unique, err)
+	}
+}
+
+// fuseErrno is the errno to give the kernel for err, or EIO if err is
+// not one.
+func fuseErrno(err error) int32 {
+	if err == nil {
+		return 0
+	}
+	if e, ok := p9Errno(err); ok {
+		return int32(e)
+	}
+	return int32(unix.EIO)
+}
+
+// errnoByText holds our errnos, by what they say, and by what the p9
+// package's say, where that is not the same.
+var errnoByText = func() map[string]unix.Errno {
+	m := map[string]unix.Errno{
+		"stale NFS file handle": unix.ESTALE,
+	}
+	for e := unix.Errno(1); e < 256; e++ {
+		if s := e.Error(); !strings.HasPrefix(s, "errno ") {
+			m[s] = e
+		}
+	}
+	return m
+}()
+
+// p9Errno returns the errno that err is, if it is one, e.g. cpu's answer
+// to a request, which the p9 client gives as a type internal to the p9
+// package. That type says what it is in Linux's words, so it is found
+// by what it says, which, unlike its number, is the same on every
+// GOARCH; or, if it has no words for it, as "errno" and the number.
+func p9Errno(err error) (unix.Errno, bool) {
+	if e, ok := err.(unix.Errno); ok {
+		return e, true
+	}
+	s := err.Error()
+	if e, ok := errnoByText[s]; ok {
+		return e, true
+	}
+	if n := strings.TrimPrefix(s, "errno "); n != s {
+		if e, err := strconv.Atoi(n); err == nil && e > 0 {
+			return unix.Errno(e), true
+		}
+	}
+	return 0, false
+}
+
+// names returns the NUL-terminated names at the start of b.
+func names(b []byte) []string {
+	return strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+}
+
+// do carries out the request h, with the rest of it, after the header,
+// in r and body, and returns what to answer with.
+func (fs *fuseFS) do(h *fuseInHeader, r io.Reader, body []byte) ([]interface{}, error) {
+	if h.Opcode == fuseInit {
+		return fs.init(r)
+	}
+	if h.Opcode == fuseBatchForget {
+		var in fuseBatchForgetIn
+		if err := binary.Read(r, fuseOrder, &in); err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < in.Count; i++ {
+			var f fuseForgetOne
+			if err := binary.Read(r, fuseOrder, &f); err != nil {
+				return nil, err
+			}
+			fs.forget(f.Nodeid, f.Nlookup)
+		}
+		return nil, nil
+	}
+	if h.Opcode == fuseInterrupt {
+		return nil, nil
+	}
+	n, err := fs.node(h.Nodeid)
+	if err != nil {
+		return nil, err
+	}
+	// read reads the fixed part of the request into in, and returns
+	// what follows it.
+	read := func(in interface{}) ([]byte, error) {
+		if err := binary.Read(r, fuseOrder, in); err != nil {
+			return nil, unix.EINVAL
+		}
+		return body[binary.Size(in):], nil
+	}
+	uid, gid := p9.UID(h.UID), p9.GID(h.GID)
+	switch h.Opcode {
+	case fuseLookup:
+		return fs.lookup(n, names(body)[0])
+	case fuseForget:
+		var in fuseForgetIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		fs.forget(h.Nodeid, in.Nlookup)
+		return nil, nil
+	case fuseGetattr:
+		return fs.getattr(n)
+	case fuseSetattr:
+		var in fuseSetattrIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		if err := n.f.SetAttr(setAttr(&in)); err != nil {
+			return nil, err
+		}
+		return fs.getattr(n)
+	case fuseReadlink:
+		s, err := n.f.Readlink()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{[]byte(s)}, nil
+	case fuseSymlink:
+		nm := append(names(body), "")
+		if _, err := n.f.Symlink(nm[1], nm[0], uid, gid); err != nil {
+			return nil, err
+		}
+		return fs.lookup(n, nm[0])
+	case fuseMkdir:
+		var in fuseMkdirIn
+		rest, err := read(&in)
+		if err != nil {
+			return nil, err
+		}
+		// The kernel has taken the umask off the mode.
+		nm := names(rest)[0]
+		if _, err := n.f.Mkdir(nm, p9.FileMode(in.Mode&07777), uid, gid); err != nil {
+			return nil, err
+		}
+		return fs.lookup(n, nm)
+	case fuseUnlink:
+		return nil, n.f.UnlinkAt(names(body)[0], 0)
+	case fuseRmdir:
+		return nil, n.f.UnlinkAt(names(body)[0], unix.AT_REMOVEDIR)
+	case fuseRename:
+		var in fuseRenameIn
+		rest, err := read(&in)
+		if err != nil {
+			return nil, err
+		}
+		nd, err := fs.node(in.Newdir)
+		if err != nil {
+			return nil, err
+		}
+		nm := append(names(rest), "")
+		if err := n.f.RenameAt(nm[0], nd.f, nm[1]); err != nil {
+			return nil, err
+		}
+		fs.renamed(n, nm[0], nd, nm[1])
+		return nil, nil
+	case fuseLink:
+		var in fuseLinkIn
+		rest, err := read(&in)
+		if err != nil {
+			return nil, err
+		}
+		t, err := fs.node(in.Oldnodeid)
+		if err != nil {
+			return nil, err
+		}
+		nm := names(rest)[0]
+		if err := n.f.Link(t.f, nm); err != nil {
+			return nil, err
+		}
+		return fs.lookup(n, nm)
+	case fuseOpen, fuseOpendir:
+		var in fuseOpenIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		// As the kernel's 9p does, we let the server truncate
+		// on open; there need be no setattr, which cpu does not
+		// have.
+		return fs.open(n, p9.OpenFlags(in.Flags)&(p9.OpenFlagsModeMask|unix.O_TRUNC))
+	case fuseCreate:
+		var in fuseCreateIn
+		rest, err := read(&in)
+		if err != nil {
+			return nil, err
+		}
+		return fs.create(n, names(rest)[0], p9.OpenFlags(in.Flags)&p9.OpenFlagsModeMask, p9.FileMode(in.Mode&07777), uid, gid)
+	case fuseRead:
+		var in fuseIOIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		f, err := fs.file(in.Fh)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, in.Size)
+		c, err := f.ReadAt(b, int64(in.Offset))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return []interface{}{b[:c]}, nil
+	case fuseWrite:
+		var in fuseIOIn
+		rest, err := read(&in)
+		if err != nil {
+			return nil, err
+		}
+		f, err := fs.file(in.Fh)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(rest)) < in.Size {
+			return nil, unix.EINVAL
+		}
+		c, err := f.WriteAt(rest[:in.Size], int64(in.Offset))
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{fuseWriteOut{Size: uint32(c)}}, nil
+	case fuseReaddir:
+		var in fuseIOIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		return fs.readdir(in.Fh, in.Offset, in.Size)
+	case fuseStatfs:
+		s, err := n.f.StatFS()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{fuseKstatfs{
+			Blocks: s.Blocks, Bfree: s.BlocksFree, Bavail: s.BlocksAvailable,
+			Files: s.Files, Ffree: s.FilesFree,
+			Bsize: s.BlockSize, Namelen: s.NameLength, Frsize: s.BlockSize,
+		}}, nil
+	case fuseRelease, fuseReleasedir:
+		var in fuseReleaseIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		fs.mu.Lock()
+		f, ok := fs.files[in.Fh]
+		delete(fs.files, in.Fh)
+		fs.mu.Unlock()
+		// A stale file's fid went with the old connection.
+		if ok && !f.stale {
+			f.f.Close()
+		}
+		return nil, nil
+	case fuseFsync, fuseFsyncdir:
+		var in fuseReleaseIn
+		if _, err := read(&in); err != nil {
+			return nil, err
+		}
+		f, err := fs.file(in.Fh)
+		if err != nil {
+			return nil, err
+		}
+		return nil, f.FSync()
+	case fuseFlush:
+		// 9p writes go to cpu as they are made; there is
+		// nothing held back to flush.
+		return nil, nil
+	}
+	return nil, unix.ENOSYS
+}
+
+// init answers the kernel's FUSE_INIT.
+func (fs *fuseFS) init(r io.Reader) ([]interface{}, error) {
+	var in fuseInitIn
+	if err := binary.Read(r, fuseOrder, &in); err != nil {
+		return nil, unix.EINVAL
+	}
+	v("CPUD:fuse: kernel speaks FUSE %d.%d", in.Major, in.Minor)
+	if in.Major != 7 || in.Minor < 12 {
+		log.Printf("CPUD:fuse: the kernel speaks FUSE %d.%d; we need 7.12 or later", in.Major, in.Minor)
+		return nil, unix.EPROTO
+	}
+	out := fuseInitOut{
+		Major:               7,
+		Minor:               fuseMinor,
+		MaxReadahead:        in.MaxReadahead,
+		Flags:               in.Flags & (fuseAsyncRead | fuseAtomicTrunc | fuseBigWrites | fuseMaxPages),
+		MaxBackground:       16,
+		CongestionThreshold: 12,
+		MaxWrite:            fuseMaxWrite,
+		TimeGran:            1,
+		MaxPages:            uint16(fuseMaxWrite / unix.Getpagesize()),
+	}
+	if in.Minor < out.Minor {
+		out.Minor = in.Minor
+	}
+	// Before 7.23, the kernel wants only the first 24 bytes.
+	if in.Minor < 23 {
+		var b bytes.Buffer
+		binary.Write(&b, fuseOrder, out)
+		return []interface{}{b.Bytes()[:24]}, nil
+	}
+	return []interface{}{out}, nil
+}
+
+// node returns the node with the id id.
+func (fs *fuseFS) node(id uint64) (*fuseNode, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[id]
+	if !ok || n.stale {
+		return nil, unix.ESTALE
+	}
+	return n, nil
+}
+
+// file returns the open file with the handle fh.
+func (fs *fuseFS) file(fh uint64) (p9.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[fh]
+	if !ok {
+		return nil, unix.EBADF
+	}
+	if f.stale {
+		return nil, unix.ESTALE
+	}
+	return f.f, nil
+}
+
+// forget drops n of the kernel's lookups of the node id, and, when it
+// has none left, the node.
+func (fs *fuseFS) forget(id, n uint64) {
+	if id == fuseRootID {
+		return
+	}
+	fs.mu.Lock()
+	nd, ok := fs.nodes[id]
+	if !ok {
+		fs.mu.Unlock()
+		return
+	}
+	if nd.refs > n {
+		nd.refs -= n
+		fs.mu.Unlock()
+		return
+	}
+	delete(fs.nodes, id)
+	delete(fs.ids, nd.path)
+	fs.mu.Unlock()
+	if !nd.stale {
+		nd.f.Close()
+	}
+}
+
+// valid returns the seconds and nanoseconds of fs.ttl.
+func (fs *fuseFS) valid() (uint64, uint32) {
+	return uint64(fs.ttl / time.Second), uint32(fs.ttl % time.Second)
+}
+
+// lookup walks from the directory d to name, and returns the entry
+// for it. A file the kernel already knows keeps its node, so that it
+// is one inode however it is reached.
+func (fs *fuseFS) lookup(d *fuseNode, name string) ([]interface{}, error) {
+	qids, f, _, a, err := d.f.WalkGetAttr([]string{name})
+	if err != nil {
+		return nil, err
+	}
+	if len(qids) != 1 {
+		f.Close()
+		return nil, unix.ENOENT
+	}
+	q := qids[0]
+	fs.mu.Lock()
+	// It is found again, with -9premount, by the way it was last
+	// reached.
+	nm := append(append([]string{}, d.names...), name)
+	id, ok := fs.ids[q.Path]
+	if ok {
+		n := fs.nodes[id]
+		n.refs++
+		n.names = nm
+		// One that was lost is found again.
+		if n.stale {
+			n.f, n.stale, ok = f, false, false
+		}
+	} else {
+		fs.next++
+		id = fs.next
+		fs.nodes[id] = &fuseNode{f: f, path: q.Path, refs: 1, names: nm}
+		fs.ids[q.Path] = id
+	}
+	fs.mu.Unlock()
+	if ok {
+		f.Close()
+	}
+	s, ns := fs.valid()
+	return []interface{}{fuseEntryOut{
+		Nodeid:     id,
+		EntryValid: s, EntryValidNsec: ns,
+		AttrValid: s, AttrValidNsec: ns,
+		Attr: fuseAttrOf(q, a),
+	}}, nil
+}
+
+// getattr returns the attributes of n.
+func (fs *fuseFS) getattr(n *fuseNode) ([]interface{}, error) {
+	q, _, a, err := n.f.GetAttr(p9.AttrMaskAll)
+	if err != nil {
+		return nil, err
+	}
+	s, ns := fs.valid()
+	return []interface{}{fuseAttrOut{AttrValid: s, AttrValidNsec: ns, Attr: fuseAttrOf(q, a)}}, nil
+}
+
+// fuseAttrOf returns the FUSE attributes of a file with the QID q
+// and the 9p attributes a.
+func fuseAttrOf(q p9.QID, a p9.Attr) fuseAttr {
+	return fuseAttr{
+		Ino:    q.Path,
+		Size:   a.Size,
+		Blocks: a.Blocks,
+		Atime:  a.ATimeSeconds, Atimensec: uint32(a.ATimeNanoSeconds),
+		Mtime: a.MTimeSeconds, Mtimensec: uint32(a.MTimeNanoSeconds),
+		Ctime: a.CTimeSeconds, Ctimensec: uint32(a.CTimeNanoSeconds),
+		Mode:    uint32(a.Mode),
+		Nlink:   uint32(a.NLink),
+		UID:     uint32(a.UID),
+		GID:     uint32(a.GID),
+		Rdev:    uint32(a.RDev),
+		Blksize: uint32(a.BlockSize),
+	}
+}
+
+// setAttr returns the 9p setattr for the FUSE one in.
+func setAttr(in *fuseSetattrIn) (p9.SetAttrMask, p9.SetAttr) {
+	m := p9.SetAttrMask{
+		Permissions: in.Valid&fattrMode != 0,
+		UID:         in.Valid&fattrUID != 0,
+		GID:         in.Valid&fattrGID != 0,
+		Size:        in.Valid&fattrSize != 0,
+		ATime:       in.Valid&(fattrAtime|fattrAtimeNow) != 0,
+		MTime:       in.Valid&(fattrMtime|fattrMtimeNow) != 0,
+		CTime:       in.Valid&fattrCtime != 0,
+		// Without these, 9p sets the times to now.
+		ATimeNotSystemTime: in.Valid&fattrAtime != 0 && in.Valid&fattrAtimeNow == 0,
+		MTimeNotSystemTime: in.Valid&fattrMtime != 0 && in.Valid&fattrMtimeNow == 0,
+	}
+	return m, p9.SetAttr{
+		Permissions:      p9.FileMode(in.Mode & 07777),
+		UID:              p9.UID(in.UID),
+		GID:              p9.GID(in.GID),
+		Size:             in.Size,
+		ATimeSeconds:     in.Atime,
+		ATimeNanoSeconds: uint64(in.Atimensec),
+		MTimeSeconds:     in.Mtime,
+		MTimeNanoSeconds: uint64(in.Mtimensec),
+	}
+}
+
+// addFile gives the file f, of the node n, opened with the flags fl, a
+// handle, and returns the answer to the open that opened it.
+func (fs *fuseFS) addFile(f p9.File, n *fuseNode, fl p9.OpenFlags) fuseOpenOut {
+	fs.mu.Lock()
+	fs.nextFh++
+	fh := fs.nextFh
+	fs.files[fh] = &fuseFile{f: f, n: n, fl: fl}
+	fs.mu.Unlock()
+	o := fuseOpenOut{Fh: fh}
+	if fs.keep {
+		o.OpenFlags = fopenKeepCache
+	}
+	return o
+}
+
+// open opens n, with the flags fl.
+func (fs *fuseFS) open(n *fuseNode, fl p9.OpenFlags) ([]interface{}, error) {
+	f, err := openFile(n.f, fl)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{fs.addFile(f, n, fl)}, nil
+}
+
+// openFile opens the file nf was walked to, with a fid of its own, with
+// the flags fl. With -parallelread, a file opened for reading reads
+// ahead.
+func openFile(nf p9.File, fl p9.OpenFlags) (p9.File, error) {
+	_, f, err := nf.Walk(nil)
+	if err != nil {
+		return nil, err
+	}
+	q, _, err := f.Open(fl)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if *parRead > 1 && q.Type&p9.TypeDir == 0 && fl&p9.OpenFlagsModeMask != p9.WriteOnly {
+		f = newReadAhead(f, *parRead)
+	}
+	return f, nil
+}
+
+// create makes, and opens, the file name in the directory d.
+func (fs *fuseFS) create(d *fuseNode, name string, fl p9.OpenFlags, mode p9.FileMode, uid p9.UID, gid p9.GID) ([]interface{}, error) {
+	_, c, err := d.f.Walk(nil)
+	if err != nil {
+		return nil, err
+	}
+	f, _, _, err := c.Create(name, fl, mode, uid, gid)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	e, err := fs.lookup(d, name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	n, err := fs.node(e[0].(fuseEntryOut).Nodeid)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return append(e, fs.addFile(f, n, fl)), nil
+}
+
+// readdir returns the entries, from offset, of the open directory fh,
+// as many as fit in size bytes.
+func (fs *fuseFS) readdir(fh, offset uint64, size uint32) ([]interface{}, error) {
+	f, err := fs.file(fh)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := f.Readdir(offset, size)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, e := range ents {
+		d := fuseDirent{Ino: e.QID.Path, Off: e.Offset, Namelen: uint32(len(e.Name)), Type: unix.DT_UNKNOWN}
+		switch e.Type {
+		case p9.TypeDir:
+			d.Type = unix.DT_DIR
+		case p9.TypeSymlink:
+			d.Type = unix.DT_LNK
+		}
+		l := (binary.Size(d) + len(e.Name) + 7) &^ 7
+		if b.Len()+l > int(size) {
+			break
+		}
+		binary.Write(&b, fuseOrder, d)
+		b.WriteString(e.Name)
+		b.Write(make([]byte, l-binary.Size(d)-len(e.Name)))
+	}
+	return []interface{}{b.Bytes()}, nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/hugelgupf/p9/fsimpl/templatefs"
+	"github.com/hugelgupf/p9/p9"
+	"golang.org/x/sys/unix"
+)
+
+// TestFuseSizes checks the FUSE structs against the sizes of those in
+// linux/fuse.h, which the kernel reads and writes.
+func TestFuseSizes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		v    interface{}
+		size int
+	}{
+		{name: "fuse_in_header", v: fuseInHeader{}, size: 40},
+		{name: "fuse_out_header", v: fuseOutHeader{}, size: 16},
+		{name: "fuse_attr", v: fuseAttr{}, size: 88},
+		{name: "fuse_entry_out", v: fuseEntryOut{}, size: 128},
+		{name: "fuse_attr_out", v: fuseAttrOut{}, size: 104},
+		{name: "fuse_init_in", v: fuseInitIn{}, size: 16},
+		{name: "fuse_init_out", v: fuseInitOut{}, size: 64},
+		{name: "fuse_setattr_in", v: fuseSetattrIn{}, size: 88},
+		{name: "fuse_open_in", v: fuseOpenIn{}, size: 8},
+		{name: "fuse_open_out", v: fuseOpenOut{}, size: 16},
+		{name: "fuse_create_in", v: fuseCreateIn{}, size: 16},
+		{name: "fuse_mkdir_in", v: fuseMkdirIn{}, size: 8},
+		{name: "fuse_rename_in", v: fuseRenameIn{}, size: 8},
+		{name: "fuse_link_in", v: fuseLinkIn{}, size: 8},
+		{name: "fuse_read_in", v: fuseIOIn{}, size: 40},
+		{name: "fuse_write_out", v: fuseWriteOut{}, size: 8},
+		{name: "fuse_forget_in", v: fuseForgetIn{}, size: 8},
+		{name: "fuse_batch_forget_in", v: fuseBatchForgetIn{}, size: 8},
+		{name: "fuse_forget_one", v: fuseForgetOne{}, size: 16},
+		{name: "fuse_kstatfs", v: fuseKstatfs{}, size: 80},
+		{name: "fuse_dirent", v: fuseDirent{}, size: 24},
+	} {
+		if got := binary.Size(tt.v); got != tt.size {
+			t.Errorf("%s: %d bytes, want %d", tt.name, got, tt.size)
+		}
+	}
+}
+
+// pipeFS returns a fuseFS whose answers to the kernel go to a pipe,
+// and the read end of it.
+func pipeFS(t *testing.T) (*fuseFS, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fuseFS{dev: int(w.Fd()), renewed: make(chan struct{})}, r
+}
+
+// readReply reads an answer, in one read, as the kernel does, and
+// returns its header and what follows it.
+func readReply(t *testing.T, r io.Reader) (fuseOutHeader, []byte) {
+	t.Helper()
+	b := make([]byte, 4096)
+	n, err := r.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h fuseOutHeader
+	if err := binary.Read(bytes.NewReader(b[:n]), fuseOrder, &h); err != nil {
+		t.Fatal(err)
+	}
+	if int(h.Len) != n {
+		t.Errorf("the header says %d bytes, and there are %d", h.Len, n)
+	}
+	return h, b[binary.Size(h):n]
+}
+
+func TestReply(t *testing.T) {
+	fs, r := pipeFS(t)
+	defer r.Close()
+	want := fuseAttrOut{AttrValid: 1, Attr: fuseAttr{Ino: 5, Size: 1 << 40, Mode: unix.S_IFREG | 0644, Nlink: 1, Blksize: 4096}}
+	fs.reply(7, nil, want)
+	h, b := readReply(t, r)
+	if h.Unique != 7 || h.Error != 0 {
+		t.Errorf("header: got %+v, want unique 7, error 0", h)
+	}
+	var got fuseAttrOut
+	if err := binary.Read(bytes.NewReader(b), fuseOrder, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// An error has no body, even if there is one to give.
+	fs.reply(8, unix.ENOENT, want)
+	if h, b = readReply(t, r); h.Unique != 8 || h.Error != -int32(unix.ENOENT) || len(b) != 0 {
+		t.Errorf("error: got %+v and %d bytes, want unique 8, error %d, and none", h, len(b), -int32(unix.ENOENT))
+	}
+
+	// A []byte is written as it is.
+	var raw bytes.Buffer
+	binary.Write(&raw, fuseOrder, fuseWriteOut{Size: 3})
+	raw.WriteString("abc\x00")
+	fs.reply(9, nil, fuseWriteOut{Size: 3}, []byte("abc\x00"))
+	if h, b = readReply(t, r); h.Unique != 9 || !bytes.Equal(b, raw.Bytes()) {
+		t.Errorf("raw: got %+v, %q, want unique 9, %q", h, b, raw.Bytes())
+	}
+}
+
+// TestInit hands fs an init request, as the kernel does, and checks the
+// answer, for a kernel that takes all of fuse_init_out, and one that
+// takes only the first 24 bytes of it.
+func TestInit(t *testing.T) {
+	fs, r := pipeFS(t)
+	defer r.Close()
+	for _, tt := range []struct {
+		minor, want uint32
+		size        int
+	}{
+		{minor: 31, want: fuseMinor, size: 64},
+		{minor: 40, want: fuseMinor, size: 64},
+		{minor: 22, want: 22, size: 24},
+	} {
+		var b bytes.Buffer
+		in := fuseInitIn{Major: 7, Minor: tt.minor, MaxReadahead: 1 << 17, Flags: fuseAsyncRead | fuseBigWrites | 1<<9}
+		binary.Write(&b, fuseOrder, fuseInHeader{Len: 56, Opcode: fuseInit, Unique: 1})
+		binary.Write(&b, fuseOrder, in)
+		fs.handle(b.Bytes())
+		h, body := readReply(t, r)
+		if h.Error != 0 || len(body) != tt.size {
+			t.Errorf("7.%d: got error %d and %d bytes, want 0 and %d", tt.minor, h.Error, len(body), tt.size)
+			continue
+		}
+		var out fuseInitOut
+		binary.Read(bytes.NewReader(append(body, make([]byte, 64-len(body))...)), fuseOrder, &out)
+		if out.Major != 7 || out.Minor != tt.want || out.MaxReadahead != in.MaxReadahead || out.Flags != fuseAsyncRead|fuseBigWrites {
+			t.Errorf("7.%d: got %+v, want 7.%d, readahead %d, flags %#x", tt.minor, out, tt.want, in.MaxReadahead, fuseAsyncRead|fuseBigWrites)
+		}
+	}
+	var b bytes.Buffer
+	binary.Write(&b, fuseOrder, fuseInHeader{Len: 56, Opcode: fuseInit, Unique: 2})
+	binary.Write(&b, fuseOrder, fuseInitIn{Major: 7, Minor: 11})
+	fs.handle(b.Bytes())
+	if h, _ := readReply(t, r); h.Error != -int32(unix.EPROTO) {
+		t.Errorf("7.11: got error %d, want %d", h.Error, -int32(unix.EPROTO))
+	}
+}
+
+// errFile is a 9p directory in which walking to a name, a number,
+// fails with that errno.
+type errFile struct {
+	templatefs.NoopFile
+}
+
+func (errFile) Walk(names []string) ([]p9.QID, p9.File, error) {
+	if len(names) == 0 {
+		return nil, errFile{}, nil
+	}
+	n, err := strconv.Atoi(names[0])
+	if err != nil {
+		return nil, nil, unix.ENOENT
+	}
+	return nil, nil, unix.Errno(n)
+}
+
+func (errFile) GetAttr(p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	return p9.QID{Type: p9.TypeDir, Path: 1}, p9.AttrMask{Mode: true}, p9.Attr{Mode: p9.ModeDirectory | 0755}, nil
+}
+
+func (errFile) Attach() (p9.File, error) {
+	return errFile{}, nil
+}
+
+// TestP9Errors walks to names that fail, with each errno, over a real
+// 9p connection, and checks that the errno the server gave is the one
+// the kernel gets, and that the connection is not taken as lost; and
+// then, once the connection is gone, that it is.
+func TestP9Errors(t *testing.T) {
+	sc, cc := net.Pipe()
+	go p9.NewServer(errFile{}).Handle(sc, sc)
+	cl, c9, root, _, err := attach9p(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	for e := unix.Errno(1); e <= unix.EHWPOISON; e++ {
+		_, _, err := root.Walk([]string{strconv.Itoa(int(e))})
+		if err == nil {
+			t.Errorf("walk to %v: got nil", e)
+			continue
+		}
+		if got := fuseErrno(err); got != int32(e) {
+			t.Errorf("walk to %v: fuseErrno(%v) is %d, want %d", e, err, got, e)
+		}
+		if connLost(err, c9) {
+			t.Errorf("walk to %v: %v is the connection failing, want cpu's answer", e, err)
+		}
+	}
+	sc.Close()
+	_, _, err = root.Walk([]string{"2"})
+	if err == nil {
+		t.Fatal("walk with no connection: got nil, want an error")
+	}
+	if got := fuseErrno(err); got != int32(unix.EIO) {
+		t.Errorf("walk with no connection: fuseErrno(%v) is %d, want EIO", err, got)
+	}
+	if !connLost(err, c9) {
+		t.Errorf("walk with no connection: %v is not the connection failing", err)
+	}
+}
+
+func TestConnLost(t *testing.T) {
+	ok, failed := &p9Conn{}, &p9Conn{failed: 1}
+	for _, tt := range []struct {
+		err  error
+		c    *p9Conn
+		want bool
+	}{
+		{err: nil, c: failed},
+		{err: io.EOF, c: failed},
+		{err: unix.ENOENT, c: failed},
+		{err: errors.New("wait: io: read/write on closed pipe"), c: ok},
+		{err: errors.New("wait: io: read/write on closed pipe"), c: failed, want: true},
+	} {
+		if got := connLost(tt.err, tt.c); got != tt.want {
+			t.Errorf("connLost(%v, failed %d): got %v, want %v", tt.err, tt.c.failed, got, tt.want)
+		}
+	}
+}
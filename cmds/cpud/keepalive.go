@@ -0,0 +1,48 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// keepAlive9p keeps the forwarded 9p channel from looking idle.
+// Some sshd reap forwarded channels that have carried no traffic
+// for a while; once that happens the mount is gone for good.
+// We can not inject 9p messages into the kernel's stream, but a
+// stat of the mount point makes the kernel do a walk and getattr
+// for us, which is traffic enough.
+// We only do it when the channel has been idle for d, which we
+// learn from the socket's TCP_INFO, so a busy mount sees no extra
+// traffic at all.
+func keepAlive9p(so *os.File, mnt string, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTicker(d / 2)
+	defer t.Stop()
+	for range t.C {
+		ti, err := unix.GetsockoptTCPInfo(int(so.Fd()), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			v("CPUD:keepalive: TCP_INFO: %v; giving up", err)
+			return
+		}
+		// Last_data_{sent,recv} are in milliseconds.
+		idle := time.Duration(ti.Last_data_sent) * time.Millisecond
+		if r := time.Duration(ti.Last_data_recv) * time.Millisecond; r < idle {
+			idle = r
+		}
+		if idle < d {
+			continue
+		}
+		v("CPUD:keepalive: 9p idle for %v, stat %v", idle, mnt)
+		if _, err := os.Stat(mnt); err != nil {
+			v("CPUD:keepalive: stat %v: %v", mnt, err)
+		}
+	}
+}
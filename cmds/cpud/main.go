@@ -14,9 +14,12 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	// We use this ssh because it implements port redirection.
@@ -37,17 +40,38 @@ var (
 	pubKeyFile  = flag.String("pk", "key.pub", "file for public key")
 	port        = flag.String("sp", "23", "cpu default port")
 
-	debug     = flag.Bool("d", false, "enable debug prints")
-	runAsInit = flag.Bool("init", false, "run as init (Debug only; normal test is if we are pid 1")
-	v         = func(string, ...interface{}) {}
-	remote    = flag.Bool("remote", false, "indicates we are the remote side of the cpu session")
-	network   = flag.String("network", "tcp", "network to use")
-	keyFile   = flag.String("key", filepath.Join(os.Getenv("HOME"), ".ssh/cpu_rsa"), "key file")
-	bin       = flag.String("bin", "cpu", "path of cpu binary")
-	port9p    = flag.String("port9p", "", "port9p # on remote machine for 9p mount")
-	dbg9p     = flag.String("dbg9p", "0", "show 9p io")
-	root      = flag.String("root", "/", "9p root")
-	klog      = flag.Bool("klog", false, "Log cpud messages in kernel log, not stdout")
+	debug      = flag.Bool("d", false, "enable debug prints")
+	runAsInit  = flag.Bool("init", false, "run as init (Debug only; normal test is if we are pid 1")
+	v          = func(string, ...interface{}) {}
+	remote     = flag.Bool("remote", false, "indicates we are the remote side of the cpu session")
+	network    = flag.String("network", "tcp", "network to use")
+	keyFile    = flag.String("key", filepath.Join(os.Getenv("HOME"), ".ssh/cpu_rsa"), "key file")
+	bin        = flag.String("bin", "cpu", "path of cpu binary")
+	port9p     = flag.String("port9p", "", "port9p # on remote machine for 9p mount")
+	statport   = flag.String("statusport", "", "port # on remote machine of the cpu status channel")
+	dbg9p      = flag.String("dbg9p", "0", "show 9p io")
+	root       = flag.String("root", "/", "9p root")
+	aname      = flag.String("aname", "", "9p attach name")
+	cache      = flag.String("cache", "", "9p cache mode: none, loose or strict")
+	login      = flag.Bool("l", false, "run the command as a login shell")
+	umask      = flag.String("umask", "", "if set, the umask, in octal, to run the command with")
+	klog       = flag.Bool("klog", false, "Log cpud messages in kernel log, not stdout")
+	keepalive  = flag.String("9pkeepalive", "", "if set, stat the 9p mount when the 9p channel has been idle this long")
+	compress   = flag.Bool("9pcompress", false, "compress the 9p channel")
+	zlevel     = flag.Int("9pcompresslevel", 5, "compression level for -9pcompress, 1 (fastest) to 9 (smallest)")
+	nonceArg   = flag.String("nonce", "", "the nonce, if it is not in $CPUNONCE; set by cpu -noncemode arg")
+	nonceFile  = flag.String("noncefile", "", "a file to read the nonce from, and remove, if it is not in $CPUNONCE; set by cpu -noncemode file")
+	noNonce    = flag.Bool("nononce", false, "INSECURE: do not write the nonce on the 9p and status channels; set by cpu -nononce")
+	remount    = flag.Bool("9premount", false, "remount /tmp/cpu when cpu asks, on the status channel, after the 9p channel broke; over FUSE, go on over the new channel")
+	rusage     = flag.Bool("rusage", false, "report the resources the command used to cpu on the status channel; set by cpu -rusage")
+	union      = flag.String("union", "", "if set, local or remote: mount a union of each part of the namespace and the directory it goes on, instead of binding over it, with that side's files on top; set by cpu -union")
+	runAs      = flag.String("runas", "", "uid:gid: once the mount is done, run the command as this user, with the user's groups, rather than as the user we were started as; set by cpu -sudo")
+	fuseSrv    = flag.Bool("fuseserver", false, "serve a FUSE mount on fd 3 from 9p on fd 4; used by cpud itself, for -mountmode fuse")
+	mountMode  = flag.String("mountmode", "auto", "how to mount what cpu serves: kernel, with the kernel's 9p; fuse, with our own 9p client, over FUSE; or auto, kernel if the kernel has 9p, and fuse if not, or for -parallelread")
+	parRead    = flag.Int("parallelread", 0, "if more than 1, over a FUSE mount, keep this many reads in flight while a file is read in order; set by cpu -parallelread")
+	exportReqs = flag.Bool("exportrequests", false, "take requests, on the Unix socket in $CPU_EXPORT, for more of cpu's files, and pass them on to cpu on the status channel; set by cpu -exportallow")
+	reqExport  = flag.String("requestexport", "", "ask cpu, through the cpud in $CPU_EXPORT, to serve this local directory of its own too, and print where it is here")
+	argv64     = flag.String("argv64", "", "the command, its arguments joined with NULs, in base64, to run as it is in place of the arguments; set by cpu -exactargs")
 
 	mountopts = flag.String("mountopts", "", "Extra options to add to the 9p mount")
 	msize     = flag.Int("msize", 1048576, "msize to use")
@@ -79,16 +103,58 @@ func dropPrivs() error {
 	return unix.Setregid(-1, gid)
 }
 
+// runAsUser returns the credential of the user given by -runas, as
+// uid:gid, with the user's groups, for the command to run as, when cpu
+// -sudo has made us root only so that we could mount. The ids are set
+// in the child, between fork and exec, and not in cpud: the setuid
+// calls in x/sys/unix change only the thread they run on, and the
+// command might be started from another, still root. Each id is set,
+// real, effective and saved, so the command can not get root back.
+func runAsUser(s string) (*syscall.Credential, error) {
+	f := strings.Split(s, ":")
+	if len(f) != 2 {
+		return nil, fmt.Errorf("runas %q: want uid:gid", s)
+	}
+	uid, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("runas %q: %v", s, err)
+	}
+	gid, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("runas %q: %v", s, err)
+	}
+	groups := []uint32{uint32(gid)}
+	if u, err := user.LookupId(f[0]); err == nil {
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if g, err := strconv.ParseUint(id, 10, 32); err == nil && g != gid {
+					groups = append(groups, uint32(g))
+				}
+			}
+		}
+	}
+	v("CPUD:runas: uid %d, gid %d, groups %v", uid, gid, groups)
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
 // start up a namespace. We must
 // mkdir /tmp/cpu on the remote machine
 // issue the mount command
 // test via an ls of /tmp/cpu
 // TODO: unshare first
 // We enter here as uid 0 and once the mount is done, back down.
-func runRemote(cmd, port9p string) error {
-	// Get the nonce and remove it from the environment.
-	nonce := os.Getenv("CPUNONCE")
-	os.Unsetenv("CPUNONCE")
+func runRemote(f []string, port9p string) error {
+	// Get the nonce, and remove it from the environment, or its file.
+	nonce, err := getNonce()
+	if err != nil {
+		return err
+	}
+	if *statport != "" {
+		if err := dialStatus(*statport, nonce); err != nil {
+			log.Printf("CPUD:status channel: %v", err)
+		}
+		defer closeStatus()
+	}
 	// for some reason echo is not set.
 	t, err := termios.New()
 	if err != nil {
@@ -125,77 +191,30 @@ func runRemote(cmd, port9p string) error {
 	v("CPUD:namespace is %q", bindover)
 	var fail bool
 	if len(bindover) != 0 {
-		// Connect to the socket, return the nonce.
-		a := net.JoinHostPort("127.0.0.1", port9p)
-		v("CPUD:Dial %v", a)
-		so, err := net.Dial("tcp4", a)
+		m, err := mount9p(port9p, nonce, user)
 		if err != nil {
-			log.Fatalf("CPUD:Dial 9p port: %v", err)
+			return err
 		}
-		v("CPUD:Connected: write nonce %s\n", nonce)
-		if _, err := fmt.Fprintf(so, "%s", nonce); err != nil {
-			log.Fatalf("CPUD:Write nonce: %v", err)
-		}
-		v("CPUD:Wrote the nonce")
-
 		// the kernel takes over the socket after the Mount.
-		defer so.Close()
-		flags := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
-		cf, err := so.(*net.TCPConn).File()
-		if err != nil {
-			log.Fatalf("CPUD:Cannot get fd for %v: %v", so, err)
-		}
-
-		fd := cf.Fd()
-		v("CPUD:fd is %v", fd)
-		// The debug= option is here so you can see how to temporarily set it if needed.
-		// It generates copious output so use it sparingly.
-		// A useful compromise value is 5.
-		opts := fmt.Sprintf("version=9p2000.L,trans=fd,rfdno=%d,wfdno=%d,uname=%v,debug=0,msize=%d", fd, fd, user, *msize)
-		if *mountopts != "" {
-			opts += "," + *mountopts
-		}
-		v("CPUD: mount 127.0.0.1 on /tmp/cpu 9p %#x %s", flags, opts)
-		if err := unix.Mount("127.0.0.1", "/tmp/cpu", "9p", flags, opts); err != nil {
-			return fmt.Errorf("9p mount %v", err)
+		defer m.Close()
+		var d time.Duration
+		if *keepalive != "" {
+			if d, err = time.ParseDuration(*keepalive); err != nil {
+				return fmt.Errorf("9pkeepalive: %v", err)
+			}
+			go keepAlive9p(m.cf, "/tmp/cpu", d)
 		}
-		v("CPUD: mount done")
 
 		// Further, bind / onto /tmp/local so a non-hacked-on version may be visible.
 		if err := unix.Mount("/", "/tmp/local", "", syscall.MS_BIND, ""); err != nil {
 			log.Printf("CPUD:Warning: binding / over /tmp/cpu did not work: %v, continuing anyway", err)
 		}
 
-		// In some cases if you set LD_LIBRARY_PATH it is ignored.
-		// This is disappointing to say the least. We just bind a few things into /
-		// bind *may* hide local resources but for now it's the least worst option.
-		dirs := strings.Split(bindover, ":")
-		for _, n := range dirs {
-			l, r := n, n
-			// If the value is local=remote, len(c) will be 2.
-			// The value might be some weird degenerate form such as
-			// =name or name=. That is considered to be an error.
-			// The convention is to split on the first =. It is not up
-			// to this code to determine that more than one = is an error.
-			c := strings.SplitN(n, "=", 2)
-			if len(c) == 2 {
-				l, r = c[0], c[1]
-				if len(r) == 0 {
-					return fmt.Errorf("Bad name in %q: zero-length remote name", n)
-				}
-				if len(l) == 0 {
-					return fmt.Errorf("Bad name in %q: zero-length local name", n)
-				}
-			}
-			t := filepath.Join("/tmp/cpu", r)
-			v("CPUD: mount %v over %v", t, n)
-			if err := unix.Mount(t, l, "", syscall.MS_BIND, ""); err != nil {
-				fail = true
-				log.Printf("CPUD:Warning: mounting %v on %v failed: %v", t, n, err)
-			} else {
-				v("CPUD:Mounted %v on %v", t, n)
-			}
-
+		if fail, err = bindOver(bindover); err != nil {
+			return err
+		}
+		if *remount {
+			remountOnRequest(m, user, bindover, d)
 		}
 	}
 	v("CPUD: bind mounts done")
@@ -209,15 +228,58 @@ func runRemote(cmd, port9p string) error {
 		log.Printf("CPUD: WTF done")
 	}
 	// We don't want to run as the wrong uid.
-	if err := dropPrivs(); err != nil {
+	var cred *syscall.Credential
+	if *runAs != "" {
+		if cred, err = runAsUser(*runAs); err != nil {
+			return err
+		}
+	} else if err := dropPrivs(); err != nil {
 		return err
 	}
+	// The socket is the user's, so that the command can connect to it.
+	if *exportReqs && status != nil {
+		sock, cleanup, err := listenExports(cred)
+		if err != nil {
+			log.Printf("CPUD:exportrequests: %v", err)
+		} else {
+			defer cleanup()
+			os.Setenv("CPU_EXPORT", sock)
+		}
+	}
+	go readStatus()
 	// The unmount happens for free since we unshared.
-	v("CPUD:runRemote: command is %q", cmd)
-	f := strings.Fields(cmd)
+	v("CPUD:runRemote: command is %q", f)
+	if len(f) == 0 {
+		return fmt.Errorf("no command to run")
+	}
 	c := exec.Command(f[0], f[1:]...)
+	// A login shell is one whose argv[0] starts with a '-'.
+	if *login {
+		c.Args[0] = "-" + filepath.Base(f[0])
+	}
 	c.Stdin, c.Stdout, c.Stderr, c.Dir = os.Stdin, os.Stdout, os.Stderr, os.Getenv("PWD")
-	err = c.Run()
+	if cred != nil {
+		c.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	// The umask is inherited by the command, and it is the command's
+	// umask that decides the mode of the files it creates.
+	if *umask != "" {
+		m, err := strconv.ParseUint(*umask, 8, 32)
+		if err != nil {
+			return fmt.Errorf("umask %q: %v", *umask, err)
+		}
+		unix.Umask(int(m))
+	}
+	err = c.Start()
+	if err == nil {
+		reportStatus("pid", c.Process.Pid)
+		stop := relaySignals(c.Process)
+		err = c.Wait()
+		stop()
+		if *rusage {
+			reportRusage(c.ProcessState)
+		}
+	}
 	if err != nil {
 		if fail && len(*wtf) != 0 {
 			c := exec.Command(*wtf)
@@ -232,6 +294,217 @@ func runRemote(cmd, port9p string) error {
 	return err
 }
 
+// A mnt9p holds what must stay open while the 9p mount on /tmp/cpu
+// is in use.
+type mnt9p struct {
+	so net.Conn
+	cf *os.File // the socket's fd, which the kernel reads and writes
+	kf *os.File // with -9pcompress, the kernel's end of the socketpair
+	// fuse is the cpud -fuseserver, if the mount is over FUSE.
+	fuse *os.Process
+	// ctl is, with -9premount, our end of the server's control socket.
+	ctl *net.UnixConn
+}
+
+// Close closes everything m holds.
+func (m *mnt9p) Close() {
+	m.so.Close()
+	m.cf.Close()
+	if m.kf != nil {
+		m.kf.Close()
+	}
+	if m.fuse != nil {
+		m.fuse.Kill()
+	}
+	if m.ctl != nil {
+		m.ctl.Close()
+	}
+}
+
+// getNonce returns the nonce cpu gave us: with -nonce, on the command
+// line, with -noncefile, in a file, which it removes, so that it is only
+// ever good for one session, or else in $CPUNONCE, which it unsets, so
+// that the command does not get it.
+func getNonce() (string, error) {
+	n := os.Getenv("CPUNONCE")
+	os.Unsetenv("CPUNONCE")
+	switch {
+	case *nonceArg != "":
+		return *nonceArg, nil
+	case *nonceFile != "":
+		b, err := ioutil.ReadFile(*nonceFile)
+		if err != nil {
+			return "", fmt.Errorf("noncefile: %v", err)
+		}
+		if err := os.Remove(*nonceFile); err != nil {
+			log.Printf("CPUD:Warning: removing the nonce file: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return n, nil
+}
+
+// mount9p connects to the socket cpu forwarded for 9p, returns the
+// nonce, and mounts it on /tmp/cpu.
+func mount9p(port9p, nonce, user string) (*mnt9p, error) {
+	switch *mountMode {
+	case "auto", "kernel", "fuse":
+	default:
+		return nil, fmt.Errorf("mountmode %q: must be auto, kernel or fuse", *mountMode)
+	}
+	if *parRead < 0 || *parRead > maxParallelRead {
+		return nil, fmt.Errorf("parallelread %d: must be from 0 to %d", *parRead, maxParallelRead)
+	}
+	fuse := *mountMode == "fuse"
+	switch {
+	case *mountMode == "auto" && no9p():
+		log.Printf("CPUD:Warning: the kernel has no 9p; mounting /tmp/cpu with FUSE, which is slower")
+		fuse = true
+	case *mountMode == "auto" && *parRead > 1:
+		// The kernel's 9p reads one piece at a time; only
+		// our own client can read ahead.
+		v("CPUD:-parallelread %d: mounting /tmp/cpu with FUSE", *parRead)
+		fuse = true
+	case *mountMode == "kernel" && *parRead > 1:
+		log.Printf("CPUD:Warning: -parallelread needs a FUSE mount; the kernel's 9p reads one piece at a time")
+	}
+	so, cf, err := dial9p(port9p, nonce)
+	if err != nil {
+		return nil, err
+	}
+	flags := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
+	m := &mnt9p{so: so, cf: cf}
+	if fuse {
+		if m.fuse, m.ctl, err = mountFuse(cf, flags); err != nil {
+			m.Close()
+			return nil, err
+		}
+		return m, nil
+	}
+
+	fd := cf.Fd()
+	if *compress {
+		if m.kf, err = compress9p(so, *zlevel); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("9pcompress: %v", err)
+		}
+		fd = m.kf.Fd()
+	}
+	v("CPUD:fd is %v", fd)
+	// The debug= option is here so you can see how to temporarily set it if needed.
+	// It generates copious output so use it sparingly.
+	// A useful compromise value is 5.
+	opts := fmt.Sprintf("version=9p2000.L,trans=fd,rfdno=%d,wfdno=%d,uname=%v,debug=0,msize=%d", fd, fd, user, *msize)
+	if *aname != "" {
+		opts += ",aname=" + *aname
+	}
+	// strict is our name: there is no such 9p cache mode. The
+	// closest is mmap, which only caches pages that are mapped,
+	// e.g. of programs and libraries, together with cpu telling
+	// us, in the QID version, when a file has changed.
+	switch *cache {
+	case "":
+	case "none", "loose":
+		opts += ",cache=" + *cache
+	case "strict":
+		opts += ",cache=mmap"
+	default:
+		m.Close()
+		return nil, fmt.Errorf("cache %q: must be none, loose or strict", *cache)
+	}
+	if *mountopts != "" {
+		opts += "," + *mountopts
+	}
+	v("CPUD: mount 127.0.0.1 on /tmp/cpu 9p %#x %s", flags, opts)
+	if err := unix.Mount("127.0.0.1", "/tmp/cpu", "9p", flags, opts); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("9p mount %v", err)
+	}
+	v("CPUD: mount done")
+	return m, nil
+}
+
+// dial9p connects to the socket cpu forwarded for 9p, on port9p, and
+// returns the nonce. It returns the connection, and its fd.
+func dial9p(port9p, nonce string) (net.Conn, *os.File, error) {
+	a := net.JoinHostPort("127.0.0.1", port9p)
+	v("CPUD:Dial %v", a)
+	so, err := net.Dial("tcp4", a)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Dial 9p port: %v", err)
+	}
+	if !*noNonce {
+		v("CPUD:Connected: write nonce %s\n", nonce)
+		if _, err := fmt.Fprintf(so, "%s", nonce); err != nil {
+			so.Close()
+			return nil, nil, fmt.Errorf("Write nonce: %v", err)
+		}
+		v("CPUD:Wrote the nonce")
+	}
+	cf, err := so.(*net.TCPConn).File()
+	if err != nil {
+		so.Close()
+		return nil, nil, fmt.Errorf("Cannot get fd for %v: %v", so, err)
+	}
+	return so, cf, nil
+}
+
+// bindPair splits one element of the namespace, local=remote or
+// just name, into the local and remote names.
+func bindPair(n string) (string, string, error) {
+	l, r := n, n
+	// If the value is local=remote, len(c) will be 2.
+	// The value might be some weird degenerate form such as
+	// =name or name=. That is considered to be an error.
+	// The convention is to split on the first =. It is not up
+	// to this code to determine that more than one = is an error.
+	c := strings.SplitN(n, "=", 2)
+	if len(c) == 2 {
+		l, r = c[0], c[1]
+		if len(r) == 0 {
+			return "", "", fmt.Errorf("Bad name in %q: zero-length remote name", n)
+		}
+		if len(l) == 0 {
+			return "", "", fmt.Errorf("Bad name in %q: zero-length local name", n)
+		}
+	}
+	return l, r, nil
+}
+
+// bindOver binds the parts of /tmp/cpu named in bindover over
+// their local counterparts. It returns true if any of them failed.
+func bindOver(bindover string) (bool, error) {
+	var fail bool
+	// In some cases if you set LD_LIBRARY_PATH it is ignored.
+	// This is disappointing to say the least. We just bind a few things into /
+	// bind *may* hide local resources but for now it's the least worst option.
+	dirs := strings.Split(bindover, ":")
+	for _, n := range dirs {
+		l, r, err := bindPair(n)
+		if err != nil {
+			return fail, err
+		}
+		t := filepath.Join("/tmp/cpu", r)
+		if *union != "" {
+			err := unionMount(t, l)
+			if err == nil {
+				v("CPUD:Mounted a union of %v and %v on %v", t, l, l)
+				continue
+			}
+			log.Printf("CPUD:Warning: union of %v and %v failed: %v; binding %v over %v instead", t, l, err, t, l)
+		}
+		v("CPUD: mount %v over %v", t, n)
+		if err := unix.Mount(t, l, "", syscall.MS_BIND, ""); err != nil {
+			fail = true
+			log.Printf("CPUD:Warning: mounting %v on %v failed: %v", t, n, err)
+		} else {
+			v("CPUD:Mounted %v on %v", t, n)
+		}
+
+	}
+	return fail, nil
+}
+
 // We do flag parsing in init so we can
 // Unshare if needed while we are still
 // single threaded.
@@ -309,6 +582,7 @@ func handler(s ssh.Session) {
 			log.Printf("CPUD:err %v", err)
 			return
 		}
+		defer relaySSHSignals(s, cmd.Process)()
 		go func() {
 			for win := range winCh {
 				setWinsize(f, win.Width, win.Height)
@@ -342,7 +616,13 @@ func handler(s ssh.Session) {
 	} else {
 		cmd.Stdin, cmd.Stdout, cmd.Stderr = s, s, s
 		verbose("running command without pty")
-		if err := cmd.Run(); err != nil {
+		err := cmd.Start()
+		if err == nil {
+			stop := relaySSHSignals(s, cmd.Process)
+			err = cmd.Wait()
+			stop()
+		}
+		if err != nil {
 			log.Printf("CPUD:err %v", err)
 			s.Exit(1)
 		}
@@ -468,9 +748,26 @@ func main() {
 		}
 	case *remote:
 		verbose("Running as remote")
-		if err := runRemote(strings.Join(args, " "), *port9p); err != nil {
+		// The command is split on white space, unless cpu gave it
+		// to us, word for word, with -argv64.
+		f := strings.Fields(strings.Join(args, " "))
+		if *argv64 != "" {
+			var err error
+			if f, err = decodeArgv(*argv64); err != nil {
+				log.Fatalf("CPUD(as remote):%v", err)
+			}
+		}
+		if err := runRemote(f, *port9p); err != nil {
 			log.Fatalf("CPUD(as remote):%v", err)
 		}
+	case *fuseSrv:
+		if err := serveFuse(); err != nil {
+			log.Fatalf("CPUD(fuse server):%v", err)
+		}
+	case *reqExport != "":
+		if err := requestExport(*reqExport); err != nil {
+			log.Fatalf("CPUD(requestexport):%v", err)
+		}
 	default:
 		log.Fatal("CPUD:can only run as remote or pid 1")
 	}
@@ -0,0 +1,108 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+// maxParallelRead is the most -parallelread may be: each read in flight
+// holds a buffer as big as the kernel's reads, up to 128 KiB.
+const maxParallelRead = 64
+
+// readAhead is a file, open for reading over the FUSE mount, that keeps
+// -parallelread reads in flight while it is read in order. The kernel
+// asks for a file a piece at a time, and mostly waits for each piece
+// before it asks for the next, so over a slow link every piece costs a
+// round trip; with the pieces after it asked for already, cpu reads
+// them at once, and the round trips overlap.
+//
+// A read that does not follow on from the last, e.g. a seek, is read as
+// it is, and starts nothing; a write through the file drops what was
+// read ahead. A write through another open of the file may not be seen
+// by reads already in flight, as with any read that crosses one.
+type readAhead struct {
+	p9.File
+	n int // how many reads to keep in flight
+
+	mu    sync.Mutex
+	ahead map[int64]*aheadRead // reads in flight, or done and not yet asked for, by offset
+	last  int64                // where the last read the kernel asked for ends
+	next  int64                // where the next read to start ahead begins
+}
+
+// aheadRead is one read started ahead of the kernel asking for it.
+type aheadRead struct {
+	b    []byte
+	n    int
+	err  error
+	done chan struct{}
+}
+
+// newReadAhead returns f, reading n pieces ahead.
+func newReadAhead(f p9.File, n int) *readAhead {
+	return &readAhead{File: f, n: n, ahead: map[int64]*aheadRead{}}
+}
+
+// start starts a read of size bytes at off.
+func (r *readAhead) start(off int64, size int) *aheadRead {
+	a := &aheadRead{b: make([]byte, size), done: make(chan struct{})}
+	go func() {
+		a.n, a.err = r.File.ReadAt(a.b, off)
+		close(a.done)
+	}()
+	return a
+}
+
+// ReadAt implements p9.File.ReadAt. If the read was started ahead, it
+// waits for that; either way, if it follows on from the last read, or
+// was one we expected, it starts the reads after it, of the same size,
+// so that there are n in flight. The kernel may ask for pieces that are
+// near each other out of order, so what was started ahead is kept until
+// reads have gone well past it.
+func (r *readAhead) ReadAt(p []byte, off int64) (int, error) {
+	size := int64(len(p))
+	r.mu.Lock()
+	a, ok := r.ahead[off]
+	delete(r.ahead, off)
+	if ok && len(a.b) < len(p) {
+		a = nil
+	}
+	if (ok || off == r.last) && size > 0 {
+		o := r.next
+		if o < off+size {
+			o = off + size
+		}
+		for ; o < off+int64(r.n)*size; o += size {
+			r.ahead[o] = r.start(o, len(p))
+		}
+		r.next = o
+	}
+	for o := range r.ahead {
+		if o < off-int64(r.n)*size {
+			delete(r.ahead, o)
+		}
+	}
+	r.last = off + size
+	r.mu.Unlock()
+	if a == nil {
+		return r.File.ReadAt(p, off)
+	}
+	<-a.done
+	n := copy(p, a.b[:a.n])
+	return n, a.err
+}
+
+// WriteAt implements p9.File.WriteAt. What was read ahead may be what
+// the write replaces, so it is dropped, and reading ahead starts again
+// from the next read.
+func (r *readAhead) WriteAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.ahead, r.next = map[int64]*aheadRead{}, 0
+	r.mu.Unlock()
+	return r.File.WriteAt(p, off)
+}
@@ -0,0 +1,162 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/p9/fsimpl/templatefs"
+	"github.com/hugelgupf/p9/p9"
+	"golang.org/x/sys/unix"
+)
+
+// memFile is a 9p tree that holds one file, f, whose contents are b.
+// Each read of it takes delay, as over a slow link.
+type memFile struct {
+	templatefs.NoopFile
+	b     []byte
+	delay time.Duration
+	dir   bool
+}
+
+func (m *memFile) Walk(names []string) ([]p9.QID, p9.File, error) {
+	switch {
+	case len(names) == 0:
+		c := *m
+		q, _, _, err := c.GetAttr(p9.AttrMaskAll)
+		return []p9.QID{q}, &c, err
+	case len(names) == 1 && names[0] == "f" && m.dir:
+		return []p9.QID{{Path: 2}}, &memFile{b: m.b, delay: m.delay}, nil
+	}
+	return nil, nil, unix.ENOENT
+}
+
+func (m *memFile) GetAttr(p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	if m.dir {
+		return p9.QID{Type: p9.TypeDir, Path: 1}, p9.AttrMask{Mode: true}, p9.Attr{Mode: p9.ModeDirectory | 0755}, nil
+	}
+	return p9.QID{Path: 2}, p9.AttrMask{Mode: true, Size: true}, p9.Attr{Mode: p9.ModeRegular | 0644, Size: uint64(len(m.b))}, nil
+}
+
+func (m *memFile) Open(p9.OpenFlags) (p9.QID, uint32, error) {
+	q, _, _, err := m.GetAttr(p9.AttrMaskAll)
+	return q, 0, err
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(m.delay)
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	return copy(p, m.b[off:]), nil
+}
+
+func (m *memFile) Attach() (p9.File, error) {
+	return m, nil
+}
+
+// openMem serves b, over 9p, with each read taking delay, and opens it,
+// as openFile does for the kernel, with -parallelread n.
+func openMem(tb testing.TB, b []byte, delay time.Duration, n int) p9.File {
+	tb.Helper()
+	sc, cc := net.Pipe()
+	go p9.NewServer(&memFile{b: b, delay: delay, dir: true}).Handle(sc, sc)
+	_, _, root, _, err := attach9p(cc)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, nf, err := root.Walk([]string{"f"})
+	if err != nil {
+		tb.Fatalf("walk to f: %v", err)
+	}
+	old := *parRead
+	*parRead = n
+	defer func() { *parRead = old }()
+	f, err := openFile(nf, p9.ReadOnly)
+	if err != nil {
+		tb.Fatalf("open f: %v", err)
+	}
+	if _, ok := f.(*readAhead); ok != (n > 1) {
+		tb.Fatalf("-parallelread %d: got %T", n, f)
+	}
+	return f
+}
+
+// readAll reads f, size bytes at a time, as the kernel does, but with
+// each pair of pieces in swap order, if swap is set, since the kernel's
+// reads in flight may reach us out of order. It returns the sha256 of
+// what it read.
+func readAll(tb testing.TB, f p9.File, size int, swap bool) [sha256.Size]byte {
+	tb.Helper()
+	h := sha256.New()
+	p, q := make([]byte, size), make([]byte, size)
+	for off := int64(0); ; off += 2 * int64(size) {
+		var n, m int
+		var err, err2 error
+		if swap {
+			m, err2 = f.ReadAt(q, off+int64(size))
+			n, err = f.ReadAt(p, off)
+		} else {
+			n, err = f.ReadAt(p, off)
+			m, err2 = f.ReadAt(q, off+int64(size))
+		}
+		if err != nil && err != io.EOF || err2 != nil && err2 != io.EOF {
+			tb.Fatalf("read at %d: %v, %v", off, err, err2)
+		}
+		h.Write(p[:n])
+		if n < size {
+			break
+		}
+		h.Write(q[:m])
+		if m < size {
+			break
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// TestParallelRead reads a large file, whose size is not a multiple of
+// the reads, over 9p, in order and out of it, with each -parallelread,
+// and checks that what it reads is the file.
+func TestParallelRead(t *testing.T) {
+	b := make([]byte, 16<<20+12345)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(b)
+	for _, n := range []int{0, 2, 4, 16, maxParallelRead} {
+		for _, swap := range []bool{false, true} {
+			f := openMem(t, b, 0, n)
+			if got := readAll(t, f, 128<<10, swap); got != want {
+				t.Errorf("-parallelread %d, out of order %v: sha256 %x, want %x", n, swap, got, want)
+			}
+			f.Close()
+		}
+	}
+}
+
+// BenchmarkParallelRead reads 8 MiB over 9p, as the kernel would, from
+// a server that takes a millisecond a read, with each -parallelread.
+func BenchmarkParallelRead(b *testing.B) {
+	data := make([]byte, 8<<20)
+	for _, n := range []int{1, 4, 16, maxParallelRead} {
+		b.Run(fmt.Sprintf("parallelread=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				f := openMem(b, data, time.Millisecond, n)
+				readAll(b, f, 128<<10, false)
+				f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// remountOnRequest sets up to wait for cpu to tell us, on the status
+// channel, with a line "remount port nonce", that the 9p channel broke
+// and where a new one is, and to move /tmp/cpu, and the binds of it, to
+// the new channel. It tells cpu how that went with a remount status
+// line, either ok or the error.
+// m is the mount in use now; d is the -9pkeepalive interval.
+func remountOnRequest(m *mnt9p, user, bindover string, d time.Duration) {
+	statusHandlers["remount"] = func(val string) {
+		// With -nononce, cpu sends only the port.
+		f := append(strings.Fields(val), "")
+		if len(f) != 3 && !(*noNonce && len(f) == 2) {
+			v("CPUD:remount: bad request %q", val)
+			return
+		}
+		nm, err := remount9p(m, f[0], f[1], user, bindover)
+		if nm != nil {
+			m.Close()
+			m = nm
+			if d > 0 {
+				go keepAlive9p(m.cf, "/tmp/cpu", d)
+			}
+		}
+		if err != nil {
+			log.Printf("CPUD:remount: %v", err)
+			reportStatus("remount", err)
+			return
+		}
+		reportStatus("remount", "ok")
+	}
+}
+
+// remount9p replaces the 9p mount m on /tmp/cpu with one on port9p.
+// The old mount, and the binds of it, are detached rather than
+// unmounted, since the kernel can not talk to cpu over the broken
+// channel to finish anything on them. Files the command had open on
+// the old mount, and its directory if that was in it, stay broken;
+// only what is opened from now on sees the new mount. A FUSE mount
+// is not replaced, but goes on over the new channel, with resumeFuse.
+func remount9p(m *mnt9p, port9p, nonce, user, bindover string) (*mnt9p, error) {
+	if m.ctl != nil {
+		return resumeFuse(m, port9p, nonce)
+	}
+	dirs := strings.Split(bindover, ":")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		l, _, err := bindPair(dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Unmount(l, unix.MNT_DETACH); err != nil {
+			v("CPUD:remount: detach %v: %v", l, err)
+		}
+	}
+	if err := unix.Unmount("/tmp/cpu", unix.MNT_DETACH); err != nil {
+		v("CPUD:remount: detach /tmp/cpu: %v", err)
+	}
+	nm, err := mount9p(port9p, nonce, user)
+	if err != nil {
+		return nil, err
+	}
+	if fail, err := bindOver(bindover); err != nil || fail {
+		return nm, fmt.Errorf("remounted /tmp/cpu, but not all of %q: %v", bindover, err)
+	}
+	return nm, nil
+}
+
+// resumeFuse gives the cpud -fuseserver of the FUSE mount m the new 9p
+// channel on port9p, on its control socket, so that what the command
+// has open, and what it was doing, goes on over it. The mnt9p it
+// returns takes the server over from m.
+func resumeFuse(m *mnt9p, port9p, nonce string) (*mnt9p, error) {
+	so, cf, err := dial9p(port9p, nonce)
+	if err != nil {
+		return nil, err
+	}
+	nm := &mnt9p{so: so, cf: cf, fuse: m.fuse, ctl: m.ctl}
+	m.fuse, m.ctl = nil, nil
+	if _, _, err := nm.ctl.WriteMsgUnix([]byte{0}, unix.UnixRights(int(cf.Fd())), nil); err != nil {
+		return nm, fmt.Errorf("fuse: giving the server the new 9p channel: %v", err)
+	}
+	// The server finds again each file the kernel knows of, one
+	// walk each, before it answers.
+	nm.ctl.SetReadDeadline(time.Now().Add(resumeWait))
+	s, err := bufio.NewReader(nm.ctl).ReadString('\n')
+	if err != nil {
+		return nm, fmt.Errorf("fuse: waiting for the server: %v", err)
+	}
+	if s = strings.TrimSpace(s); s != "ok" {
+		return nm, fmt.Errorf("fuse: %s", s)
+	}
+	return nm, nil
+}
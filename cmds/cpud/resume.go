@@ -0,0 +1,277 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+	"golang.org/x/sys/unix"
+)
+
+// With -9premount, and a FUSE mount, a broken 9p channel need not
+// break what the command is doing. The kernel's 9p client holds the
+// command's files itself, so on a kernel mount they are lost with the
+// channel; but over FUSE, the client is ours. When cpu gives cpud a new
+// channel, cpud hands it to the -fuseserver, on its control socket,
+// rather than mounting /tmp/cpu again. The server walks again to every
+// file the kernel knows, by the names it last reached it by, and opens
+// again every file that is open, and the requests that the old channel
+// failed under are done again on the new one. A read or write says
+// where in the file it is, so a big copy goes on from where it was,
+// rather than failing.
+//
+// Only requests that can safely be done twice are: a lookup, getattr,
+// setattr, readlink, open, read, write, readdir, statfs or fsync. A
+// mkdir, create, remove, rename, link or symlink may or may not have
+// been done before the channel broke, and still fails with EIO. A file
+// that can not be found again, as it was, e.g. because it was removed
+// or renamed on our side while the channel was down, gets ESTALE. A
+// request waits resumeWait for the new channel before it fails.
+
+// resumeWait is how long a request the 9p channel failed under waits
+// for cpu to give us a new one.
+const resumeWait = time.Minute
+
+// resumable are the FUSE requests that can be done again.
+var resumable = map[uint32]bool{
+	fuseLookup:   true,
+	fuseGetattr:  true,
+	fuseSetattr:  true,
+	fuseReadlink: true,
+	fuseOpen:     true,
+	fuseOpendir:  true,
+	fuseRead:     true,
+	fuseWrite:    true,
+	fuseReaddir:  true,
+	fuseStatfs:   true,
+	fuseFsync:    true,
+	fuseFsyncdir: true,
+}
+
+// A p9Conn is the connection a 9p client runs over. The p9 client gives
+// a failure of it as an error that is only text, so the connection keeps
+// track itself of whether it has failed.
+type p9Conn struct {
+	net.Conn
+	failed int32 // set, with atomic, once a read or write has failed
+}
+
+// Read implements net.Conn.Read.
+func (c *p9Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		atomic.StoreInt32(&c.failed, 1)
+	}
+	return n, err
+}
+
+// Write implements net.Conn.Write.
+func (c *p9Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		atomic.StoreInt32(&c.failed, 1)
+	}
+	return n, err
+}
+
+// Close implements net.Conn.Close. What is waiting on c then fails.
+func (c *p9Conn) Close() error {
+	atomic.StoreInt32(&c.failed, 1)
+	return c.Conn.Close()
+}
+
+// connLost reports whether err, from a request on c, is c failing,
+// rather than cpu answering with an errno, or the end of a file.
+func connLost(err error, c *p9Conn) bool {
+	if err == nil || err == io.EOF {
+		return false
+	}
+	if _, ok := p9Errno(err); ok {
+		return false
+	}
+	return atomic.LoadInt32(&c.failed) != 0
+}
+
+// resume reports whether the request op, which failed with err on c,
+// the connection of generation gen, is to be done again: with
+// -9premount, if it can be, and c was lost, once there is a new one.
+func (fs *fuseFS) resume(op uint32, err error, gen uint64, c *p9Conn) bool {
+	if !*remount || !resumable[op] || !connLost(err, c) {
+		return false
+	}
+	fs.mu.Lock()
+	g, renewed := fs.gen, fs.renewed
+	fs.mu.Unlock()
+	if g != gen {
+		return true
+	}
+	select {
+	case <-renewed:
+		return true
+	case <-time.After(resumeWait):
+		return false
+	}
+}
+
+// renamed keeps the names of the nodes at, and below, the name from in
+// the directory d, which has been renamed to the name to in nd.
+func (fs *fuseFS) renamed(d *fuseNode, from string, nd *fuseNode, to string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	old := append(append([]string{}, d.names...), from)
+	nm := append(append([]string{}, nd.names...), to)
+	for _, n := range fs.nodes {
+		if len(n.names) < len(old) || strings.Join(n.names[:len(old)], "/") != strings.Join(old, "/") {
+			continue
+		}
+		n.names = append(append([]string{}, nm...), n.names[len(old):]...)
+	}
+}
+
+// renewOnRequest reads, from the control socket f, the new 9p
+// connections cpud sends us, each as an fd, and goes on, over each,
+// from where the last left off. It answers each with a line, ok or
+// the error.
+func (fs *fuseFS) renewOnRequest(f *os.File) {
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		log.Printf("CPUD:fuse: control socket: %v", err)
+		return
+	}
+	u := c.(*net.UnixConn)
+	for {
+		b, oob := make([]byte, 1), make([]byte, unix.CmsgSpace(4))
+		_, oobn, _, _, err := u.ReadMsgUnix(b, oob)
+		if err != nil {
+			v("CPUD:fuse: control socket: %v", err)
+			return
+		}
+		nc, err := recvConn(oob[:oobn])
+		if err == nil {
+			err = fs.renew(nc)
+		}
+		reply := "ok"
+		if err != nil {
+			log.Printf("CPUD:fuse: resume: %v", err)
+			reply = strings.Replace(err.Error(), "\n", " ", -1)
+		}
+		if _, err := fmt.Fprintln(u, reply); err != nil {
+			v("CPUD:fuse: control socket: %v", err)
+			return
+		}
+	}
+}
+
+// recvConn returns the connection whose fd is in the control message oob.
+func recvConn(oob []byte) (net.Conn, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil || len(msgs) != 1 {
+		return nil, fmt.Errorf("no 9p connection in the request: %v", err)
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, fmt.Errorf("no 9p connection in the request: %v", err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "9p")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// dropFile lets go of f, a file of a 9p connection that is gone,
+// without the clunk that the p9 package sends, and logs the failure
+// of, when it is collected.
+func dropFile(f p9.File) {
+	if r, ok := f.(*readAhead); ok {
+		f = r.File
+	}
+	runtime.SetFinalizer(f, nil)
+}
+
+// renew makes c the 9p connection, in place of the one that broke. It
+// walks again to each node, and opens again each open file; one that
+// is not there, or is not the file it was, is stale from then on. The
+// requests waiting to be done again go on once it returns.
+func (fs *fuseFS) renew(c net.Conn) error {
+	cl, c9, root, q, err := attach9p(c)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	// What is still waiting on the old connection fails now, and
+	// lets go of fs.conn.
+	fs.mu.Lock()
+	old := fs.cl
+	fs.mu.Unlock()
+	old.Close()
+
+	fs.conn.Lock()
+	defer fs.conn.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if r := fs.nodes[fuseRootID]; q.Path != r.path {
+		cl.Close()
+		return fmt.Errorf("the new 9p connection serves another tree")
+	}
+	fs.cl, fs.c9 = cl, c9
+	var stale int
+	for id, n := range fs.nodes {
+		if n.stale {
+			continue
+		}
+		dropFile(n.f)
+		if id == fuseRootID {
+			n.f = root
+			continue
+		}
+		qids, f, err := root.Walk(n.names)
+		if err == nil && (len(qids) != len(n.names) || qids[len(qids)-1].Path != n.path) {
+			f.Close()
+			err = unix.ESTALE
+		}
+		if err != nil {
+			v("CPUD:fuse: resume: %q: %v", strings.Join(n.names, "/"), err)
+			n.stale = true
+			stale++
+			continue
+		}
+		n.f = f
+	}
+	for _, ff := range fs.files {
+		if ff.stale {
+			continue
+		}
+		dropFile(ff.f)
+		if ff.n.stale {
+			ff.stale = true
+			stale++
+			continue
+		}
+		// The file was truncated, if it was to be, when it was
+		// first opened.
+		f, err := openFile(ff.n.f, ff.fl&^p9.OpenFlags(unix.O_TRUNC))
+		if err != nil {
+			v("CPUD:fuse: resume: opening %q: %v", strings.Join(ff.n.names, "/"), err)
+			ff.stale = true
+			stale++
+			continue
+		}
+		ff.f = f
+	}
+	fs.gen++
+	close(fs.renewed)
+	fs.renewed = make(chan struct{})
+	log.Printf("CPUD:fuse: going on over the new 9p connection: %d files known, %d open, %d lost", len(fs.nodes), len(fs.files), stale)
+	return nil
+}
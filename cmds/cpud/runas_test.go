@@ -0,0 +1,75 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRunAsUserBad(t *testing.T) {
+	for _, s := range []string{"", "1", "1:2:3", "a:1", "1:b", "-1:1", "1:4294967296"} {
+		if _, err := runAsUser(s); err == nil {
+			t.Errorf("runAsUser(%q): got nil, want an error", s)
+		}
+	}
+}
+
+// TestRunAsUser starts a command, as runRemote does, with the
+// credential for -runas, and checks that it is not root, nor any of
+// root's groups.
+func TestRunAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can run a command as another user")
+	}
+	cred, err := runAsUser("65534:65534")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := exec.Command("sh", "-c", "id -u; id -g; id -G")
+	c.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	b, err := c.Output()
+	if err != nil {
+		t.Fatalf("%v: %v", c.Args, err)
+	}
+	f := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(f) != 3 || f[0] != "65534" || f[1] != "65534" {
+		t.Fatalf("the command's uid and gid: got %q, want 65534 and 65534", f)
+	}
+	for _, g := range strings.Fields(f[2]) {
+		if g == "0" {
+			t.Errorf("the command's groups: got %q, which has root's", f[2])
+		}
+	}
+}
+
+// TestListenExportsOwner checks that, with -runas, the socket for the
+// command's export requests is the user's, as the command runs as the
+// user and must be able to connect to it.
+func TestListenExportsOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can give a file away")
+	}
+	cred := &syscall.Credential{Uid: 65534, Gid: 65534}
+	sock, cleanup, err := listenExports(cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	for _, n := range []string{filepath.Dir(sock), sock} {
+		fi, err := os.Stat(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != cred.Uid || st.Gid != cred.Gid {
+			t.Errorf("%s: owned by %d:%d, want %d:%d", n, st.Uid, st.Gid, cred.Uid, cred.Gid)
+		}
+	}
+}
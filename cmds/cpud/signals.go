@@ -0,0 +1,71 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// relayed are the signals cpu's -forwardsignals may send us, which
+// we pass on to the command.
+var relayed = map[ssh.Signal]syscall.Signal{
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// relaySSHSignals passes the signals the client sends on the session
+// s on to p, until the returned function is called.
+func relaySSHSignals(s ssh.Session, p *os.Process) func() {
+	c, done := make(chan ssh.Signal, 8), make(chan struct{})
+	s.Signals(c)
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				if n, ok := relayed[sig]; ok {
+					v("CPUD:relay signal %v to %d", sig, p.Pid)
+					p.Signal(n)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	// c is not closed: the ssh package may still be sending
+	// signals that were buffered before we asked for them.
+	return func() {
+		s.Signals(nil)
+		close(done)
+	}
+}
+
+// relaySignals passes the signals the sshd sends us, as the remote
+// side of cpu, on to the command p, until the returned function is
+// called.
+func relaySignals(p *os.Process) func() {
+	var sigs []os.Signal
+	for _, n := range relayed {
+		sigs = append(sigs, n)
+	}
+	c := make(chan os.Signal, 8)
+	signal.Notify(c, sigs...)
+	go func() {
+		for sig := range c {
+			v("CPUD:relay signal %v to %d", sig, p.Pid)
+			p.Signal(sig)
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// status is our connection to the cpu status channel, if there is one.
+var status net.Conn
+
+// dialStatus connects to the cpu status channel and authenticates
+// with the nonce, just as we do for 9p.
+func dialStatus(port, nonce string) error {
+	a := net.JoinHostPort("127.0.0.1", port)
+	v("CPUD:Dial status %v", a)
+	c, err := net.Dial("tcp4", a)
+	if err != nil {
+		return err
+	}
+	if *noNonce {
+		status = c
+		return nil
+	}
+	if _, err := fmt.Fprintf(c, "%s", nonce); err != nil {
+		c.Close()
+		return err
+	}
+	status = c
+	return nil
+}
+
+// reportStatus sends a key and value to cpu on the status channel.
+func reportStatus(k string, val interface{}) {
+	if status == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(status, "%s %v\n", k, val); err != nil {
+		v("CPUD:status %s %v: %v", k, val, err)
+	}
+}
+
+// reportRusage sends cpu, for -rusage, the user and system time, in
+// nanoseconds, the largest resident set, in KiB, and how it ended, of
+// the command that ran as ps. A command that was killed still has its
+// usage up to then.
+func reportRusage(ps *os.ProcessState) {
+	if ps == nil {
+		return
+	}
+	var maxRSS int64
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		// Maxrss is an int32 on 32-bit Linux.
+		maxRSS = int64(ru.Maxrss)
+	}
+	reportStatus("rusage", fmt.Sprintf("%d %d %d %s", ps.UserTime(), ps.SystemTime(), maxRSS, ps))
+}
+
+func closeStatus() {
+	if status != nil {
+		status.Close()
+	}
+}
+
+// statusHandlers are called, by readStatus, with the value of each
+// line cpu sends us on the status channel with their key. They are all
+// set before readStatus starts.
+var statusHandlers = map[string]func(val string){}
+
+// readStatus calls the handler of the key of each line cpu sends us on
+// the status channel, until the channel closes.
+func readStatus() {
+	if status == nil {
+		return
+	}
+	s := bufio.NewScanner(status)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), " ", 2)
+		if len(kv) != 2 {
+			v("CPUD:status: bad line %q", s.Text())
+			continue
+		}
+		if f, ok := statusHandlers[kv[0]]; ok {
+			f(kv[1])
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// unionMount mounts, on the local directory l, a union of it and
+// t, its part of /tmp/cpu, for -union: an overlayfs with the two as
+// its lower layers, the one -union says wins on top. A name in both
+// is the top one's; a directory in both is merged, all the way down.
+// There is no upper layer, so the union is read-only; what cpu
+// serves can still be written under /tmp/cpu.
+func unionMount(t, l string) error {
+	top, bottom := t, l
+	switch *union {
+	case "local":
+	case "remote":
+		top, bottom = l, t
+	default:
+		return fmt.Errorf("union %q: want local or remote", *union)
+	}
+	for _, d := range []string{top, bottom} {
+		if strings.ContainsAny(d, ":,") {
+			return fmt.Errorf("union: %q has a : or , in it, which overlayfs can not take", d)
+		}
+	}
+	return unix.Mount("overlay", l, "overlay", unix.MS_RDONLY, "lowerdir="+top+":"+bottom)
+}
@@ -0,0 +1,229 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cputest provides an in-process ssh server that stands in for
+// a remote running cpud, for end to end tests of the cpu client.
+//
+// The server speaks enough ssh for cpu: public key auth, sessions with
+// env, pty-req and exec, and remote port forwarding. When cpu runs
+// cpud -remote on it, the server does what cpud would up to the point
+// of running the command: it connects to the 9p forward, writes back
+// the nonce and attaches over 9p, and connects to the status channel.
+// It then calls the test's Handler instead of running the command.
+//
+// A test does something like
+//
+//	s, err := cputest.NewServer(func(r *cputest.Remote) error {
+//		// look at r.Cmd, use r.FS, write to r.Stdout ...
+//		return nil
+//	})
+//	defer s.Close()
+//
+// and runs the client with -sp s.Port() and -hk s.HostKeyFile().
+//
+// To see what a command does when 9p misbehaves, set s.Faults, e.g.
+//
+//	s.Faults = &cputest.Faults{ErrorRate: 0.1, Delay: 10 * time.Millisecond}
+//
+// and the Handler's r.Root fails, is slow and reads short at random.
+// To have cpu serve the faults, so the remote gets them over 9p, wrap
+// what it serves with the Faults' Attacher.
+package cputest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hugelgupf/p9/p9"
+	"golang.org/x/crypto/ssh"
+)
+
+// A Handler stands in for the command cpu asked cpud to run.
+// If it returns an error, the error is written to the
+// session's stderr and the exit status is 1.
+type Handler func(*Remote) error
+
+// Remote is what a Handler gets: the command and the session it
+// runs in, as cpud would have set it up.
+type Remote struct {
+	// Cmd is the command cpu asked for, e.g. "/bin/date".
+	Cmd string
+	// Args are all the arguments cpu gave cpud, Cmd included.
+	Args []string
+	// Flags are the cpud flags cpu gave, by name, e.g. "cache".
+	Flags map[string]string
+	// Env is the environment cpu set, less CPUNONCE.
+	Env []string
+	// Pty is true if cpu asked for a pty.
+	Pty    bool
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// FS is the 9p client on the namespace cpu exports, or nil
+	// if cpu does not export one.
+	FS *p9.Client
+	// Root is the attached root of FS, using the aname, if any.
+	Root p9.File
+
+	status net.Conn
+}
+
+// Status sends a key and value on the status channel, as cpud does
+// with e.g. the pid of the command. It does nothing if cpu did not
+// ask for a status channel.
+func (r *Remote) Status(key string, val interface{}) error {
+	if r.status == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(r.status, "%s %v\n", key, val)
+	return err
+}
+
+// Server is an in-process ssh server standing in for cpud.
+type Server struct {
+	// AuthorizedKeys are the keys clients may log in with.
+	// If it is empty, any key is accepted.
+	AuthorizedKeys []ssh.PublicKey
+	// Faults, if not nil, are injected into Remote.Root for every
+	// session, to test how the remote copes with a flaky 9p.
+	Faults *Faults
+
+	handler Handler
+	l       net.Listener
+	config  *ssh.ServerConfig
+	dir     string
+	hostKey ssh.Signer
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+	wg    sync.WaitGroup
+}
+
+// NewServer starts a Server on 127.0.0.1, with a new host key,
+// which calls h for every cpud command it is asked to run.
+// Set AuthorizedKeys, if need be, before the first client connects.
+func NewServer(h Handler) (*Server, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hk, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ioutil.TempDir("", "cputest")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "hostkey.pub"), hk.PublicKey().Marshal(), 0644); err != nil {
+		os.RemoveAll(d)
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(d)
+		return nil, err
+	}
+	s := &Server{handler: h, l: l, dir: d, hostKey: hk}
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.checkKey}
+	s.config.AddHostKey(hk)
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address, host:port, the server listens on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Port returns the port the server listens on, e.g. for cpu -sp.
+func (s *Server) Port() string {
+	_, p, _ := net.SplitHostPort(s.Addr())
+	return p
+}
+
+// HostKey returns the server's public host key.
+func (s *Server) HostKey() ssh.PublicKey {
+	return s.hostKey.PublicKey()
+}
+
+// HostKeyFile returns the name of a file holding the server's public
+// host key, in the ssh wire format cpu -hk wants.
+func (s *Server) HostKeyFile() string {
+	return filepath.Join(s.dir, "hostkey.pub")
+}
+
+// Close stops the server and drops all its connections.
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+	return err
+}
+
+func (s *Server) checkKey(_ ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+	if len(s.AuthorizedKeys) == 0 {
+		return nil, nil
+	}
+	for _, a := range s.AuthorizedKeys {
+		if string(a.Marshal()) == string(k.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("cputest: key %s is not authorized", ssh.FingerprintSHA256(k))
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(c)
+		}()
+	}
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	sc, chans, reqs, err := ssh.NewServerConn(c, s.config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, sc)
+	s.mu.Unlock()
+	f := &forwards{conn: sc, l: map[string]net.Listener{}}
+	defer f.close()
+	go f.handle(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "cputest: only sessions are supported")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, creqs)
+	}
+}
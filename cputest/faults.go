@@ -0,0 +1,225 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cputest
+
+import (
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+)
+
+// Faults describes faults injected into a 9p namespace, to test how a
+// remote command copes with a flaky 9p channel. Each operation on a
+// file, and the files walked to from it, may be delayed, may fail,
+// and, for reads, may come back short, at random.
+//
+// The faults go in on one side or the other. As a Server's Faults,
+// they are injected into the Remote.Root its Handler sees, and cpu
+// serves the namespace as usual; Remote.FS itself is left alone. With
+// Attacher, they are injected into what cpu serves, and the remote
+// gets them over 9p, as it would from a flaky disk. A Faults may be
+// used by many sessions at once.
+type Faults struct {
+	// ErrorRate is the fraction, from 0 to 1, of operations that fail
+	// with Err instead of being done.
+	ErrorRate float64
+	// Err is the error a failed operation returns; EIO if it is nil.
+	Err error
+	// ShortReadRate is the fraction of reads that return only part,
+	// at least one byte, of what they read.
+	ShortReadRate float64
+	// Delay is the longest time an operation waits before it is done;
+	// each waits a random time up to it.
+	Delay time.Duration
+	// Seed seeds the random choices, so that a failing test can be
+	// run again with the same faults.
+	Seed int64
+
+	once sync.Once
+	mu   sync.Mutex
+	r    *rand.Rand
+}
+
+// float returns a random number in [0,1).
+func (f *Faults) float() float64 {
+	f.once.Do(func() {
+		f.r = rand.New(rand.NewSource(f.Seed))
+	})
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.r.Float64()
+}
+
+// fault waits for a random part of Delay, and returns the error the
+// operation is to fail with, if it is to fail.
+func (f *Faults) fault() error {
+	if f.Delay > 0 {
+		time.Sleep(time.Duration(f.float() * float64(f.Delay)))
+	}
+	if f.ErrorRate > 0 && f.float() < f.ErrorRate {
+		if f.Err != nil {
+			return f.Err
+		}
+		return syscall.EIO
+	}
+	return nil
+}
+
+// wrap returns file, with the faults injected.
+func (f *Faults) wrap(file p9.File) p9.File {
+	if file == nil {
+		return nil
+	}
+	return &faultFile{File: file, f: f}
+}
+
+// Attacher returns a, with the faults injected into the files it
+// serves. Attach, and the GetAttr of the root the 9p server does to
+// attach, are left alone, so that a session starts.
+func (f *Faults) Attacher(a p9.Attacher) p9.Attacher {
+	return &faultAttacher{a: a, f: f}
+}
+
+type faultAttacher struct {
+	a p9.Attacher
+	f *Faults
+}
+
+// Attach implements p9.Attacher.Attach.
+func (fa *faultAttacher) Attach() (p9.File, error) {
+	file, err := fa.a.Attach()
+	if err != nil {
+		return nil, err
+	}
+	return &faultRoot{faultFile{File: file, f: fa.f}}, nil
+}
+
+// A faultRoot is the faultFile an Attacher attaches to.
+type faultRoot struct {
+	faultFile
+}
+
+// GetAttr implements p9.File.GetAttr.
+func (fr *faultRoot) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	return fr.File.GetAttr(req)
+}
+
+// A faultFile is a p9.File with Faults injected. The operations that
+// are not here are passed through as they are.
+type faultFile struct {
+	p9.File
+	f *Faults
+}
+
+// unwrap returns the p9.File under file, for the operations that
+// take another file, which the 9p client must get as its own.
+func unwrap(file p9.File) p9.File {
+	switch ff := file.(type) {
+	case *faultFile:
+		return ff.File
+	case *faultRoot:
+		return ff.File
+	}
+	return file
+}
+
+// Walk implements p9.File.Walk.
+func (ff *faultFile) Walk(names []string) ([]p9.QID, p9.File, error) {
+	if err := ff.f.fault(); err != nil {
+		return nil, nil, err
+	}
+	q, file, err := ff.File.Walk(names)
+	return q, ff.f.wrap(file), err
+}
+
+// WalkGetAttr implements p9.File.WalkGetAttr.
+func (ff *faultFile) WalkGetAttr(names []string) ([]p9.QID, p9.File, p9.AttrMask, p9.Attr, error) {
+	if err := ff.f.fault(); err != nil {
+		return nil, nil, p9.AttrMask{}, p9.Attr{}, err
+	}
+	q, file, m, a, err := ff.File.WalkGetAttr(names)
+	return q, ff.f.wrap(file), m, a, err
+}
+
+// GetAttr implements p9.File.GetAttr.
+func (ff *faultFile) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	if err := ff.f.fault(); err != nil {
+		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, err
+	}
+	return ff.File.GetAttr(req)
+}
+
+// Open implements p9.File.Open.
+func (ff *faultFile) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
+	if err := ff.f.fault(); err != nil {
+		return p9.QID{}, 0, err
+	}
+	return ff.File.Open(mode)
+}
+
+// ReadAt implements p9.File.ReadAt.
+func (ff *faultFile) ReadAt(p []byte, offset int64) (int, error) {
+	if err := ff.f.fault(); err != nil {
+		return 0, err
+	}
+	n, err := ff.File.ReadAt(p, offset)
+	if n > 1 && ff.f.ShortReadRate > 0 && ff.f.float() < ff.f.ShortReadRate {
+		n = 1 + int(ff.f.float()*float64(n-1))
+		err = nil
+	}
+	return n, err
+}
+
+// WriteAt implements p9.File.WriteAt.
+func (ff *faultFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := ff.f.fault(); err != nil {
+		return 0, err
+	}
+	return ff.File.WriteAt(p, offset)
+}
+
+// Create implements p9.File.Create.
+func (ff *faultFile) Create(name string, flags p9.OpenFlags, perm p9.FileMode, uid p9.UID, gid p9.GID) (p9.File, p9.QID, uint32, error) {
+	if err := ff.f.fault(); err != nil {
+		return nil, p9.QID{}, 0, err
+	}
+	file, q, n, err := ff.File.Create(name, flags, perm, uid, gid)
+	return ff.f.wrap(file), q, n, err
+}
+
+// Readdir implements p9.File.Readdir.
+func (ff *faultFile) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
+	if err := ff.f.fault(); err != nil {
+		return nil, err
+	}
+	return ff.File.Readdir(offset, count)
+}
+
+// Link implements p9.File.Link.
+func (ff *faultFile) Link(target p9.File, newName string) error {
+	if err := ff.f.fault(); err != nil {
+		return err
+	}
+	return ff.File.Link(unwrap(target), newName)
+}
+
+// Rename implements p9.File.Rename.
+func (ff *faultFile) Rename(newDir p9.File, newName string) error {
+	if err := ff.f.fault(); err != nil {
+		return err
+	}
+	return ff.File.Rename(unwrap(newDir), newName)
+}
+
+// RenameAt implements p9.File.RenameAt.
+func (ff *faultFile) RenameAt(oldName string, newDir p9.File, newName string) error {
+	if err := ff.f.fault(); err != nil {
+		return err
+	}
+	return ff.File.RenameAt(oldName, unwrap(newDir), newName)
+}
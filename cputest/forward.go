@@ -0,0 +1,135 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cputest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwards handles the remote port forwards, tcpip-forward in
+// RFC 4254 section 7.1, for one connection. cpu uses them for the
+// 9p and status channels.
+type forwards struct {
+	conn *ssh.ServerConn
+	mu   sync.Mutex
+	l    map[string]net.Listener
+}
+
+type forwardReq struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedTCPIP struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func (f *forwards) handle(reqs <-chan *ssh.Request) {
+	for r := range reqs {
+		switch r.Type {
+		case "tcpip-forward":
+			var fr forwardReq
+			if err := ssh.Unmarshal(r.Payload, &fr); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			port, err := f.listen(fr)
+			if err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			r.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+		case "cancel-tcpip-forward":
+			var fr forwardReq
+			if err := ssh.Unmarshal(r.Payload, &fr); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			f.cancel(fr)
+			r.Reply(true, nil)
+		default:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (f *forwards) listen(fr forwardReq) (uint32, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(fr.Addr, strconv.Itoa(int(fr.Port))))
+	if err != nil {
+		return 0, err
+	}
+	_, ps, _ := net.SplitHostPort(l.Addr().String())
+	p, err := strconv.Atoi(ps)
+	if err != nil {
+		l.Close()
+		return 0, err
+	}
+	fr.Port = uint32(p)
+	f.mu.Lock()
+	f.l[fmt.Sprintf("%s:%d", fr.Addr, fr.Port)] = l
+	f.mu.Unlock()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.forward(fr, c)
+		}
+	}()
+	return fr.Port, nil
+}
+
+func (f *forwards) forward(fr forwardReq, c net.Conn) {
+	defer c.Close()
+	oa, ops, _ := net.SplitHostPort(c.RemoteAddr().String())
+	op, _ := strconv.Atoi(ops)
+	ch, reqs, err := f.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwardedTCPIP{
+		Addr:       fr.Addr,
+		Port:       fr.Port,
+		OriginAddr: oa,
+		OriginPort: uint32(op),
+	}))
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	io.Copy(c, ch)
+}
+
+func (f *forwards) cancel(fr forwardReq) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := fmt.Sprintf("%s:%d", fr.Addr, fr.Port)
+	if l, ok := f.l[k]; ok {
+		l.Close()
+		delete(f.l, k)
+	}
+}
+
+func (f *forwards) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, l := range f.l {
+		l.Close()
+		delete(f.l, k)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cputest
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hugelgupf/p9/p9"
+	"golang.org/x/crypto/ssh"
+)
+
+// session handles one ssh session. Only exec is supported: cpu
+// always gives a command.
+func (s *Server) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	r := &Remote{Stdin: ch, Stdout: ch, Stderr: ch.Stderr()}
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var e struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &e); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			r.Env = append(r.Env, e.Name+"="+e.Value)
+			req.Reply(true, nil)
+		case "pty-req":
+			r.Pty = true
+			req.Reply(true, nil)
+		case "window-change":
+			req.Reply(true, nil)
+		case "exec":
+			var e struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &e); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			status := uint32(0)
+			if err := s.run(r, e.Command); err != nil {
+				fmt.Fprintf(r.Stderr, "%v\n", err)
+				status = 1
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// run does what cpud -remote does with c, up to running the command,
+// then calls the Handler.
+func (s *Server) run(r *Remote, c string) error {
+	args, err := splitCommand(c)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("cputest: empty command")
+	}
+	// These are the flags cpu gives cpud. Most are only
+	// accepted, so that the command line parses.
+	f := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	var (
+		port9p   = f.String("port9p", "", "")
+		statport = f.String("statusport", "", "")
+		aname    = f.String("aname", "", "")
+		compress = f.Bool("9pcompress", false, "")
+	)
+	f.Bool("remote", false, "")
+	f.String("bin", "", "")
+	f.Bool("l", false, "")
+	f.String("9pkeepalive", "", "")
+	f.Bool("9premount", false, "")
+	f.Int("9pcompresslevel", 5, "")
+	f.String("umask", "", "")
+	f.String("cache", "", "")
+	f.Bool("nononce", false, "")
+	nonceArg := f.String("nonce", "", "")
+	nonceFile := f.String("noncefile", "", "")
+	f.Bool("rusage", false, "")
+	f.String("union", "", "")
+	f.String("runas", "", "")
+	f.String("mountmode", "", "")
+	f.Int("parallelread", 0, "")
+	f.Bool("exportrequests", false, "")
+	argv64 := f.String("argv64", "", "")
+	if err := f.Parse(args[1:]); err != nil {
+		return fmt.Errorf("cputest: %q: %v", c, err)
+	}
+	r.Args = f.Args()
+	r.Flags = map[string]string{}
+	f.Visit(func(fl *flag.Flag) {
+		r.Flags[fl.Name] = fl.Value.String()
+	})
+	// With -argv64, cpu gives the arguments word for word, as
+	// cpud would run them.
+	if *argv64 != "" {
+		b, err := base64.StdEncoding.DecodeString(*argv64)
+		if err != nil {
+			return fmt.Errorf("cputest: -argv64: %v", err)
+		}
+		r.Args = strings.Split(string(b), "\x00")
+	}
+	r.Cmd = strings.Join(r.Args, " ")
+
+	var n string
+	env := r.Env[:0]
+	for _, e := range r.Env {
+		if strings.HasPrefix(e, "CPUNONCE=") {
+			n = strings.TrimPrefix(e, "CPUNONCE=")
+			continue
+		}
+		env = append(env, e)
+	}
+	r.Env = env
+	switch {
+	case *nonceArg != "":
+		n = *nonceArg
+	case *nonceFile != "":
+		b, err := ioutil.ReadFile(*nonceFile)
+		if err != nil {
+			return fmt.Errorf("cputest: -noncefile: %v", err)
+		}
+		os.Remove(*nonceFile)
+		n = strings.TrimSpace(string(b))
+	}
+
+	if *statport != "" {
+		if r.status, err = dialNonce(*statport, n); err != nil {
+			return fmt.Errorf("cputest: status channel: %v", err)
+		}
+		defer r.status.Close()
+	}
+	if *port9p != "" {
+		if *compress {
+			return fmt.Errorf("cputest: -9pcompress is not supported")
+		}
+		so, err := dialNonce(*port9p, n)
+		if err != nil {
+			return fmt.Errorf("cputest: 9p: %v", err)
+		}
+		defer so.Close()
+		if r.FS, err = p9.NewClient(so); err != nil {
+			return fmt.Errorf("cputest: 9p: %v", err)
+		}
+		if r.Root, err = r.FS.Attach(*aname); err != nil {
+			return fmt.Errorf("cputest: 9p attach %q: %v", *aname, err)
+		}
+		defer r.Root.Close()
+		if s.Faults != nil {
+			r.Root = s.Faults.wrap(r.Root)
+		}
+	}
+	return s.handler(r)
+}
+
+// dialNonce connects to a port cpu forwarded and writes the nonce,
+// as cpud does.
+func dialNonce(port, n string) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write([]byte(n)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// splitCommand splits an exec request into words, as a shell would
+// for the commands cpu sends: words are separated by spaces, and a
+// word may be double quoted, as by %q.
+func splitCommand(c string) ([]string, error) {
+	var w []string
+	for {
+		c = strings.TrimLeft(c, " \t")
+		if c == "" {
+			return w, nil
+		}
+		if c[0] != '"' {
+			i := strings.IndexAny(c, " \t")
+			if i < 0 {
+				i = len(c)
+			}
+			w = append(w, c[:i])
+			c = c[i:]
+			continue
+		}
+		q, err := strconv.QuotedPrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("cputest: %q: %v", c, err)
+		}
+		u, err := strconv.Unquote(q)
+		if err != nil {
+			return nil, fmt.Errorf("cputest: %q: %v", q, err)
+		}
+		w = append(w, u)
+		c = c[len(q):]
+	}
+}
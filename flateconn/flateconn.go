@@ -0,0 +1,55 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package flateconn compresses a connection with deflate, as cpu and
+// cpud do for -9pcompress. Both ends must use it.
+package flateconn
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// Conn is a net.Conn which compresses what is written to it and
+// decompresses what is read from it. Every Write is flushed, since
+// 9p is request/response and nothing may sit in the compressor.
+type Conn struct {
+	net.Conn
+	r  io.ReadCloser
+	mu sync.Mutex
+	w  *flate.Writer
+}
+
+// New returns c, compressed at level, from flate.BestSpeed to
+// flate.BestCompression.
+func New(c net.Conn, level int) (*Conn, error) {
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		return nil, fmt.Errorf("compression level %d: must be from %d to %d", level, flate.BestSpeed, flate.BestCompression)
+	}
+	w, err := flate.NewWriter(c, level)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, r: flate.NewReader(c), w: w}, nil
+}
+
+// Read implements io.Reader.Read.
+func (f *Conn) Read(b []byte) (int, error) {
+	return f.r.Read(b)
+}
+
+// Write implements io.Writer.Write.
+func (f *Conn) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
@@ -0,0 +1,131 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flateconn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca, err := New(a, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := New(b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("Tversion 9P2000.L "), 4096)
+	go func() {
+		for i := 0; i < len(want); i += 1000 {
+			e := i + 1000
+			if e > len(want) {
+				e = len(want)
+			}
+			if _, err := ca.Write(want[i:e]); err != nil {
+				return
+			}
+		}
+	}()
+	// Each Write is flushed, so what was written can all be read
+	// without the writer closing.
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(cb, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read back %d bytes that differ from what was written", len(got))
+	}
+}
+
+func TestLevel(t *testing.T) {
+	for _, l := range []int{-1, 0, 10} {
+		if _, err := New(nil, l); err == nil {
+			t.Errorf("New(nil, %d): got nil, want an error", l)
+		}
+	}
+}
+
+// counter is a net.Conn that counts what is written to it.
+type counter struct {
+	net.Conn
+	n int64
+}
+
+func (c *counter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+// benchData is what BenchmarkLevels compresses: the Go source in the
+// vendor tree, as a source tree, and the test binary, as a Go binary.
+func benchData(b *testing.B) map[string][]byte {
+	var src bytes.Buffer
+	filepath.Walk(filepath.Join("..", "vendor"), func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(p, ".go") || src.Len() > 32<<20 {
+			return nil
+		}
+		d, err := ioutil.ReadFile(p)
+		if err == nil {
+			src.Write(d)
+		}
+		return nil
+	})
+	if src.Len() == 0 {
+		b.Skip("no Go source in ../vendor")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		b.Fatal(err)
+	}
+	bin, err := ioutil.ReadFile(exe)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return map[string][]byte{"source": src.Bytes(), "binary": bin}
+}
+
+// BenchmarkLevels compresses a source tree and a Go binary, in 64 KiB
+// writes, each flushed, as 9p would, at each level. size is how big
+// the compressed data is, as a percentage of the original. The numbers
+// in the -9pcompresslevel doc come from running it with -cpu 1.
+func BenchmarkLevels(b *testing.B) {
+	data := benchData(b)
+	for _, name := range []string{"source", "binary"} {
+		d := data[name]
+		for _, l := range []int{1, 3, 5, 7, 9} {
+			b.Run(fmt.Sprintf("%s/level=%d", name, l), func(b *testing.B) {
+				b.SetBytes(int64(len(d)))
+				var c *counter
+				for i := 0; i < b.N; i++ {
+					c = &counter{}
+					f, err := New(c, l)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for o := 0; o < len(d); o += 64 << 10 {
+						e := o + 64<<10
+						if e > len(d) {
+							e = len(d)
+						}
+						f.Write(d[o:e])
+					}
+				}
+				b.ReportMetric(100*float64(c.n)/float64(len(d)), "%size")
+			})
+		}
+	}
+}